@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/backup"
+	"github.com/nexdb/nexdb/pkg/config"
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/logging"
+	"github.com/nexdb/nexdb/pkg/storage"
+)
+
+// backupCommand runs the backup command, it loads every database from the
+// configured storage and writes a backup archive of them.
+func backupCommand(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	output := fs.String("output", "nexdb-"+time.Now().UTC().Format("20060102T150405Z")+".tar.gz", "path the archive is written to, - writes to stdout")
+
+	cfg, err := config.LoadFlagSet(fs, args)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logging.New(os.Stderr))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, err := openDatabases(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.OpenFile(*output, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	manifest, err := backup.Write(w, m, []byte(cfg.Backup.EncryptionKey))
+	if err != nil {
+		return err
+	}
+
+	slog.Info("backup written", "output", *output, "databases", len(manifest.Databases), "documents", manifest.Documents(), "encrypted", manifest.Encrypted)
+	return nil
+}
+
+// restoreCommand runs the restore command, it checks a backup archive and
+// writes its documents to the configured storage, or restores the storage to
+// a point in time from its history of changes.
+func restoreCommand(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	input := fs.String("input", "", "path of the archive to restore")
+	at := fs.String("at", "", "point in time the configured storage is restored to instead of an archive, within storage.retention: an RFC 3339 timestamp or how long ago, such as 5m")
+	verifyOnly := fs.Bool("verify-only", false, "check the archive without restoring it")
+
+	cfg, err := config.LoadFlagSet(fs, args)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logging.New(os.Stderr))
+
+	if *at != "" {
+		if *input != "" || *verifyOnly {
+			return errors.New("--at can't be used with --input or --verify-only")
+		}
+
+		t, err := parsePointInTime(*at, time.Now())
+		if err != nil {
+			return err
+		}
+
+		return restoreAt(context.Background(), cfg, t)
+	}
+
+	if *input == "" {
+		return fmt.Errorf("--input or --at is required")
+	}
+
+	key := []byte(cfg.Backup.EncryptionKey)
+
+	// check the whole archive before anything is written
+	manifest, err := readArchive(*input, func(r io.Reader) (*backup.Manifest, error) {
+		return backup.Verify(r, key)
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("backup verified", "input", *input, "created_at", manifest.CreatedAt, "documents", manifest.Documents())
+
+	if *verifyOnly {
+		return nil
+	}
+
+	driver := storage.Driver(cfg.Storage.Driver)
+	manifest, err = readArchive(*input, func(r io.Reader) (*backup.Manifest, error) {
+		return backup.Restore(r, key, func(name, encryptionKey string) (storage.Storage, error) {
+			return database.OpenStorage(driver, name, encryptionKey, cfg.Storage.Options()...)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("backup restored", "driver", driver, "databases", len(manifest.Databases), "documents", manifest.Documents())
+	return nil
+}
+
+// parsePointInTime parses s as an RFC 3339 timestamp, or as a duration
+// before now.
+func parsePointInTime(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("--at: %q is not an RFC 3339 timestamp or a duration ago", s)
+	}
+
+	return now.Add(-d), nil
+}
+
+// restoreAt restores every database of the configured storage to the point in
+// time at, the server must be stopped while it does. Databases created since
+// are emptied and databases dropped since are brought back. Every database is
+// checked to be restorable to at before any is written.
+func restoreAt(ctx context.Context, cfg *config.Config, at time.Time) error {
+	driver := storage.Driver(cfg.Storage.Driver)
+	system, err := storage.New(driver, cfg.Storage.Options()...)
+	if err != nil {
+		return err
+	}
+	defer storage.Close(system)
+
+	current, err := listDatabases(ctx, system, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	// listing the databases as they were checks the default database can
+	// be restored to at
+	databases, err := listDatabases(ctx, system, at)
+	if err != nil {
+		return fmt.Errorf("%s: %w", database.DefaultName, err)
+	}
+
+	// a database created since is only in the current list, its encryption
+	// key is still needed to open it
+	for name, key := range current {
+		if _, ok := databases[name]; !ok {
+			databases[name] = key
+		}
+	}
+
+	stores := map[string]storage.Storage{}
+	defer func() {
+		for _, store := range stores {
+			storage.Close(store)
+		}
+	}()
+
+	for name, key := range databases {
+		store, err := database.OpenStorage(driver, name, key, cfg.Storage.Options()...)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		stores[name] = store
+
+		if err := storage.CanRestore(ctx, store, at); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	report, err := storage.Restore(ctx, system, at)
+	if err != nil {
+		return fmt.Errorf("%s: %w", database.DefaultName, err)
+	}
+	slog.Info("database restored", "database", database.DefaultName, "written", report.Written, "deleted", report.Deleted)
+
+	for name, store := range stores {
+		report, err := storage.Restore(ctx, store, at)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		slog.Info("database restored", "database", name, "written", report.Written, "deleted", report.Deleted)
+	}
+
+	slog.Info("storage restored", "driver", driver, "at", at.UTC().Format(time.RFC3339Nano), "databases", len(stores)+1)
+	return nil
+}
+
+// listDatabases returns the encryption keys of the databases listed in the
+// system database of store, by name, as they were at the point in time at,
+// or as they are if at is zero.
+func listDatabases(ctx context.Context, store storage.Storage, at time.Time) (map[string]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		docs <-chan *document.Document
+		errs <-chan error
+		err  error
+	)
+	if at.IsZero() {
+		docs, errs, err = storage.StreamErrors(ctx, store)
+	} else {
+		docs, errs, err = storage.StreamAt(ctx, store, at)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	databases := map[string]string{}
+	for docs != nil || errs != nil {
+		select {
+		case doc, ok := <-docs:
+			if !ok {
+				docs = nil
+				continue
+			}
+
+			if doc.Collection == database.DatabasesCollection && !cache.IsDeleted(doc) {
+				name, key := database.Metadata(doc)
+				databases[name] = key
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+
+			return nil, err
+		}
+	}
+
+	return databases, nil
+}
+
+// readArchive opens the archive at path and passes it to fn.
+func readArchive(path string, fn func(r io.Reader) (*backup.Manifest, error)) (*backup.Manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return fn(f)
+}
+
+// openDatabases loads every database from the configured storage without
+// serving them.
+func openDatabases(ctx context.Context, cfg *config.Config) (*database.Manager, error) {
+	driver := storage.Driver(cfg.Storage.Driver)
+	store, err := storage.New(driver, cfg.Storage.Options()...)
+	if err != nil {
+		return nil, err
+	}
+
+	system := &database.Database{Cache: cache.NewCache(ctx, cache.NewQueue(store))}
+	if err := system.Load(store); err != nil {
+		return nil, err
+	}
+
+	m := database.NewManager(ctx, driver, system, cfg.Storage.Options()...)
+	return m, m.Load()
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nexdb/nexdb/pkg/config"
+)
+
+// configCommand runs the config command, config print prints the effective
+// configuration with secrets redacted.
+func configCommand(args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return fmt.Errorf("unknown config command, must be print")
+	}
+
+	cfg, err := config.Load("config print", args[1:])
+	if err != nil {
+		return err
+	}
+
+	b, err := cfg.Redacted().YAML()
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(b)
+	return err
+}
@@ -3,112 +3,495 @@ package main
 import (
 	"context"
 	"errors"
-	"log"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/nexdb/nexdb/pkg/certs"
+	"github.com/nexdb/nexdb/pkg/cluster"
+	"github.com/nexdb/nexdb/pkg/config"
 	"github.com/nexdb/nexdb/pkg/database"
 	"github.com/nexdb/nexdb/pkg/database/cache"
 	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/fieldcrypt"
 	"github.com/nexdb/nexdb/pkg/handlers"
+	"github.com/nexdb/nexdb/pkg/logging"
+	"github.com/nexdb/nexdb/pkg/metrics"
+	"github.com/nexdb/nexdb/pkg/replication"
+	"github.com/nexdb/nexdb/pkg/services/admin"
+	"github.com/nexdb/nexdb/pkg/services/audit"
 	"github.com/nexdb/nexdb/pkg/services/auth"
 	"github.com/nexdb/nexdb/pkg/services/reader"
+	"github.com/nexdb/nexdb/pkg/services/status"
 	"github.com/nexdb/nexdb/pkg/services/writer"
 	"github.com/nexdb/nexdb/pkg/storage"
+	"github.com/nexdb/nexdb/pkg/tracing"
 
 	"github.com/gorilla/mux"
 )
 
 var (
 	db        *database.Database
+	manager   *database.Manager
 	dbCache   *cache.Cache
 	queue     *cache.Queue
 	store     storage.Storage
 	wr        *writer.Writer
 	readerSvc *reader.Reader
 	authSvc   *auth.AuthService
+	adminSvc  *admin.Admin
+	auditor   *audit.Auditor
+	statusSvc *status.Status
+	node      *replication.Node
+	member    *cluster.Node
 )
 
+// version is the version of the server, set at build time with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
 func main() {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// the first argument selects the command, serve is the default
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
 
-	// get storage driver from env
-	storageDriver := storage.MemoryDriver
-	driver := os.Getenv("NEXDB_STORAGE_DRIVER")
-	if driver != "" {
-		switch driver {
-		case "aws-s3":
-			storageDriver = storage.AWS3Driver
-		}
+	var err error
+	switch cmd {
+	case "serve":
+		err = serve(args)
+	case "config":
+		err = configCommand(args)
+	case "backup":
+		err = backupCommand(args)
+	case "restore":
+		err = restoreCommand(args)
+	case "migrate":
+		err = migrateCommand(args)
+	default:
+		err = fmt.Errorf("unknown command %q, must be serve, config, backup, restore or migrate", cmd)
+	}
+
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+// serve runs the server.
+func serve(args []string) error {
+	cfg, err := config.Load("serve", args)
+	if err != nil {
+		return err
+	}
+
+	// structured logs, the level can be changed at runtime
+	level, _ := logging.ParseLevel(cfg.Log.Level)
+	logging.Level.Set(level)
+	slog.SetDefault(logging.New(os.Stderr))
+
+	// tracing, disabled unless an exporter is configured
+	tracingOpts := cfg.Tracing.Options()
+	tracingOpts.Version = version
+	shutdownTracing, err := tracing.Setup(context.Background(), tracingOpts)
+	if err != nil {
+		return err
 	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("failed to flush spans", "error", err)
+		}
+	}()
+
+	// ctx is cancelled on SIGINT or SIGTERM, the queues get their own context
+	// so they keep flushing while in-flight requests finish
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	queueCtx, cancelQueues := context.WithCancel(context.Background())
+	defer cancelQueues()
 
 	// create storage driver
-	var err error
-	store, err = storage.New(storageDriver)
+	storageDriver := storage.Driver(cfg.Storage.Driver)
+	storageOpts := append(cfg.Storage.Options(), storage.WithMiddleware(tracing.Storage, metrics.Storage))
+	store, err = storage.New(storageDriver, storageOpts...)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	// queue
 	queue = cache.NewQueue(store)
-	go queue.Start(ctx)
+	queue.Use(tracing.Queue, metrics.Queue)
+
+	// replication log, records the writes of every database for followers
+	var replicationLog *replication.Log
+	if cfg.Replication.Role != "" {
+		replicationLog = replication.NewLog(cfg.Replication.LogSize)
+		queue.Observe(replicationLog.Observer(database.DefaultName))
+	}
 
-	// cache
-	dbCache = cache.NewCache(ctx, queue)
+	// cache, starts the queue
+	dbCache = cache.NewCache(queueCtx, queue)
 
 	// database
 	db = &database.Database{Cache: dbCache}
 
+	// database manager, serves db as the default database
+	loadOpts := cfg.Storage.Load.Options(logProgress)
+	manager = database.NewManager(queueCtx, storageDriver, db, storageOpts...).
+		WithQueueMiddleware(tracing.Queue, metrics.Queue).
+		WithLoadOptions(loadOpts...)
+	metrics.Registry.MustRegister(metrics.NewDatabaseCollector(manager))
+
+	// replication, disabled unless a role is configured
+	if replicationLog != nil {
+		manager.WithQueueObserver(replicationLog.Observer)
+		node = replication.New(manager, replicationLog, replication.Role(cfg.Replication.Role)).
+			WithLeader(cfg.Replication.Leader, cfg.Replication.APIKey).
+			WithWritePolicy(replication.WritePolicy(cfg.Replication.Writes)).
+			WithSharedStorage(cfg.Replication.SharedStorage)
+	}
+
+	// clustering, disabled unless a node id is configured. Writes are
+	// committed to the log of the cluster and applied by every member
+	if cfg.Cluster.NodeID != "" {
+		member = cluster.New(manager, cfg.Cluster.NodeID, cfg.Cluster.Address).
+			WithAPIAddress(cfg.Cluster.APIAddress).
+			WithAPIKey(cfg.Cluster.APIKey).
+			WithDir(cfg.Cluster.Dir).
+			WithBootstrap(cfg.Cluster.Bootstrap).
+			WithJoin(cfg.Cluster.Join).
+			WithReadConsistency(cluster.ReadConsistency(cfg.Cluster.ReadConsistency), time.Duration(cfg.Cluster.MaxStaleness)).
+			WithApplyTimeout(time.Duration(cfg.Cluster.ApplyTimeout)).
+			WithSnapshotThreshold(uint64(cfg.Cluster.SnapshotThreshold))
+		manager.WithCommitter(member)
+	}
+
+	// audit log, disabled unless a sink is configured
+	auditor = newAuditor(cfg.Audit)
+	go auditor.Start(ctx)
+
+	// field encryption, disabled unless a key is configured
+	fields, err := fieldcrypt.New([]byte(cfg.Storage.FieldEncryptionKey))
+	if err != nil {
+		return err
+	}
+
 	// writer
-	wr = writer.New(db)
+	wr = writer.New(db).WithAuditor(auditor).WithFieldEncrypter(fields)
 
 	// reader service
-	readerSvc = reader.New(db)
+	readerSvc = reader.New(db).WithFieldEncrypter(fields)
 
 	// auth service
 	authSvc = auth.New(db)
+
+	// admin service
+	adminSvc = admin.New(manager).
+		WithAuditor(auditor).
+		WithBackupKey([]byte(cfg.Backup.EncryptionKey)).
+		WithFieldEncrypter(fields)
+
+	// status service
+	statusSvc = status.New(manager, store, storageDriver, version)
 	// << end services setup >>
 
-	// << start database setup >>
-	// load the database from storage
-	if err := db.Load(store); err != nil {
-		log.Fatal(err)
+	// << start router setup >>
+	r := mux.NewRouter()
+	r.Use(handlers.RequestID, tracing.Middleware, handlers.AccessLog, metrics.Middleware)
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
+	r.HandleFunc("/healthz", handlers.Healthz().ServeHTTP).Methods("GET")
+	r.HandleFunc("/readyz", handlers.Readyz(statusSvc).ServeHTTP).Methods("GET")
+
+	// routes that write are served by the leader, followers reject or forward them
+	replicaMiddleware := &handlers.ReplicaMiddleware{Node: node}
+	clusterMiddleware := &handlers.ClusterMiddleware{Node: member}
+	writes := func(next http.Handler) http.Handler {
+		return replicaMiddleware.IsLeader(clusterMiddleware.IsLeader(next))
 	}
 
-	// check if we have any api keys in the database
-	if err := initilaiseAuthentication(); err != nil {
-		log.Fatal(err)
+	// routes that read are served by members with the read consistency of
+	// the cluster, others forward them to the leader
+	reads := clusterMiddleware.IsConsistent
+
+	// admin routes, only keys of the default database are accepted
+	adminRouter := r.PathPrefix("/v1/admin").Subrouter()
+	adminRouter.Handle("/databases", writes(handlers.CreateDatabase(adminSvc))).Methods("POST")
+	adminRouter.Handle("/databases", reads(handlers.ListDatabases(adminSvc))).Methods("GET")
+	adminRouter.Handle("/databases/{db}", writes(handlers.DropDatabase(adminSvc))).Methods("DELETE")
+	adminRouter.Handle("/databases/{db}/keys", writes(handlers.CreateAPIKey(adminSvc))).Methods("POST")
+	adminRouter.Handle("/databases/{db}/keys", reads(handlers.ListAPIKeys(adminSvc))).Methods("GET")
+	adminRouter.Handle("/databases/{db}/keys/{id}", writes(handlers.DeleteAPIKey(adminSvc))).Methods("DELETE")
+	adminRouter.Handle("/databases/{db}/collections/{collection}/encrypted-fields", reads(handlers.GetEncryptedFields(adminSvc))).Methods("GET")
+	adminRouter.Handle("/databases/{db}/collections/{collection}/encrypted-fields", writes(handlers.SetEncryptedFields(adminSvc))).Methods("PUT")
+	adminRouter.Handle("/databases/{db}/collections/{collection}/revisions", reads(handlers.GetRevisionSettings(adminSvc))).Methods("GET")
+	adminRouter.Handle("/databases/{db}/collections/{collection}/revisions", writes(handlers.SetRevisionSettings(adminSvc))).Methods("PUT")
+	adminRouter.Handle("/databases/{db}/collections/{collection}/soft-delete", reads(handlers.GetSoftDeleteSettings(adminSvc))).Methods("GET")
+	adminRouter.Handle("/databases/{db}/collections/{collection}/soft-delete", writes(handlers.SetSoftDeleteSettings(adminSvc))).Methods("PUT")
+	adminRouter.HandleFunc("/audit", handlers.QueryAudit(auditor).ServeHTTP).Methods("GET")
+	adminRouter.HandleFunc("/backup", handlers.Backup(adminSvc)).Methods("GET")
+	adminRouter.HandleFunc("/log-level", handlers.GetLogLevel().ServeHTTP).Methods("GET")
+	adminRouter.HandleFunc("/log-level", handlers.SetLogLevel().ServeHTTP).Methods("PUT")
+	if node != nil {
+		adminRouter.HandleFunc("/replication", handlers.ReplicationStatus(node).ServeHTTP).Methods("GET")
+		adminRouter.HandleFunc("/replication/stream", handlers.ReplicationStream(node)).Methods("GET")
+		adminRouter.HandleFunc("/replication/promote", handlers.Promote(node).ServeHTTP).Methods("POST")
+	}
+	if member != nil {
+		adminRouter.HandleFunc("/cluster", handlers.ClusterStatus(member).ServeHTTP).Methods("GET")
+		adminRouter.Handle("/cluster/members", writes(handlers.JoinCluster(member))).Methods("POST")
+		adminRouter.Handle("/cluster/members/{id}", writes(handlers.RemoveMember(member))).Methods("DELETE")
+		adminRouter.Handle("/cluster/apply", writes(handlers.ApplyWrite(member))).Methods("POST")
 	}
-	// << end database setup >>
 
-	// << start router setup >>
-	r := mux.NewRouter()
-	r.HandleFunc("/v1/collections/{collection}", handlers.WriteDocument(wr).ServeHTTP).Methods("PUT")
-	r.HandleFunc("/v1/collections/{collection}/{id}", handlers.GetDocument(readerSvc).ServeHTTP).Methods("GET")
-	r.HandleFunc("/v1/collections/{collection}/{id}", handlers.DeleteDocument(wr).ServeHTTP).Methods("DELETE")
-	r.HandleFunc("/v1/collections/{collection}", handlers.SearchDocuments(readerSvc).ServeHTTP).Methods("POST")
+	// status of the server, only keys of the default database are accepted
+	statusRouter := r.PathPrefix("/v1/status").Subrouter()
+	statusRouter.HandleFunc("", handlers.Status(statusSvc).ServeHTTP).Methods("GET")
+
+	// document routes, /v1/collections is served by the default database
+	apiRouter := r.PathPrefix("/v1").Subrouter()
+	for _, prefix := range []string{"", "/db/{db}"} {
+		apiRouter.Handle(prefix+"/collections/{collection}", writes(handlers.WriteDocument(wr))).Methods("PUT")
+		apiRouter.Handle(prefix+"/collections/{collection}/_export", reads(http.HandlerFunc(handlers.ExportDocuments(readerSvc)))).Methods("GET")
+		apiRouter.Handle(prefix+"/collections/{collection}/_import", writes(handlers.ImportDocuments(wr))).Methods("POST")
+		apiRouter.Handle(prefix+"/collections/{collection}/_trash", reads(handlers.ListTrash(readerSvc))).Methods("GET")
+		apiRouter.Handle(prefix+"/collections/{collection}/_trash/{id}/restore", writes(handlers.UndeleteDocument(wr))).Methods("POST")
+		apiRouter.Handle(prefix+"/collections/{collection}/_trash/{id}", writes(handlers.PurgeDocument(wr))).Methods("DELETE")
+		apiRouter.Handle(prefix+"/collections/{collection}/{id}", reads(handlers.GetDocument(readerSvc))).Methods("GET")
+		apiRouter.Handle(prefix+"/collections/{collection}/{id}", writes(handlers.DeleteDocument(wr))).Methods("DELETE")
+		apiRouter.Handle(prefix+"/collections/{collection}/{id}/_revisions", reads(handlers.ListRevisions(readerSvc))).Methods("GET")
+		apiRouter.Handle(prefix+"/collections/{collection}/{id}/_revisions/{revision}", reads(handlers.GetRevision(readerSvc))).Methods("GET")
+		apiRouter.Handle(prefix+"/collections/{collection}/{id}/_revisions/{revision}/diff", reads(handlers.DiffRevision(readerSvc))).Methods("GET")
+		apiRouter.Handle(prefix+"/collections/{collection}/{id}/_revisions/{revision}/restore", writes(handlers.RestoreRevision(wr))).Methods("POST")
+		apiRouter.Handle(prefix+"/collections/{collection}", reads(handlers.SearchDocuments(readerSvc))).Methods("POST")
+	}
 
 	// << start middleware setup >>
 	authMiddleware := &handlers.AuthMiddleware{AuthService: authSvc}
-	r.Use(authMiddleware.IsAuthenticated)
+	databaseMiddleware := &handlers.DatabaseMiddleware{Manager: manager}
+	readyMiddleware := &handlers.ReadyMiddleware{Status: statusSvc}
+	adminRouter.Use(readyMiddleware.IsLoaded, handlers.SourceIP, authMiddleware.IsAuthenticated)
+	statusRouter.Use(readyMiddleware.IsLoaded, authMiddleware.IsAuthenticated)
+	apiRouter.Use(readyMiddleware.IsLoaded, handlers.SourceIP, databaseMiddleware.WithDatabase, authMiddleware.IsAuthenticated)
 	// << end middleware setup >>
 
 	// << end router setup >>
 
-	if err := http.ListenAndServe(":9000", r); err != nil {
-		log.Fatal(err)
+	srv := &http.Server{
+		Addr:    cfg.Server.Address,
+		Handler: r,
+	}
+
+	slog.Info("listening", "address", cfg.Server.Address, "tls", cfg.Server.TLS.Options().Enabled(), "version", version)
+
+	serveErr := make(chan error, 1)
+	if !cfg.Server.TLS.Options().Enabled() {
+		go func() {
+			serveErr <- srv.ListenAndServe()
+		}()
+	} else {
+		reloader, err := certs.NewReloader(cfg.Server.TLS.Options())
+		if err != nil {
+			return err
+		}
+
+		// pick up rotated certificates without a restart
+		go reloader.Watch(ctx, time.Duration(cfg.Server.TLS.ReloadInterval), func(err error) {
+			slog.Error("failed to reload tls certificates", "error", err)
+		})
+
+		srv.TLSConfig = reloader.TLSConfig()
+		go func() {
+			serveErr <- srv.ListenAndServeTLS("", "")
+		}()
 	}
 
-	// wait for the queue to drain
-	queue.WaitForShutdown()
+	// << start database setup >>
+	// load the databases while the server answers health probes, requests
+	// are rejected until they are loaded
+	if err := loadDatabases(cfg.Auth.APIKey, loadOpts); err != nil {
+		srv.Close()
+		return err
+	}
+
+	// join the cluster, members apply the writes committed since they
+	// stopped before serving requests
+	if member != nil {
+		if err := member.Open(); err != nil {
+			srv.Close()
+			return err
+		}
+		go member.Start(ctx)
+
+		// the api key is added by the leader, once one is elected
+		go func() {
+			if err := member.WaitLeader(ctx); err != nil || !member.IsLeader() {
+				return
+			}
+			if err := initilaiseAuthentication(cfg.Auth.APIKey); err != nil {
+				slog.Error("failed to initialise authentication", "error", err)
+			}
+		}()
+	}
+	statusSvc.SetLoaded()
+
+	// follow the leader
+	if node != nil {
+		go node.Start(ctx)
+	}
+
+	// re-encrypt documents sealed with older keys while serving requests,
+	// followers sharing the storage of the leader leave it to the leader
+	go func() {
+		if node.Role() == replication.RoleFollower && cfg.Replication.SharedStorage {
+			return
+		}
+
+		n, err := manager.Reencrypt(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			slog.Error("failed to re-encrypt documents", "error", err)
+			return
+		}
+		if n > 0 {
+			slog.Info("re-encrypted stale documents with the primary key", "documents", n)
+		}
+		if cfg.Storage.AllowPlaintext {
+			slog.Warn("every document is encrypted, storage.allow_plaintext can be turned off")
+		}
+	}()
+
+	// purge documents kept in the trash for longer than their retention
+	go purgeTrash(ctx, time.Duration(cfg.Trash.PurgeInterval))
+	// << end database setup >>
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	case <-ctx.Done():
+		slog.Info("shutting down")
+	}
+
+	return shutdown(srv, cfg, cancelQueues)
+}
+
+// shutdown stops accepting requests, waits for in-flight requests to finish
+// and then flushes the queues to storage, reporting how many writes were
+// flushed or abandoned.
+func shutdown(srv *http.Server, cfg *config.Config, cancelQueues context.CancelFunc) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Server.ShutdownTimeout))
+	defer cancel()
+
+	serverErr := srv.Shutdown(ctx)
+	if serverErr != nil {
+		slog.Error("failed to wait for in-flight requests", "error", serverErr)
+	}
+
+	// hand over the leadership of the cluster, writes are no longer applied
+	if member != nil {
+		if err := member.Shutdown(); err != nil {
+			slog.Error("failed to leave the cluster", "error", err)
+		}
+	}
+
+	// no more writes can arrive, drain the queues, reporting the writes
+	// handled by the drain rather than since the server started
+	before := manager.Stats()
+	cancelQueues()
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Duration(cfg.Storage.FlushTimeout))
+	defer cancel()
+
+	stats, err := manager.Shutdown(ctx)
+	stats = stats.Sub(before)
+	slog.Info("flushed writes to storage", "flushed", stats.Flushed, "failed", stats.Failed, "abandoned", stats.Abandoned)
+	if err != nil {
+		return fmt.Errorf("failed to flush writes before the deadline: %w", err)
+	}
+
+	return serverErr
 }
 
-func initilaiseAuthentication() error {
-	apiKeys := db.Filter("_api_keys", cache.Query{})
+// loadDatabases loads the default database and every other database from
+// storage, then makes sure there is an api key.
+func loadDatabases(apiKey string, opts []database.LoadOption) error {
+	// load the database from storage
+	if err := db.Load(store, opts...); err != nil {
+		return err
+	}
+
+	// open the other databases, their metadata lives in the default database
+	if err := manager.Load(); err != nil {
+		return err
+	}
+
+	// followers are sent the api keys of the leader, the leader of a
+	// cluster adds the api key once it is elected
+	if node.Role() == replication.RoleFollower || member != nil {
+		return nil
+	}
+
+	// check if we have any api keys in the database
+	return initilaiseAuthentication(apiKey)
+}
+
+// purgeTrash purges the expired documents in the trash of every database
+// at the given interval until the context is cancelled.
+func purgeTrash(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// followers are sent the purges of the leader, which purges once it
+		// takes writes
+		if node.Role() == replication.RoleFollower || (member != nil && member.Write() != nil) {
+			continue
+		}
+
+		for _, d := range manager.Databases() {
+			n, err := wr.PurgeExpired(ctx, d)
+			if err != nil {
+				slog.Error("failed to purge the trash", "database", d.Name, "error", err)
+			}
+			if n > 0 {
+				slog.Info("purged expired documents from the trash", "database", d.Name, "documents", n)
+			}
+		}
+	}
+}
+
+// logProgress logs how far a database has been loaded.
+func logProgress(p database.Progress) {
+	msg := "loading database"
+	if p.Done {
+		msg = "loaded database"
+	}
+
+	slog.Info(msg, "database", p.Database, "documents", p.Loaded, "skipped", p.Skipped)
+}
+
+func initilaiseAuthentication(apiKey string) error {
+	apiKeys := db.Filter(auth.KeysCollection, cache.Query{})
 	if len(apiKeys) == 0 {
-		if apiKey := os.Getenv("NEXDB_API_KEY"); apiKey != "" {
-			doc := document.New().SetCollection("_api_keys").SetData(map[string]interface{}{
+		if apiKey != "" {
+			doc := document.New().SetCollection(auth.KeysCollection).SetData(map[string]interface{}{
 				"key": apiKey,
 			})
 
@@ -124,3 +507,21 @@ func initilaiseAuthentication() error {
 
 	return nil
 }
+
+// newAuditor returns the auditor configured by the audit config, or nil
+// when auditing is disabled.
+func newAuditor(cfg config.Audit) *audit.Auditor {
+	var sink audit.Sink
+	switch cfg.Sink {
+	case "collection":
+		sink = audit.NewCollectionSink(db)
+	case "file":
+		sink = audit.NewFileSink(cfg.File)
+	default:
+		return nil
+	}
+
+	return audit.New(sink).
+		WithDiffs(cfg.Diffs).
+		WithRetention(time.Duration(cfg.Retention))
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/nexdb/nexdb/pkg/config"
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/logging"
+	"github.com/nexdb/nexdb/pkg/migrate"
+	"github.com/nexdb/nexdb/pkg/storage"
+)
+
+// migrateCommand runs the migrate command, it copies every database from
+// the configured storage to another driver and verifies the copy. Servers
+// writing to the source must be stopped first, see package migrate.
+func migrateCommand(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	from := fs.String("from", "", "driver documents are read from, defaults to storage.driver")
+	to := fs.String("to", "", "driver documents are written to: aws-s3 or filesystem")
+	toKey := fs.String("to-encryption-key", "", "32 byte key documents are re-encrypted with, defaults to $NEXDB_TARGET_ENCRYPTION_KEY or storage.encryption_key")
+	toKeyring := fs.String("to-keyring-file", "", "keyring file documents are re-encrypted with, defaults to storage.keyring_file")
+	toRegion := fs.String("to-aws-region", "", "region of the target aws-s3 bucket, defaults to storage.aws.region")
+	toBucket := fs.String("to-aws-bucket", "", "name of the target aws-s3 bucket, defaults to storage.aws.bucket")
+	toFormat := fs.String("to-format", "", "format documents are rewritten with, defaults to storage.format")
+	toCompression := fs.String("to-compression", "", "compression documents are rewritten with, defaults to storage.compression")
+	toLayout := fs.String("to-layout", "", "layout documents are rewritten in: documents or log, defaults to storage.layout")
+	toEndpoint := fs.String("to-aws-endpoint", "", "url of the target S3 compatible service, defaults to storage.aws.endpoint")
+	toPrefix := fs.String("to-aws-prefix", "", "prefix of the keys of the target objects, defaults to storage.aws.prefix")
+	toPath := fs.String("to-path", "", "directory of the target filesystem driver, defaults to storage.filesystem.path")
+	checkpoint := fs.String("checkpoint", "nexdb-migrate.checkpoint", "file copied documents are recorded in so an interrupted migration resumes, empty disables resuming")
+	verifyOnly := fs.Bool("verify-only", false, "compare the source and target without copying")
+
+	cfg, err := config.LoadFlagSet(fs, args)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logging.New(os.Stderr))
+
+	if *from != "" {
+		cfg.Storage.Driver = *from
+	}
+
+	target := cfg.Storage
+	target.Driver = *to
+	if key, ok := os.LookupEnv("NEXDB_TARGET_ENCRYPTION_KEY"); ok {
+		target.EncryptionKey = key
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "to-encryption-key":
+			target.EncryptionKey = *toKey
+		case "to-keyring-file":
+			target.KeyringFile = *toKeyring
+		case "to-aws-region":
+			target.AWS.Region = *toRegion
+		case "to-aws-bucket":
+			target.AWS.Bucket = *toBucket
+		case "to-format":
+			target.Format = *toFormat
+		case "to-compression":
+			target.Compression = *toCompression
+		case "to-layout":
+			target.Layout = *toLayout
+		case "to-aws-endpoint":
+			target.AWS.Endpoint = *toEndpoint
+		case "to-aws-prefix":
+			target.AWS.Prefix = *toPrefix
+		case "to-path":
+			target.Filesystem.Path = *toPath
+		}
+	})
+
+	if err := validateMigration(cfg, target); err != nil {
+		return err
+	}
+
+	sourceKeyring, err := storage.Keyring(cfg.Storage.Options()...)
+	if err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+
+	targetKeyring, err := storage.Keyring(target.Options()...)
+	if err != nil {
+		return fmt.Errorf("target: %w", err)
+	}
+
+	opts := migrate.Options{
+		Source:        opener(cfg.Storage),
+		Target:        opener(target),
+		Checkpoint:    *checkpoint,
+		SourceKeyring: sourceKeyring,
+		TargetKeyring: targetKeyring,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if *verifyOnly {
+		report, err := migrate.Verify(ctx, opts)
+		if err != nil {
+			return err
+		}
+
+		slog.Info("migration verified", "databases", len(report.Databases), "documents", report.Documents())
+		return nil
+	}
+
+	slog.Warn("writes to the source storage must be stopped until the migration is complete")
+	slog.Info("migrating", "from", cfg.Storage.Driver, "to", target.Driver, "reencrypt", cfg.Storage.EncryptionKey != target.EncryptionKey || cfg.Storage.KeyringFile != target.KeyringFile)
+	report, err := migrate.Run(ctx, opts)
+	if err != nil {
+		if *checkpoint != "" && !errors.Is(err, migrate.ErrVerificationFailed) {
+			slog.Info("run the same command again to resume", "checkpoint", *checkpoint)
+		}
+		return err
+	}
+
+	for _, db := range report.Databases {
+		slog.Info("database migrated", "database", db.Name, "documents", db.Documents, "checksum", db.Checksum)
+	}
+	slog.Info("migration verified", "databases", len(report.Databases), "documents", report.Documents())
+	return nil
+}
+
+// validateMigration checks the source and target storage configurations.
+func validateMigration(cfg *config.Config, target config.Storage) error {
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+
+	targetCfg := *cfg
+	targetCfg.Storage = target
+	if err := targetCfg.Validate(); err != nil {
+		return fmt.Errorf("target: %w", err)
+	}
+
+	// memory storage only lives as long as the server holding it, its
+	// documents are moved with a backup restored onto the new driver
+	if storage.Driver(cfg.Storage.Driver) == storage.MemoryDriver || storage.Driver(target.Driver) == storage.MemoryDriver {
+		return errors.New("the memory driver can't be migrated from or to, back up the running server and restore the archive onto the new driver instead")
+	}
+
+	// the layouts keep their objects apart, so storage can be migrated
+	// from one to the other in place
+	if cfg.Storage.Driver == target.Driver && cfg.Storage.AWS == target.AWS && cfg.Storage.Filesystem == target.Filesystem &&
+		cfg.Storage.Layout == target.Layout {
+		return errors.New("the source and target are the same storage")
+	}
+
+	return nil
+}
+
+// opener returns an opener of the databases of a storage configuration.
+func opener(s config.Storage) migrate.Opener {
+	driver := storage.Driver(s.Driver)
+	return func(name, encryptionKey string) (storage.Storage, error) {
+		return database.OpenStorage(driver, name, encryptionKey, s.Options()...)
+	}
+}
@@ -1,9 +1,12 @@
 package rest
 
 import (
+	"encoding/json"
+	"log/slog"
 	"net/http"
 
 	"github.com/nexdb/nexdb/pkg/errors"
+	"github.com/nexdb/nexdb/pkg/logging"
 )
 
 // JsonHandler is a handler that returns a response.
@@ -29,14 +32,22 @@ func (h JsonHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(resp.Status())
 		}
 
-		// if a system error, return a generic error message
-		respErr, ok := respErr.(*errors.Error)
+		// the request id lets clients point at the logs of a failed request
+		requestID := ""
+		if id := logging.RequestID(r.Context()); id != "" {
+			b, _ := json.Marshal(id)
+			requestID = `,"request_id":` + string(b)
+		}
+
+		// if a system error, log it and return a generic error message
+		internalErr, ok := respErr.(*errors.Error)
 		if !ok {
-			w.Write([]byte(`{"error":"system error"}`))
+			slog.ErrorContext(r.Context(), "request failed", "method", r.Method, "path", r.URL.Path, "error", respErr)
+			w.Write([]byte(`{"error":"system error"` + requestID + `}`))
 			return
 		}
 
-		w.Write([]byte(`{"error":"` + respErr.Error() + `","code":` + respErr.Code().ToString() + `}`))
+		w.Write([]byte(`{"error":"` + internalErr.Error() + `","code":` + internalErr.Code().ToString() + requestID + `}`))
 		return
 	}
 
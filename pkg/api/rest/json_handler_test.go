@@ -8,6 +8,7 @@ import (
 
 	"github.com/nexdb/nexdb/pkg/api/rest"
 	"github.com/nexdb/nexdb/pkg/errors"
+	"github.com/nexdb/nexdb/pkg/logging"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -94,3 +95,20 @@ func TestJsonHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestJsonHandler_RequestID(t *testing.T) {
+	handler := rest.JsonHandler(func(r *http.Request) *rest.Response {
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusNotFound),
+			rest.WithError(errors.New(errors.ErrDocumentNotFound)),
+		)
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req = req.WithContext(logging.WithRequestID(req.Context(), "01HREQUEST"))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, `{"error":"document not found","code":3000,"request_id":"01HREQUEST"}`, rr.Body.String())
+}
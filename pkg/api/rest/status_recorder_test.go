@@ -0,0 +1,30 @@
+package rest_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nexdb/nexdb/pkg/api/rest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusRecorder(t *testing.T) {
+	w := httptest.NewRecorder()
+	rec := rest.NewStatusRecorder(w)
+	assert.Equal(t, http.StatusOK, rec.Status())
+
+	rec.WriteHeader(http.StatusAccepted)
+	assert.Equal(t, http.StatusAccepted, rec.Status())
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	// streamed responses are flushed through the recorder
+	rec.Flush()
+	assert.True(t, w.Flushed)
+
+	w = httptest.NewRecorder()
+	require.NoError(t, http.NewResponseController(rest.NewStatusRecorder(w)).Flush())
+	assert.True(t, w.Flushed)
+}
@@ -0,0 +1,464 @@
+// Package backup writes consistent snapshots of every database to a single
+// archive and restores them into any storage driver.
+//
+// An archive is a gzipped tar file. Its first entry is manifest.json, which
+// lists every database and collection with the number of documents and the
+// SHA-256 checksum of its file. Each collection is stored as newline-delimited
+// JSON documents in databases/<database>/<collection>.ndjson, sealed with
+// AES-GCM when the archive is encrypted. The default database is written
+// first, its _databases and _api_keys collections hold the metadata and api
+// keys of every database.
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/storage"
+)
+
+// Version is the version of the archive format written by Write.
+const Version = 1
+
+// manifestName is the name of the manifest entry of an archive.
+const manifestName = "manifest.json"
+
+var (
+	// ErrManifestMissing is returned when an archive doesn't start with a manifest.
+	ErrManifestMissing = errors.New("archive has no manifest")
+	// ErrUnsupportedVersion is returned when an archive was written by a newer format.
+	ErrUnsupportedVersion = errors.New("unsupported archive version")
+	// ErrChecksumMismatch is returned when a file doesn't match its checksum.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrUnexpectedFile is returned when an archive holds a file its manifest doesn't list.
+	ErrUnexpectedFile = errors.New("file is not listed in the manifest")
+	// ErrIncomplete is returned when a file listed in the manifest is missing.
+	ErrIncomplete = errors.New("archive is incomplete")
+	// ErrEncryptionKeyRequired is returned when restoring an encrypted archive without a key.
+	ErrEncryptionKeyRequired = errors.New("archive is encrypted, an encryption key is required")
+	// ErrEncryptionKeyInvalid is returned when the encryption key is not 32 bytes long.
+	ErrEncryptionKeyInvalid = errors.New("encryption key must be 32 bytes")
+)
+
+// Manifest describes the contents of an archive.
+type Manifest struct {
+	Version   int        `json:"version"`
+	CreatedAt time.Time  `json:"created_at"`
+	Encrypted bool       `json:"encrypted"`
+	Databases []Database `json:"databases"`
+}
+
+// Database is a database in an archive.
+type Database struct {
+	Name        string       `json:"name"`
+	Collections []Collection `json:"collections"`
+}
+
+// Collection is a collection of a database in an archive.
+type Collection struct {
+	Name      string `json:"name"`
+	File      string `json:"file"`
+	Documents int    `json:"documents"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+}
+
+// Documents returns the number of documents in the archive.
+func (m *Manifest) Documents() int {
+	n := 0
+	for _, d := range m.Databases {
+		for _, c := range d.Collections {
+			n += c.Documents
+		}
+	}
+
+	return n
+}
+
+// file is a collection file, its documents are encoded as it is written.
+type file struct {
+	name string
+	docs []document.Document
+	// nonce is the nonce the file is sealed with, the same for both times
+	// it is encoded so it matches its checksum.
+	nonce []byte
+	size  int64
+}
+
+// Write writes a snapshot of every database of the manager to w. The
+// snapshot is taken at a single point in time. Each collection is encoded
+// once to checksum it for the manifest, which is written first, and again as
+// it is written to w, so at most one collection is held encoded in memory.
+// The archive is encrypted if key is not empty.
+func Write(w io.Writer, m *database.Manager, key []byte) (*Manifest, error) {
+	if len(key) > 0 && len(key) != 32 {
+		return nil, ErrEncryptionKeyInvalid
+	}
+
+	var gcm cipher.AEAD
+	if len(key) > 0 {
+		var err error
+		if gcm, err = newGCM(key); err != nil {
+			return nil, err
+		}
+	}
+
+	// the default database goes first so its metadata is restored first
+	databases := m.Databases()
+	sort.SliceStable(databases, func(i, j int) bool {
+		return databases[i].Name == database.DefaultName && databases[j].Name != database.DefaultName
+	})
+
+	caches := make([]*cache.Cache, len(databases))
+	for i, d := range databases {
+		caches[i] = d.Cache
+	}
+	snapshot := cache.Snapshot(caches...)
+
+	manifest := &Manifest{
+		Version:   Version,
+		CreatedAt: time.Now().UTC(),
+		Encrypted: len(key) > 0,
+	}
+
+	var files []*file
+	for i, d := range databases {
+		collections := map[string][]document.Document{}
+		for _, doc := range snapshot[i] {
+			collections[doc.Collection] = append(collections[doc.Collection], doc)
+		}
+
+		names := make([]string, 0, len(collections))
+		for name := range collections {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		db := Database{Name: d.Name, Collections: []Collection{}}
+		for _, name := range names {
+			f := &file{name: path.Join("databases", d.Name, name+".ndjson"), docs: collections[name]}
+			if gcm != nil {
+				f.nonce = make([]byte, gcm.NonceSize())
+				if _, err := io.ReadFull(rand.Reader, f.nonce); err != nil {
+					return nil, err
+				}
+			}
+
+			h := sha256.New()
+			cw := &countingWriter{w: h}
+			if err := encode(cw, f.docs, gcm, f.nonce); err != nil {
+				return nil, err
+			}
+			f.size = cw.n
+			files = append(files, f)
+
+			db.Collections = append(db.Collections, Collection{
+				Name:      name,
+				File:      f.name,
+				Documents: len(f.docs),
+				Size:      f.size,
+				SHA256:    hex.EncodeToString(h.Sum(nil)),
+			})
+		}
+
+		manifest.Databases = append(manifest.Databases, db)
+	}
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	if err := writeEntry(tw, manifestName, int64(len(b)), manifest.CreatedAt, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		if err := writeEntry(tw, f.name, f.size, manifest.CreatedAt, func(w io.Writer) error {
+			return encode(w, f.docs, gcm, f.nonce)
+		}); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	return manifest, gz.Close()
+}
+
+// writeEntry writes an entry of size bytes to an archive, its contents are
+// written by fn.
+func writeEntry(tw *tar.Writer, name string, size int64, modTime time.Time, fn func(w io.Writer) error) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0o600,
+		Size:    size,
+		ModTime: modTime,
+	}); err != nil {
+		return err
+	}
+
+	return fn(tw)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// encode writes documents to w as newline-delimited JSON, sorted by id so
+// the same documents are always encoded the same. If gcm is set they are
+// sealed with it and nonce, sealed files are encoded in memory before they
+// are written.
+func encode(w io.Writer, docs []document.Document, gcm cipher.AEAD, nonce []byte) error {
+	// documents are sorted by id, which sorts them by creation time
+	sort.Slice(docs, func(i, j int) bool {
+		return docs[i].ID.Compare(docs[j].ID) < 0
+	})
+
+	if gcm == nil {
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		for i := range docs {
+			if err := enc.Encode(&docs[i]); err != nil {
+				return err
+			}
+		}
+
+		return bw.Flush()
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := range docs {
+		if err := enc.Encode(&docs[i]); err != nil {
+			return err
+		}
+	}
+
+	if _, err := w.Write(nonce); err != nil {
+		return err
+	}
+
+	_, err := w.Write(gcm.Seal(nil, nonce, buf.Bytes(), nil))
+	return err
+}
+
+// decode decodes the documents of a collection file, opening it with key if
+// it is not empty.
+func decode(data []byte, key []byte) ([]*document.Document, error) {
+	if len(key) > 0 {
+		gcm, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(data) < gcm.NonceSize() {
+			return nil, ErrChecksumMismatch
+		}
+
+		nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+		if data, err = gcm.Open(nil, nonce, ciphertext, nil); err != nil {
+			return nil, fmt.Errorf("failed to decrypt, is the encryption key correct? %w", err)
+		}
+	}
+
+	var docs []*document.Document
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		doc := &document.Document{}
+		if err := json.Unmarshal(scanner.Bytes(), doc); err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+
+	return docs, scanner.Err()
+}
+
+// newGCM returns an AES-GCM cipher for key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Opener returns the storage a database is restored into, encryptionKey is
+// the database's own key recorded in the default database, if any.
+type Opener func(name, encryptionKey string) (storage.Storage, error)
+
+// Verify reads an archive and checks every file against the manifest without
+// restoring anything.
+func Verify(r io.Reader, key []byte) (*Manifest, error) {
+	return read(r, key, func(Database, Collection, []*document.Document) error {
+		return nil
+	})
+}
+
+// Restore writes the documents of an archive to the storage returned by open
+// for each database. Documents that already exist in storage are overwritten.
+// Each file is checked against the manifest before its documents are written,
+// use Verify first to check the whole archive before anything is written.
+// The storage is closed once the archive is restored.
+func Restore(r io.Reader, key []byte, open Opener) (*Manifest, error) {
+	stores := map[string]storage.Storage{}
+	keys := map[string]string{}
+	defer func() {
+		for _, s := range stores {
+			storage.Close(s)
+		}
+	}()
+
+	return read(r, key, func(db Database, c Collection, docs []*document.Document) error {
+		s, ok := stores[db.Name]
+		if !ok {
+			var err error
+			if s, err = open(db.Name, keys[db.Name]); err != nil {
+				return fmt.Errorf("failed to open storage of database %s: %w", db.Name, err)
+			}
+			stores[db.Name] = s
+		}
+
+		for _, doc := range docs {
+			if db.Name == database.DefaultName && doc.Collection == database.DatabasesCollection {
+				name, encryptionKey := database.Metadata(doc)
+				keys[name] = encryptionKey
+			}
+
+			if err := s.Write(doc); err != nil {
+				return fmt.Errorf("failed to restore document %s of %s/%s: %w", doc.ID, db.Name, c.Name, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// read reads an archive, checking each file against the manifest before
+// passing its documents to fn.
+func read(r io.Reader, key []byte, fn func(db Database, c Collection, docs []*document.Document) error) (*Manifest, error) {
+	if len(key) > 0 && len(key) != 32 {
+		return nil, ErrEncryptionKeyInvalid
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != manifestName {
+		return nil, ErrManifestMissing
+	}
+
+	manifest := &Manifest{}
+	if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	if manifest.Version > Version {
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedVersion, manifest.Version)
+	}
+
+	if manifest.Encrypted && len(key) == 0 {
+		return nil, ErrEncryptionKeyRequired
+	}
+	if !manifest.Encrypted {
+		key = nil
+	}
+
+	type entry struct {
+		db Database
+		c  Collection
+	}
+	pending := map[string]entry{}
+	for _, db := range manifest.Databases {
+		for _, c := range db.Collections {
+			pending[c.File] = entry{db: db, c: c}
+		}
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		e, ok := pending[hdr.Name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnexpectedFile, hdr.Name)
+		}
+		delete(pending, hdr.Name)
+
+		data, err := io.ReadAll(io.LimitReader(tr, e.c.Size+1))
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(data)
+		if int64(len(data)) != e.c.Size || hex.EncodeToString(sum[:]) != e.c.SHA256 {
+			return nil, fmt.Errorf("%w: %s", ErrChecksumMismatch, hdr.Name)
+		}
+
+		docs, err := decode(data, key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+
+		if len(docs) != e.c.Documents {
+			return nil, fmt.Errorf("%w: %s has %d documents, expected %d", ErrChecksumMismatch, hdr.Name, len(docs), e.c.Documents)
+		}
+
+		if err := fn(e.db, e.c, docs); err != nil {
+			return nil, err
+		}
+	}
+
+	for name := range pending {
+		return nil, fmt.Errorf("%w: %s is missing", ErrIncomplete, name)
+	}
+
+	return manifest, nil
+}
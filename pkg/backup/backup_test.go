@@ -0,0 +1,213 @@
+package backup_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/nexdb/nexdb/pkg/backup"
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/keyring"
+	"github.com/nexdb/nexdb/pkg/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const key = "key-that-is-thirty-2-bytes-long!"
+
+// serverKey is the key the storage of the server is encrypted with, it seals
+// the keys of the databases.
+const serverKey = "server-key-is-thirty-2-bytes-ok!"
+
+// newManager returns a manager with a default database holding an api key
+// and an encrypted tenant database holding two users.
+func newManager(t *testing.T) *database.Manager {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	s, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	system := &database.Database{Cache: cache.NewCache(ctx, cache.NewQueue(s))}
+	require.NoError(t, system.Put(document.New().SetCollection("_api_keys").SetData(map[string]interface{}{"key": "secret"}), false))
+
+	m := database.NewManager(ctx, storage.MemoryDriver, system, storage.WithEncryptionKey([]byte(serverKey)))
+	_, err = m.Create("tenant", "tenant-key-is-thirty-2-bytes-ok!")
+	require.NoError(t, err)
+
+	tenant, err := m.Get("tenant")
+	require.NoError(t, err)
+	for _, name := range []string{"ada", "grace"} {
+		require.NoError(t, tenant.Put(document.New().SetCollection("users").SetData(map[string]interface{}{"name": name}), false))
+	}
+
+	return m
+}
+
+// opener returns an opener of memory storage that records the storage and
+// key of each database, documents are stored serialised as other drivers do.
+func opener(stores map[string]*storage.Memory, keys map[string]string) backup.Opener {
+	return func(name, encryptionKey string) (storage.Storage, error) {
+		m, _ := storage.NewMemory()
+		m.WithSerialisation(true)
+		stores[name] = m
+
+		server, err := keyring.FromKey([]byte(serverKey))
+		if err != nil {
+			return nil, err
+		}
+		if encryptionKey, err = database.OpenKey(server, encryptionKey); err != nil {
+			return nil, err
+		}
+		keys[name] = encryptionKey
+
+		kr, err := keyring.FromKey([]byte(encryptionKey))
+		if err != nil {
+			return nil, err
+		}
+		return m.WithKeyring(kr)
+	}
+}
+
+func count(t *testing.T, s storage.Storage) int {
+	t.Helper()
+
+	ch, err := s.Stream()
+	require.NoError(t, err)
+
+	n := 0
+	for range ch {
+		n++
+	}
+	return n
+}
+
+func TestRestore(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		writeKey   string
+		restoreKey string
+		wantErr    error
+	}{
+		{name: "unencrypted archive"},
+		{name: "encrypted archive", writeKey: key, restoreKey: key},
+		{name: "encrypted archive without a key", writeKey: key, wantErr: backup.ErrEncryptionKeyRequired},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			manifest, err := backup.Write(&buf, newManager(t), []byte(tc.writeKey))
+			require.NoError(t, err)
+			assert.Equal(t, 4, manifest.Documents())
+			assert.Equal(t, database.DefaultName, manifest.Databases[0].Name)
+
+			stores, keys := map[string]*storage.Memory{}, map[string]string{}
+			restored, err := backup.Restore(bytes.NewReader(buf.Bytes()), []byte(tc.restoreKey), opener(stores, keys))
+			if tc.wantErr != nil {
+				require.ErrorIs(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			assert.Equal(t, manifest.Documents(), restored.Documents())
+			assert.Equal(t, 2, count(t, stores[database.DefaultName]))
+			assert.Equal(t, 2, count(t, stores["tenant"]))
+
+			// the tenant is restored with its own key from the default database
+			assert.Equal(t, "tenant-key-is-thirty-2-bytes-ok!", keys["tenant"])
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := backup.Write(&buf, newManager(t), []byte(key))
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name    string
+		archive []byte
+		key     string
+		wantErr error
+	}{
+		{
+			name:    "valid archive",
+			archive: buf.Bytes(),
+			key:     key,
+		},
+		{
+			name:    "wrong key",
+			archive: buf.Bytes(),
+			key:     "a-different-key-of-thirty-2-byte",
+		},
+		{
+			name:    "tampered file",
+			archive: tamper(t, buf.Bytes()),
+			key:     key,
+			wantErr: backup.ErrChecksumMismatch,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := backup.Verify(bytes.NewReader(tc.archive), []byte(tc.key))
+			switch {
+			case tc.wantErr != nil:
+				require.ErrorIs(t, err, tc.wantErr)
+			case tc.key != key:
+				require.Error(t, err)
+			default:
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+// tamper rewrites an archive with a byte of its last file flipped.
+func tamper(t *testing.T, archive []byte) []byte {
+	t.Helper()
+
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	require.NoError(t, err)
+	tr := tar.NewReader(gz)
+
+	var out bytes.Buffer
+	gw := gzip.NewWriter(&out)
+	tw := tar.NewWriter(gw)
+
+	var last []byte
+	var lastHdr *tar.Header
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+
+		if lastHdr != nil {
+			require.NoError(t, tw.WriteHeader(lastHdr))
+			_, err = tw.Write(last)
+			require.NoError(t, err)
+		}
+		lastHdr, last = hdr, data
+	}
+
+	last[len(last)-1] ^= 0xff
+	require.NoError(t, tw.WriteHeader(lastHdr))
+	_, err = tw.Write(last)
+	require.NoError(t, err)
+
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return out.Bytes()
+}
@@ -0,0 +1,232 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// ClientAuth is the policy for client certificates.
+type ClientAuth string
+
+const (
+	// ClientAuthNone does not ask clients for a certificate.
+	ClientAuthNone ClientAuth = "none"
+	// ClientAuthRequest asks clients for a certificate and verifies it if one is sent.
+	ClientAuthRequest ClientAuth = "request"
+	// ClientAuthRequire requires clients to send a valid certificate.
+	ClientAuthRequire ClientAuth = "require"
+)
+
+var (
+	// ErrCertificateRequired is returned when only one of the certificate and key files is set.
+	ErrCertificateRequired = errors.New("both a certificate and key file are required")
+	// ErrClientCAInvalid is returned when the client CA file holds no certificates.
+	ErrClientCAInvalid = errors.New("client CA file contains no certificates")
+	// ErrUnknownClientAuth is returned when the client auth policy is not recognised.
+	ErrUnknownClientAuth = errors.New("unknown client auth, must be none, request or require")
+)
+
+// Options are the TLS settings of the server.
+type Options struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile enables mutual TLS, client certificates must be signed
+	// by one of the CAs in the file.
+	ClientCAFile string
+	// ClientAuth defaults to ClientAuthRequire when a client CA file is set.
+	ClientAuth ClientAuth
+}
+
+// Enabled reports whether TLS is configured.
+func (o Options) Enabled() bool {
+	return o.CertFile != "" || o.KeyFile != ""
+}
+
+// Validate validates the options.
+func (o Options) Validate() error {
+	if o.Enabled() && (o.CertFile == "" || o.KeyFile == "") {
+		return ErrCertificateRequired
+	}
+
+	switch o.ClientAuth {
+	case "", ClientAuthNone, ClientAuthRequest, ClientAuthRequire:
+		return nil
+	default:
+		return ErrUnknownClientAuth
+	}
+}
+
+// clientAuthType returns the crypto/tls policy of the options.
+func (o Options) clientAuthType() tls.ClientAuthType {
+	if o.ClientCAFile == "" {
+		return tls.NoClientCert
+	}
+
+	switch o.ClientAuth {
+	case ClientAuthNone:
+		return tls.NoClientCert
+	case ClientAuthRequest:
+		return tls.VerifyClientCertIfGiven
+	default:
+		return tls.RequireAndVerifyClientCert
+	}
+}
+
+// Reloader serves the certificate, key and client CAs from disk and reloads
+// them when the files change, so certificates can be rotated without
+// restarting the server.
+//
+// To initialise a new Reloader use the NewReloader function.
+type Reloader struct {
+	opts Options
+
+	mx        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTime   time.Time
+}
+
+// TLSConfig returns a TLS config that always uses the latest loaded files.
+func (r *Reloader) TLSConfig() *tls.Config {
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+		GetCertificate: r.getCertificate,
+	}
+
+	// the client CAs can't be swapped through a callback, so a config
+	// is built per handshake from the latest loaded files.
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.mx.RLock()
+		defer r.mx.RUnlock()
+
+		c := cfg.Clone()
+		c.GetConfigForClient = nil
+		c.ClientAuth = r.opts.clientAuthType()
+		c.ClientCAs = r.clientCAs
+
+		return c, nil
+	}
+
+	return cfg
+}
+
+// getCertificate returns the latest loaded certificate.
+func (r *Reloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	return r.cert, nil
+}
+
+// Reload loads the files from disk, if they fail to load the previously
+// loaded files remain in use.
+func (r *Reloader) Reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.opts.CertFile, r.opts.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if r.opts.ClientCAFile != "" {
+		b, err := os.ReadFile(r.opts.ClientCAFile)
+		if err != nil {
+			return err
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(b) {
+			return ErrClientCAInvalid
+		}
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTime = modTime
+
+	return nil
+}
+
+// Watch checks the files for changes every interval and reloads them,
+// until the context is cancelled.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		modTime, err := r.latestModTime()
+		if err != nil {
+			onError(err)
+			continue
+		}
+
+		r.mx.RLock()
+		changed := modTime.After(r.modTime)
+		r.mx.RUnlock()
+
+		if !changed {
+			continue
+		}
+
+		if err := r.Reload(); err != nil {
+			onError(err)
+		}
+	}
+}
+
+// latestModTime returns the most recent modification time of the files.
+func (r *Reloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{r.opts.CertFile, r.opts.KeyFile, r.opts.ClientCAFile} {
+		if f == "" {
+			continue
+		}
+
+		info, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// NewReloader returns a new Reloader with the files loaded.
+func NewReloader(opts Options) (*Reloader, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	r := &Reloader{
+		opts: opts,
+	}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
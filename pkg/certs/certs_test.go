@@ -0,0 +1,185 @@
+package certs_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/certs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOptions_Validate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts certs.Options
+		want error
+	}{
+		{
+			name: "disabled, no error should be returned",
+			opts: certs.Options{},
+		},
+		{
+			name: "certificate without key, expect ErrCertificateRequired to be returned",
+			opts: certs.Options{CertFile: "cert.pem"},
+			want: certs.ErrCertificateRequired,
+		},
+		{
+			name: "unknown client auth, expect ErrUnknownClientAuth to be returned",
+			opts: certs.Options{CertFile: "cert.pem", KeyFile: "key.pem", ClientAuth: "maybe"},
+			want: certs.ErrUnknownClientAuth,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.opts.Validate())
+		})
+	}
+}
+
+func TestReloader_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, caKey := newCA(t)
+	writeCert(t, dir, "server", ca, caKey, "localhost", 1)
+	writeCert(t, dir, "client", ca, caKey, "reporting", 2)
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.Raw)
+
+	r, err := certs.NewReloader(certs.Options{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server-key.pem"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+	})
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.VerifiedChains[0][0].Subject.CommonName)
+	}))
+	srv.TLS = r.TLSConfig()
+	srv.StartTLS()
+	defer srv.Close()
+
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem"))
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	get := func(certificates []tls.Certificate) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:      roots,
+				ServerName:   "localhost",
+				Certificates: certificates,
+			},
+		}}
+		return client.Get(srv.URL)
+	}
+
+	// a client certificate is required
+	_, err = get(nil)
+	require.Error(t, err)
+
+	resp, err := get([]tls.Certificate{clientCert})
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "reporting", string(body))
+	assert.Equal(t, int64(1), resp.TLS.PeerCertificates[0].SerialNumber.Int64())
+
+	// rotate the server certificate
+	writeCert(t, dir, "server", ca, caKey, "localhost", 3)
+	require.NoError(t, r.Reload())
+
+	resp, err = get([]tls.Certificate{clientCert})
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, int64(3), resp.TLS.PeerCertificates[0].SerialNumber.Int64())
+}
+
+func TestReloader_KeepsCertificateOnFailedReload(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, caKey := newCA(t)
+	writeCert(t, dir, "server", ca, caKey, "localhost", 1)
+
+	r, err := certs.NewReloader(certs.Options{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "server.pem"), []byte("garbage"), 0o600))
+	require.Error(t, r.Reload())
+
+	cert, err := r.TLSConfig().GetCertificate(nil)
+	require.NoError(t, err)
+	assert.NotNil(t, cert)
+}
+
+func newCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(100),
+		Subject:               pkix.Name{CommonName: "nexdb test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	b, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	ca, err := x509.ParseCertificate(b)
+	require.NoError(t, err)
+
+	return ca, key
+}
+
+func writeCert(t *testing.T, dir, name string, ca *x509.Certificate, caKey *ecdsa.PrivateKey, commonName string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	b, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	writePEM(t, filepath.Join(dir, name+".pem"), "CERTIFICATE", b)
+	writePEM(t, filepath.Join(dir, name+"-key.pem"), "EC PRIVATE KEY", keyBytes)
+}
+
+func writePEM(t *testing.T, path, blockType string, b []byte) {
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: b}), 0o600))
+}
@@ -0,0 +1,612 @@
+// Package cluster runs the databases of a server as a member of a Raft
+// cluster, typically of three or five nodes, so the cluster keeps taking
+// writes while a majority of its nodes are up.
+//
+// Writes are committed to a log replicated by Raft before they are applied,
+// the Node is the committer of every database, see database.Committer. A
+// write returns once a majority of the cluster has it and the node has
+// applied it, so writes are linearizable. Writes are made by the leader,
+// the other nodes forward them to it.
+//
+// Reads are served by the leader once it has confirmed it is still the
+// leader, or by any node that has applied the writes of the leader recently
+// enough, see ReadConsistency.
+//
+// A cluster is bootstrapped by one node and the others join it by asking a
+// member, see WithBootstrap and WithJoin. The leader is elected, and
+// replaced when it fails, automatically.
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/errors"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// ReadConsistency is how up to date the documents a node reads must be.
+type ReadConsistency string
+
+const (
+	// ReadLeader serves reads from the leader once it has confirmed it is
+	// still the leader, the other nodes forward reads to it. Reads see every
+	// write that returned before them.
+	ReadLeader ReadConsistency = "leader"
+	// ReadFollower serves reads from any node that was up to date with the
+	// leader within the maximum staleness, they may miss the latest writes.
+	ReadFollower ReadConsistency = "follower"
+)
+
+const (
+	// DefaultMaxStaleness is how long a node serves reads for after it was
+	// last up to date with the leader if the maximum staleness isn't set.
+	DefaultMaxStaleness = 5 * time.Second
+	// DefaultApplyTimeout is how long a write waits to be committed and
+	// applied if the apply timeout isn't set.
+	DefaultApplyTimeout = 10 * time.Second
+	// DefaultSnapshotThreshold is the number of writes after which the log
+	// is snapshotted if the snapshot threshold isn't set.
+	DefaultSnapshotThreshold = 8192
+)
+
+// MembersCollection is the collection of the default database that holds
+// the api address of every member, writes are forwarded to the api address
+// of the leader.
+const MembersCollection = "_cluster_members"
+
+const (
+	// ApplyPath is the path writes are forwarded to, relative to the api
+	// address of the leader.
+	ApplyPath = "/v1/admin/cluster/apply"
+	// MembersPath is the path nodes ask to join a cluster at, relative to
+	// the api address of a member.
+	MembersPath = "/v1/admin/cluster/members"
+)
+
+// Member is a member of a cluster.
+type Member struct {
+	ID string `json:"id"`
+	// Address is the address the member serves raft on, such as node1:7000.
+	Address string `json:"address"`
+	// APIAddress is the address the member serves the api on, such as
+	// http://node1:9000.
+	APIAddress string `json:"api_address"`
+	Leader     bool   `json:"leader"`
+}
+
+// Status is the cluster status of a node.
+type Status struct {
+	ID string `json:"id"`
+	// State is leader, follower, candidate or shutdown.
+	State string `json:"state"`
+	// Leader is the id of the leader, if the node knows it.
+	Leader string `json:"leader,omitempty"`
+	Term   uint64 `json:"term"`
+	// CommitIndex is the index of the latest write the node knows is
+	// committed, AppliedIndex that of the latest write it has applied.
+	CommitIndex     uint64          `json:"commit_index"`
+	AppliedIndex    uint64          `json:"applied_index"`
+	LastContact     time.Time       `json:"last_contact,omitempty"`
+	ReadConsistency ReadConsistency `json:"read_consistency"`
+	Members         []Member        `json:"members"`
+}
+
+// Node is a member of a cluster, it commits the writes made to the
+// databases of its manager to the replicated log and applies the writes
+// committed to it.
+//
+// To initialise a new Node use the New function, it joins the cluster once
+// it is opened with Open.
+type Node struct {
+	manager      *database.Manager
+	id           string
+	address      string
+	apiAddress   string
+	apiKey       string
+	dir          string
+	bootstrap    bool
+	join         string
+	consistency  ReadConsistency
+	maxStaleness time.Duration
+	applyTimeout time.Duration
+	// electionTimeout is how long followers wait to hear from the leader
+	// before standing for election, the default of raft if it isn't set.
+	electionTimeout   time.Duration
+	snapshotThreshold uint64
+	transport         raft.Transport
+	client            *http.Client
+
+	raft *raft.Raft
+	fsm  *fsm
+	// logs is the store of the log, reads check the writes the node hasn't
+	// applied yet in it.
+	logs raft.LogStore
+	// closers close the stores of the log once raft is shut down.
+	closers []io.Closer
+	// hasState is set if the node was a member when it was opened, it
+	// doesn't ask to join again.
+	hasState bool
+	// seed is set on the node that bootstrapped the cluster until it has
+	// committed the documents it loaded from storage, the leader doesn't
+	// take writes while it is set.
+	seed atomic.Bool
+	// ready is set while the node is the leader and has applied every write
+	// committed by earlier leaders.
+	ready    atomic.Bool
+	leaderCh chan bool
+	done     chan struct{}
+}
+
+// Open starts raft, bootstrapping the cluster if the node is set to and
+// has never been a member. The databases of the manager must be loaded
+// first, the writes committed since the node last applied them are applied
+// on top of them.
+func (n *Node) Open() error {
+	logger := newLogger()
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(n.id)
+	conf.Logger = logger
+	conf.NotifyCh = n.leaderCh
+	conf.SnapshotThreshold = n.snapshotThreshold
+	conf.TrailingLogs = n.snapshotThreshold
+	if n.electionTimeout > 0 {
+		conf.HeartbeatTimeout = n.electionTimeout
+		conf.ElectionTimeout = n.electionTimeout
+		conf.LeaderLeaseTimeout = n.electionTimeout / 2
+	}
+
+	logs, stable, snaps, err := n.stores(logger)
+	if err != nil {
+		return err
+	}
+
+	if n.transport == nil {
+		advertise, err := net.ResolveTCPAddr("tcp", n.address)
+		if err != nil {
+			return fmt.Errorf("cluster address %q can't be resolved: %w", n.address, err)
+		}
+
+		n.transport, err = raft.NewTCPTransportWithLogger(n.address, advertise, 3, 10*time.Second, logger)
+		if err != nil {
+			return err
+		}
+	}
+
+	n.hasState, err = raft.HasExistingState(logs, stable, snaps)
+	if err != nil {
+		return err
+	}
+
+	n.fsm = &fsm{manager: n.manager}
+	n.logs = logs
+	n.raft, err = raft.NewRaft(conf, n.fsm, logs, stable, snaps, n.transport)
+	if err != nil {
+		return err
+	}
+
+	if n.bootstrap && !n.hasState {
+		err := n.raft.BootstrapCluster(raft.Configuration{
+			Servers: []raft.Server{{ID: conf.LocalID, Address: n.transport.LocalAddr()}},
+		}).Error()
+		if err != nil {
+			return err
+		}
+
+		slog.Info("bootstrapped a new cluster", "id", n.id, "address", n.transport.LocalAddr())
+	}
+
+	// the documents loaded from storage aren't in the log until the log
+	// records they have been committed, seeding resumes if the node stopped
+	// before then
+	n.seed.Store(n.bootstrap)
+
+	go n.watch()
+
+	return nil
+}
+
+// stores returns the stores of the log and its snapshots, they are kept in
+// memory if the node has no directory.
+func (n *Node) stores(logger hclog.Logger) (raft.LogStore, raft.StableStore, raft.SnapshotStore, error) {
+	if n.dir == "" {
+		store := raft.NewInmemStore()
+		return store, store, raft.NewInmemSnapshotStore(), nil
+	}
+
+	if err := os.MkdirAll(n.dir, 0o700); err != nil {
+		return nil, nil, nil, err
+	}
+
+	bolt, err := raftboltdb.NewBoltStore(filepath.Join(n.dir, "raft.db"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	n.closers = append(n.closers, bolt)
+
+	logs, err := raft.NewLogCache(512, bolt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	snaps, err := raft.NewFileSnapshotStoreWithLogger(n.dir, 2, logger)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return logs, bolt, snaps, nil
+}
+
+// watch follows the leadership of the node until it is shut down.
+func (n *Node) watch() {
+	for {
+		select {
+		case <-n.done:
+			return
+		case leader := <-n.leaderCh:
+			if !leader {
+				n.ready.Store(false)
+				slog.Info("no longer the leader of the cluster", "id", n.id)
+				continue
+			}
+
+			// raft waits for the channel to be read, the leader gets ready
+			// without holding it up
+			go n.lead()
+		}
+	}
+}
+
+// lead gets a node that has been elected ready to serve reads, records its
+// api address for the other nodes to forward writes to and commits the
+// documents it loaded from storage if they aren't in the log yet.
+func (n *Node) lead() {
+	// the writes committed by earlier leaders are applied before reads
+	if err := n.raft.Barrier(n.applyTimeout).Error(); err != nil {
+		slog.Warn("elected the leader of the cluster but failed to catch up", "id", n.id, "error", err)
+		return
+	}
+	if !n.IsLeader() {
+		return
+	}
+	n.ready.Store(true)
+	slog.Info("elected the leader of the cluster", "id", n.id)
+
+	if err := n.register(Member{ID: n.id, Address: string(n.transport.LocalAddr()), APIAddress: n.apiAddress}); err != nil {
+		slog.Error("failed to record the api address of the leader", "id", n.id, "error", err)
+	}
+
+	for n.seed.Load() && !n.fsm.seeded.Load() {
+		err := n.seedLog()
+		if err == nil {
+			break
+		}
+		if !n.IsLeader() {
+			return
+		}
+
+		slog.Error("failed to commit the documents loaded from storage, committing them again", "error", err)
+		select {
+		case <-n.done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+	n.seed.Store(false)
+}
+
+// seedLog commits the documents of every database, so the nodes joining a
+// cluster bootstrapped by a server that already had documents have them
+// too, and then records they have been committed. The default database
+// goes first, it records the other databases.
+func (n *Node) seedLog() error {
+	databases := n.manager.Databases()
+	for i, d := range databases {
+		if d.Name == database.DefaultName {
+			databases[0], databases[i] = databases[i], databases[0]
+		}
+	}
+
+	total := 0
+	for _, d := range databases {
+		for _, doc := range d.Documents() {
+			// the latest version, unless it has been deleted since
+			current := d.GetAnyByID(doc.ID.String())
+			if current == nil {
+				continue
+			}
+
+			if err := n.commit(d.Name, cache.OperationUpdate, current); err != nil {
+				return err
+			}
+			total++
+		}
+	}
+
+	if _, err := n.apply(seededCommand); err != nil {
+		return err
+	}
+
+	if total > 0 {
+		slog.Info("committed the documents loaded from storage", "documents", total)
+	}
+
+	return nil
+}
+
+// ID returns the id of the node.
+func (n *Node) ID() string {
+	return n.id
+}
+
+// IsLeader returns whether the node is the leader.
+func (n *Node) IsLeader() bool {
+	return n.raft.State() == raft.Leader
+}
+
+// Write reports whether the node can take a write. It returns ErrNotLeader
+// if the write must be forwarded to the leader, and ErrNoLeader if a newly
+// elected leader hasn't caught up or committed the documents it loaded from
+// storage.
+func (n *Node) Write() error {
+	if !n.IsLeader() {
+		return errors.New(errors.ErrNotLeader)
+	}
+	if !n.ready.Load() || n.seed.Load() {
+		return errors.New(errors.ErrNoLeader)
+	}
+
+	return nil
+}
+
+// Read reports whether the node can serve a read with its read consistency.
+// It returns ErrNotLeader if the read must be served by the leader,
+// ErrStaleRead if the node hasn't been up to date with the leader within
+// the maximum staleness and ErrNoLeader if a newly elected leader hasn't
+// caught up.
+func (n *Node) Read() error {
+	if n.IsLeader() {
+		if !n.ready.Load() {
+			return errors.New(errors.ErrNoLeader)
+		}
+		if n.consistency == ReadFollower {
+			return nil
+		}
+
+		// a leader cut off from the cluster may not know it has been replaced
+		return fromRaft(n.raft.VerifyLeader().Error())
+	}
+
+	if n.consistency == ReadLeader {
+		return errors.New(errors.ErrNotLeader)
+	}
+
+	// a node that has applied every write it knows is committed is as up to
+	// date as when it last heard from the leader, one that is behind only as
+	// up to date as the latest write it applied
+	at := n.raft.LastContact()
+	if !n.caughtUp() {
+		if applied := n.fsm.appliedAt(); applied.Before(at) {
+			at = applied
+		}
+	}
+
+	if time.Since(at) > n.maxStaleness {
+		return errors.New(errors.ErrStaleRead)
+	}
+
+	return nil
+}
+
+// caughtUp reports whether the node has applied every write it knows is
+// committed. The entries raft doesn't hand over to be applied, such as the
+// no-op committed by a newly elected leader, aren't waited for, nor are
+// those compacted into a snapshot the node has restored.
+func (n *Node) caughtUp() bool {
+	commit := n.raft.CommitIndex()
+	for i := n.fsm.applied.Load() + 1; i <= commit; i++ {
+		var l raft.Log
+		err := n.logs.GetLog(i, &l)
+		if err == raft.ErrLogNotFound {
+			continue
+		}
+		if err != nil || l.Type == raft.LogCommand {
+			return false
+		}
+	}
+
+	return true
+}
+
+// WaitLeader waits until the node knows the leader of the cluster, and the
+// leader is ready to take writes if it is the node, or ctx is done.
+func (n *Node) WaitLeader(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if _, id := n.raft.LeaderWithID(); id != "" && (id != raft.ServerID(n.id) || n.Write() == nil) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Status returns the cluster status of the node.
+func (n *Node) Status() (Status, error) {
+	members, err := n.Members()
+	if err != nil {
+		return Status{}, err
+	}
+
+	_, leader := n.raft.LeaderWithID()
+	term, _ := strconv.ParseUint(n.raft.Stats()["term"], 10, 64)
+
+	return Status{
+		ID:              n.id,
+		State:           strings.ToLower(n.raft.State().String()),
+		Leader:          string(leader),
+		Term:            term,
+		CommitIndex:     n.raft.CommitIndex(),
+		AppliedIndex:    n.fsm.applied.Load(),
+		LastContact:     n.raft.LastContact(),
+		ReadConsistency: n.consistency,
+		Members:         members,
+	}, nil
+}
+
+// Snapshot snapshots the databases, so the log before the snapshot can be
+// compacted. Nodes too far behind the log are sent the snapshot instead.
+func (n *Node) Snapshot() error {
+	return n.raft.Snapshot().Error()
+}
+
+// Shutdown leaves the leadership of the cluster to another node if it is
+// the leader, and stops raft. Writes are no longer applied once it returns.
+func (n *Node) Shutdown() error {
+	if n.IsLeader() {
+		if err := n.raft.LeadershipTransfer().Error(); err != nil {
+			slog.Warn("failed to hand over the leadership of the cluster", "id", n.id, "error", err)
+		}
+	}
+
+	err := n.raft.Shutdown().Error()
+	close(n.done)
+
+	for _, c := range n.closers {
+		if closeErr := c.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// WithAPIAddress sets the address the node serves the api on, such as
+// http://node1:9000, the other nodes forward writes to it while it is the
+// leader.
+func (n *Node) WithAPIAddress(address string) *Node {
+	n.apiAddress = address
+	return n
+}
+
+// WithAPIKey sets the api key of the default database the node
+// authenticates with when it forwards writes or asks to join.
+func (n *Node) WithAPIKey(key string) *Node {
+	n.apiKey = key
+	return n
+}
+
+// WithDir sets the directory the log and its snapshots are kept in, they
+// are kept in memory if it isn't set.
+func (n *Node) WithDir(dir string) *Node {
+	n.dir = dir
+	return n
+}
+
+// WithBootstrap sets whether the node bootstraps a new cluster of its own
+// when it has never been a member of one.
+func (n *Node) WithBootstrap(bootstrap bool) *Node {
+	n.bootstrap = bootstrap
+	return n
+}
+
+// WithJoin sets the api address of a member of the cluster, such as
+// http://node1:9000, the node asks to join the cluster when it has never
+// been a member of it.
+func (n *Node) WithJoin(address string) *Node {
+	n.join = address
+	return n
+}
+
+// WithReadConsistency sets the read consistency of the node and the
+// maximum staleness of the reads it serves as a follower, ReadLeader and
+// DefaultMaxStaleness if it isn't set.
+func (n *Node) WithReadConsistency(c ReadConsistency, maxStaleness time.Duration) *Node {
+	n.consistency = c
+	n.maxStaleness = maxStaleness
+	return n
+}
+
+// WithApplyTimeout sets how long a write waits to be committed and applied,
+// DefaultApplyTimeout if it isn't set.
+func (n *Node) WithApplyTimeout(d time.Duration) *Node {
+	n.applyTimeout = d
+	return n
+}
+
+// WithElectionTimeout sets how long followers wait to hear from the leader
+// before standing for election, one second if it isn't set.
+func (n *Node) WithElectionTimeout(d time.Duration) *Node {
+	n.electionTimeout = d
+	return n
+}
+
+// WithSnapshotThreshold sets the number of writes after which the log is
+// snapshotted, the latest threshold writes are kept when it is compacted.
+// DefaultSnapshotThreshold if it isn't set.
+func (n *Node) WithSnapshotThreshold(threshold uint64) *Node {
+	n.snapshotThreshold = threshold
+	return n
+}
+
+// WithTransport sets the transport raft is served over, such as an
+// in-memory transport in tests. Raft is served over TCP on the address of
+// the node if it isn't set.
+func (n *Node) WithTransport(t raft.Transport) *Node {
+	n.transport = t
+	return n
+}
+
+// New returns a member of a cluster with the given id that commits the
+// writes made to the databases of manager, and serves raft on address, such
+// as node1:7000. The manager must be set to commit its writes with the node,
+// see database.Manager.WithCommitter.
+func New(manager *database.Manager, id, address string) *Node {
+	return &Node{
+		manager:           manager,
+		id:                id,
+		address:           address,
+		consistency:       ReadLeader,
+		maxStaleness:      DefaultMaxStaleness,
+		applyTimeout:      DefaultApplyTimeout,
+		snapshotThreshold: DefaultSnapshotThreshold,
+		client:            &http.Client{},
+		leaderCh:          make(chan bool, 1),
+		done:              make(chan struct{}),
+	}
+}
+
+// fromRaft returns the error of the errors package for the errors raft
+// returns when there is no leader to take a write.
+func fromRaft(err error) error {
+	switch err {
+	case raft.ErrNotLeader, raft.ErrLeadershipLost, raft.ErrLeadershipTransferInProgress:
+		return errors.New(errors.ErrNotLeader)
+	case raft.ErrEnqueueTimeout, raft.ErrRaftShutdown:
+		return errors.New(errors.ErrNoLeader)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,273 @@
+package cluster_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/cluster"
+	"github.com/nexdb/nexdb/pkg/cluster/clustertest"
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/errors"
+	"github.com/nexdb/nexdb/pkg/storage"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// caughtUp waits for every node of the cluster to apply the writes
+// committed by the leader.
+func caughtUp(t *testing.T, c *clustertest.Cluster) {
+	t.Helper()
+
+	ls, err := c.Leader().Status()
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		for _, n := range c.Nodes() {
+			s, err := n.Status()
+			if err != nil || s.AppliedIndex < ls.AppliedIndex {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCluster(t *testing.T) {
+	c := clustertest.New(t, 3)
+	leader := c.Leader()
+	followers := c.Followers()
+	require.Len(t, followers, 2)
+
+	// writes to the leader are applied by every node
+	ada := document.New().SetCollection("users").SetData(map[string]interface{}{"name": "ada", "age": int64(36)})
+	require.NoError(t, leader.Database(t, database.DefaultName).Put(ada, false))
+	caughtUp(t, c)
+	for _, n := range c.Nodes() {
+		doc := n.Database(t, database.DefaultName).GetByID(ada.ID.String())
+		require.NotNil(t, doc, n.ID())
+		assert.Equal(t, "ada", doc.Data["name"])
+		assert.Equal(t, int64(36), doc.Data["age"])
+	}
+
+	// writes to a follower are forwarded, and can be read straight away
+	grace := document.New().SetCollection("users").SetData(map[string]interface{}{"name": "grace"})
+	fdb := followers[0].Database(t, database.DefaultName)
+	require.NoError(t, fdb.Put(grace, false))
+	assert.Equal(t, "grace", fdb.GetByID(grace.ID.String()).Data["name"])
+
+	require.NoError(t, fdb.Delete(ada.ID.String()))
+	assert.Nil(t, fdb.GetAnyByID(ada.ID.String()))
+	caughtUp(t, c)
+	assert.Nil(t, leader.Database(t, database.DefaultName).GetAnyByID(ada.ID.String()))
+
+	// databases are created and dropped on every node
+	_, err := followers[1].Manager.Create("acme", "")
+	require.NoError(t, err)
+	order := document.New().SetCollection("orders").SetData(map[string]interface{}{"total": 42.0})
+	require.NoError(t, followers[1].Database(t, "acme").Put(order, false))
+	caughtUp(t, c)
+	for _, n := range c.Nodes() {
+		assert.Equal(t, 42.0, n.Database(t, "acme").GetByID(order.ID.String()).Data["total"], n.ID())
+	}
+
+	_, err = leader.Manager.Create("acme", "")
+	assert.Equal(t, errors.New(errors.ErrDatabaseAlreadyExists).Error(), err.Error())
+
+	require.NoError(t, followers[0].Manager.Drop("acme"))
+	caughtUp(t, c)
+	for _, n := range c.Nodes() {
+		_, err := n.Manager.Get("acme")
+		assert.Equal(t, errors.New(errors.ErrDatabaseNotFound).Error(), err.Error(), n.ID())
+	}
+}
+
+func TestClusterFailover(t *testing.T) {
+	c := clustertest.New(t, 3)
+	old := c.Leader()
+
+	ada := document.New().SetCollection("users").SetData(map[string]interface{}{"name": "ada"})
+	require.NoError(t, old.Database(t, database.DefaultName).Put(ada, false))
+	caughtUp(t, c)
+
+	c.Stop(old)
+
+	// the others elect a leader among themselves and carry on taking writes
+	leader := c.Leader()
+	assert.NotEqual(t, old.ID(), leader.ID())
+	assert.Equal(t, "ada", leader.Database(t, database.DefaultName).GetByID(ada.ID.String()).Data["name"])
+
+	grace := document.New().SetCollection("users").SetData(map[string]interface{}{"name": "grace"})
+	follower := c.Followers()[0]
+	require.NoError(t, follower.Database(t, database.DefaultName).Put(grace, false))
+	caughtUp(t, c)
+	assert.Equal(t, "grace", leader.Database(t, database.DefaultName).GetByID(grace.ID.String()).Data["name"])
+
+	// without a majority there is no leader to take writes
+	c.Stop(leader)
+	err := follower.Database(t, database.DefaultName).Put(document.New().SetCollection("users"), false)
+	require.Error(t, err)
+}
+
+func TestClusterMembership(t *testing.T) {
+	c := clustertest.New(t, 3, func(n *cluster.Node) {
+		n.WithSnapshotThreshold(2)
+	})
+	leader := c.Leader()
+
+	members, err := leader.Members()
+	require.NoError(t, err)
+	require.Len(t, members, 3)
+	for _, m := range members {
+		assert.NotEmpty(t, m.APIAddress, m.ID)
+		assert.Equal(t, m.ID == leader.ID(), m.Leader, m.ID)
+	}
+
+	// members are removed by the leader
+	follower := c.Followers()[0]
+	assert.Equal(t, errors.New(errors.ErrNotLeader).Error(), follower.Remove(context.Background(), leader.ID()).Error())
+	assert.Equal(t, errors.New(errors.ErrMemberNotFound).Error(), leader.Remove(context.Background(), "unknown").Error())
+
+	require.NoError(t, leader.Remove(context.Background(), follower.ID()))
+	c.Stop(follower)
+	members, err = leader.Members()
+	require.NoError(t, err)
+	assert.Len(t, members, 2)
+
+	// a member that joins after the log is compacted is sent a snapshot
+	docs := make([]*document.Document, 10)
+	for i := range docs {
+		docs[i] = document.New().SetCollection("users").SetData(map[string]interface{}{"n": int64(i)})
+		require.NoError(t, leader.Database(t, database.DefaultName).Put(docs[i], false))
+	}
+	_, err = leader.Manager.Create("acme", "")
+	require.NoError(t, err)
+	order := document.New().SetCollection("orders").SetData(map[string]interface{}{"total": 42.0})
+	require.NoError(t, leader.Database(t, "acme").Put(order, false))
+	require.NoError(t, leader.Snapshot())
+
+	n := c.Add()
+	for i, doc := range docs {
+		got := n.Database(t, database.DefaultName).GetByID(doc.ID.String())
+		require.NotNil(t, got)
+		assert.Equal(t, int64(i), got.Data["n"])
+	}
+	assert.Equal(t, 42.0, n.Database(t, "acme").GetByID(order.ID.String()).Data["total"])
+
+	members, err = leader.Members()
+	require.NoError(t, err)
+	assert.Len(t, members, 3)
+}
+
+func TestNode_Read(t *testing.T) {
+	tests := []struct {
+		name        string
+		consistency cluster.ReadConsistency
+		leader      error
+		follower    error
+		stale       error
+	}{
+		{
+			name:        "leader",
+			consistency: cluster.ReadLeader,
+			follower:    errors.New(errors.ErrNotLeader),
+			stale:       errors.New(errors.ErrNotLeader),
+		},
+		{
+			name:        "follower",
+			consistency: cluster.ReadFollower,
+			stale:       errors.New(errors.ErrStaleRead),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := clustertest.New(t, 3, func(n *cluster.Node) {
+				n.WithReadConsistency(tt.consistency, 4*clustertest.ElectionTimeout)
+			})
+
+			leader := c.Leader()
+			follower := c.Followers()[0]
+			assert.Equal(t, tt.leader, leader.Read())
+			assert.Equal(t, tt.follower, follower.Read())
+
+			// a follower that has applied every write stays up to date
+			// while the cluster is idle, the entries committed by a newly
+			// elected leader aren't writes it waits for
+			c.Stop(leader)
+			follower = c.Followers()[0]
+			time.Sleep(6 * clustertest.ElectionTimeout)
+			assert.Equal(t, tt.follower, follower.Read())
+
+			// the follower stops hearing from a leader once the others stop
+			for _, n := range c.Nodes() {
+				if n != follower {
+					c.Stop(n)
+				}
+			}
+			require.Eventually(t, func() bool {
+				err := follower.Read()
+				return err != nil && err.Error() == tt.stale.Error()
+			}, 5*time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestClusterSeed(t *testing.T) {
+	dir := t.TempDir()
+	docs := make([]*document.Document, 20)
+	for i := range docs {
+		docs[i] = document.New().SetCollection("users").SetData(map[string]interface{}{"n": int64(i)})
+	}
+
+	// open bootstraps a single node cluster with the documents loaded from
+	// storage and waits for it to take writes
+	open := func() (*cluster.Node, *database.Database) {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		s, err := storage.New(storage.MemoryDriver)
+		require.NoError(t, err)
+		system := &database.Database{Cache: cache.NewCache(ctx, cache.NewQueue(s))}
+		for _, doc := range docs {
+			require.NoError(t, system.Put(doc, false))
+		}
+		manager := database.NewManager(ctx, storage.MemoryDriver, system)
+
+		address, transport := raft.NewInmemTransport("")
+		n := cluster.New(manager, "node1", string(address)).
+			WithBootstrap(true).
+			WithDir(dir).
+			WithElectionTimeout(clustertest.ElectionTimeout).
+			WithTransport(transport)
+		manager.WithCommitter(n)
+		require.NoError(t, n.Open())
+
+		ctx, cancel = context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		require.NoError(t, n.WaitLeader(ctx))
+		require.NoError(t, n.Write())
+
+		return n, system
+	}
+
+	n, system := open()
+	s, err := n.Status()
+	require.NoError(t, err)
+	assert.Greater(t, s.CommitIndex, uint64(len(docs)))
+
+	require.NoError(t, system.Put(document.New().SetCollection("users"), false))
+	require.NoError(t, n.Snapshot())
+	require.NoError(t, n.Shutdown())
+
+	// the log records the documents were committed, they aren't again
+	n, _ = open()
+	defer n.Shutdown()
+	restarted, err := n.Status()
+	require.NoError(t, err)
+	assert.Less(t, restarted.CommitIndex, s.CommitIndex+uint64(len(docs)))
+}
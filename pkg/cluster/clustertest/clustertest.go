@@ -0,0 +1,262 @@
+// Package clustertest runs clusters of nodes in-process, for tests.
+//
+// The nodes of a cluster are connected by an in-memory transport, keep
+// their log and databases in memory and serve the cluster endpoints over
+// HTTP, so writes and requests to join are forwarded as they are between
+// servers.
+package clustertest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/cluster"
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/handlers"
+	"github.com/nexdb/nexdb/pkg/storage"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+// ElectionTimeout is how long the followers of a cluster wait to hear from
+// the leader before standing for election.
+const ElectionTimeout = 100 * time.Millisecond
+
+// waitFor is how long the cluster is given to elect a leader or catch up.
+const waitFor = 10 * time.Second
+
+// Node is a node of a cluster.
+type Node struct {
+	*cluster.Node
+
+	// Manager manages the databases of the node.
+	Manager *database.Manager
+	// URL is the address the node serves the cluster endpoints on.
+	URL string
+
+	transport *raft.InmemTransport
+	stopped   bool
+}
+
+// Database returns the named database of the node.
+func (n *Node) Database(t testing.TB, name string) *database.Database {
+	t.Helper()
+
+	d, err := n.Manager.Get(name)
+	require.NoError(t, err)
+
+	return d
+}
+
+// Option is a function that modifies the nodes of a cluster before they
+// are opened.
+type Option func(n *cluster.Node)
+
+// Cluster is a cluster of nodes run in-process.
+//
+// To initialise a new Cluster use the New function.
+type Cluster struct {
+	t    testing.TB
+	opts []Option
+
+	mx    sync.Mutex
+	nodes []*Node
+}
+
+// New starts a cluster of size nodes, the first bootstraps the cluster and
+// the others join it. It returns once every node has joined, the cluster is
+// shut down when the test ends.
+func New(t testing.TB, size int, opts ...Option) *Cluster {
+	t.Helper()
+
+	c := &Cluster{t: t, opts: opts}
+	t.Cleanup(c.shutdown)
+
+	c.start(true)
+	c.Leader()
+
+	for i := 1; i < size; i++ {
+		c.Add()
+	}
+
+	return c
+}
+
+// Add starts a node that joins the cluster through one of its members, it
+// returns once the node has caught up with the leader.
+func (c *Cluster) Add() *Node {
+	c.t.Helper()
+
+	n := c.start(false)
+
+	leader := c.Leader()
+	require.Eventually(c.t, func() bool {
+		ls, err := leader.Status()
+		if err != nil {
+			return false
+		}
+		s, err := n.Status()
+		if err != nil || s.Leader == "" || s.AppliedIndex < ls.AppliedIndex {
+			return false
+		}
+
+		// the leader records its api address once it has added it
+		for _, m := range ls.Members {
+			if m.ID == n.ID() && m.APIAddress != "" {
+				return true
+			}
+		}
+		return false
+	}, waitFor, 10*time.Millisecond, "node %s didn't join the cluster", n.ID())
+
+	return n
+}
+
+// start starts a node, it bootstraps the cluster or joins it through one of
+// its members.
+func (c *Cluster) start(bootstrap bool) *Node {
+	c.t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.t.Cleanup(cancel)
+
+	s, err := storage.New(storage.MemoryDriver)
+	require.NoError(c.t, err)
+
+	manager := database.NewManager(ctx, storage.MemoryDriver, &database.Database{Cache: cache.NewCache(ctx, cache.NewQueue(s))})
+
+	c.mx.Lock()
+	id := fmt.Sprintf("node%d", len(c.nodes)+1)
+	join := ""
+	if len(c.nodes) > 0 {
+		join = c.nodes[len(c.nodes)-1].URL
+	}
+	c.mx.Unlock()
+
+	// the endpoints are served before the node exists, the node is created
+	// with their address
+	n := &Node{Manager: manager}
+	router := mux.NewRouter()
+	srv := httptest.NewServer(router)
+	c.t.Cleanup(srv.Close)
+	n.URL = srv.URL
+
+	var address raft.ServerAddress
+	address, n.transport = raft.NewInmemTransport(raft.ServerAddress(id))
+	n.Node = cluster.New(manager, id, string(address)).
+		WithAPIAddress(srv.URL).
+		WithBootstrap(bootstrap).
+		WithJoin(join).
+		WithElectionTimeout(ElectionTimeout).
+		WithTransport(n.transport)
+	for _, opt := range c.opts {
+		opt(n.Node)
+	}
+	manager.WithCommitter(n.Node)
+
+	m := &handlers.ClusterMiddleware{Node: n.Node}
+	router.Handle(cluster.ApplyPath, m.IsLeader(handlers.ApplyWrite(n.Node))).Methods(http.MethodPost)
+	router.Handle(cluster.MembersPath, m.IsLeader(handlers.JoinCluster(n.Node))).Methods(http.MethodPost)
+
+	c.mx.Lock()
+	for _, peer := range c.nodes {
+		if !peer.stopped {
+			n.transport.Connect(peer.transport.LocalAddr(), peer.transport)
+			peer.transport.Connect(address, n.transport)
+		}
+	}
+	c.nodes = append(c.nodes, n)
+	c.mx.Unlock()
+
+	require.NoError(c.t, n.Open())
+	go n.Start(ctx)
+
+	return n
+}
+
+// Nodes returns the nodes of the cluster that are running.
+func (c *Cluster) Nodes() []*Node {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	nodes := []*Node{}
+	for _, n := range c.nodes {
+		if !n.stopped {
+			nodes = append(nodes, n)
+		}
+	}
+
+	return nodes
+}
+
+// Leader waits for the cluster to have a leader that is ready to serve
+// reads and take writes and returns it.
+func (c *Cluster) Leader() *Node {
+	c.t.Helper()
+
+	var leader *Node
+	require.Eventually(c.t, func() bool {
+		for _, n := range c.Nodes() {
+			if n.Write() == nil && n.Read() == nil {
+				leader = n
+				return true
+			}
+		}
+		return false
+	}, waitFor, 10*time.Millisecond, "the cluster didn't elect a leader")
+
+	return leader
+}
+
+// Followers returns the nodes of the cluster that are running and are not
+// the leader.
+func (c *Cluster) Followers() []*Node {
+	c.t.Helper()
+
+	leader := c.Leader()
+
+	followers := []*Node{}
+	for _, n := range c.Nodes() {
+		if n != leader {
+			followers = append(followers, n)
+		}
+	}
+
+	return followers
+}
+
+// Stop stops a node as if it failed, it is cut off from the other nodes
+// before it is shut down so it can't hand over its leadership.
+func (c *Cluster) Stop(n *Node) {
+	c.t.Helper()
+
+	c.mx.Lock()
+	n.stopped = true
+	c.mx.Unlock()
+
+	n.transport.DisconnectAll()
+	for _, peer := range c.Nodes() {
+		peer.transport.Disconnect(n.transport.LocalAddr())
+	}
+
+	require.NoError(c.t, n.Shutdown())
+}
+
+// shutdown shuts down the nodes that are running.
+func (c *Cluster) shutdown() {
+	for _, n := range c.Nodes() {
+		c.mx.Lock()
+		n.stopped = true
+		c.mx.Unlock()
+
+		_ = n.Shutdown()
+	}
+}
@@ -0,0 +1,186 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/errors"
+)
+
+// ForwardedHeader is set on the requests forwarded to the leader, a node
+// that is sent one when it isn't the leader doesn't forward it again.
+const ForwardedHeader = "X-NexDB-Forwarded"
+
+// Commit commits a write to the named database and waits for the node to
+// apply it, it implements database.Committer. Writes made on a node that
+// isn't the leader are forwarded to the leader, a leader that isn't ready
+// to take writes returns ErrNoLeader, see Write.
+func (n *Node) Commit(ctx context.Context, name string, op cache.Operation, doc *document.Document) error {
+	cmd, err := encodeCommand(name, op, doc)
+	if err != nil {
+		return err
+	}
+
+	if n.IsLeader() {
+		_, err := n.Apply(cmd)
+		return err
+	}
+
+	return n.forward(ctx, cmd)
+}
+
+// Apply commits an encoded write on the leader, such as one forwarded by
+// another node, and waits for the leader to apply it. It returns the index
+// of the write in the log.
+func (n *Node) Apply(cmd []byte) (uint64, error) {
+	if _, _, err := decodeCommand(cmd); err != nil {
+		return 0, err
+	}
+
+	if err := n.Write(); err != nil {
+		return 0, err
+	}
+
+	return n.apply(cmd)
+}
+
+// commit commits a write to the named database on the leader whether or not
+// it is ready to take writes, for the writes the leader makes to get ready.
+func (n *Node) commit(name string, op cache.Operation, doc *document.Document) error {
+	cmd, err := encodeCommand(name, op, doc)
+	if err != nil {
+		return err
+	}
+
+	_, err = n.apply(cmd)
+	return err
+}
+
+// apply commits an encoded write and waits for the leader to apply it.
+func (n *Node) apply(cmd []byte) (uint64, error) {
+	f := n.raft.Apply(cmd, n.applyTimeout)
+	if err := f.Error(); err != nil {
+		return 0, fromRaft(err)
+	}
+
+	// the error applying the write, such as to a database that was dropped
+	if err, ok := f.Response().(error); ok {
+		return 0, err
+	}
+
+	return f.Index(), nil
+}
+
+// applied is the response of the leader to a forwarded write.
+type applied struct {
+	Data struct {
+		Index uint64 `json:"index"`
+	} `json:"data"`
+	Error string           `json:"error"`
+	Code  errors.ErrorCode `json:"code"`
+}
+
+// forward forwards an encoded write to the leader and waits for the node to
+// apply it, so the write can be read from the node once it returns.
+func (n *Node) forward(ctx context.Context, cmd []byte) error {
+	leader, err := n.LeaderAPIAddress()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(leader, "/")+ApplyPath, bytes.NewReader(cmd))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ForwardedHeader, n.id)
+	req.SetBasicAuth(n.apiKey, "")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var body applied
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return fmt.Errorf("leader responded with %s: %w", resp.Status, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		if body.Code != 0 {
+			return errors.New(body.Code)
+		}
+		return fmt.Errorf("leader responded with %s: %s", resp.Status, body.Error)
+	}
+
+	return n.waitApplied(ctx, body.Data.Index)
+}
+
+// waitApplied waits for the node to apply the write at index of the log.
+func (n *Node) waitApplied(ctx context.Context, index uint64) error {
+	ctx, cancel := context.WithTimeout(ctx, n.applyTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+
+	for n.fsm.applied.Load() < index {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("write %d was committed but not applied in time: %w", index, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// LeaderAPIAddress returns the api address of the leader, requests are
+// forwarded to it. It returns ErrNoLeader if the node doesn't know the
+// leader.
+func (n *Node) LeaderAPIAddress() (string, error) {
+	if n.IsLeader() {
+		return n.apiAddress, nil
+	}
+
+	_, id := n.raft.LeaderWithID()
+	if id == "" {
+		return "", errors.New(errors.ErrNoLeader)
+	}
+
+	// the leader records its api address once it is elected
+	doc := n.memberDocument(string(id))
+	if doc == nil {
+		return "", errors.New(errors.ErrNoLeader)
+	}
+
+	address, _ := doc.Data["api_address"].(string)
+	return address, nil
+}
+
+// memberDocument returns the document of MembersCollection that records
+// the member with the given id, if any.
+func (n *Node) memberDocument(id string) *document.Document {
+	system, err := n.manager.Get(database.DefaultName)
+	if err != nil {
+		return nil
+	}
+
+	for _, doc := range system.Filter(MembersCollection, cache.Query{}) {
+		if doc.Data["id"] == id {
+			return doc
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,304 @@
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
+
+	"github.com/hashicorp/raft"
+)
+
+// command is a write committed to the log.
+type command struct {
+	Database  string          `json:"database"`
+	Operation cache.Operation `json:"operation"`
+	// Document is the document in the binary storage format, so its values
+	// are applied with the types they were written with.
+	Document []byte `json:"document"`
+	// Seeded records that the node that bootstrapped the cluster has
+	// committed the documents it loaded from storage, it has no document.
+	Seeded bool `json:"seeded,omitempty"`
+}
+
+// seededCommand is committed once the documents loaded from storage have
+// been committed, see command.Seeded.
+var seededCommand = []byte(`{"seeded":true}`)
+
+// encodeCommand returns a write to the named database encoded for the log.
+func encodeCommand(name string, op cache.Operation, doc *document.Document) ([]byte, error) {
+	b, err := doc.ToStorage(nil, document.WithFormat(document.FormatCBOR))
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(command{Database: name, Operation: op, Document: b})
+}
+
+// decodeCommand returns a write encoded for the log and its document.
+func decodeCommand(b []byte) (command, *document.Document, error) {
+	var cmd command
+	if err := json.Unmarshal(b, &cmd); err != nil {
+		return command{}, nil, fmt.Errorf("write can't be decoded: %w", err)
+	}
+	if cmd.Seeded {
+		return cmd, nil, nil
+	}
+
+	doc, err := document.FromStorage(cmd.Document, nil)
+	if err != nil {
+		return command{}, nil, fmt.Errorf("document of write can't be decoded: %w", err)
+	}
+
+	return cmd, doc, nil
+}
+
+// fsm applies the writes committed to the log to the databases of a
+// manager, straight to their caches.
+type fsm struct {
+	manager *database.Manager
+	// applied is the index of the latest write applied. Raft moves on its
+	// own applied index as it hands writes over, before they are applied.
+	applied atomic.Uint64
+	// at is when the latest write was applied, in unix nanoseconds.
+	at atomic.Int64
+	// seeded is set once the log records that the documents loaded from
+	// storage have been committed.
+	seeded atomic.Bool
+}
+
+// Apply implements raft.FSM, it returns the error applying the write if
+// there is one.
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	defer f.stamp(l.Index)
+
+	cmd, doc, err := decodeCommand(l.Data)
+	if err != nil {
+		slog.Error("skipped a write that can't be applied", "index", l.Index, "error", err)
+		return err
+	}
+	if cmd.Seeded {
+		f.seeded.Store(true)
+		return nil
+	}
+
+	return f.apply(cmd.Database, cmd.Operation, doc)
+}
+
+// stamp records that the write at index has been applied.
+func (f *fsm) stamp(index uint64) {
+	f.at.Store(time.Now().UnixNano())
+	f.applied.Store(index)
+}
+
+// appliedAt returns when the latest write was applied, the zero time if
+// none has been.
+func (f *fsm) appliedAt() time.Time {
+	at := f.at.Load()
+	if at == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, at)
+}
+
+// apply applies a write to the named database.
+func (f *fsm) apply(name string, op cache.Operation, doc *document.Document) error {
+	d, err := f.manager.Get(name)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if op == cache.OperationDelete {
+		err = d.Cache.DeleteContext(ctx, doc.ID.String())
+	} else {
+		err = d.Cache.PutContext(ctx, doc, false)
+	}
+	if err != nil {
+		return err
+	}
+
+	// databases are created and dropped by writing their metadata
+	if d.Name == database.DefaultName && doc.Collection == database.DatabasesCollection {
+		return f.manager.Sync()
+	}
+
+	return nil
+}
+
+// Snapshot implements raft.FSM, it copies the documents of every database.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	databases := f.manager.Databases()
+
+	names := make([]string, len(databases))
+	caches := make([]*cache.Cache, len(databases))
+	for i, d := range databases {
+		names[i] = d.Name
+		caches[i] = d.Cache
+	}
+
+	return &snapshot{applied: f.applied.Load(), seeded: f.seeded.Load(), names: names, documents: cache.Snapshot(caches...)}, nil
+}
+
+// Restore implements raft.FSM, it replaces the documents of every database
+// with those of a snapshot, opening and dropping databases to match it.
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(rc))
+
+	var h header
+	if err := dec.Decode(&h); err != nil {
+		return err
+	}
+
+	documents := map[string][]*document.Document{}
+	for {
+		var r record
+		if err := dec.Decode(&r); stderrors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		doc, err := document.FromStorage(r.Document, nil)
+		if err != nil {
+			return err
+		}
+		documents[r.Database] = append(documents[r.Database], doc)
+	}
+
+	// the default database first, it records the other databases
+	system, err := f.manager.Get(database.DefaultName)
+	if err != nil {
+		return err
+	}
+
+	if err := replace(system, documents[database.DefaultName]); err != nil {
+		return err
+	}
+
+	if err := f.manager.Sync(); err != nil {
+		return err
+	}
+
+	for _, d := range f.manager.Databases() {
+		if d.Name == database.DefaultName {
+			continue
+		}
+
+		if err := replace(d, documents[d.Name]); err != nil {
+			return err
+		}
+	}
+
+	f.seeded.Store(h.Seeded)
+	f.stamp(h.Applied)
+
+	return nil
+}
+
+// replace replaces the documents of d with docs, documents that are
+// unchanged are left alone.
+func replace(d *database.Database, docs []*document.Document) error {
+	ctx := context.Background()
+
+	keep := make(map[string]bool, len(docs))
+	for _, doc := range docs {
+		id := doc.ID.String()
+		keep[id] = true
+
+		current := d.GetAnyByID(id)
+		if current != nil && current.Collection == doc.Collection && reflect.DeepEqual(current.Data, doc.Data) {
+			continue
+		}
+
+		if err := d.Cache.PutContext(ctx, doc, false); err != nil {
+			return err
+		}
+	}
+
+	for _, doc := range d.Documents() {
+		if !keep[doc.ID.String()] {
+			if err := d.Cache.DeleteContext(ctx, doc.ID.String()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// header is the first line of a snapshot.
+type header struct {
+	// Applied is the index of the latest write in the snapshot.
+	Applied uint64 `json:"applied"`
+	// Seeded is set if the log recorded that the documents loaded from
+	// storage had been committed, see command.Seeded.
+	Seeded bool `json:"seeded,omitempty"`
+}
+
+// record is a document of a snapshot, snapshots are written one record per
+// line after the header.
+type record struct {
+	Database string `json:"database"`
+	Document []byte `json:"document"`
+}
+
+// snapshot is a copy of the documents of every database, it is written to
+// the snapshot store while the log carries on being applied.
+type snapshot struct {
+	applied   uint64
+	seeded    bool
+	names     []string
+	documents [][]document.Document
+}
+
+// Persist implements raft.FSMSnapshot.
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if err := s.write(sink); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	return sink.Close()
+}
+
+// write writes the records of the snapshot to w.
+func (s *snapshot) write(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+
+	if err := enc.Encode(header{Applied: s.applied, Seeded: s.seeded}); err != nil {
+		return err
+	}
+
+	for i, name := range s.names {
+		for j := range s.documents[i] {
+			b, err := s.documents[i][j].ToStorage(nil, document.WithFormat(document.FormatCBOR))
+			if err != nil {
+				return err
+			}
+
+			if err := enc.Encode(record{Database: name, Document: b}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return buf.Flush()
+}
+
+// Release implements raft.FSMSnapshot.
+func (s *snapshot) Release() {}
@@ -0,0 +1,52 @@
+package cluster
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// levels are the levels of the lines logged by raft, by their prefix.
+var levels = []struct {
+	prefix string
+	level  slog.Level
+}{
+	{"[ERROR]", slog.LevelError},
+	{"[WARN]", slog.LevelWarn},
+	{"[INFO]", slog.LevelInfo},
+	{"[DEBUG]", slog.LevelDebug},
+	{"[TRACE]", slog.LevelDebug},
+}
+
+// logWriter writes the lines logged by raft to the default logger, at the
+// level they were logged at.
+type logWriter struct{}
+
+// Write implements io.Writer.
+func (logWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+
+	level := slog.LevelInfo
+	for _, l := range levels {
+		if strings.HasPrefix(line, l.prefix) {
+			line, level = strings.TrimSpace(strings.TrimPrefix(line, l.prefix)), l.level
+			break
+		}
+	}
+
+	slog.Log(context.Background(), level, line, "component", "raft")
+
+	return len(p), nil
+}
+
+// newLogger returns the logger of raft, it logs to the default logger.
+func newLogger() hclog.Logger {
+	return hclog.New(&hclog.LoggerOptions{
+		Name:        "raft",
+		Level:       hclog.Info,
+		Output:      logWriter{},
+		DisableTime: true,
+	})
+}
@@ -0,0 +1,189 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/errors"
+
+	"github.com/hashicorp/raft"
+)
+
+// maxBackoff is the longest a node waits before asking to join again.
+const maxBackoff = 30 * time.Second
+
+// Start asks to join the cluster until the node is a member or the context
+// is cancelled. It returns straight away for nodes that were members when
+// they were opened, or that aren't set to join a cluster.
+func (n *Node) Start(ctx context.Context) {
+	if n.join == "" || n.hasState {
+		return
+	}
+
+	backoff := time.Second
+	for {
+		err := n.askToJoin(ctx)
+		if err == nil {
+			slog.Info("joined the cluster", "id", n.id, "via", n.join)
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		slog.Warn("failed to join the cluster, asking again", "id", n.id, "via", n.join, "error", err, "in", backoff.String())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// askToJoin asks the member the node joins the cluster through to add it.
+func (n *Node) askToJoin(ctx context.Context) error {
+	body, err := json.Marshal(Member{
+		ID:         n.id,
+		Address:    string(n.transport.LocalAddr()),
+		APIAddress: n.apiAddress,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(n.join, "/")+MembersPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(n.apiKey, "")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("member responded with %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	return nil
+}
+
+// Join adds a member to the cluster as a voter and records its api
+// address, it must be called on the leader. Adding a member that is in the
+// cluster already updates its addresses. It returns the members of the
+// cluster.
+func (n *Node) Join(ctx context.Context, m Member) ([]Member, error) {
+	if m.ID == "" || m.Address == "" || m.APIAddress == "" {
+		return nil, errors.New(errors.ErrMemberIsInvalid)
+	}
+
+	if !n.IsLeader() {
+		return nil, errors.New(errors.ErrNotLeader)
+	}
+
+	if err := n.raft.AddVoter(raft.ServerID(m.ID), raft.ServerAddress(m.Address), 0, n.applyTimeout).Error(); err != nil {
+		return nil, fromRaft(err)
+	}
+
+	if err := n.register(m); err != nil {
+		return nil, err
+	}
+
+	return n.Members()
+}
+
+// Remove removes a member from the cluster, it must be called on the
+// leader. A leader that removes itself steps down once it is removed.
+func (n *Node) Remove(ctx context.Context, id string) error {
+	f := n.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return fromRaft(err)
+	}
+
+	found := false
+	for _, s := range f.Configuration().Servers {
+		found = found || s.ID == raft.ServerID(id)
+	}
+	if !found {
+		return errors.New(errors.ErrMemberNotFound)
+	}
+
+	if !n.IsLeader() {
+		return errors.New(errors.ErrNotLeader)
+	}
+
+	// forget its api address while this node can still write
+	if doc := n.memberDocument(id); doc != nil {
+		system, err := n.manager.Get(database.DefaultName)
+		if err != nil {
+			return err
+		}
+		if err := system.DeleteContext(ctx, doc.ID.String()); err != nil {
+			return err
+		}
+	}
+
+	return fromRaft(n.raft.RemoveServer(raft.ServerID(id), 0, n.applyTimeout).Error())
+}
+
+// Members returns the members of the cluster.
+func (n *Node) Members() ([]Member, error) {
+	f := n.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return nil, fromRaft(err)
+	}
+
+	_, leader := n.raft.LeaderWithID()
+
+	servers := f.Configuration().Servers
+	members := make([]Member, 0, len(servers))
+	for _, s := range servers {
+		m := Member{
+			ID:      string(s.ID),
+			Address: string(s.Address),
+			Leader:  s.ID == leader,
+		}
+		if doc := n.memberDocument(m.ID); doc != nil {
+			m.APIAddress, _ = doc.Data["api_address"].(string)
+		}
+
+		members = append(members, m)
+	}
+
+	return members, nil
+}
+
+// register records the api address of a member, unless it is recorded
+// already. The leader records its own before it is ready to take writes.
+func (n *Node) register(m Member) error {
+	doc := document.New().SetCollection(MembersCollection)
+	if current := n.memberDocument(m.ID); current != nil {
+		if current.Data["api_address"] == m.APIAddress {
+			return nil
+		}
+		doc.SetID(current.ID.String())
+	}
+
+	doc.SetData(map[string]interface{}{
+		"id":          m.ID,
+		"api_address": m.APIAddress,
+	})
+
+	return n.commit(database.DefaultName, cache.OperationUpdate, doc)
+}
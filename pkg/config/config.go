@@ -0,0 +1,890 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/certs"
+	"github.com/nexdb/nexdb/pkg/cluster"
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/keyring"
+	"github.com/nexdb/nexdb/pkg/logging"
+	"github.com/nexdb/nexdb/pkg/replication"
+	"github.com/nexdb/nexdb/pkg/storage"
+	"github.com/nexdb/nexdb/pkg/tracing"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// ErrUnknownFormat is returned when the config file is not YAML or TOML.
+	ErrUnknownFormat = errors.New("unknown config file format, must be .yaml, .yml or .toml")
+)
+
+// redacted replaces the value of secrets when printing the configuration.
+const redacted = "[redacted]"
+
+// Config is the configuration of the server.
+//
+// Settings are read from, in order of precedence, command-line flags,
+// environment variables, a YAML or TOML config file and the defaults.
+type Config struct {
+	Server      Server      `yaml:"server" toml:"server"`
+	Storage     Storage     `yaml:"storage" toml:"storage"`
+	Auth        Auth        `yaml:"auth" toml:"auth"`
+	Audit       Audit       `yaml:"audit" toml:"audit"`
+	Trash       Trash       `yaml:"trash" toml:"trash"`
+	Replication Replication `yaml:"replication" toml:"replication"`
+	Cluster     Cluster     `yaml:"cluster" toml:"cluster"`
+	Log         Log         `yaml:"log" toml:"log"`
+	Tracing     Tracing     `yaml:"tracing" toml:"tracing"`
+	Backup      Backup      `yaml:"backup" toml:"backup"`
+}
+
+// Server is the configuration of the http server.
+type Server struct {
+	Address string `yaml:"address" toml:"address"`
+	TLS     TLS    `yaml:"tls" toml:"tls"`
+	// ShutdownTimeout is how long in-flight requests are given to finish on shutdown.
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+}
+
+// TLS is the configuration of TLS, it is disabled unless a certificate is set.
+type TLS struct {
+	CertFile       string   `yaml:"cert_file" toml:"cert_file"`
+	KeyFile        string   `yaml:"key_file" toml:"key_file"`
+	ClientCAFile   string   `yaml:"client_ca_file" toml:"client_ca_file"`
+	ClientAuth     string   `yaml:"client_auth" toml:"client_auth"`
+	ReloadInterval Duration `yaml:"reload_interval" toml:"reload_interval"`
+}
+
+// Options returns the TLS settings as certs options.
+func (t TLS) Options() certs.Options {
+	return certs.Options{
+		CertFile:     t.CertFile,
+		KeyFile:      t.KeyFile,
+		ClientCAFile: t.ClientCAFile,
+		ClientAuth:   certs.ClientAuth(t.ClientAuth),
+	}
+}
+
+// Storage is the configuration of the storage driver.
+type Storage struct {
+	Driver        string `yaml:"driver" toml:"driver"`
+	EncryptionKey string `yaml:"encryption_key" toml:"encryption_key"`
+	// FieldEncryptionKey is the 32 byte key the encrypted fields of
+	// collections are encrypted with, fields can't be encrypted without it.
+	FieldEncryptionKey string `yaml:"field_encryption_key" toml:"field_encryption_key"`
+	// KeyringFile is the keyring documents are sealed with, the encryption
+	// key is kept to read documents sealed before it was set.
+	KeyringFile string `yaml:"keyring_file" toml:"keyring_file"`
+	// AllowPlaintext reads documents written before encryption was enabled,
+	// it is meant for the window while they are re-encrypted.
+	AllowPlaintext bool `yaml:"allow_plaintext" toml:"allow_plaintext"`
+	// Format is the format documents are written with: json or cbor, which
+	// keeps integers and binary values exact. Documents in either can be read.
+	Format string `yaml:"format" toml:"format"`
+	// Compression is the compression documents are written with: none,
+	// gzip, zstd or snappy. Documents written with any of them can be read.
+	Compression string `yaml:"compression" toml:"compression"`
+	// Layout is how documents are laid out: documents, an object per
+	// document, or log, periodic snapshots and a log of the changes since.
+	Layout string `yaml:"layout" toml:"layout"`
+	// SnapshotEvery is how many changes the log layout records before
+	// compacting them into a snapshot.
+	SnapshotEvery int `yaml:"snapshot_every" toml:"snapshot_every"`
+	// Retention is how long the log layout keeps the history of changes
+	// for, so storage can be restored to any point in time since.
+	Retention  Duration   `yaml:"retention" toml:"retention"`
+	AWS        AWS        `yaml:"aws" toml:"aws"`
+	Filesystem Filesystem `yaml:"filesystem" toml:"filesystem"`
+	Memory     Memory     `yaml:"memory" toml:"memory"`
+	Load       Loading    `yaml:"load" toml:"load"`
+	// FlushTimeout is how long pending writes are given to reach storage on
+	// shutdown, writes still queued afterwards are abandoned.
+	FlushTimeout Duration `yaml:"flush_timeout" toml:"flush_timeout"`
+}
+
+// Options returns the storage options of the configuration.
+func (s Storage) Options() []storage.Option {
+	format, _ := document.ParseFormat(s.Format)
+	compression, _ := document.ParseCompression(s.Compression)
+
+	return []storage.Option{
+		storage.WithFormat(format),
+		storage.WithCompression(compression),
+		storage.WithLayout(storage.Layout(s.Layout)),
+		storage.WithSnapshotEvery(s.SnapshotEvery),
+		storage.WithRetention(time.Duration(s.Retention)),
+		storage.WithEncryptionKey([]byte(s.EncryptionKey)),
+		storage.WithKeyringFile(s.KeyringFile),
+		storage.WithPlaintextReads(s.AllowPlaintext),
+		storage.WithAWS(s.AWS.Region, s.AWS.Bucket),
+		storage.WithS3(s.AWS.S3Config()),
+		storage.WithPath(s.Filesystem.Path),
+		storage.WithSerialisation(s.Memory.Serialise),
+		storage.WithConcurrency(s.Load.Workers),
+	}
+}
+
+// AWS is the configuration of the aws-s3 storage driver, see
+// storage.S3Config.
+type AWS struct {
+	Region string `yaml:"region" toml:"region"`
+	Bucket string `yaml:"bucket" toml:"bucket"`
+	// Endpoint is the URL of an S3 compatible service such as MinIO.
+	Endpoint             string `yaml:"endpoint" toml:"endpoint"`
+	PathStyle            bool   `yaml:"path_style" toml:"path_style"`
+	Prefix               string `yaml:"prefix" toml:"prefix"`
+	Profile              string `yaml:"profile" toml:"profile"`
+	ServerSideEncryption string `yaml:"server_side_encryption" toml:"server_side_encryption"`
+	KMSKeyID             string `yaml:"kms_key_id" toml:"kms_key_id"`
+	StorageClass         string `yaml:"storage_class" toml:"storage_class"`
+}
+
+// S3Config returns the configuration of the aws-s3 driver beyond its region
+// and bucket.
+func (a AWS) S3Config() storage.S3Config {
+	return storage.S3Config{
+		Endpoint:             a.Endpoint,
+		PathStyle:            a.PathStyle,
+		Prefix:               a.Prefix,
+		Profile:              a.Profile,
+		ServerSideEncryption: a.ServerSideEncryption,
+		KMSKeyID:             a.KMSKeyID,
+		StorageClass:         a.StorageClass,
+	}
+}
+
+// Filesystem is the configuration of the filesystem storage driver.
+type Filesystem struct {
+	Path string `yaml:"path" toml:"path"`
+}
+
+// Memory is the configuration of the memory storage driver.
+type Memory struct {
+	// Serialise stores documents encoded and encrypted, as the other
+	// drivers do, so encoding and key problems surface as they would.
+	Serialise bool `yaml:"serialise" toml:"serialise"`
+}
+
+// Loading is the configuration of how databases are loaded from storage on
+// startup.
+type Loading struct {
+	// Workers is how many documents are read from storage at once.
+	Workers int `yaml:"workers" toml:"workers"`
+	// OnError is what happens to documents that can't be read: fail stops
+	// the server from starting, skip logs them and loads the rest.
+	OnError string `yaml:"on_error" toml:"on_error"`
+	// ProgressInterval is how often the progress of loading is logged.
+	ProgressInterval Duration `yaml:"progress_interval" toml:"progress_interval"`
+}
+
+// Options returns the load options of the configuration, progress is
+// reported to fn.
+func (l Loading) Options(fn func(database.Progress)) []database.LoadOption {
+	return []database.LoadOption{
+		database.WithLoadPolicy(database.LoadPolicy(l.OnError)),
+		database.WithProgress(time.Duration(l.ProgressInterval), fn),
+	}
+}
+
+// Auth is the configuration of authentication.
+type Auth struct {
+	// APIKey is added to the default database on startup if it has no keys.
+	APIKey string `yaml:"api_key" toml:"api_key"`
+}
+
+// Audit is the configuration of the audit log, it is disabled unless a sink is set.
+type Audit struct {
+	Sink      string   `yaml:"sink" toml:"sink"`
+	File      string   `yaml:"file" toml:"file"`
+	Diffs     bool     `yaml:"diffs" toml:"diffs"`
+	Retention Duration `yaml:"retention" toml:"retention"`
+}
+
+// Trash is the configuration of soft deleted documents.
+type Trash struct {
+	// PurgeInterval is how often documents kept in the trash for longer than
+	// the retention of their collection are purged.
+	PurgeInterval Duration `yaml:"purge_interval" toml:"purge_interval"`
+}
+
+// Replication is the configuration of replication, it is disabled unless a
+// role is set.
+type Replication struct {
+	// Role is leader or follower.
+	Role string `yaml:"role" toml:"role"`
+	// Leader is the address followers stream writes from, such as
+	// http://leader:9000.
+	Leader string `yaml:"leader" toml:"leader"`
+	// APIKey is the api key of the leader's default database followers
+	// authenticate with.
+	APIKey string `yaml:"api_key" toml:"api_key"`
+	// Writes is what followers do with writes: reject or forward.
+	Writes string `yaml:"writes" toml:"writes"`
+	// LogSize is how many of the latest writes are kept for followers to
+	// catch up from, followers further behind are sent a snapshot.
+	LogSize int `yaml:"log_size" toml:"log_size"`
+	// SharedStorage is set when followers share the storage of the leader.
+	SharedStorage bool `yaml:"shared_storage" toml:"shared_storage"`
+}
+
+// Cluster is the configuration of clustering, it is disabled unless a node
+// id is set.
+type Cluster struct {
+	// NodeID is the id of the server in the cluster, it must not change.
+	NodeID string `yaml:"node_id" toml:"node_id"`
+	// Address is the host and port the server replicates the log on, such as
+	// node1:7000.
+	Address string `yaml:"address" toml:"address"`
+	// APIAddress is the address the other members forward requests to, such
+	// as http://node1:9000.
+	APIAddress string `yaml:"api_address" toml:"api_address"`
+	// APIKey is the api key of the default database members authenticate
+	// with.
+	APIKey string `yaml:"api_key" toml:"api_key"`
+	// Dir is the directory the log and its snapshots are kept in.
+	Dir string `yaml:"dir" toml:"dir"`
+	// Bootstrap is set on the one server that starts a new cluster.
+	Bootstrap bool `yaml:"bootstrap" toml:"bootstrap"`
+	// Join is the api address of a member the server asks to join the
+	// cluster through.
+	Join string `yaml:"join" toml:"join"`
+	// ReadConsistency is where reads are served: leader or follower.
+	ReadConsistency string `yaml:"read_consistency" toml:"read_consistency"`
+	// MaxStaleness is how long followers serve reads for without hearing
+	// from the leader.
+	MaxStaleness Duration `yaml:"max_staleness" toml:"max_staleness"`
+	// ApplyTimeout is how long a write is given to be committed.
+	ApplyTimeout Duration `yaml:"apply_timeout" toml:"apply_timeout"`
+	// SnapshotThreshold is how many writes are made between snapshots of
+	// the log.
+	SnapshotThreshold int `yaml:"snapshot_threshold" toml:"snapshot_threshold"`
+}
+
+// Log is the configuration of logging.
+type Log struct {
+	// Level is the initial log level, it can be changed at runtime.
+	Level string `yaml:"level" toml:"level"`
+}
+
+// Backup is the configuration of backups.
+type Backup struct {
+	// EncryptionKey is the 32 byte key backups are encrypted with, backups
+	// are not encrypted if it is empty.
+	EncryptionKey string `yaml:"encryption_key" toml:"encryption_key"`
+}
+
+// Tracing is the configuration of tracing, it is disabled unless an exporter is set.
+type Tracing struct {
+	Exporter string `yaml:"exporter" toml:"exporter"`
+	Endpoint string `yaml:"endpoint" toml:"endpoint"`
+	Insecure bool   `yaml:"insecure" toml:"insecure"`
+	File     string `yaml:"file" toml:"file"`
+}
+
+// Options returns the tracing settings as tracing options.
+func (t Tracing) Options() tracing.Options {
+	return tracing.Options{
+		Exporter: tracing.Exporter(t.Exporter),
+		Endpoint: t.Endpoint,
+		Insecure: t.Insecure,
+		File:     t.File,
+	}
+}
+
+// Duration is a time.Duration that is written as a string such as "1h30m".
+type Duration time.Duration
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+// Default returns the default configuration.
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Address: ":9000",
+			TLS: TLS{
+				ReloadInterval: Duration(30 * time.Second),
+			},
+			ShutdownTimeout: Duration(30 * time.Second),
+		},
+		Storage: Storage{
+			Driver:        string(storage.MemoryDriver),
+			Layout:        string(storage.LayoutDocuments),
+			SnapshotEvery: storage.DefaultSnapshotEvery,
+			FlushTimeout:  Duration(30 * time.Second),
+			Load: Loading{
+				Workers:          storage.DefaultConcurrency,
+				OnError:          string(database.LoadFail),
+				ProgressInterval: Duration(10 * time.Second),
+			},
+		},
+		Trash: Trash{
+			PurgeInterval: Duration(time.Hour),
+		},
+		Replication: Replication{
+			Writes:  string(replication.WritesReject),
+			LogSize: replication.DefaultLogSize,
+		},
+		Cluster: Cluster{
+			ReadConsistency:   string(cluster.ReadLeader),
+			MaxStaleness:      Duration(cluster.DefaultMaxStaleness),
+			ApplyTimeout:      Duration(cluster.DefaultApplyTimeout),
+			SnapshotThreshold: cluster.DefaultSnapshotThreshold,
+		},
+		Log: Log{
+			Level: "info",
+		},
+	}
+}
+
+// Validate validates the configuration.
+func (c *Config) Validate() error {
+	if c.Server.Address == "" {
+		return errors.New("server.address is required")
+	}
+
+	if err := c.Server.TLS.Options().Validate(); err != nil {
+		return fmt.Errorf("server.tls: %w", err)
+	}
+
+	if c.Server.TLS.ReloadInterval <= 0 {
+		return errors.New("server.tls.reload_interval must be positive")
+	}
+
+	if c.Server.ShutdownTimeout <= 0 {
+		return errors.New("server.shutdown_timeout must be positive")
+	}
+
+	switch storage.Driver(c.Storage.Driver) {
+	case storage.MemoryDriver:
+	case storage.AWS3Driver:
+		if c.Storage.AWS.Region == "" || c.Storage.AWS.Bucket == "" {
+			return errors.New("storage.aws.region and storage.aws.bucket are required by the aws-s3 driver")
+		}
+
+		if err := c.Storage.AWS.S3Config().Validate(); err != nil {
+			return fmt.Errorf("storage.aws: %w", err)
+		}
+	case storage.FilesystemDriver:
+		if c.Storage.Filesystem.Path == "" {
+			return errors.New("storage.filesystem.path is required by the filesystem driver")
+		}
+	default:
+		return fmt.Errorf("storage.driver: %w %q", storage.ErrUnknownDriver, c.Storage.Driver)
+	}
+
+	if len(c.Storage.EncryptionKey) > 0 && len(c.Storage.EncryptionKey) != 32 {
+		return fmt.Errorf("storage.encryption_key: %w", storage.ErrEncryptionKeyInvalid)
+	}
+
+	if len(c.Storage.FieldEncryptionKey) > 0 && len(c.Storage.FieldEncryptionKey) != 32 {
+		return fmt.Errorf("storage.field_encryption_key: %w", storage.ErrEncryptionKeyInvalid)
+	}
+
+	if c.Storage.KeyringFile != "" {
+		if _, err := keyring.Load(c.Storage.KeyringFile); err != nil {
+			return fmt.Errorf("storage.keyring_file: %w", err)
+		}
+	}
+
+	if _, err := document.ParseFormat(c.Storage.Format); err != nil {
+		return fmt.Errorf("storage.format: %w", err)
+	}
+
+	if _, err := document.ParseCompression(c.Storage.Compression); err != nil {
+		return fmt.Errorf("storage.compression: %w", err)
+	}
+
+	switch storage.Layout(c.Storage.Layout) {
+	case storage.LayoutDocuments, storage.LayoutLog:
+	default:
+		return fmt.Errorf("storage.layout: %w %q", storage.ErrUnknownLayout, c.Storage.Layout)
+	}
+
+	if c.Storage.SnapshotEvery <= 0 {
+		return errors.New("storage.snapshot_every must be positive")
+	}
+
+	if c.Storage.Retention < 0 {
+		return errors.New("storage.retention must not be negative")
+	}
+
+	if c.Storage.Retention > 0 && storage.Layout(c.Storage.Layout) != storage.LayoutLog {
+		return errors.New("storage.retention requires the log storage layout")
+	}
+
+	if len(c.Backup.EncryptionKey) > 0 && len(c.Backup.EncryptionKey) != 32 {
+		return fmt.Errorf("backup.encryption_key: %w", storage.ErrEncryptionKeyInvalid)
+	}
+
+	if c.Storage.Load.Workers <= 0 {
+		return errors.New("storage.load.workers must be positive")
+	}
+
+	switch database.LoadPolicy(c.Storage.Load.OnError) {
+	case database.LoadFail, database.LoadSkip:
+	default:
+		return fmt.Errorf("storage.load.on_error: unknown policy %q, must be fail or skip", c.Storage.Load.OnError)
+	}
+
+	if c.Storage.Load.ProgressInterval <= 0 {
+		return errors.New("storage.load.progress_interval must be positive")
+	}
+
+	if c.Storage.FlushTimeout <= 0 {
+		return errors.New("storage.flush_timeout must be positive")
+	}
+
+	switch c.Audit.Sink {
+	case "", "collection":
+	case "file":
+		if c.Audit.File == "" {
+			return errors.New("audit.file is required by the file audit sink")
+		}
+	default:
+		return fmt.Errorf("audit.sink: unknown sink %q, must be collection or file", c.Audit.Sink)
+	}
+
+	if c.Audit.Retention < 0 {
+		return errors.New("audit.retention must not be negative")
+	}
+
+	if c.Trash.PurgeInterval <= 0 {
+		return errors.New("trash.purge_interval must be positive")
+	}
+
+	switch replication.Role(c.Replication.Role) {
+	case "", replication.RoleLeader:
+	case replication.RoleFollower:
+		if c.Replication.Leader == "" {
+			return errors.New("replication.leader is required by followers")
+		}
+		if u, err := url.Parse(c.Replication.Leader); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("replication.leader: %q is not an address such as http://leader:9000", c.Replication.Leader)
+		}
+	default:
+		return fmt.Errorf("replication.role: unknown role %q, must be leader or follower", c.Replication.Role)
+	}
+
+	switch replication.WritePolicy(c.Replication.Writes) {
+	case replication.WritesReject, replication.WritesForward:
+	default:
+		return fmt.Errorf("replication.writes: unknown policy %q, must be reject or forward", c.Replication.Writes)
+	}
+
+	if c.Replication.LogSize <= 0 {
+		return errors.New("replication.log_size must be positive")
+	}
+
+	if err := c.Cluster.validate(); err != nil {
+		return err
+	}
+
+	if c.Cluster.NodeID != "" && c.Replication.Role != "" {
+		return errors.New("cluster.node_id: clustering replaces replication, replication.role must be empty")
+	}
+
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		return fmt.Errorf("log.level: %w", err)
+	}
+
+	if err := c.Tracing.Options().Validate(); err != nil {
+		return fmt.Errorf("tracing: %w", err)
+	}
+
+	return nil
+}
+
+// validate validates the configuration of clustering, if it is enabled.
+func (c Cluster) validate() error {
+	if c.NodeID == "" {
+		return nil
+	}
+
+	if host, _, err := net.SplitHostPort(c.Address); err != nil || host == "" {
+		return fmt.Errorf("cluster.address: %q is not a host and port such as node1:7000", c.Address)
+	}
+
+	if u, err := url.Parse(c.APIAddress); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("cluster.api_address: %q is not an address such as http://node1:9000", c.APIAddress)
+	}
+
+	if c.APIKey == "" {
+		return errors.New("cluster.api_key is required")
+	}
+
+	if c.Dir == "" {
+		return errors.New("cluster.dir is required")
+	}
+
+	if c.Bootstrap && c.Join != "" {
+		return errors.New("cluster.join: a server that bootstraps a cluster can't join another")
+	}
+
+	if c.Join != "" {
+		if u, err := url.Parse(c.Join); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("cluster.join: %q is not an address such as http://node1:9000", c.Join)
+		}
+	}
+
+	switch cluster.ReadConsistency(c.ReadConsistency) {
+	case cluster.ReadLeader, cluster.ReadFollower:
+	default:
+		return fmt.Errorf("cluster.read_consistency: unknown consistency %q, must be leader or follower", c.ReadConsistency)
+	}
+
+	if c.MaxStaleness <= 0 {
+		return errors.New("cluster.max_staleness must be positive")
+	}
+
+	if c.ApplyTimeout <= 0 {
+		return errors.New("cluster.apply_timeout must be positive")
+	}
+
+	if c.SnapshotThreshold <= 0 {
+		return errors.New("cluster.snapshot_threshold must be positive")
+	}
+
+	return nil
+}
+
+// Redacted returns a copy of the configuration with secrets replaced,
+// so it can be printed.
+func (c *Config) Redacted() *Config {
+	r := *c
+	for _, s := range settings {
+		if s.secret && s.get(&r) != "" {
+			_ = s.set(&r, redacted)
+		}
+	}
+
+	return &r
+}
+
+// YAML returns the configuration encoded as YAML.
+func (c *Config) YAML() ([]byte, error) {
+	return yaml.Marshal(c)
+}
+
+// Load loads the configuration from the config file, environment variables
+// and command-line flags. The config file is given by the --config flag or
+// the NEXDB_CONFIG environment variable.
+func Load(name string, args []string) (*Config, error) {
+	return LoadFlagSet(flag.NewFlagSet(name, flag.ContinueOnError), args)
+}
+
+// LoadFlagSet is Load with a flag set that may already define flags of its
+// own, such as the flags of a command. The settings' flags are added to it.
+func LoadFlagSet(fs *flag.FlagSet, args []string) (*Config, error) {
+	c := Default()
+
+	path := fs.String("config", os.Getenv("NEXDB_CONFIG"), "path to a YAML or TOML config file")
+
+	flags := make(map[string]*string, len(settings))
+	for _, s := range settings {
+		flags[s.key] = fs.String(s.key, "", s.usage+" (env "+s.env+")")
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		if err := c.readFile(*path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok {
+			if err := s.set(c, v); err != nil {
+				return nil, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		s, ok := settingByKey(f.Name)
+		if !ok || err != nil {
+			return
+		}
+
+		if setErr := s.set(c, *flags[f.Name]); setErr != nil {
+			err = fmt.Errorf("--%s: %w", f.Name, setErr)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// readFile reads the config file at path over the current values.
+func (c *Config) readFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, c)
+	case ".toml":
+		err = toml.Unmarshal(b, c)
+	default:
+		return ErrUnknownFormat
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+// setting is a single configuration value that can be set by an
+// environment variable or a command-line flag.
+type setting struct {
+	// key is the path of the setting in the config file, it is also the flag name.
+	key    string
+	env    string
+	usage  string
+	secret bool
+	get    func(c *Config) string
+	set    func(c *Config, v string) error
+}
+
+// settingByKey returns the setting with the given key.
+func settingByKey(key string) (setting, bool) {
+	for _, s := range settings {
+		if s.key == key {
+			return s, true
+		}
+	}
+
+	return setting{}, false
+}
+
+// settings are all the settings that can be overridden by environment
+// variables and command-line flags.
+var settings = []setting{
+	stringSetting("server.address", "NEXDB_LISTEN_ADDR", "address the server listens on", false,
+		func(c *Config) *string { return &c.Server.Address }),
+	stringSetting("server.tls.cert_file", "NEXDB_TLS_CERT_FILE", "path to the tls certificate", false,
+		func(c *Config) *string { return &c.Server.TLS.CertFile }),
+	stringSetting("server.tls.key_file", "NEXDB_TLS_KEY_FILE", "path to the tls private key", false,
+		func(c *Config) *string { return &c.Server.TLS.KeyFile }),
+	stringSetting("server.tls.client_ca_file", "NEXDB_TLS_CLIENT_CA_FILE", "path to the CAs client certificates are verified against", false,
+		func(c *Config) *string { return &c.Server.TLS.ClientCAFile }),
+	stringSetting("server.tls.client_auth", "NEXDB_TLS_CLIENT_AUTH", "client certificate policy: none, request or require", false,
+		func(c *Config) *string { return &c.Server.TLS.ClientAuth }),
+	durationSetting("server.tls.reload_interval", "NEXDB_TLS_RELOAD_INTERVAL", "how often certificates are checked for changes",
+		func(c *Config) *Duration { return &c.Server.TLS.ReloadInterval }),
+	durationSetting("server.shutdown_timeout", "NEXDB_SHUTDOWN_TIMEOUT", "how long in-flight requests are given to finish on shutdown",
+		func(c *Config) *Duration { return &c.Server.ShutdownTimeout }),
+	stringSetting("storage.driver", "NEXDB_STORAGE_DRIVER", "storage driver: memory, aws-s3 or filesystem", false,
+		func(c *Config) *string { return &c.Storage.Driver }),
+	stringSetting("storage.encryption_key", "NEXDB_ENCRYPTION_KEY", "32 byte key documents are encrypted with at rest", true,
+		func(c *Config) *string { return &c.Storage.EncryptionKey }),
+	stringSetting("storage.field_encryption_key", "NEXDB_FIELD_ENCRYPTION_KEY", "32 byte key the encrypted fields of collections are encrypted with", true,
+		func(c *Config) *string { return &c.Storage.FieldEncryptionKey }),
+	stringSetting("storage.keyring_file", "NEXDB_KEYRING_FILE", "keyring file documents are sealed with, replacing the encryption key", false,
+		func(c *Config) *string { return &c.Storage.KeyringFile }),
+	boolSetting("storage.allow_plaintext", "NEXDB_ALLOW_PLAINTEXT", "read documents written before encryption was enabled, only while they are re-encrypted",
+		func(c *Config) *bool { return &c.Storage.AllowPlaintext }),
+	stringSetting("storage.format", "NEXDB_STORAGE_FORMAT", "format documents are written with: json or cbor", false,
+		func(c *Config) *string { return &c.Storage.Format }),
+	stringSetting("storage.compression", "NEXDB_STORAGE_COMPRESSION", "compression documents are written with: none, gzip, zstd or snappy", false,
+		func(c *Config) *string { return &c.Storage.Compression }),
+	stringSetting("storage.layout", "NEXDB_STORAGE_LAYOUT", "layout of documents in storage: documents or log", false,
+		func(c *Config) *string { return &c.Storage.Layout }),
+	intSetting("storage.snapshot_every", "NEXDB_SNAPSHOT_EVERY", "how many changes the log layout records before taking a snapshot",
+		func(c *Config) *int { return &c.Storage.SnapshotEvery }),
+	durationSetting("storage.retention", "NEXDB_STORAGE_RETENTION", "how long the log layout keeps the history of changes for point-in-time recovery",
+		func(c *Config) *Duration { return &c.Storage.Retention }),
+	stringSetting("storage.aws.region", "AWS_REGION", "region of the aws-s3 bucket", false,
+		func(c *Config) *string { return &c.Storage.AWS.Region }),
+	stringSetting("storage.aws.bucket", "AWS_BUCKET", "name of the aws-s3 bucket", false,
+		func(c *Config) *string { return &c.Storage.AWS.Bucket }),
+	stringSetting("storage.aws.endpoint", "AWS_ENDPOINT_URL", "url of an S3 compatible service such as MinIO, empty uses AWS", false,
+		func(c *Config) *string { return &c.Storage.AWS.Endpoint }),
+	boolSetting("storage.aws.path_style", "NEXDB_S3_PATH_STYLE", "address buckets as endpoint/bucket, needed by most S3 compatible services",
+		func(c *Config) *bool { return &c.Storage.AWS.PathStyle }),
+	stringSetting("storage.aws.prefix", "NEXDB_S3_PREFIX", "prefix of the key of every object", false,
+		func(c *Config) *string { return &c.Storage.AWS.Prefix }),
+	stringSetting("storage.aws.profile", "AWS_PROFILE", "shared config profile credentials are read from", false,
+		func(c *Config) *string { return &c.Storage.AWS.Profile }),
+	stringSetting("storage.aws.server_side_encryption", "NEXDB_S3_SERVER_SIDE_ENCRYPTION", "server-side encryption of objects: AES256 or aws:kms", false,
+		func(c *Config) *string { return &c.Storage.AWS.ServerSideEncryption }),
+	stringSetting("storage.aws.kms_key_id", "NEXDB_S3_KMS_KEY_ID", "kms key objects are encrypted with by aws:kms", false,
+		func(c *Config) *string { return &c.Storage.AWS.KMSKeyID }),
+	stringSetting("storage.aws.storage_class", "NEXDB_S3_STORAGE_CLASS", "storage class of objects, such as STANDARD_IA", false,
+		func(c *Config) *string { return &c.Storage.AWS.StorageClass }),
+	stringSetting("storage.filesystem.path", "NEXDB_STORAGE_PATH", "directory of the filesystem driver", false,
+		func(c *Config) *string { return &c.Storage.Filesystem.Path }),
+	boolSetting("storage.memory.serialise", "NEXDB_MEMORY_SERIALISE", "store documents of the memory driver serialised and encrypted",
+		func(c *Config) *bool { return &c.Storage.Memory.Serialise }),
+	intSetting("storage.load.workers", "NEXDB_LOAD_WORKERS", "how many documents are read from storage at once on startup",
+		func(c *Config) *int { return &c.Storage.Load.Workers }),
+	stringSetting("storage.load.on_error", "NEXDB_LOAD_ON_ERROR", "what happens to documents that can't be read on startup: fail or skip", false,
+		func(c *Config) *string { return &c.Storage.Load.OnError }),
+	durationSetting("storage.load.progress_interval", "NEXDB_LOAD_PROGRESS_INTERVAL", "how often the progress of loading is logged",
+		func(c *Config) *Duration { return &c.Storage.Load.ProgressInterval }),
+	durationSetting("storage.flush_timeout", "NEXDB_FLUSH_TIMEOUT", "how long pending writes are given to reach storage on shutdown",
+		func(c *Config) *Duration { return &c.Storage.FlushTimeout }),
+	stringSetting("auth.api_key", "NEXDB_API_KEY", "api key added on startup when there are none", true,
+		func(c *Config) *string { return &c.Auth.APIKey }),
+	stringSetting("audit.sink", "NEXDB_AUDIT_SINK", "audit sink: collection or file, empty disables auditing", false,
+		func(c *Config) *string { return &c.Audit.Sink }),
+	stringSetting("audit.file", "NEXDB_AUDIT_FILE", "path of the file audit sink", false,
+		func(c *Config) *string { return &c.Audit.File }),
+	boolSetting("audit.diffs", "NEXDB_AUDIT_DIFFS", "record the before and after data of documents",
+		func(c *Config) *bool { return &c.Audit.Diffs }),
+	durationSetting("audit.retention", "NEXDB_AUDIT_RETENTION", "how long audit entries are kept, 0 keeps them forever",
+		func(c *Config) *Duration { return &c.Audit.Retention }),
+	durationSetting("trash.purge_interval", "NEXDB_TRASH_PURGE_INTERVAL", "how often expired documents are purged from the trash",
+		func(c *Config) *Duration { return &c.Trash.PurgeInterval }),
+	stringSetting("replication.role", "NEXDB_REPLICATION_ROLE", "replication role: leader or follower, empty disables replication", false,
+		func(c *Config) *string { return &c.Replication.Role }),
+	stringSetting("replication.leader", "NEXDB_REPLICATION_LEADER", "address of the leader followers stream writes from, such as http://leader:9000", false,
+		func(c *Config) *string { return &c.Replication.Leader }),
+	stringSetting("replication.api_key", "NEXDB_REPLICATION_API_KEY", "api key of the leader's default database followers authenticate with", true,
+		func(c *Config) *string { return &c.Replication.APIKey }),
+	stringSetting("replication.writes", "NEXDB_REPLICATION_WRITES", "what followers do with writes: reject or forward", false,
+		func(c *Config) *string { return &c.Replication.Writes }),
+	intSetting("replication.log_size", "NEXDB_REPLICATION_LOG_SIZE", "how many of the latest writes are kept for followers to catch up from",
+		func(c *Config) *int { return &c.Replication.LogSize }),
+	boolSetting("replication.shared_storage", "NEXDB_REPLICATION_SHARED_STORAGE", "followers share the storage of the leader and don't write to it",
+		func(c *Config) *bool { return &c.Replication.SharedStorage }),
+	stringSetting("cluster.node_id", "NEXDB_CLUSTER_NODE_ID", "id of the server in the cluster, empty disables clustering", false,
+		func(c *Config) *string { return &c.Cluster.NodeID }),
+	stringSetting("cluster.address", "NEXDB_CLUSTER_ADDRESS", "host and port the log is replicated on, such as node1:7000", false,
+		func(c *Config) *string { return &c.Cluster.Address }),
+	stringSetting("cluster.api_address", "NEXDB_CLUSTER_API_ADDRESS", "address members forward requests to, such as http://node1:9000", false,
+		func(c *Config) *string { return &c.Cluster.APIAddress }),
+	stringSetting("cluster.api_key", "NEXDB_CLUSTER_API_KEY", "api key of the default database members authenticate with", true,
+		func(c *Config) *string { return &c.Cluster.APIKey }),
+	stringSetting("cluster.dir", "NEXDB_CLUSTER_DIR", "directory the log and its snapshots are kept in", false,
+		func(c *Config) *string { return &c.Cluster.Dir }),
+	boolSetting("cluster.bootstrap", "NEXDB_CLUSTER_BOOTSTRAP", "start a new cluster, set on one server only",
+		func(c *Config) *bool { return &c.Cluster.Bootstrap }),
+	stringSetting("cluster.join", "NEXDB_CLUSTER_JOIN", "address of a member to join the cluster through, such as http://node1:9000", false,
+		func(c *Config) *string { return &c.Cluster.Join }),
+	stringSetting("cluster.read_consistency", "NEXDB_CLUSTER_READ_CONSISTENCY", "where reads are served: leader or follower", false,
+		func(c *Config) *string { return &c.Cluster.ReadConsistency }),
+	durationSetting("cluster.max_staleness", "NEXDB_CLUSTER_MAX_STALENESS", "how long followers serve reads for without hearing from the leader",
+		func(c *Config) *Duration { return &c.Cluster.MaxStaleness }),
+	durationSetting("cluster.apply_timeout", "NEXDB_CLUSTER_APPLY_TIMEOUT", "how long a write is given to be committed",
+		func(c *Config) *Duration { return &c.Cluster.ApplyTimeout }),
+	intSetting("cluster.snapshot_threshold", "NEXDB_CLUSTER_SNAPSHOT_THRESHOLD", "how many writes are made between snapshots of the log",
+		func(c *Config) *int { return &c.Cluster.SnapshotThreshold }),
+	stringSetting("log.level", "NEXDB_LOG_LEVEL", "log level: debug, info, warn or error", false,
+		func(c *Config) *string { return &c.Log.Level }),
+	stringSetting("backup.encryption_key", "NEXDB_BACKUP_ENCRYPTION_KEY", "32 byte key backups are encrypted with", true,
+		func(c *Config) *string { return &c.Backup.EncryptionKey }),
+	stringSetting("tracing.exporter", "NEXDB_TRACING_EXPORTER", "span exporter: otlp, stdout or file, empty disables tracing", false,
+		func(c *Config) *string { return &c.Tracing.Exporter }),
+	stringSetting("tracing.endpoint", "NEXDB_TRACING_ENDPOINT", "host and port of the otlp collector", false,
+		func(c *Config) *string { return &c.Tracing.Endpoint }),
+	boolSetting("tracing.insecure", "NEXDB_TRACING_INSECURE", "send spans to the otlp collector without tls",
+		func(c *Config) *bool { return &c.Tracing.Insecure }),
+	stringSetting("tracing.file", "NEXDB_TRACING_FILE", "path of the file spans are written to by the file exporter", false,
+		func(c *Config) *string { return &c.Tracing.File }),
+}
+
+// stringSetting returns a setting for a string field.
+func stringSetting(key, env, usage string, secret bool, field func(c *Config) *string) setting {
+	return setting{
+		key:    key,
+		env:    env,
+		usage:  usage,
+		secret: secret,
+		get:    func(c *Config) string { return *field(c) },
+		set: func(c *Config, v string) error {
+			*field(c) = v
+			return nil
+		},
+	}
+}
+
+// boolSetting returns a setting for a bool field.
+func boolSetting(key, env, usage string, field func(c *Config) *bool) setting {
+	return setting{
+		key:   key,
+		env:   env,
+		usage: usage,
+		get:   func(c *Config) string { return strconv.FormatBool(*field(c)) },
+		set: func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+
+			*field(c) = b
+			return nil
+		},
+	}
+}
+
+// intSetting returns a setting for an int field.
+func intSetting(key, env, usage string, field func(c *Config) *int) setting {
+	return setting{
+		key:   key,
+		env:   env,
+		usage: usage,
+		get:   func(c *Config) string { return strconv.Itoa(*field(c)) },
+		set: func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return err
+			}
+
+			*field(c) = n
+			return nil
+		},
+	}
+}
+
+// durationSetting returns a setting for a Duration field.
+func durationSetting(key, env, usage string, field func(c *Config) *Duration) setting {
+	return setting{
+		key:   key,
+		env:   env,
+		usage: usage,
+		get:   func(c *Config) string { return time.Duration(*field(c)).String() },
+		set: func(c *Config, v string) error {
+			return field(c).UnmarshalText([]byte(v))
+		},
+	}
+}
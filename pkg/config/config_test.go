@@ -0,0 +1,278 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad_Precedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nexdb.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+server:
+  address: ":8000"
+storage:
+  driver: aws-s3
+  aws:
+    region: eu-west-1
+    bucket: from-file
+audit:
+  retention: 24h
+`), 0o600))
+
+	t.Setenv("AWS_BUCKET", "from-env")
+	t.Setenv("NEXDB_LISTEN_ADDR", ":8001")
+
+	cfg, err := config.Load("test", []string{"--config", path, "--server.address", ":8002"})
+	require.NoError(t, err)
+
+	// flags override env, env overrides the file, the file overrides defaults
+	assert.Equal(t, ":8002", cfg.Server.Address)
+	assert.Equal(t, "from-env", cfg.Storage.AWS.Bucket)
+	assert.Equal(t, "eu-west-1", cfg.Storage.AWS.Region)
+	assert.Equal(t, "aws-s3", cfg.Storage.Driver)
+	assert.Equal(t, config.Duration(24*time.Hour), cfg.Audit.Retention)
+	assert.Equal(t, config.Duration(30*time.Second), cfg.Server.TLS.ReloadInterval)
+}
+
+func TestLoad_TOML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nexdb.toml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+[server]
+address = ":8000"
+
+[audit]
+sink = "file"
+file = "/var/log/nexdb/audit.log"
+diffs = true
+`), 0o600))
+
+	cfg, err := config.Load("test", []string{"--config", path})
+	require.NoError(t, err)
+
+	assert.Equal(t, ":8000", cfg.Server.Address)
+	assert.Equal(t, "file", cfg.Audit.Sink)
+	assert.True(t, cfg.Audit.Diffs)
+}
+
+// clusterEnv returns the environment of a valid cluster member with the
+// given variables changed.
+func clusterEnv(changes map[string]string) map[string]string {
+	env := map[string]string{
+		"NEXDB_CLUSTER_NODE_ID":     "node1",
+		"NEXDB_CLUSTER_ADDRESS":     "node1:7000",
+		"NEXDB_CLUSTER_API_ADDRESS": "http://node1:9000",
+		"NEXDB_CLUSTER_API_KEY":     "key",
+		"NEXDB_CLUSTER_DIR":         "/var/lib/nexdb/raft",
+		"NEXDB_CLUSTER_BOOTSTRAP":   "true",
+	}
+	for k, v := range changes {
+		env[k] = v
+	}
+
+	return env
+}
+
+func TestLoad_Cluster(t *testing.T) {
+	for k, v := range clusterEnv(map[string]string{"NEXDB_CLUSTER_READ_CONSISTENCY": "follower"}) {
+		t.Setenv(k, v)
+	}
+
+	cfg, err := config.Load("test", []string{"--cluster.max_staleness", "2s"})
+	require.NoError(t, err)
+
+	assert.Equal(t, "node1", cfg.Cluster.NodeID)
+	assert.True(t, cfg.Cluster.Bootstrap)
+	assert.Equal(t, "follower", cfg.Cluster.ReadConsistency)
+	assert.Equal(t, config.Duration(2*time.Second), cfg.Cluster.MaxStaleness)
+	assert.Equal(t, config.Duration(10*time.Second), cfg.Cluster.ApplyTimeout)
+	assert.Equal(t, 8192, cfg.Cluster.SnapshotThreshold)
+}
+
+func TestLoad_Validation(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		args []string
+	}{
+		{
+			name: "unknown storage driver",
+			env:  map[string]string{"NEXDB_STORAGE_DRIVER": "postgres"},
+		},
+		{
+			name: "aws-s3 driver without a bucket",
+			args: []string{"--storage.driver", "aws-s3", "--storage.aws.region", "eu-west-1"},
+		},
+		{
+			name: "filesystem driver without a path",
+			args: []string{"--storage.driver", "filesystem"},
+		},
+		{
+			name: "short field encryption key",
+			env:  map[string]string{"NEXDB_FIELD_ENCRYPTION_KEY": "short"},
+		},
+		{
+			name: "unknown s3 storage class",
+			env: map[string]string{
+				"NEXDB_STORAGE_DRIVER":   "aws-s3",
+				"AWS_REGION":             "eu-west-1",
+				"AWS_BUCKET":             "nexdb",
+				"NEXDB_S3_STORAGE_CLASS": "COLD",
+			},
+		},
+		{
+			name: "unknown load policy",
+			env:  map[string]string{"NEXDB_LOAD_ON_ERROR": "ignore"},
+		},
+		{
+			name: "no load workers",
+			args: []string{"--storage.load.workers", "0"},
+		},
+		{
+			name: "unknown format",
+			env:  map[string]string{"NEXDB_STORAGE_FORMAT": "xml"},
+		},
+		{
+			name: "unknown compression",
+			env:  map[string]string{"NEXDB_STORAGE_COMPRESSION": "lz4"},
+		},
+		{
+			name: "unknown layout",
+			env:  map[string]string{"NEXDB_STORAGE_LAYOUT": "tree"},
+		},
+		{
+			name: "no snapshot interval",
+			args: []string{"--storage.snapshot_every", "0"},
+		},
+		{
+			name: "retention without the log layout",
+			env:  map[string]string{"NEXDB_STORAGE_RETENTION": "24h"},
+		},
+		{
+			name: "missing keyring file",
+			env:  map[string]string{"NEXDB_KEYRING_FILE": "/does/not/exist.json"},
+		},
+		{
+			name: "short encryption key",
+			env:  map[string]string{"NEXDB_ENCRYPTION_KEY": "short"},
+		},
+		{
+			name: "tls certificate without key",
+			args: []string{"--server.tls.cert_file", "cert.pem"},
+		},
+		{
+			name: "file audit sink without a file",
+			args: []string{"--audit.sink", "file"},
+		},
+		{
+			name: "invalid duration",
+			env:  map[string]string{"NEXDB_AUDIT_RETENTION": "forever"},
+		},
+		{
+			name: "zero trash purge interval",
+			env:  map[string]string{"NEXDB_TRASH_PURGE_INTERVAL": "0s"},
+		},
+		{
+			name: "unknown replication role",
+			env:  map[string]string{"NEXDB_REPLICATION_ROLE": "primary"},
+		},
+		{
+			name: "follower without a leader",
+			args: []string{"--replication.role", "follower"},
+		},
+		{
+			name: "follower with a leader that is not an address",
+			args: []string{"--replication.role", "follower", "--replication.leader", "leader:9000"},
+		},
+		{
+			name: "unknown replication write policy",
+			env:  map[string]string{"NEXDB_REPLICATION_WRITES": "drop"},
+		},
+		{
+			name: "cluster member without a directory",
+			env:  clusterEnv(map[string]string{"NEXDB_CLUSTER_DIR": ""}),
+		},
+		{
+			name: "cluster address without a port",
+			env:  clusterEnv(map[string]string{"NEXDB_CLUSTER_ADDRESS": "node1"}),
+		},
+		{
+			name: "cluster api address that is not an address",
+			env:  clusterEnv(map[string]string{"NEXDB_CLUSTER_API_ADDRESS": "node1:9000"}),
+		},
+		{
+			name: "cluster member without an api key",
+			env:  clusterEnv(map[string]string{"NEXDB_CLUSTER_API_KEY": ""}),
+		},
+		{
+			name: "cluster member that bootstraps and joins",
+			env:  clusterEnv(map[string]string{"NEXDB_CLUSTER_BOOTSTRAP": "true", "NEXDB_CLUSTER_JOIN": "http://node2:9000"}),
+		},
+		{
+			name: "unknown read consistency",
+			env:  clusterEnv(map[string]string{"NEXDB_CLUSTER_READ_CONSISTENCY": "any"}),
+		},
+		{
+			name: "zero max staleness",
+			env:  clusterEnv(map[string]string{"NEXDB_CLUSTER_MAX_STALENESS": "0s"}),
+		},
+		{
+			name: "zero snapshot threshold",
+			env:  clusterEnv(map[string]string{"NEXDB_CLUSTER_SNAPSHOT_THRESHOLD": "0"}),
+		},
+		{
+			name: "cluster member with a replication role",
+			env:  clusterEnv(map[string]string{"NEXDB_REPLICATION_ROLE": "leader"}),
+		},
+		{
+			name: "file exporter without a file",
+			args: []string{"--tracing.exporter", "file"},
+		},
+		{
+			name: "unknown log level",
+			env:  map[string]string{"NEXDB_LOG_LEVEL": "loud"},
+		},
+		{
+			name: "zero flush timeout",
+			args: []string{"--storage.flush_timeout", "0s"},
+		},
+		{
+			name: "invalid bool",
+			args: []string{"--audit.diffs", "sometimes"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+
+			_, err := config.Load("test", tc.args)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestConfig_Redacted(t *testing.T) {
+	cfg := config.Default()
+	cfg.Storage.EncryptionKey = "key-that-is-thirty-2-bytes-long!"
+	cfg.Storage.AWS.Bucket = "bucket"
+
+	redacted := cfg.Redacted()
+	assert.Equal(t, "[redacted]", redacted.Storage.EncryptionKey)
+	assert.Equal(t, "", redacted.Auth.APIKey)
+	assert.Equal(t, "bucket", redacted.Storage.AWS.Bucket)
+
+	// the original is left untouched
+	assert.Equal(t, "key-that-is-thirty-2-bytes-long!", cfg.Storage.EncryptionKey)
+
+	b, err := redacted.YAML()
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "key-that-is-thirty-2-bytes-long!")
+}
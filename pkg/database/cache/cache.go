@@ -5,8 +5,15 @@ import (
 	"sync"
 
 	"github.com/nexdb/nexdb/pkg/document"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// tracer traces the reads and writes of the cache.
+var tracer = otel.Tracer("github.com/nexdb/nexdb/pkg/database/cache")
+
 // Operation is the type of operation to perform on a document.
 type Operation int
 
@@ -19,6 +26,31 @@ const (
 	OperationDelete
 )
 
+// String returns the name of the operation.
+func (o Operation) String() string {
+	switch o {
+	case OperationCreate:
+		return "create"
+	case OperationUpdate:
+		return "update"
+	case OperationDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+// DeletedAt is the field soft deleted documents are marked with, it holds
+// when they were deleted. They are hidden from GetByID and Filter unless
+// asked for, see Query.Deleted.
+const DeletedAt = "_deleted_at"
+
+// IsDeleted returns whether a document has been soft deleted.
+func IsDeleted(d *document.Document) bool {
+	_, ok := d.Data[DeletedAt]
+	return ok
+}
+
 // Cache is a cache of documents, used for primary access to documents.
 //
 // Writes/Deletes to the cache are queued and eventually written/removed to/from the storage
@@ -32,77 +64,144 @@ type Cache struct {
 	txQueue *Queue
 	sync.RWMutex
 	docs map[string]*document.Document
+
+	// pushing is held from writing a document to the cache until its event
+	// is pushed, so events are pushed in the order documents are written
+	// without the cache being locked while a full queue blocks the push.
+	pushing sync.Mutex
 }
 
 // Put puts a document into the cache.
 func (c *Cache) Put(d *document.Document, blackhole bool) error {
+	return c.PutContext(context.Background(), d, blackhole)
+}
+
+// PutContext puts a document into the cache, the write to storage is linked
+// to the span carried by ctx.
+//
+// Events are pushed in the order documents are written to the cache, reads
+// carry on while a full queue blocks the push.
+func (c *Cache) PutContext(ctx context.Context, d *document.Document, blackhole bool) error {
+	ctx, span := tracer.Start(ctx, "Cache.Put", trace.WithAttributes(
+		attribute.String("nexdb.collection", d.Collection),
+		attribute.String("nexdb.document_id", d.ID.String()),
+	))
+	defer span.End()
+
+	c.pushing.Lock()
+	defer c.pushing.Unlock()
+
+	c.Lock()
+
 	// determine the operation
 	op := OperationCreate
-	if d := c.GetByID(d.ID.String()); d != nil {
+	if _, ok := c.docs[d.ID.String()]; ok {
 		op = OperationUpdate
 	}
+	span.SetAttributes(attribute.String("nexdb.operation", op.String()))
+
+	// update the cache
+	c.docs[d.ID.String()] = d
+	c.Unlock()
 
 	// push the event to the queue
 	if !blackhole {
 		c.txQueue.Push(Event{
 			Operation: op,
 			Document:  d,
+			Context:   ctx,
 		})
 	}
 
-	// update the cache
-	if op == OperationCreate {
-		return c.createDocument(d)
+	return nil
+}
+
+// GetByID gets a document from the cache by ID, soft deleted documents
+// are not returned. It will lock the cache and release it when the function
+// returns.
+func (c *Cache) GetByID(id string) *document.Document {
+	d := c.GetAnyByID(id)
+	if d == nil || IsDeleted(d) {
+		return nil
 	}
 
-	// update the document
-	return c.updateDocument(d)
+	return d
 }
 
-// createDocument creates a document in the cache. It will lock the cache
-// and release it when the function returns.
-func (c *Cache) createDocument(d *document.Document) error {
-	c.Lock()
-	defer c.Unlock()
-
-	c.docs[d.ID.String()] = d
+// GetAnyByID gets a document from the cache by ID, whether or not it has
+// been soft deleted.
+func (c *Cache) GetAnyByID(id string) *document.Document {
+	c.RLock()
+	defer c.RUnlock()
 
-	return nil
+	return c.docs[id]
 }
 
-// updateDocument updates a document in the cache. It will lock the cache
-// and release it when the function returns.
-func (c *Cache) updateDocument(d *document.Document) error {
-	c.Lock()
-	defer c.Unlock()
+// Documents returns every document in the cache, regardless of collection.
+// It will lock the cache and release it when the function returns.
+func (c *Cache) Documents() []*document.Document {
+	c.RLock()
+	defer c.RUnlock()
 
-	if _, ok := c.docs[d.ID.String()]; !ok {
-		return nil
+	docs := make([]*document.Document, 0, len(c.docs))
+	for _, d := range c.docs {
+		docs = append(docs, d)
 	}
 
-	// update the document
-	c.docs[d.ID.String()] = d
-
-	return nil
+	return docs
 }
 
-// GetByID gets a document from the cache by ID. It will lock the cache
-// and release it when the function returns.
-func (c *Cache) GetByID(id string) *document.Document {
-	c.RLock()
-	defer c.RUnlock()
+// Snapshot returns a deep copy of the documents of every cache taken at a
+// single point in time, the caches are locked for reading until all are
+// copied. The copies share no data with the cache, so they can be encoded
+// while the documents carry on being written.
+func Snapshot(caches ...*Cache) [][]document.Document {
+	for _, c := range caches {
+		c.RLock()
+		defer c.RUnlock()
+	}
 
-	return c.docs[id]
+	snapshot := make([][]document.Document, len(caches))
+	for i, c := range caches {
+		docs := make([]document.Document, 0, len(c.docs))
+		for _, d := range c.docs {
+			docs = append(docs, *d.Clone())
+		}
+		snapshot[i] = docs
+	}
+
+	return snapshot
 }
 
 // Delete deletes a document from the cache. It will lock the cache
 // and release it when the function returns.
 func (c *Cache) Delete(id string) error {
+	return c.DeleteContext(context.Background(), id)
+}
+
+// DeleteContext deletes a document from the cache, the delete from storage
+// is linked to the span carried by ctx.
+func (c *Cache) DeleteContext(ctx context.Context, id string) error {
+	ctx, span := tracer.Start(ctx, "Cache.Delete", trace.WithAttributes(
+		attribute.String("nexdb.document_id", id),
+	))
+	defer span.End()
+
+	c.pushing.Lock()
+	defer c.pushing.Unlock()
+
 	c.Lock()
-	defer c.Unlock()
 
-	// get the document
-	d := c.docs[id]
+	// get the document, deleting one that isn't in the cache does nothing
+	d, ok := c.docs[id]
+	if !ok {
+		c.Unlock()
+		return nil
+	}
+
+	// delete the document from the slice
+	delete(c.docs, id)
+	c.Unlock()
 
 	// create a copy to pass to the queue
 	dCopy := document.New().SetCollection(d.Collection).SetID(d.ID.String()).SetData(d.Data)
@@ -111,12 +210,57 @@ func (c *Cache) Delete(id string) error {
 	c.txQueue.Push(Event{
 		Operation: OperationDelete,
 		Document:  dCopy,
+		Context:   ctx,
 	})
 
-	// delete the document from the slice
+	return nil
+}
+
+// Evict removes a document from the cache without deleting it from storage,
+// such as when the storage is shared with another server that deletes it.
+func (c *Cache) Evict(id string) {
+	c.Lock()
+	defer c.Unlock()
+
 	delete(c.docs, id)
+}
 
-	return nil
+// Rewrite writes d to storage again if it is still the current version of
+// its document, such as to re-encrypt it. It reports whether d was written,
+// it is not if the document has been updated or deleted since d was read.
+func (c *Cache) Rewrite(ctx context.Context, d *document.Document) bool {
+	ctx, span := tracer.Start(ctx, "Cache.Rewrite", trace.WithAttributes(
+		attribute.String("nexdb.collection", d.Collection),
+		attribute.String("nexdb.document_id", d.ID.String()),
+	))
+	defer span.End()
+
+	c.pushing.Lock()
+	defer c.pushing.Unlock()
+
+	c.Lock()
+	if c.docs[d.ID.String()] != d {
+		c.Unlock()
+		return false
+	}
+
+	// replace the document with a copy that is no longer stale
+	dCopy := document.New().SetCollection(d.Collection).SetID(d.ID.String()).SetData(d.Data)
+	c.docs[d.ID.String()] = dCopy
+	c.Unlock()
+
+	c.txQueue.Push(Event{
+		Operation: OperationUpdate,
+		Document:  dCopy,
+		Context:   ctx,
+	})
+
+	return true
+}
+
+// Queue returns the queue the cache pushes its writes to.
+func (c *Cache) Queue() *Queue {
+	return c.txQueue
 }
 
 // NewCache returns a new cache.
@@ -3,6 +3,7 @@ package cache_test
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/nexdb/nexdb/pkg/database/cache"
 	"github.com/nexdb/nexdb/pkg/document"
@@ -93,3 +94,45 @@ func TestCache_Delete(t *testing.T) {
 	got = c.GetByID(d.ID.String())
 	assert.Nil(t, got)
 }
+
+func TestCache_PutWithFullQueue(t *testing.T) {
+	s, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	st := &blockingStorage{
+		Storage: s,
+		writing: make(chan struct{}, 2048),
+		release: make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := cache.NewCache(ctx, cache.NewQueue(st))
+
+	first := document.New().SetCollection("test")
+	require.NoError(t, c.Put(first, false))
+	<-st.writing
+
+	// fill the queue, the last put blocks until storage catches up
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1025; i++ {
+			assert.NoError(t, c.Put(document.New().SetCollection("test"), false))
+		}
+	}()
+	require.Eventually(t, func() bool { return c.Queue().Len() == 1024 }, 5*time.Second, time.Millisecond)
+
+	// reads carry on while the put is blocked
+	read := make(chan *document.Document)
+	go func() { read <- c.GetByID(first.ID.String()) }()
+	select {
+	case got := <-read:
+		assert.Equal(t, first, got)
+	case <-time.After(time.Second):
+		t.Fatal("read blocked by a full queue")
+	}
+
+	close(st.release)
+	<-done
+}
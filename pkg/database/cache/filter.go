@@ -1,11 +1,15 @@
 package cache
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strings"
 
 	"github.com/nexdb/nexdb/pkg/document"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Operator is the type of operator to use in a condition.
@@ -23,9 +27,26 @@ type Condition struct {
 	Value    string   `json:"value"`
 }
 
+// Deleted is which documents a query matches by whether they have been
+// soft deleted.
+type Deleted string
+
+const (
+	// DeletedExclude matches documents that have not been deleted, it is
+	// the default.
+	DeletedExclude Deleted = ""
+	// DeletedInclude matches documents whether or not they have been deleted.
+	DeletedInclude Deleted = "include"
+	// DeletedOnly matches documents that have been deleted.
+	DeletedOnly Deleted = "only"
+)
+
 type Query struct {
 	And []Element `json:"and,omitempty"`
 	Or  []Element `json:"or,omitempty"`
+	// Deleted is which documents are matched by whether they have been
+	// soft deleted, it only applies to the outermost query.
+	Deleted Deleted `json:"deleted,omitempty"`
 }
 
 type Element struct {
@@ -53,6 +74,16 @@ func (e *Element) UnmarshalJSON(data []byte) error {
 
 // Filter filters documents in the cache.
 func (c *Cache) Filter(collection string, query Query) []*document.Document {
+	return c.FilterContext(context.Background(), collection, query)
+}
+
+// FilterContext is Filter, traced as a child of the span carried by ctx.
+func (c *Cache) FilterContext(ctx context.Context, collection string, query Query) []*document.Document {
+	_, span := tracer.Start(ctx, "Cache.Filter", trace.WithAttributes(
+		attribute.String("nexdb.collection", collection),
+	))
+	defer span.End()
+
 	c.RLock()
 	defer c.RUnlock()
 	results := []*document.Document{}
@@ -61,10 +92,23 @@ func (c *Cache) Filter(collection string, query Query) []*document.Document {
 			continue
 		}
 
+		switch deleted := IsDeleted(doc); query.Deleted {
+		case DeletedInclude:
+		case DeletedOnly:
+			if !deleted {
+				continue
+			}
+		default:
+			if deleted {
+				continue
+			}
+		}
+
 		if applyQuery(doc, query) {
 			results = append(results, doc)
 		}
 	}
+	span.SetAttributes(attribute.Int("nexdb.results", len(results)))
 	return results
 }
 
@@ -2,18 +2,68 @@ package cache
 
 import (
 	"context"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 
 	"github.com/nexdb/nexdb/pkg/document"
 	"github.com/nexdb/nexdb/pkg/storage"
 )
 
+// queueSize is the number of events a queue holds before pushes block.
+const queueSize = 1024
+
 // Event is an event that is emitted when a document is written to storage.
 type Event struct {
 	// Operation is the operation that was performed on the document.
 	Operation Operation
 	// Document is the document that was written to storage.
 	Document *document.Document
+	// Context is the context of the write that emitted the event, the
+	// processing of the event is linked to its span. It may be nil.
+	Context context.Context
+}
+
+// Processor processes an event, writing it to storage.
+type Processor func(event Event) error
+
+// Middleware wraps the processing of events, such as to instrument it.
+type Middleware func(next Processor) Processor
+
+// Observer is notified of every event pushed to a queue, in the order they
+// are pushed, before the event is processed. The cache pushing the event is
+// locked while it is notified so it must not block.
+type Observer func(event Event)
+
+// Stats counts what happened to the events pushed to a queue.
+type Stats struct {
+	// Flushed is the number of events written to storage.
+	Flushed int
+	// Failed is the number of events the storage returned an error for.
+	Failed int
+	// Abandoned is the number of events never written to storage, because
+	// they were pushed after the queue started draining or the drain deadline
+	// passed before they were processed.
+	Abandoned int
+}
+
+// Add returns the events counted by both s and o, such as by two queues.
+func (s Stats) Add(o Stats) Stats {
+	return Stats{
+		Flushed:   s.Flushed + o.Flushed,
+		Failed:    s.Failed + o.Failed,
+		Abandoned: s.Abandoned + o.Abandoned,
+	}
+}
+
+// Sub returns the events counted by s since earlier stats of the same
+// queue were taken, such as while it drained.
+func (s Stats) Sub(earlier Stats) Stats {
+	return Stats{
+		Flushed:   s.Flushed - earlier.Flushed,
+		Failed:    s.Failed - earlier.Failed,
+		Abandoned: s.Abandoned - earlier.Abandoned,
+	}
 }
 
 // Queue is a queue of events to be processed by the cache
@@ -22,7 +72,7 @@ type Event struct {
 // If the maximum number of attempts is reached, the event is discarded.
 //
 // The Queue will finish processing all events when receiving
-// cancel signal and stop safely.
+// cancel signal and stop safely, unless Shutdown's deadline passes first.
 type Queue struct {
 	Storage storage.Storage
 
@@ -31,87 +81,229 @@ type Queue struct {
 	sync.RWMutex
 	// draining is a flag that indicates whether the queue is draining.
 	draining bool
+	// pushing tracks pushes that are waiting to enqueue an event, the queue
+	// waits for them before draining so no event is left behind.
+	pushing sync.WaitGroup
+	// stopping is closed when the queue starts draining, it releases
+	// pushes blocked on a full queue.
+	stopping chan struct{}
+	// abandon is closed to stop draining before the queue is empty.
+	abandon     chan struct{}
+	abandonOnce sync.Once
 	// drained is a channel that is closed when the queue is drained.
 	drained chan struct{}
+	// processor writes events to storage, wrapped by the queue's middleware.
+	processor Processor
+	// observers are notified of every event pushed to the queue.
+	observers []Observer
+	// started guards against the queue being started twice.
+	started atomic.Bool
+
+	flushed   atomic.Int64
+	failed    atomic.Int64
+	abandoned atomic.Int64
 }
 
-// Push pushes a write event to the queue.
+// Push pushes a write event to the queue, events pushed once the queue is
+// draining are abandoned.
 func (q *Queue) Push(event Event) {
+	for _, observe := range q.observers {
+		observe(event)
+	}
+
 	q.RLock()
-	defer q.RUnlock()
 	if q.draining {
+		q.RUnlock()
+		q.abandoned.Add(1)
+		slog.Warn("write abandoned, the queue is shutting down", eventAttrs(event)...)
 		return
 	}
+	q.pushing.Add(1)
+	q.RUnlock()
 
-	q.queue <- event
+	defer q.pushing.Done()
+
+	select {
+	case q.queue <- event:
+	case <-q.stopping:
+		q.abandoned.Add(1)
+		slog.Warn("write abandoned, the queue is shutting down", eventAttrs(event)...)
+	}
 }
 
-// Start starts the queue.
+// Start starts the queue, it processes events until the context is
+// cancelled and then drains the queue and closes its storage. Starting a
+// queue more than once has no effect.
 func (q *Queue) Start(ctx context.Context) {
+	if !q.started.CompareAndSwap(false, true) {
+		return
+	}
+
 	for {
+		// prefer draining once cancelled so the drain deadline applies
+		if ctx.Err() != nil {
+			q.drain()
+			return
+		}
+
 		select {
 		case <-ctx.Done():
-			q.Lock()
-			q.draining = true
-			q.drained = make(chan struct{})
-			q.Unlock()
-
-			// drain the queue
-			close(q.queue)
-			for event := range q.queue {
-				q.process(event)
-			}
-
-			// close the drained channel
-			q.drained <- struct{}{}
-			close(q.drained)
+			q.drain()
+			return
+		case event := <-q.queue:
+			q.process(event)
+		}
+	}
+}
+
+// drain stops accepting events, processes the events left in the queue and
+// closes the storage.
+func (q *Queue) drain() {
+	defer close(q.drained)
+	defer func() {
+		if err := storage.Close(q.Storage); err != nil {
+			slog.Error("failed to close storage", "error", err)
+		}
+	}()
+
+	q.Lock()
+	q.draining = true
+	q.Unlock()
+
+	close(q.stopping)
+	q.pushing.Wait()
+
+	for {
+		select {
+		case <-q.abandon:
+			n := len(q.queue)
+			q.abandoned.Add(int64(n))
+			slog.Warn("writes abandoned, the queue did not drain before the deadline", "count", n)
 			return
+		default:
+		}
+
+		select {
 		case event := <-q.queue:
 			q.process(event)
+		default:
+			return
 		}
 	}
 }
 
+// Use wraps the processing of events in the given middleware, the first
+// middleware is the outermost. It must be called before the queue is started.
+func (q *Queue) Use(mw ...Middleware) {
+	for i := len(mw) - 1; i >= 0; i-- {
+		q.processor = mw[i](q.processor)
+	}
+}
+
+// Observe notifies the given observers of every event pushed to the queue,
+// including events that are then abandoned. It must be called before the
+// queue is started.
+func (q *Queue) Observe(observers ...Observer) {
+	q.observers = append(q.observers, observers...)
+}
+
 // process processes an event.
 func (q *Queue) process(event Event) {
+	if err := q.processor(event); err != nil {
+		q.failed.Add(1)
+		slog.Error("failed to write event to storage", append(eventAttrs(event), "error", err)...)
+		return
+	}
+	q.flushed.Add(1)
+}
+
+// eventAttrs returns the log attributes of an event.
+func eventAttrs(event Event) []any {
+	return []any{
+		"operation", event.Operation.String(),
+		"collection", event.Document.Collection,
+		"id", event.Document.ID.String(),
+	}
+}
+
+// write writes an event to storage.
+func (q *Queue) write(event Event) error {
+	ctx := event.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
 	switch event.Operation {
 	case OperationCreate:
-		q.processCreate(event.Document)
+		return q.processCreate(ctx, event.Document)
 	case OperationUpdate:
-		q.processCreate(event.Document)
+		return q.processCreate(ctx, event.Document)
 	case OperationDelete:
-		q.processDelete(event.Document)
+		return q.processDelete(ctx, event.Document)
 	}
+
+	return nil
 }
 
 // processCreate processes a create event.
-func (q *Queue) processCreate(doc *document.Document) {
-	_ = q.Storage.Write(doc)
+func (q *Queue) processCreate(ctx context.Context, doc *document.Document) error {
+	return storage.WriteContext(ctx, q.Storage, doc)
 }
 
 // processDelete processes a delete event.
-func (q *Queue) processDelete(doc *document.Document) {
-	_ = q.Storage.Delete(doc)
+func (q *Queue) processDelete(ctx context.Context, doc *document.Document) error {
+	return storage.DeleteContext(ctx, q.Storage, doc)
 }
 
-// WaitForShutdown waits for the queue to finish processing all events.
-func (q *Queue) WaitForShutdown() {
-	for {
-		q.RLock()
-		if q.drained != nil {
-			q.RUnlock()
-			break
-		}
-		q.RUnlock()
+// Len returns the number of events waiting to be processed.
+func (q *Queue) Len() int {
+	return len(q.queue)
+}
+
+// Stats returns the counts of what happened to the events pushed to the queue.
+func (q *Queue) Stats() Stats {
+	return Stats{
+		Flushed:   int(q.flushed.Load()),
+		Failed:    int(q.failed.Load()),
+		Abandoned: int(q.abandoned.Load()),
 	}
+}
 
+// WaitForShutdown waits for the queue to finish processing all events.
+func (q *Queue) WaitForShutdown() Stats {
 	<-q.drained
+
+	return q.Stats()
+}
+
+// Shutdown waits for the queue to drain once its context is cancelled. If
+// ctx is done first, the events left in the queue are abandoned and the
+// context's error is returned.
+func (q *Queue) Shutdown(ctx context.Context) (Stats, error) {
+	select {
+	case <-q.drained:
+		return q.Stats(), nil
+	case <-ctx.Done():
+		q.abandonOnce.Do(func() {
+			close(q.abandon)
+		})
+
+		// wait for the event being processed, if any
+		<-q.drained
+		return q.Stats(), ctx.Err()
+	}
 }
 
 // NewQueue returns a new queue.
 func NewQueue(storage storage.Storage) *Queue {
-	return &Queue{
-		Storage: storage,
-		queue:   make(chan Event),
+	q := &Queue{
+		Storage:  storage,
+		queue:    make(chan Event, queueSize),
+		stopping: make(chan struct{}),
+		abandon:  make(chan struct{}),
+		drained:  make(chan struct{}),
 	}
+	q.processor = q.write
+
+	return q
 }
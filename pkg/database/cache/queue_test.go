@@ -4,6 +4,7 @@ import (
 	"context"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/nexdb/nexdb/pkg/database/cache"
 	"github.com/nexdb/nexdb/pkg/document"
@@ -76,3 +77,99 @@ func TestQueue_Push(t *testing.T) {
 
 	assert.True(t, found)
 }
+
+// blockingStorage is a storage that blocks writes until release is closed.
+type blockingStorage struct {
+	storage.Storage
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStorage) Write(doc *document.Document) error {
+	s.writing <- struct{}{}
+	<-s.release
+	return s.Storage.Write(doc)
+}
+
+func TestQueue_Shutdown(t *testing.T) {
+	s, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name   string
+		verify func(t *testing.T, q *cache.Queue, st *blockingStorage)
+	}{
+		{
+			name: "flushes pending events",
+			verify: func(t *testing.T, q *cache.Queue, st *blockingStorage) {
+				close(st.release)
+				go func() {
+					for range st.writing {
+					}
+				}()
+
+				stats, err := q.Shutdown(context.Background())
+				require.NoError(t, err)
+				assert.Equal(t, cache.Stats{Flushed: 3}, stats)
+			},
+		},
+		{
+			name: "abandons events after the deadline",
+			verify: func(t *testing.T, q *cache.Queue, st *blockingStorage) {
+				// the first event is being written when the deadline passes
+				<-st.writing
+
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+
+				// release it once shutdown has given up on the queue
+				time.AfterFunc(50*time.Millisecond, func() {
+					close(st.release)
+				})
+
+				stats, err := q.Shutdown(ctx)
+				require.ErrorIs(t, err, context.Canceled)
+				assert.Equal(t, cache.Stats{Flushed: 1, Abandoned: 2}, stats)
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			st := &blockingStorage{
+				Storage: s,
+				writing: make(chan struct{}, 3),
+				release: make(chan struct{}),
+			}
+			q := cache.NewQueue(st)
+
+			for i := 0; i < 3; i++ {
+				q.Push(cache.Event{
+					Operation: cache.OperationCreate,
+					Document:  document.New().SetCollection("test"),
+				})
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			go q.Start(ctx)
+
+			tc.verify(t, q, st)
+
+			// pushes after shutdown are abandoned
+			before := q.Stats().Abandoned
+			q.Push(cache.Event{
+				Operation: cache.OperationCreate,
+				Document:  document.New().SetCollection("test"),
+			})
+			assert.Equal(t, before+1, q.Stats().Abandoned)
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	lifetime := cache.Stats{Flushed: 10, Failed: 2, Abandoned: 1}
+	before := cache.Stats{Flushed: 7, Failed: 2}
+
+	assert.Equal(t, cache.Stats{Flushed: 3, Abandoned: 1}, lifetime.Sub(before))
+	assert.Equal(t, cache.Stats{Flushed: 17, Failed: 4, Abandoned: 1}, lifetime.Add(before))
+}
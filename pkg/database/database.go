@@ -1,27 +1,222 @@
 package database
 
 import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"log/slog"
+	"time"
+
 	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
 	"github.com/nexdb/nexdb/pkg/storage"
 )
 
 // Database is a database of documents, it acts as a proxy to the cache.
 type Database struct {
 	*cache.Cache
+
+	// Name is the name the database is addressed by, see Manager.
+	Name string
+
+	// committer commits the writes of the database, if set, see
+	// Manager.WithCommitter.
+	committer Committer
+	// stop stops the queue of a database opened by a Manager once it has
+	// drained, see Manager.open.
+	stop context.CancelFunc
+	// locks are the locks of collections and documents, see LockDocument.
+	locks locks
+}
+
+// Committer commits the writes made to a database before they are applied,
+// such as to a replicated log. Committed writes are applied straight to the
+// cache of their database by the committer, not through the Database.
+//
+// op is OperationDelete for deletes and OperationUpdate for puts, whether a
+// put creates its document is decided when it is applied.
+type Committer interface {
+	Commit(ctx context.Context, database string, op cache.Operation, doc *document.Document) error
+}
+
+// Put puts a document into the database, see PutContext.
+func (d *Database) Put(doc *document.Document, blackhole bool) error {
+	return d.PutContext(context.Background(), doc, blackhole)
 }
 
-// Load loads the database from storage.
-func (d *Database) Load(store storage.Storage) error {
-	str, err := store.Stream()
-	if str == nil || err != nil {
+// PutContext puts a document into the database. The write is committed by
+// the committer of the database if it has one, otherwise it is put straight
+// into the cache. Puts that are not written to storage, such as of
+// documents loaded from it, are always put straight into the cache.
+func (d *Database) PutContext(ctx context.Context, doc *document.Document, blackhole bool) error {
+	if d.committer == nil || blackhole {
+		return d.Cache.PutContext(ctx, doc, blackhole)
+	}
+
+	return d.committer.Commit(ctx, d.Name, cache.OperationUpdate, doc)
+}
+
+// Delete deletes a document from the database, see DeleteContext.
+func (d *Database) Delete(id string) error {
+	return d.DeleteContext(context.Background(), id)
+}
+
+// DeleteContext deletes a document from the database. The delete is
+// committed by the committer of the database if it has one, otherwise the
+// document is deleted straight from the cache.
+func (d *Database) DeleteContext(ctx context.Context, id string) error {
+	if d.committer == nil {
+		return d.Cache.DeleteContext(ctx, id)
+	}
+
+	// deleting a document that isn't in the database does nothing
+	doc := d.GetAnyByID(id)
+	if doc == nil {
 		return nil
 	}
 
-	for doc := range str {
-		if err := d.Put(doc, true); err != nil {
-			return err
+	return d.committer.Commit(ctx, d.Name, cache.OperationDelete, document.New().SetCollection(doc.Collection).SetID(id))
+}
+
+// LoadPolicy is what Load does with documents that can't be read from
+// storage.
+type LoadPolicy string
+
+const (
+	// LoadFail stops loading at the first document that can't be read.
+	LoadFail LoadPolicy = "fail"
+	// LoadSkip logs the documents that can't be read and loads the rest.
+	LoadSkip LoadPolicy = "skip"
+)
+
+// Progress is how far a database has been loaded.
+type Progress struct {
+	Database string
+	Loaded   int
+	Skipped  int
+	// Done is set on the last report, once every document is loaded.
+	Done bool
+}
+
+// LoadOption is a function that modifies how Load loads documents.
+type LoadOption func(*loadOptions)
+
+// loadOptions are the settings Load loads documents with.
+type loadOptions struct {
+	policy   LoadPolicy
+	interval time.Duration
+	progress func(Progress)
+}
+
+// WithLoadPolicy sets what Load does with documents that can't be read,
+// LoadFail if it isn't set.
+func WithLoadPolicy(p LoadPolicy) LoadOption {
+	return func(o *loadOptions) {
+		o.policy = p
+	}
+}
+
+// WithProgress reports the progress of Load to fn every interval, and once
+// more when it is done.
+func WithProgress(interval time.Duration, fn func(Progress)) LoadOption {
+	return func(o *loadOptions) {
+		o.interval = interval
+		o.progress = fn
+	}
+}
+
+// Load loads the database from storage. Documents that can't be read fail
+// the load unless the policy is LoadSkip, errors ending the stream always
+// fail it.
+func (d *Database) Load(store storage.Storage, opts ...LoadOption) error {
+	o := &loadOptions{policy: LoadFail}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	// stop the stream if loading fails part way
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	docs, errs, err := storage.StreamErrors(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	var tick <-chan time.Time
+	if o.progress != nil && o.interval > 0 {
+		ticker := time.NewTicker(o.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	p := Progress{Database: d.Name}
+	for docs != nil || errs != nil {
+		select {
+		case doc, ok := <-docs:
+			if !ok {
+				docs = nil
+				continue
+			}
+
+			if err := d.Put(doc, true); err != nil {
+				return err
+			}
+			p.Loaded++
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+
+			var objErr *storage.ObjectError
+			if o.policy != LoadSkip || !stderrors.As(err, &objErr) {
+				return fmt.Errorf("failed to load database %s: %w", d.Name, err)
+			}
+
+			slog.Warn("skipped document that can't be read", "database", d.Name, "key", objErr.Key, "error", objErr.Err)
+			p.Skipped++
+		case <-tick:
+			o.progress(p)
 		}
 	}
 
+	if o.progress != nil {
+		p.Done = true
+		o.progress(p)
+	}
+
 	return nil
 }
+
+// Reencrypt rewrites the stale documents of the database, those read from
+// storage that are not sealed with the primary key, so they are sealed with
+// it. It returns the number of documents rewritten.
+func (d *Database) Reencrypt(ctx context.Context) (int, error) {
+	n := 0
+	for _, doc := range d.Documents() {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+
+		if doc.Stale && d.Rewrite(ctx, doc) {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// contextKey is the key used to store a database in a context.
+type contextKey struct{}
+
+// NewContext returns a copy of ctx that carries the database d.
+func NewContext(ctx context.Context, d *Database) context.Context {
+	return context.WithValue(ctx, contextKey{}, d)
+}
+
+// FromContext returns the database carried by ctx, if any.
+func FromContext(ctx context.Context) (*Database, bool) {
+	d, ok := ctx.Value(contextKey{}).(*Database)
+	return d, ok
+}
@@ -0,0 +1,175 @@
+package database_test
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatabase_Reencrypt(t *testing.T) {
+	dir := t.TempDir()
+	oldKey := []byte("key-that-is-thirty-2-bytes-long!")
+
+	// documents sealed with the encryption key
+	before, err := storage.New(storage.FilesystemDriver, storage.WithPath(dir), storage.WithEncryptionKey(oldKey))
+	require.NoError(t, err)
+	for _, name := range []string{"ada", "grace", "linus"} {
+		require.NoError(t, before.Write(document.New().SetCollection("users").SetData(map[string]interface{}{"name": name})))
+	}
+
+	// rotated to a keyring file that replaces it
+	keyringFile := filepath.Join(t.TempDir(), "keyring.json")
+	require.NoError(t, os.WriteFile(keyringFile, []byte(`{"primary": "new", "keys": {"new": "`+
+		base64.StdEncoding.EncodeToString([]byte("another-key-thirty-2-bytes-long!"))+`"}}`), 0o600))
+
+	after, err := storage.New(storage.FilesystemDriver, storage.WithPath(dir), storage.WithEncryptionKey(oldKey), storage.WithKeyringFile(keyringFile))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &database.Database{Cache: cache.NewCache(ctx, cache.NewQueue(after))}
+	require.NoError(t, d.Load(after))
+
+	// a document updated since it was loaded is already sealed with the
+	// primary key and is left alone
+	updated := d.Documents()[0]
+	require.NoError(t, d.Put(document.New().SetCollection("users").SetID(updated.ID.String()).SetData(map[string]interface{}{"name": "updated"}), false))
+
+	n, err := d.Reencrypt(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	cancel()
+	_, err = d.Queue().Shutdown(context.Background())
+	require.NoError(t, err)
+
+	// every document is readable with the keyring file alone
+	rotated, err := storage.New(storage.FilesystemDriver, storage.WithPath(dir), storage.WithKeyringFile(keyringFile))
+	require.NoError(t, err)
+	c, err := rotated.Stream()
+	require.NoError(t, err)
+
+	names := []string{}
+	for doc := range c {
+		assert.False(t, doc.Stale)
+		names = append(names, doc.Data["name"].(string))
+	}
+	assert.Len(t, names, 3)
+	assert.Contains(t, names, "updated")
+}
+
+func TestDatabase_Load(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		opts       []database.LoadOption
+		wantErr    bool
+		wantLoaded int
+	}{
+		{
+			name:    "corrupt document, expect load to fail",
+			wantErr: true,
+		},
+		{
+			name:    "corrupt document with fail policy, expect load to fail",
+			opts:    []database.LoadOption{database.WithLoadPolicy(database.LoadFail)},
+			wantErr: true,
+		},
+		{
+			name:       "corrupt document with skip policy, expect the rest to be loaded",
+			opts:       []database.LoadOption{database.WithLoadPolicy(database.LoadSkip)},
+			wantLoaded: 3,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := storage.New(storage.FilesystemDriver, storage.WithPath(dir), storage.WithConcurrency(2))
+			require.NoError(t, err)
+			for _, name := range []string{"ada", "grace", "linus"} {
+				require.NoError(t, s.Write(document.New().SetCollection("users").SetData(map[string]interface{}{"name": name})))
+			}
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "users", document.New().ID.String()), []byte("{corrupt"), 0o600))
+
+			var reports []database.Progress
+			opts := append(tc.opts, database.WithProgress(time.Hour, func(p database.Progress) {
+				reports = append(reports, p)
+			}))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			t.Cleanup(cancel)
+			d := &database.Database{Cache: cache.NewCache(ctx, cache.NewQueue(s)), Name: "test"}
+
+			err = d.Load(s, opts...)
+			if tc.wantErr {
+				var objErr *storage.ObjectError
+				require.ErrorAs(t, err, &objErr)
+				return
+			}
+			require.NoError(t, err)
+
+			assert.Len(t, d.Documents(), tc.wantLoaded)
+			assert.Equal(t, []database.Progress{{Database: "test", Loaded: 3, Skipped: 1, Done: true}}, reports)
+		})
+	}
+}
+
+func TestDatabase_Locks(t *testing.T) {
+	d := &database.Database{}
+
+	// documents of other collections, or other documents, are not locked
+	unlockCollection := d.LockCollection("users")
+	d.LockDocument("orders", "1")()
+	unlockDocument := d.LockDocument("orders", "2")
+
+	locked := make(chan struct{})
+	go func() {
+		unlock := d.LockDocument("users", "1")
+		close(locked)
+		unlock()
+	}()
+
+	// documents of a locked collection wait for it
+	select {
+	case <-locked:
+		t.Fatal("document of a locked collection was locked")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	unlockCollection()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("document was not locked once its collection was unlocked")
+	}
+
+	// the collection waits for the documents locked in it
+	locked = make(chan struct{})
+	go func() {
+		unlock := d.LockCollection("orders")
+		close(locked)
+		unlock()
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("collection with a locked document was locked")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	unlockDocument()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("collection was not locked once its documents were unlocked")
+	}
+}
@@ -0,0 +1,77 @@
+package database
+
+import "sync"
+
+// locks are read-write mutexes by key, a mutex is only kept while it is
+// held or waited on. The zero value is ready to use.
+type locks struct {
+	mx   sync.Mutex
+	held map[string]*lockEntry
+}
+
+// lockEntry is the mutex of a key and the number of holders and waiters.
+type lockEntry struct {
+	sync.RWMutex
+	refs int
+}
+
+// lock locks the mutex of key, for reading if shared is set, and returns
+// the function that unlocks it.
+func (l *locks) lock(key string, shared bool) func() {
+	l.mx.Lock()
+	if l.held == nil {
+		l.held = map[string]*lockEntry{}
+	}
+	e, ok := l.held[key]
+	if !ok {
+		e = &lockEntry{}
+		l.held[key] = e
+	}
+	e.refs++
+	l.mx.Unlock()
+
+	if shared {
+		e.RLock()
+	} else {
+		e.Lock()
+	}
+
+	return func() {
+		if shared {
+			e.RUnlock()
+		} else {
+			e.Unlock()
+		}
+
+		l.mx.Lock()
+		if e.refs--; e.refs == 0 {
+			delete(l.held, key)
+		}
+		l.mx.Unlock()
+	}
+}
+
+// LockCollection locks a collection against writes to its documents made
+// under LockDocument, such as while every document of the collection is
+// rewritten. It returns the function that unlocks it.
+//
+// Locks are held by this server alone, writes forwarded to it by other
+// members of a cluster are not locked out.
+func (d *Database) LockCollection(collection string) func() {
+	return d.locks.lock("collection/"+collection, false)
+}
+
+// LockDocument locks a document of a collection, so a write that reads the
+// document first, or writes more than one document, isn't interleaved with
+// another write of it. Documents of a collection locked by LockCollection
+// can't be locked until it is unlocked. It returns the function that unlocks
+// the document.
+func (d *Database) LockDocument(collection, id string) func() {
+	unlockCollection := d.locks.lock("collection/"+collection, true)
+	unlockDocument := d.locks.lock("document/"+id, false)
+
+	return func() {
+		unlockDocument()
+		unlockCollection()
+	}
+}
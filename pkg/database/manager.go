@@ -0,0 +1,525 @@
+package database
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/database/validation"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/errors"
+	"github.com/nexdb/nexdb/pkg/keyring"
+	"github.com/nexdb/nexdb/pkg/storage"
+)
+
+// DefaultName is the name of the database served by the /v1/collections routes.
+const DefaultName = "default"
+
+// DatabasesCollection is the collection of the default database that holds
+// the metadata of every other database.
+const DatabasesCollection = "_databases"
+
+// sealedKeyPrefix starts the encryption keys of databases that are sealed
+// with the keyring of the server, see SealKey.
+const sealedKeyPrefix = "nxk1:"
+
+// Info describes a database managed by a Manager.
+type Info struct {
+	Name      string `json:"name"`
+	Prefix    string `json:"prefix"`
+	Encrypted bool   `json:"encrypted"`
+}
+
+// Manager manages the named databases hosted by a server. Each database has
+// its own cache partition, storage prefix, api keys and optionally its own
+// encryption key. The metadata of each database is kept in the default database
+// so they can be re-opened on startup.
+//
+// To initialise a new Manager use the NewManager function.
+type Manager struct {
+	ctx    context.Context
+	driver storage.Driver
+	opts   []storage.Option
+	system *Database
+	// queueMiddleware wraps the queues of the databases opened by the manager.
+	queueMiddleware []cache.Middleware
+	// queueObserver returns the observer of the queue of a database opened
+	// by the manager, if set.
+	queueObserver func(name string) cache.Observer
+	loadOptions   []LoadOption
+	// committer commits the writes of every database, if set.
+	committer Committer
+
+	// changes serialises creating and dropping databases, syncing is held
+	// while syncing them. Neither is held while writing, writes that are
+	// committed may sync the databases before they return.
+	changes sync.Mutex
+	syncing sync.Mutex
+
+	mx        sync.RWMutex
+	databases map[string]*Database
+	info      map[string]*document.Document
+	// dropped are the databases that were closed, their queues drain
+	// until Shutdown.
+	dropped []*Database
+}
+
+// Load opens every database recorded in the default database and loads
+// its documents from storage.
+func (m *Manager) Load() error {
+	for _, doc := range m.system.Filter(DatabasesCollection, cache.Query{}) {
+		if err := m.load(doc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Sync opens the databases recorded in the default database that are not
+// open, loading their documents from storage, and closes the open databases
+// that are no longer recorded, deleting their documents. It brings the
+// databases in line with a default database that was written to directly,
+// such as by replication.
+//
+// The documents of closed databases are deleted straight from their caches,
+// Sync applies writes rather than making them.
+func (m *Manager) Sync() error {
+	m.syncing.Lock()
+	defer m.syncing.Unlock()
+
+	recorded := map[string]bool{}
+	for _, doc := range m.system.Filter(DatabasesCollection, cache.Query{}) {
+		name, _ := Metadata(doc)
+		recorded[name] = true
+
+		m.mx.RLock()
+		_, ok := m.databases[name]
+		m.mx.RUnlock()
+		if ok {
+			continue
+		}
+
+		if err := m.load(doc); err != nil {
+			return err
+		}
+	}
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	for name, d := range m.databases {
+		if recorded[name] {
+			continue
+		}
+
+		for _, doc := range d.Documents() {
+			if err := d.Cache.Delete(doc.ID.String()); err != nil {
+				return err
+			}
+		}
+
+		// the queue writes the deletes to storage and stops
+		d.stop()
+
+		delete(m.databases, name)
+		delete(m.info, name)
+		m.dropped = append(m.dropped, d)
+	}
+
+	return nil
+}
+
+// load opens the database recorded in doc and loads its documents from
+// storage.
+func (m *Manager) load(doc *document.Document) error {
+	name, key := Metadata(doc)
+
+	d, store, err := m.open(name, key)
+	if err != nil {
+		return err
+	}
+
+	if err := d.Load(store, m.loadOptions...); err != nil {
+		d.stop()
+		return err
+	}
+
+	m.mx.Lock()
+	m.databases[name] = d
+	m.info[name] = doc
+	m.mx.Unlock()
+
+	return nil
+}
+
+// Get returns the database with the given name.
+func (m *Manager) Get(name string) (*Database, error) {
+	if name == DefaultName {
+		return m.system, nil
+	}
+
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+
+	d, ok := m.databases[name]
+	if !ok {
+		return nil, errors.New(errors.ErrDatabaseNotFound)
+	}
+
+	return d, nil
+}
+
+// List returns the info of every database, including the default database.
+func (m *Manager) List() []Info {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+
+	list := []Info{{Name: DefaultName}}
+	for name, doc := range m.info {
+		list = append(list, infoFromDocument(name, doc))
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	return list
+}
+
+// Databases returns every open database, including the default database,
+// sorted by name.
+func (m *Manager) Databases() []*Database {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+
+	list := []*Database{m.system}
+	for _, d := range m.databases {
+		list = append(list, d)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	return list
+}
+
+// Reencrypt rewrites the stale documents of every database, see
+// Database.Reencrypt. It returns the number of documents rewritten.
+func (m *Manager) Reencrypt(ctx context.Context) (int, error) {
+	total := 0
+	for _, d := range m.Databases() {
+		n, err := d.Reencrypt(ctx)
+		total += n
+		if err != nil {
+			return total, err
+		}
+
+		if n > 0 {
+			slog.InfoContext(ctx, "re-encrypted documents", "database", d.Name, "documents", n)
+		}
+	}
+
+	return total, nil
+}
+
+// Shutdown waits for the queue of every database to drain, including those
+// of databases that were dropped, the context the manager was created with
+// must be cancelled first. If ctx is done first the writes left in the
+// queues are abandoned. It returns the combined stats of the queues.
+func (m *Manager) Shutdown(ctx context.Context) (cache.Stats, error) {
+	var (
+		total    cache.Stats
+		firstErr error
+	)
+
+	for _, d := range m.queued() {
+		stats, err := d.Queue().Shutdown(ctx)
+		total = total.Add(stats)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return total, firstErr
+}
+
+// Stats returns the combined stats of the queues of every database,
+// including those of databases that were dropped.
+func (m *Manager) Stats() cache.Stats {
+	var total cache.Stats
+	for _, d := range m.queued() {
+		total = total.Add(d.Queue().Stats())
+	}
+
+	return total
+}
+
+// queued returns every database whose queue may still hold writes, the
+// open databases and those dropped since the manager was created.
+func (m *Manager) queued() []*Database {
+	databases := m.Databases()
+
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+
+	return append(databases, m.dropped...)
+}
+
+// Create creates a new database, if encryptionKey is empty the database
+// uses the encryption key of the manager's storage options.
+func (m *Manager) Create(name, encryptionKey string) (Info, error) {
+	if err := validation.ValidateDatabaseName(name); err != nil {
+		return Info{}, err
+	}
+
+	if len(encryptionKey) > 0 && len(encryptionKey) != 32 {
+		return Info{}, errors.New(errors.ErrEncryptionKeyIsInvalid)
+	}
+
+	// the key is recorded sealed, so it is never written in plaintext
+	if encryptionKey != "" {
+		kr, err := storage.Keyring(m.opts...)
+		if err != nil {
+			return Info{}, err
+		}
+
+		if encryptionKey, err = SealKey(kr, encryptionKey); err != nil {
+			return Info{}, err
+		}
+	}
+
+	m.changes.Lock()
+	defer m.changes.Unlock()
+
+	m.mx.RLock()
+	_, ok := m.databases[name]
+	m.mx.RUnlock()
+	if ok || name == DefaultName {
+		return Info{}, errors.New(errors.ErrDatabaseAlreadyExists)
+	}
+
+	doc := document.New().SetCollection(DatabasesCollection).SetData(map[string]interface{}{
+		"name":           name,
+		"prefix":         prefixFor(name),
+		"encryption_key": encryptionKey,
+	})
+	if err := m.system.Put(doc, false); err != nil {
+		return Info{}, err
+	}
+
+	// opens the database now it is recorded
+	if err := m.Sync(); err != nil {
+		return Info{}, err
+	}
+
+	return infoFromDocument(name, doc), nil
+}
+
+// Drop deletes a database and all of its documents.
+func (m *Manager) Drop(name string) error {
+	m.changes.Lock()
+	defer m.changes.Unlock()
+
+	m.mx.RLock()
+	d, ok := m.databases[name]
+	info := m.info[name]
+	m.mx.RUnlock()
+	if !ok {
+		return errors.New(errors.ErrDatabaseNotFound)
+	}
+
+	for _, doc := range d.Documents() {
+		if err := d.Delete(doc.ID.String()); err != nil {
+			return err
+		}
+	}
+
+	if err := m.system.Delete(info.ID.String()); err != nil {
+		return err
+	}
+
+	// closes the database now it is no longer recorded
+	return m.Sync()
+}
+
+// Metadata returns the name and encryption key of a database recorded in a
+// document of the DatabasesCollection. The key is returned as it is
+// recorded, sealed unless it was recorded by an earlier version, OpenStorage
+// opens it.
+func Metadata(doc *document.Document) (name, encryptionKey string) {
+	name, _ = doc.Data["name"].(string)
+	encryptionKey, _ = doc.Data["encryption_key"].(string)
+	return name, encryptionKey
+}
+
+// OpenStorage returns the storage of the named database, scoped to its prefix
+// and encrypted with the keyring of opts. Documents of a database with its
+// own key are sealed with it, the keys of the keyring are kept to read and
+// re-encrypt documents sealed with them. A sealed key is opened with the
+// keyring of opts. The storage of the default database is not scoped.
+func OpenStorage(driver storage.Driver, name, encryptionKey string, opts ...storage.Option) (storage.Storage, error) {
+	if name == DefaultName {
+		return storage.New(driver, opts...)
+	}
+
+	if IsSealedKey(encryptionKey) {
+		kr, err := storage.Keyring(opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		if encryptionKey, err = OpenKey(kr, encryptionKey); err != nil {
+			return nil, fmt.Errorf("encryption key of database %s: %w", name, err)
+		}
+	}
+
+	opts = append(append([]storage.Option{}, opts...), storage.WithPrefix(prefixFor(name)))
+	if encryptionKey != "" {
+		opts = append(opts, storage.WithDatabaseKey([]byte(encryptionKey)))
+	}
+
+	return storage.New(driver, opts...)
+}
+
+// SealKey seals the encryption key of a database with kr, so it can be
+// recorded in the DatabasesCollection. It returns ErrEncryptionKeyUnprotected
+// if kr is nil.
+func SealKey(kr *keyring.Keyring, encryptionKey string) (string, error) {
+	if kr == nil {
+		return "", errors.New(errors.ErrEncryptionKeyUnprotected)
+	}
+
+	sealed, err := kr.Seal([]byte(encryptionKey))
+	if err != nil {
+		return "", err
+	}
+
+	return sealedKeyPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// OpenKey opens an encryption key sealed by SealKey with kr, keys recorded in
+// plaintext by earlier versions are returned as they are.
+func OpenKey(kr *keyring.Keyring, encryptionKey string) (string, error) {
+	if !IsSealedKey(encryptionKey) {
+		return encryptionKey, nil
+	}
+
+	if kr == nil {
+		return "", fmt.Errorf("%w: the key is sealed and there is no keyring to open it", keyring.ErrUnknownKey)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(encryptionKey, sealedKeyPrefix))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", keyring.ErrMalformed, err)
+	}
+
+	key, _, err := kr.Open(sealed)
+	if err != nil {
+		return "", err
+	}
+
+	return string(key), nil
+}
+
+// IsSealedKey reports whether the encryption key of a database is sealed,
+// see SealKey.
+func IsSealedKey(encryptionKey string) bool {
+	return strings.HasPrefix(encryptionKey, sealedKeyPrefix)
+}
+
+// open creates the storage and cache of a database, it does not load
+// any documents.
+func (m *Manager) open(name, encryptionKey string) (*Database, storage.Storage, error) {
+	store, err := OpenStorage(m.driver, name, encryptionKey, m.opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	queue := cache.NewQueue(store)
+	queue.Use(m.queueMiddleware...)
+	if m.queueObserver != nil {
+		queue.Observe(m.queueObserver(name))
+	}
+
+	// each queue stops with the manager, or when its database is dropped
+	ctx, stop := context.WithCancel(m.ctx)
+
+	return &Database{
+		Cache:     cache.NewCache(ctx, queue),
+		Name:      name,
+		committer: m.committer,
+		stop:      stop,
+	}, store, nil
+}
+
+// WithQueueMiddleware wraps the queues of the databases opened by the manager
+// in the given middleware, the default database's queue is left untouched.
+func (m *Manager) WithQueueMiddleware(mw ...cache.Middleware) *Manager {
+	m.queueMiddleware = append(m.queueMiddleware, mw...)
+	return m
+}
+
+// WithQueueObserver notifies the observer fn returns for each database
+// opened by the manager of the events pushed to its queue, the default
+// database's queue is left untouched.
+func (m *Manager) WithQueueObserver(fn func(name string) cache.Observer) *Manager {
+	m.queueObserver = fn
+	return m
+}
+
+// WithCommitter commits the writes made to every database, including the
+// default database, with c before they are applied, see Committer. It must
+// be set before any database is opened.
+func (m *Manager) WithCommitter(c Committer) *Manager {
+	m.committer = c
+	m.system.committer = c
+	return m
+}
+
+// WithLoadOptions sets the options the databases recorded in the default
+// database are loaded with by Load.
+func (m *Manager) WithLoadOptions(opts ...LoadOption) *Manager {
+	m.loadOptions = append(m.loadOptions, opts...)
+	return m
+}
+
+// prefixFor returns the storage prefix of a database.
+func prefixFor(name string) string {
+	return "_db/" + name + "/"
+}
+
+// infoFromDocument returns the info of a database from its metadata document.
+func infoFromDocument(name string, doc *document.Document) Info {
+	key, _ := doc.Data["encryption_key"].(string)
+
+	return Info{
+		Name:      name,
+		Prefix:    prefixFor(name),
+		Encrypted: key != "",
+	}
+}
+
+// NewManager returns a new manager, the system database is served as the
+// default database and holds the metadata of all other databases. The storage
+// options are applied to the storage of every database.
+func NewManager(ctx context.Context, driver storage.Driver, system *Database, opts ...storage.Option) *Manager {
+	if system.Name == "" {
+		system.Name = DefaultName
+	}
+
+	return &Manager{
+		ctx:       ctx,
+		driver:    driver,
+		opts:      opts,
+		system:    system,
+		databases: make(map[string]*Database),
+		info:      make(map[string]*document.Document),
+	}
+}
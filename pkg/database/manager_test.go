@@ -0,0 +1,216 @@
+package database_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/errors"
+	"github.com/nexdb/nexdb/pkg/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager_Create(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		database      string
+		encryptionKey string
+		// unprotected creates the manager without a server key
+		unprotected bool
+		before      func(m *database.Manager)
+		verify      func(t *testing.T, m *database.Manager, info database.Info, err error)
+	}{
+		{
+			name:     "valid, database should be retrievable by name",
+			database: "acme",
+			before:   func(m *database.Manager) {},
+			verify: func(t *testing.T, m *database.Manager, info database.Info, err error) {
+				require.NoError(t, err)
+				assert.Equal(t, "acme", info.Name)
+				assert.Equal(t, "_db/acme/", info.Prefix)
+				assert.False(t, info.Encrypted)
+
+				d, err := m.Get("acme")
+				require.NoError(t, err)
+				assert.Equal(t, "acme", d.Name)
+			},
+		},
+		{
+			name:          "with encryption key, database should be reported as encrypted",
+			database:      "acme",
+			encryptionKey: "key-that-is-thirty-2-bytes-long!",
+			before:        func(m *database.Manager) {},
+			verify: func(t *testing.T, m *database.Manager, info database.Info, err error) {
+				require.NoError(t, err)
+				assert.True(t, info.Encrypted)
+
+				// the key is recorded sealed with the server key
+				def, err := m.Get(database.DefaultName)
+				require.NoError(t, err)
+				docs := def.Filter(database.DatabasesCollection, cache.Query{})
+				require.Len(t, docs, 1)
+				_, recorded := database.Metadata(docs[0])
+				assert.True(t, database.IsSealedKey(recorded))
+				assert.NotContains(t, recorded, "key-that-is-thirty-2-bytes-long!")
+
+				kr, err := storage.Keyring(storage.WithEncryptionKey([]byte(serverKey)))
+				require.NoError(t, err)
+				key, err := database.OpenKey(kr, recorded)
+				require.NoError(t, err)
+				assert.Equal(t, "key-that-is-thirty-2-bytes-long!", key)
+			},
+		},
+		{
+			name:          "with encryption key and no server key, expect ErrEncryptionKeyUnprotected to be returned",
+			database:      "acme",
+			encryptionKey: "key-that-is-thirty-2-bytes-long!",
+			unprotected:   true,
+			before:        func(m *database.Manager) {},
+			verify: func(t *testing.T, m *database.Manager, info database.Info, err error) {
+				require.Equal(t, errors.New(errors.ErrEncryptionKeyUnprotected).Error(), err.Error())
+			},
+		},
+		{
+			name:          "with short encryption key, expect ErrEncryptionKeyIsInvalid to be returned",
+			database:      "acme",
+			encryptionKey: "short",
+			before:        func(m *database.Manager) {},
+			verify: func(t *testing.T, m *database.Manager, info database.Info, err error) {
+				require.Equal(t, errors.New(errors.ErrEncryptionKeyIsInvalid).Error(), err.Error())
+			},
+		},
+		{
+			name:     "invalid name, expect ErrDatabaseNameIsInvalid to be returned",
+			database: "Acme",
+			before:   func(m *database.Manager) {},
+			verify: func(t *testing.T, m *database.Manager, info database.Info, err error) {
+				require.Equal(t, errors.New(errors.ErrDatabaseNameIsInvalid).Error(), err.Error())
+			},
+		},
+		{
+			name:     "default name, expect ErrDatabaseAlreadyExists to be returned",
+			database: database.DefaultName,
+			before:   func(m *database.Manager) {},
+			verify: func(t *testing.T, m *database.Manager, info database.Info, err error) {
+				require.Equal(t, errors.New(errors.ErrDatabaseAlreadyExists).Error(), err.Error())
+			},
+		},
+		{
+			name:     "existing name, expect ErrDatabaseAlreadyExists to be returned",
+			database: "acme",
+			before: func(m *database.Manager) {
+				m.Create("acme", "")
+			},
+			verify: func(t *testing.T, m *database.Manager, info database.Info, err error) {
+				require.Equal(t, errors.New(errors.ErrDatabaseAlreadyExists).Error(), err.Error())
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			opts := []storage.Option{storage.WithEncryptionKey([]byte(serverKey))}
+			if tc.unprotected {
+				opts = nil
+			}
+
+			m := newManager(t, ctx, opts...)
+			tc.before(m)
+
+			info, err := m.Create(tc.database, tc.encryptionKey)
+			tc.verify(t, m, info, err)
+		})
+	}
+}
+
+func TestManager_PartitionsDocuments(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newManager(t, ctx)
+
+	_, err := m.Create("acme", "")
+	require.NoError(t, err)
+
+	acme, err := m.Get("acme")
+	require.NoError(t, err)
+
+	def, err := m.Get(database.DefaultName)
+	require.NoError(t, err)
+
+	doc := document.New().SetCollection("users")
+	require.NoError(t, acme.Put(doc, false))
+
+	assert.Len(t, acme.Filter("users", cache.Query{}), 1)
+	assert.Empty(t, def.Filter("users", cache.Query{}))
+}
+
+func TestManager_Load(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newManager(t, ctx)
+
+	_, err := m.Create("acme", "")
+	require.NoError(t, err)
+
+	// a second manager sharing the default database should re-open acme
+	def, err := m.Get(database.DefaultName)
+	require.NoError(t, err)
+
+	reopened := database.NewManager(ctx, storage.MemoryDriver, def)
+	require.NoError(t, reopened.Load())
+
+	_, err = reopened.Get("acme")
+	require.NoError(t, err)
+	assert.Len(t, reopened.List(), 2)
+}
+
+func TestManager_Drop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newManager(t, ctx)
+
+	_, err := m.Create("acme", "")
+	require.NoError(t, err)
+
+	acme, err := m.Get("acme")
+	require.NoError(t, err)
+	require.NoError(t, acme.Put(document.New().SetCollection("users"), false))
+
+	require.NoError(t, m.Drop("acme"))
+
+	// the queue of the dropped database is stopped once it has written the
+	// delete
+	stats := acme.Queue().WaitForShutdown()
+	assert.Equal(t, 2, stats.Flushed)
+
+	_, err = m.Get("acme")
+	require.Equal(t, errors.New(errors.ErrDatabaseNotFound).Error(), err.Error())
+	assert.Len(t, m.List(), 1)
+
+	err = m.Drop("acme")
+	require.Equal(t, errors.New(errors.ErrDatabaseNotFound).Error(), err.Error())
+}
+
+// serverKey is the key the storage of the server is encrypted with, it seals
+// the keys of the databases.
+const serverKey = "server-key-is-thirty-2-bytes-ok!"
+
+func newManager(t *testing.T, ctx context.Context, opts ...storage.Option) *database.Manager {
+	s, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	d := &database.Database{
+		Cache: cache.NewCache(ctx, cache.NewQueue(s)),
+	}
+
+	return database.NewManager(ctx, storage.MemoryDriver, d, opts...)
+}
@@ -0,0 +1,22 @@
+package validation
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/nexdb/nexdb/pkg/errors"
+)
+
+// ValidateDatabaseName validates the database name.
+func ValidateDatabaseName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New(errors.ErrDatabaseNameIsEmpty)
+	}
+
+	databaseNameRegex := regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+	if !databaseNameRegex.MatchString(name) {
+		return errors.New(errors.ErrDatabaseNameIsInvalid)
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package document
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is an algorithm documents are compressed with before they are
+// encrypted.
+type Compression string
+
+const (
+	// CompressionNone stores documents uncompressed.
+	CompressionNone Compression = ""
+	// CompressionGzip compresses documents with gzip.
+	CompressionGzip Compression = "gzip"
+	// CompressionZstd compresses documents with Zstandard, it compresses
+	// best for the time it takes.
+	CompressionZstd Compression = "zstd"
+	// CompressionSnappy compresses documents with Snappy, the fastest of the
+	// three but the least compact.
+	CompressionSnappy Compression = "snappy"
+)
+
+// maxDecompressedSize is the largest a compressed document may decompress
+// to, a document claiming more is invalid rather than allocated.
+const maxDecompressedSize = 64 << 20
+
+var (
+	// ErrUnknownCompression is returned when a compression is not recognised.
+	ErrUnknownCompression = errors.New("unknown compression")
+	// ErrCompressionInvalid is returned when a compressed document can't be
+	// decompressed.
+	ErrCompressionInvalid = errors.New("compressed document is invalid")
+)
+
+// compressedMagic prefixes compressed documents, it is followed by the
+// version of the header and the algorithm. Uncompressed documents start
+// with the JSON of the document so the two can't be mistaken.
+const (
+	compressedMagic   = "NXZ"
+	compressedVersion = 1
+	compressedHeader  = len(compressedMagic) + 2
+)
+
+// compressionIDs are the identifiers of the algorithms in the header, they
+// must never change.
+var compressionIDs = map[Compression]byte{
+	CompressionGzip:   1,
+	CompressionZstd:   2,
+	CompressionSnappy: 3,
+}
+
+// ParseCompression returns the compression named s, "none" and the empty
+// string are CompressionNone.
+func ParseCompression(s string) (Compression, error) {
+	if s == "none" {
+		return CompressionNone, nil
+	}
+
+	c := Compression(s)
+	if _, ok := compressionIDs[c]; !ok && c != CompressionNone {
+		return CompressionNone, fmt.Errorf("%w: %q", ErrUnknownCompression, s)
+	}
+
+	return c, nil
+}
+
+// zstd encoders and decoders are safe for concurrent use of EncodeAll and
+// DecodeAll, they are created on first use.
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+		return zstd.NewWriter(nil)
+	})
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+		return zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxDecompressedSize))
+	})
+)
+
+// compress returns b compressed with c behind the compressed header. b is
+// returned as it is if c is CompressionNone or compressing doesn't make it
+// any smaller.
+func compress(c Compression, b []byte) ([]byte, error) {
+	if c == CompressionNone {
+		return b, nil
+	}
+
+	id, ok := compressionIDs[c]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCompression, c)
+	}
+
+	out := append([]byte(compressedMagic), compressedVersion, id)
+	switch c {
+	case CompressionGzip:
+		buf := bytes.NewBuffer(out)
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		out = buf.Bytes()
+	case CompressionZstd:
+		enc, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		out = enc.EncodeAll(b, out)
+	case CompressionSnappy:
+		out = append(out, snappy.Encode(nil, b)...)
+	}
+
+	if len(out) >= len(b) {
+		return b, nil
+	}
+
+	return out, nil
+}
+
+// isCompressed returns whether b has the compressed header.
+func isCompressed(b []byte) bool {
+	return len(b) >= compressedHeader && string(b[:len(compressedMagic)]) == compressedMagic
+}
+
+// decompress returns b decompressed, b is returned as it is if it isn't
+// compressed.
+func decompress(b []byte) ([]byte, error) {
+	if !isCompressed(b) {
+		return b, nil
+	}
+
+	if b[len(compressedMagic)] != compressedVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrCompressionInvalid, b[len(compressedMagic)])
+	}
+
+	id, payload := b[len(compressedMagic)+1], b[compressedHeader:]
+	switch id {
+	case compressionIDs[CompressionGzip]:
+		r, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCompressionInvalid, err)
+		}
+		defer r.Close()
+
+		out, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCompressionInvalid, err)
+		}
+		if len(out) > maxDecompressedSize {
+			return nil, fmt.Errorf("%w: larger than %d bytes", ErrCompressionInvalid, maxDecompressedSize)
+		}
+		return out, nil
+	case compressionIDs[CompressionZstd]:
+		dec, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+
+		out, err := dec.DecodeAll(payload, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCompressionInvalid, err)
+		}
+		return out, nil
+	case compressionIDs[CompressionSnappy]:
+		n, err := snappy.DecodedLen(payload)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCompressionInvalid, err)
+		}
+		if n > maxDecompressedSize {
+			return nil, fmt.Errorf("%w: larger than %d bytes", ErrCompressionInvalid, maxDecompressedSize)
+		}
+
+		out, err := snappy.Decode(nil, payload)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCompressionInvalid, err)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown algorithm %d", ErrCompressionInvalid, id)
+	}
+}
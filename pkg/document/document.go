@@ -1,11 +1,10 @@
 package document
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
 	"encoding/json"
-	"io"
+	"errors"
+
+	"github.com/nexdb/nexdb/pkg/keyring"
 
 	"github.com/oklog/ulid/v2"
 )
@@ -15,8 +14,20 @@ type Document struct {
 	ID         ulid.ULID              `json:"_id"`
 	Collection string                 `json:"collection"`
 	Data       map[string]interface{} `json:"data"`
+
+	// Stale is set on documents read from storage that are not sealed with
+	// the primary key, they are re-encrypted in the background.
+	Stale bool `json:"-"`
 }
 
+// ErrKeyringRequired is returned when reading an encrypted document without
+// a keyring.
+var ErrKeyringRequired = errors.New("document is encrypted but no encryption key is set")
+
+// ErrPlaintextNotAllowed is returned when reading a document that is not
+// encrypted with a keyring that doesn't allow plaintext.
+var ErrPlaintextNotAllowed = errors.New("document is not encrypted, plaintext documents are only read while storage is re-encrypted")
+
 // SetID sets the ID of the document. Should only be used for testing.
 func (d *Document) SetID(id string) *Document {
 	d.ID = ulid.MustParse(id)
@@ -42,70 +53,145 @@ func (d *Document) SetData(data map[string]interface{}) *Document {
 	return d
 }
 
-// ToStorage returns the document as a byte slice that can be stored in a database,
-// if an encryption key is provided, the document will be encrypted.
-func (d *Document) ToStorage(encryptionKey []byte) ([]byte, error) {
-	b, err := json.Marshal(&d)
-	if err != nil {
-		return nil, err
+// Clone returns a deep copy of the document, its data shares no maps or
+// slices with the original.
+func (d *Document) Clone() *Document {
+	c := *d
+	if d.Data != nil {
+		c.Data = cloneValue(d.Data).(map[string]interface{})
 	}
 
-	if len(encryptionKey) > 0 {
-		block, err := aes.NewCipher(encryptionKey)
-		if err != nil {
-			return nil, err
-		}
+	return &c
+}
 
-		gcm, err := cipher.NewGCM(block)
-		if err != nil {
-			return nil, err
+// cloneValue returns a deep copy of a decoded value.
+func cloneValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = cloneValue(e)
 		}
-
-		nonce := make([]byte, gcm.NonceSize())
-		if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-			return nil, err
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, e := range v {
+			s[i] = cloneValue(e)
 		}
+		return s
+	default:
+		return v
+	}
+}
 
-		return gcm.Seal(nonce, nonce, b, nil), nil
+// Option is a function that modifies how ToStorage encodes a document.
+type Option func(*encoding)
+
+// encoding are the settings ToStorage encodes a document with.
+type encoding struct {
+	format      Format
+	compression Compression
+}
+
+// WithFormat sets the format the document is serialised with, FormatJSON
+// if it isn't set.
+func WithFormat(f Format) Option {
+	return func(e *encoding) {
+		e.format = f
+	}
+}
+
+// WithCompression sets the compression the document is compressed with
+// before it is sealed.
+func WithCompression(c Compression) Option {
+	return func(e *encoding) {
+		e.compression = c
+	}
+}
+
+// ToStorage returns the document as a byte slice that can be stored in a database,
+// if a keyring is provided, the document will be sealed with its primary key.
+func (d *Document) ToStorage(kr *keyring.Keyring, opts ...Option) ([]byte, error) {
+	e := &encoding{}
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	b, err := d.marshal(e.format)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err = compress(e.compression, b)
+	if err != nil {
+		return nil, err
+	}
+
+	if kr != nil {
+		return kr.Seal(b)
 	}
 
 	return b, nil
 }
 
 // FromStorage returns a document from a byte slice that was stored in a database,
-// if an encryption key is provided, the document will be decrypted.
-func FromStorage(b []byte, encryptionKey []byte) (*Document, error) {
-	if len(encryptionKey) > 0 {
-		block, err := aes.NewCipher(encryptionKey)
-		if err != nil {
-			return nil, err
+// if a keyring is provided, the document will be decrypted. Documents that are
+// not sealed with the primary key of the keyring are marked as stale. Compressed
+// documents are decompressed whatever they were compressed with, and the format
+// documents are serialised with is detected.
+//
+// Documents written before the storage was encrypted are only read if the
+// keyring allows plaintext, see keyring.Keyring.WithPlaintext, otherwise
+// ErrPlaintextNotAllowed is returned.
+func FromStorage(b []byte, kr *keyring.Keyring) (*Document, error) {
+	if kr == nil {
+		if keyring.IsSealed(b) {
+			return nil, ErrKeyringRequired
 		}
 
-		gcm, err := cipher.NewGCM(block)
-		if err != nil {
-			return nil, err
-		}
+		return decode(b)
+	}
 
-		nonceSize := gcm.NonceSize()
-		if len(b) < nonceSize {
-			return nil, err
+	// written before the storage was encrypted, payloads encrypted before
+	// keys were identified may look like plaintext so they are opened if
+	// they can't be decoded
+	plain := !keyring.IsSealed(b) && (isCompressed(b) || isBinary(b) || json.Valid(b))
+	if plain && kr.AllowsPlaintext() {
+		if d, err := decode(b); err == nil {
+			d.Stale = true
+			return d, nil
 		}
+	}
 
-		nonce, ciphertext := b[:nonceSize], b[nonceSize:]
-		b, err = gcm.Open(nil, nonce, ciphertext, nil)
-		if err != nil {
-			return nil, err
+	plaintext, keyID, err := kr.Open(b)
+	if err != nil {
+		if plain && !kr.AllowsPlaintext() {
+			return nil, ErrPlaintextNotAllowed
 		}
+
+		return nil, err
 	}
 
-	d := &Document{}
-	if err := json.Unmarshal(b, d); err != nil {
+	d, err := decode(plaintext)
+	if err != nil {
 		return nil, err
 	}
+	// payloads encrypted before keys were identified open without a key id
+	d.Stale = keyID != kr.Primary()
 
 	return d, nil
 }
 
+// decode decompresses and unmarshals a document that is not encrypted.
+func decode(b []byte) (*Document, error) {
+	b, err := decompress(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshal(b)
+}
+
 // New returns a new document.
 func New() *Document {
 	return &Document{
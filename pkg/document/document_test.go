@@ -1,11 +1,18 @@
 package document_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/keyring"
 
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -75,6 +82,25 @@ func TestDocument_SetData(t *testing.T) {
 	}
 }
 
+func TestDocument_Clone(t *testing.T) {
+	d := document.New().SetCollection("users").SetData(map[string]interface{}{
+		"name":    "ada",
+		"address": map[string]interface{}{"city": "London"},
+		"tags":    []interface{}{"admin", map[string]interface{}{"level": 1.0}},
+	})
+
+	c := d.Clone()
+	assert.Equal(t, d, c)
+
+	// changes to the clone are not seen by the original
+	c.Data["name"] = "grace"
+	c.Data["address"].(map[string]interface{})["city"] = "Paris"
+	c.Data["tags"].([]interface{})[1].(map[string]interface{})["level"] = 2.0
+	assert.Equal(t, "ada", d.Data["name"])
+	assert.Equal(t, "London", d.Data["address"].(map[string]interface{})["city"])
+	assert.Equal(t, 1.0, d.Data["tags"].([]interface{})[1].(map[string]interface{})["level"])
+}
+
 func TestDocument_ToStorage(t *testing.T) {
 	for _, tc := range []struct {
 		name          string
@@ -113,7 +139,9 @@ func TestDocument_ToStorage(t *testing.T) {
 				require.Error(t, err)
 
 				// decode
-				got, err = document.FromStorage(b, []byte("key-that-is-thirty-2-bytes-long!"))
+				kr, err := keyring.FromKey([]byte("key-that-is-thirty-2-bytes-long!"))
+				require.NoError(t, err)
+				got, err = document.FromStorage(b, kr)
 				require.NoError(t, err)
 				assert.Equal(t, d, got)
 			},
@@ -121,8 +149,270 @@ func TestDocument_ToStorage(t *testing.T) {
 	} {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
-			b, err := tc.doc.ToStorage(tc.encryptionKey)
+			kr, err := keyring.FromKey(tc.encryptionKey)
+			require.NoError(t, err)
+
+			b, err := tc.doc.ToStorage(kr)
 			tc.verify(t, tc.doc, b, err)
 		})
 	}
 }
+
+func TestDocument_ToStorage_Compression(t *testing.T) {
+	kr, err := keyring.FromKey([]byte("key-that-is-thirty-2-bytes-long!"))
+	require.NoError(t, err)
+
+	big := document.New().SetCollection("test").SetData(map[string]interface{}{
+		"text": strings.Repeat("compress me ", 100),
+	})
+
+	for _, tc := range []struct {
+		name        string
+		doc         *document.Document
+		compression document.Compression
+		keyring     *keyring.Keyring
+		wantErr     error
+		verify      func(t *testing.T, b []byte)
+	}{
+		{
+			name:        "gzip: should be smaller than json",
+			doc:         big,
+			compression: document.CompressionGzip,
+		},
+		{
+			name:        "zstd: should be smaller than json",
+			doc:         big,
+			compression: document.CompressionZstd,
+		},
+		{
+			name:        "snappy: should be smaller than json",
+			doc:         big,
+			compression: document.CompressionSnappy,
+		},
+		{
+			name:        "zstd and encryption key: should decrypt and decompress",
+			doc:         big,
+			compression: document.CompressionZstd,
+			keyring:     kr,
+		},
+		{
+			name:        "small document: should be stored as json",
+			doc:         document.New().SetCollection("test"),
+			compression: document.CompressionGzip,
+			verify: func(t *testing.T, b []byte) {
+				assert.True(t, json.Valid(b))
+			},
+		},
+		{
+			name:        "unknown compression: should return ErrUnknownCompression",
+			doc:         big,
+			compression: "lz4",
+			wantErr:     document.ErrUnknownCompression,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := tc.doc.ToStorage(tc.keyring, document.WithCompression(tc.compression))
+			if tc.wantErr != nil {
+				require.ErrorIs(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			if tc.verify != nil {
+				tc.verify(t, b)
+			} else {
+				plain, err := tc.doc.ToStorage(nil)
+				require.NoError(t, err)
+				assert.Less(t, len(b), len(plain))
+			}
+
+			got, err := document.FromStorage(b, tc.keyring)
+			require.NoError(t, err)
+			assert.Equal(t, tc.doc, got)
+		})
+	}
+}
+
+func TestDocument_FromStorage_Compression(t *testing.T) {
+	kr, err := keyring.FromKey([]byte("key-that-is-thirty-2-bytes-long!"))
+	require.NoError(t, err)
+
+	doc := document.New().SetCollection("test").SetData(map[string]interface{}{
+		"text": strings.Repeat("compress me ", 100),
+	})
+	b, err := doc.ToStorage(nil, document.WithCompression(document.CompressionSnappy))
+	require.NoError(t, err)
+
+	// compressed before the storage was encrypted, read while it is
+	// re-encrypted
+	got, err := document.FromStorage(b, kr.WithPlaintext())
+	require.NoError(t, err)
+	assert.True(t, got.Stale)
+	assert.Equal(t, doc.Data, got.Data)
+
+	// plaintext is refused once storage is expected to be encrypted
+	_, err = document.FromStorage(b, kr)
+	require.ErrorIs(t, err, document.ErrPlaintextNotAllowed)
+
+	// truncated payload
+	_, err = document.FromStorage(b[:len(b)/2], nil)
+	require.ErrorIs(t, err, document.ErrCompressionInvalid)
+}
+
+func TestDocument_FromStorage_DecompressionBomb(t *testing.T) {
+	// zeros compress to almost nothing but decompress past the limit
+	zeros := make([]byte, 65<<20)
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	_, err := w.Write(zeros)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	enc, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name    string
+		id      byte
+		payload []byte
+	}{
+		{name: "gzip", id: 1, payload: gz.Bytes()},
+		{name: "zstd", id: 2, payload: enc.EncodeAll(zeros, nil)},
+		{name: "snappy", id: 3, payload: snappy.Encode(nil, zeros)},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			b := append([]byte("NXZ\x01"), tc.id)
+			_, err := document.FromStorage(append(b, tc.payload...), nil)
+			require.ErrorIs(t, err, document.ErrCompressionInvalid)
+		})
+	}
+}
+
+func TestDocument_ToStorage_Format(t *testing.T) {
+	kr, err := keyring.FromKey([]byte("key-that-is-thirty-2-bytes-long!"))
+	require.NoError(t, err)
+
+	doc := document.New().SetCollection("test").SetData(map[string]interface{}{
+		"count":  int64(9007199254740993),
+		"ratio":  0.5,
+		"name":   "ada",
+		"blob":   []byte{0x00, 0xff},
+		"tags":   []interface{}{"a", int64(-1)},
+		"nested": map[string]interface{}{"n": int64(42)},
+		"none":   nil,
+	})
+
+	for _, tc := range []struct {
+		name    string
+		opts    []document.Option
+		doc     *document.Document
+		keyring *keyring.Keyring
+		verify  func(t *testing.T, got *document.Document)
+	}{
+		{
+			name: "cbor: should round trip integers and binary exactly",
+			opts: []document.Option{document.WithFormat(document.FormatCBOR)},
+			verify: func(t *testing.T, got *document.Document) {
+				assert.Equal(t, doc, got)
+			},
+		},
+		{
+			name:    "cbor with compression and encryption key: should round trip exactly",
+			opts:    []document.Option{document.WithFormat(document.FormatCBOR), document.WithCompression(document.CompressionSnappy)},
+			keyring: kr,
+			verify: func(t *testing.T, got *document.Document) {
+				assert.Equal(t, doc, got)
+			},
+		},
+		{
+			name: "cbor with json numbers: should read integers back as int64",
+			opts: []document.Option{document.WithFormat(document.FormatCBOR)},
+			doc: document.New().SetCollection("test").SetData(map[string]interface{}{
+				"count":  json.Number("9007199254740993"),
+				"ratio":  json.Number("0.5"),
+				"nested": map[string]interface{}{"tags": []interface{}{json.Number("-1")}},
+			}),
+			verify: func(t *testing.T, got *document.Document) {
+				assert.Equal(t, int64(9007199254740993), got.Data["count"])
+				assert.Equal(t, 0.5, got.Data["ratio"])
+				assert.Equal(t, map[string]interface{}{"tags": []interface{}{int64(-1)}}, got.Data["nested"])
+			},
+		},
+		{
+			name: "json: should read integers back as float64",
+			opts: []document.Option{document.WithFormat(document.FormatJSON)},
+			verify: func(t *testing.T, got *document.Document) {
+				assert.Equal(t, float64(9007199254740992), got.Data["count"])
+				assert.Equal(t, "AP8=", got.Data["blob"])
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			in := doc
+			if tc.doc != nil {
+				in = tc.doc
+			}
+
+			b, err := in.ToStorage(tc.keyring, tc.opts...)
+			require.NoError(t, err)
+
+			got, err := document.FromStorage(b, tc.keyring)
+			require.NoError(t, err)
+			tc.verify(t, got)
+		})
+	}
+}
+
+func TestDocument_FromStorage_Format(t *testing.T) {
+	b, err := document.New().ToStorage(nil, document.WithFormat(document.FormatCBOR))
+	require.NoError(t, err)
+
+	// truncated payload
+	_, err = document.FromStorage(b[:len(b)-2], nil)
+	require.ErrorIs(t, err, document.ErrFormatInvalid)
+
+	// unknown version
+	b[3] = 0xff
+	_, err = document.FromStorage(b, nil)
+	require.ErrorIs(t, err, document.ErrFormatInvalid)
+
+	_, err = document.New().ToStorage(nil, document.WithFormat("xml"))
+	require.ErrorIs(t, err, document.ErrUnknownFormat)
+}
+
+// BenchmarkFromStorage compares how long documents take to load from each
+// format, as they are on startup.
+func BenchmarkFromStorage(b *testing.B) {
+	items := make([]interface{}, 50)
+	for i := range items {
+		items[i] = map[string]interface{}{
+			"sku":      fmt.Sprintf("sku-%d", i),
+			"quantity": int64(i),
+			"price":    float64(i) * 1.25,
+		}
+	}
+	doc := document.New().SetCollection("orders").SetData(map[string]interface{}{
+		"customer": "ada",
+		"total":    int64(123456),
+		"items":    items,
+	})
+
+	for _, format := range []document.Format{document.FormatJSON, document.FormatCBOR} {
+		data, err := doc.ToStorage(nil, document.WithFormat(format))
+		require.NoError(b, err)
+
+		b.Run(string(format), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := document.FromStorage(data, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package document
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/oklog/ulid/v2"
+)
+
+// Format is the encoding documents are serialised with in storage.
+type Format string
+
+const (
+	// FormatJSON serialises documents as JSON, numbers are read back as
+	// float64 and binary values as base64 strings.
+	FormatJSON Format = "json"
+	// FormatCBOR serialises documents as CBOR, integers are read back as
+	// int64 and binary values as []byte.
+	FormatCBOR Format = "cbor"
+)
+
+var (
+	// ErrUnknownFormat is returned when a format is not recognised.
+	ErrUnknownFormat = errors.New("unknown format")
+	// ErrFormatInvalid is returned when a document can't be decoded from
+	// its binary format.
+	ErrFormatInvalid = errors.New("binary document is invalid")
+)
+
+// binaryMagic prefixes documents in a binary format, it is followed by the
+// version of the header, which identifies the format. JSON documents start
+// with '{' so the two can't be mistaken.
+const (
+	binaryMagic  = "NXB"
+	binaryCBOR   = 1
+	binaryHeader = len(binaryMagic) + 1
+)
+
+// ParseFormat returns the format named s, the empty string is FormatJSON.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case "", FormatJSON:
+		return FormatJSON, nil
+	case FormatCBOR:
+		return f, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnknownFormat, s)
+	}
+}
+
+// binaryDocument is the layout of a document in a binary format, the fields
+// are stored as an array in this order.
+type binaryDocument struct {
+	_          struct{} `cbor:",toarray"`
+	ID         []byte
+	Collection string
+	Data       map[string]interface{}
+}
+
+// cborMode are the modes documents are encoded and decoded with.
+type cborMode struct {
+	enc cbor.EncMode
+	dec cbor.DecMode
+}
+
+// cborModes returns the modes documents are encoded and decoded with, they
+// are created on first use. Integers are always decoded as int64 and maps as
+// map[string]interface{}, as Go code writes them.
+var cborModes = sync.OnceValues(func() (cborMode, error) {
+	enc, err := cbor.EncOptions{}.EncMode()
+	if err != nil {
+		return cborMode{}, err
+	}
+
+	dec, err := cbor.DecOptions{
+		DefaultMapType:   reflect.TypeOf(map[string]interface{}{}),
+		IntDec:           cbor.IntDecConvertSigned,
+		MaxNestedLevels:  1024,
+		MaxArrayElements: math.MaxInt32,
+		MaxMapPairs:      math.MaxInt32,
+	}.DecMode()
+	if err != nil {
+		return cborMode{}, err
+	}
+
+	return cborMode{enc: enc, dec: dec}, nil
+})
+
+// marshal returns the document serialised in format f.
+func (d *Document) marshal(f Format) ([]byte, error) {
+	switch f {
+	case "", FormatJSON:
+		return json.Marshal(d)
+	case FormatCBOR:
+		modes, err := cborModes()
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := cborValue(d.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := modes.enc.Marshal(binaryDocument{
+			ID:         d.ID[:],
+			Collection: d.Collection,
+			Data:       data.(map[string]interface{}),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return append(append([]byte(binaryMagic), binaryCBOR), b...), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownFormat, f)
+	}
+}
+
+// cborValue returns a copy of v with the json.Number values of documents
+// decoded from requests converted to int64, or float64 if they aren't
+// integers, rather than encoded as strings.
+func cborValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			c, err := cborValue(e)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = c
+		}
+		return m, nil
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, e := range v {
+			c, err := cborValue(e)
+			if err != nil {
+				return nil, err
+			}
+			s[i] = c
+		}
+		return s, nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+
+		f, err := v.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("number %s: %w", v, err)
+		}
+		return f, nil
+	default:
+		return v, nil
+	}
+}
+
+// isBinary returns whether b has the binary header.
+func isBinary(b []byte) bool {
+	return len(b) >= binaryHeader && string(b[:len(binaryMagic)]) == binaryMagic
+}
+
+// unmarshal returns the document serialised in b, the format is detected
+// from its header.
+func unmarshal(b []byte) (*Document, error) {
+	d := &Document{}
+	if !isBinary(b) {
+		if err := json.Unmarshal(b, d); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+
+	if v := b[len(binaryMagic)]; v != binaryCBOR {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrFormatInvalid, v)
+	}
+
+	modes, err := cborModes()
+	if err != nil {
+		return nil, err
+	}
+
+	var bd binaryDocument
+	if err := modes.dec.Unmarshal(b[binaryHeader:], &bd); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFormatInvalid, err)
+	}
+
+	if len(bd.ID) != len(ulid.ULID{}) {
+		return nil, fmt.Errorf("%w: id is %d bytes", ErrFormatInvalid, len(bd.ID))
+	}
+
+	copy(d.ID[:], bd.ID)
+	d.Collection = bd.Collection
+	d.Data = bd.Data
+	if d.Data == nil {
+		d.Data = make(map[string]interface{})
+	}
+
+	return d, nil
+}
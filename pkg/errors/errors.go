@@ -40,10 +40,64 @@ func errorMessageFromCode(code ErrorCode) string {
 		return "collection name is empty"
 	case ErrCollectionNameIsInvalid:
 		return "collection name is invalid, must match the follow regex ^[a-z]*$"
+	case ErrDatabaseNameIsEmpty:
+		return "database name is empty"
+	case ErrDatabaseNameIsInvalid:
+		return "database name is invalid, must match the follow regex ^[a-z][a-z0-9-]*$"
+	case ErrEncryptionKeyIsInvalid:
+		return "encryption key is invalid, must be 32 bytes"
+	case ErrLogLevelIsInvalid:
+		return "log level is invalid, must be debug, info, warn or error"
+	case ErrFormatIsInvalid:
+		return "format is invalid, must be ndjson or csv"
+	case ErrIDModeIsInvalid:
+		return "id mode is invalid, must be preserve or regenerate"
+	case ErrColumnsAreInvalid:
+		return "columns are invalid, must be a comma separated list of column or column:field"
+	case ErrEncryptedFieldsAreInvalid:
+		return "encrypted fields are invalid, each must have a unique path other than _id and a mode of deterministic or randomized"
+	case ErrFieldEncryptionDisabled:
+		return "field encryption is not enabled, the server has no field encryption key"
+	case ErrFieldNotQueryable:
+		return "field is encrypted, it can only be queried with equals if it is encrypted deterministically"
+	case ErrPermissionIsInvalid:
+		return "permission is invalid, must be decrypt_fields"
+	case ErrRevisionSettingsAreInvalid:
+		return "revision settings are invalid, keep must not be negative and max_age must be a positive duration such as 720h"
+	case ErrSoftDeleteSettingsAreInvalid:
+		return "soft delete settings are invalid, retention must be a positive duration such as 720h and needs soft delete to be enabled"
+	case ErrFieldIsReserved:
+		return "field is reserved, _deleted_at can't be written"
+	case ErrMemberIsInvalid:
+		return "member is invalid, id, address and api_address are required"
+	case ErrEncryptionKeyUnprotected:
+		return "encryption key can't be protected, the server has no encryption key or keyring to seal it with"
 	case ErrUnauthorized:
 		return "unauthorized"
 	case ErrDocumentNotFound:
 		return "document not found"
+	case ErrDatabaseNotFound:
+		return "database not found"
+	case ErrAPIKeyNotFound:
+		return "api key not found"
+	case ErrRevisionNotFound:
+		return "revision not found"
+	case ErrMemberNotFound:
+		return "cluster member not found"
+	case ErrDatabaseAlreadyExists:
+		return "database already exists"
+	case ErrNotReady:
+		return "not ready, databases are still loading"
+	case ErrStorageUnreachable:
+		return "storage is unreachable"
+	case ErrNotLeader:
+		return "not the leader, writes must be sent to the leader"
+	case ErrAlreadyLeader:
+		return "already the leader, only followers can be promoted"
+	case ErrNoLeader:
+		return "no leader, the cluster can't take writes or consistent reads until one is elected"
+	case ErrStaleRead:
+		return "too stale, the server has not been up to date with the leader within the maximum staleness"
 	default:
 		return "unknown error"
 	}
@@ -55,6 +109,39 @@ const (
 	ErrCollectionNameIsEmpty ErrorCode = 1000 + iota
 	// ErrCollectionNameIsInvalid is returned when the collection name is invalid.
 	ErrCollectionNameIsInvalid
+	// ErrDatabaseNameIsEmpty is returned when the database name is empty.
+	ErrDatabaseNameIsEmpty
+	// ErrDatabaseNameIsInvalid is returned when the database name is invalid.
+	ErrDatabaseNameIsInvalid
+	// ErrEncryptionKeyIsInvalid is returned when an encryption key is not 32 bytes long.
+	ErrEncryptionKeyIsInvalid
+	// ErrLogLevelIsInvalid is returned when a log level is not recognised.
+	ErrLogLevelIsInvalid
+	// ErrFormatIsInvalid is returned when an import or export format is not recognised.
+	ErrFormatIsInvalid
+	// ErrIDModeIsInvalid is returned when an import id mode is not recognised.
+	ErrIDModeIsInvalid
+	// ErrColumnsAreInvalid is returned when a csv column mapping can't be parsed.
+	ErrColumnsAreInvalid
+	// ErrEncryptedFieldsAreInvalid is returned when the encrypted fields of a collection are invalid.
+	ErrEncryptedFieldsAreInvalid
+	// ErrFieldEncryptionDisabled is returned when encrypted fields are used without a field encryption key.
+	ErrFieldEncryptionDisabled
+	// ErrFieldNotQueryable is returned when a query can't be answered because a field is encrypted.
+	ErrFieldNotQueryable
+	// ErrPermissionIsInvalid is returned when an api key permission is not recognised.
+	ErrPermissionIsInvalid
+	// ErrRevisionSettingsAreInvalid is returned when the revision settings of a collection are invalid.
+	ErrRevisionSettingsAreInvalid
+	// ErrSoftDeleteSettingsAreInvalid is returned when the soft delete settings of a collection are invalid.
+	ErrSoftDeleteSettingsAreInvalid
+	// ErrFieldIsReserved is returned when a document is written with a field reserved by the server.
+	ErrFieldIsReserved
+	// ErrMemberIsInvalid is returned when a node asks to join a cluster without an id or address.
+	ErrMemberIsInvalid
+	// ErrEncryptionKeyUnprotected is returned when a database is created with
+	// its own encryption key on a server that can't seal it.
+	ErrEncryptionKeyUnprotected
 )
 
 const (
@@ -65,4 +152,32 @@ const (
 const (
 	// ErrDocumentNotFound is returned when a document is not found.
 	ErrDocumentNotFound ErrorCode = 3000 + iota
+	// ErrDatabaseNotFound is returned when a database is not found.
+	ErrDatabaseNotFound
+	// ErrAPIKeyNotFound is returned when an api key is not found.
+	ErrAPIKeyNotFound
+	// ErrRevisionNotFound is returned when a revision of a document is not found.
+	ErrRevisionNotFound
+	// ErrMemberNotFound is returned when a node is not a member of the cluster.
+	ErrMemberNotFound
+)
+
+const (
+	// ErrDatabaseAlreadyExists is returned when creating a database with a name that is taken.
+	ErrDatabaseAlreadyExists ErrorCode = 4000 + iota
+	// ErrAlreadyLeader is returned when promoting a node that is not a follower.
+	ErrAlreadyLeader
+)
+
+const (
+	// ErrNotReady is returned when the databases have not finished loading.
+	ErrNotReady ErrorCode = 5000 + iota
+	// ErrStorageUnreachable is returned when the storage backend can't be reached.
+	ErrStorageUnreachable
+	// ErrNotLeader is returned when a follower is asked to write.
+	ErrNotLeader
+	// ErrNoLeader is returned when the cluster has no leader to write to.
+	ErrNoLeader
+	// ErrStaleRead is returned when a follower has not been up to date with the leader recently enough to serve a read.
+	ErrStaleRead
 )
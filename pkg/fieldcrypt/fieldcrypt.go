@@ -0,0 +1,406 @@
+// Package fieldcrypt encrypts individual fields of documents, so sensitive
+// values are stored, cached, logged and audited as ciphertext and only
+// revealed to api keys allowed to decrypt them.
+//
+// Fields encrypted deterministically always encrypt equal values to the same
+// ciphertext, so they can still be queried with the equals operator. Fields
+// encrypted randomly can't be queried but don't reveal which documents share
+// a value.
+package fieldcrypt
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	stderrors "errors"
+	"io"
+	"strings"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/errors"
+)
+
+// Collection is the collection of each database that holds the encrypted
+// fields of its collections, one document per collection.
+const Collection = "_encrypted_fields"
+
+// prefix starts every encrypted value, followed by the mode.
+const prefix = "nxf1:"
+
+// Mode is how a field is encrypted.
+type Mode string
+
+const (
+	// ModeDeterministic encrypts equal values to the same ciphertext, the
+	// field can be queried with the equals operator.
+	ModeDeterministic Mode = "deterministic"
+	// ModeRandomized encrypts every value with a random nonce, the field
+	// can't be queried.
+	ModeRandomized Mode = "randomized"
+)
+
+// tag returns the tag of a mode in encrypted values.
+func (m Mode) tag() string {
+	if m == ModeDeterministic {
+		return "d:"
+	}
+
+	return "r:"
+}
+
+// Field is an encrypted field of a collection, fields of nested objects are
+// given as dot paths.
+type Field struct {
+	Path string `json:"path"`
+	Mode Mode   `json:"mode"`
+}
+
+// ErrCiphertextInvalid is returned when an encrypted value can't be decrypted.
+var ErrCiphertextInvalid = stderrors.New("encrypted field value is invalid")
+
+// Validate checks fields are a valid configuration of a collection.
+func Validate(fields []Field) error {
+	seen := map[string]bool{}
+	for _, f := range fields {
+		if f.Path == "" || f.Path == "_id" || strings.HasPrefix(f.Path, ".") || strings.HasSuffix(f.Path, ".") || strings.Contains(f.Path, "..") {
+			return errors.New(errors.ErrEncryptedFieldsAreInvalid)
+		}
+
+		if f.Mode != ModeDeterministic && f.Mode != ModeRandomized {
+			return errors.New(errors.ErrEncryptedFieldsAreInvalid)
+		}
+
+		if seen[f.Path] {
+			return errors.New(errors.ErrEncryptedFieldsAreInvalid)
+		}
+		seen[f.Path] = true
+	}
+
+	return nil
+}
+
+// Fields returns the encrypted fields of a collection of d.
+func Fields(ctx context.Context, d *database.Database, collection string) []Field {
+	doc := Config(ctx, d, collection)
+	if doc == nil {
+		return nil
+	}
+
+	raw, _ := doc.Data["fields"].([]interface{})
+	fields := make([]Field, 0, len(raw))
+	for _, r := range raw {
+		m, _ := r.(map[string]interface{})
+		path, _ := m["path"].(string)
+		mode, _ := m["mode"].(string)
+		fields = append(fields, Field{Path: path, Mode: Mode(mode)})
+	}
+
+	return fields
+}
+
+// Config returns the document of d that holds the encrypted fields of a
+// collection, if any.
+func Config(ctx context.Context, d *database.Database, collection string) *document.Document {
+	results := d.FilterContext(ctx, Collection, cache.Query{
+		And: []cache.Element{
+			{
+				Condition: &cache.Condition{
+					Field:    "collection",
+					Operator: cache.Equals,
+					Value:    collection,
+				},
+			},
+		},
+	})
+	if len(results) == 0 {
+		return nil
+	}
+
+	return results[0]
+}
+
+// Encrypter encrypts and decrypts fields with a key derived from the field
+// encryption key of the server.
+type Encrypter struct {
+	aead cipher.AEAD
+	// nonceKey derives the nonces of deterministically encrypted values.
+	nonceKey []byte
+}
+
+// New returns an encrypter of the 32 byte field encryption key, or nil if
+// the key is empty.
+func New(key []byte) (*Encrypter, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+
+	if len(key) != 32 {
+		return nil, errors.New(errors.ErrEncryptionKeyIsInvalid)
+	}
+
+	block, err := aes.NewCipher(derive(key, "nexdb field encryption"))
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Encrypter{
+		aead:     aead,
+		nonceKey: derive(key, "nexdb field nonce"),
+	}, nil
+}
+
+// derive returns a key for purpose derived from key.
+func derive(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// Encrypt returns a copy of data whose fields are encrypted, values that
+// are already encrypted are kept. Data is returned as is if there are no
+// fields, an error is returned if there are fields but e is nil.
+func (e *Encrypter) Encrypt(collection string, fields []Field, data map[string]interface{}) (map[string]interface{}, error) {
+	if len(fields) == 0 {
+		return data, nil
+	}
+
+	if e == nil {
+		return nil, errors.New(errors.ErrFieldEncryptionDisabled)
+	}
+
+	for _, f := range fields {
+		v, ok := get(data, f.Path)
+		if !ok || v == nil {
+			continue
+		}
+
+		if s, ok := v.(string); ok && strings.HasPrefix(s, prefix) {
+			if _, err := e.decryptValue(collection, f.Path, s); err == nil {
+				continue
+			}
+		}
+
+		encrypted, err := e.encryptValue(collection, f, v)
+		if err != nil {
+			return nil, err
+		}
+		data = set(data, f.Path, encrypted)
+	}
+
+	return data, nil
+}
+
+// Decrypt returns a copy of data whose fields are decrypted, values that
+// are not encrypted are kept.
+func (e *Encrypter) Decrypt(collection string, fields []Field, data map[string]interface{}) (map[string]interface{}, error) {
+	if len(fields) == 0 {
+		return data, nil
+	}
+
+	if e == nil {
+		return nil, errors.New(errors.ErrFieldEncryptionDisabled)
+	}
+
+	for _, f := range fields {
+		v, _ := get(data, f.Path)
+		s, ok := v.(string)
+		if !ok || !strings.HasPrefix(s, prefix) {
+			continue
+		}
+
+		decrypted, err := e.decryptValue(collection, f.Path, s)
+		if err != nil {
+			return nil, err
+		}
+		data = set(data, f.Path, decrypted)
+	}
+
+	return data, nil
+}
+
+// Query returns a copy of query whose equals conditions on deterministically
+// encrypted fields compare against the ciphertext of their value. Any other
+// condition on an encrypted field can't be answered and is refused.
+func (e *Encrypter) Query(collection string, fields []Field, query cache.Query) (cache.Query, error) {
+	if len(fields) == 0 {
+		return query, nil
+	}
+
+	modes := make(map[string]Mode, len(fields))
+	for _, f := range fields {
+		modes[f.Path] = f.Mode
+	}
+
+	var err error
+	out := cache.Query{Deleted: query.Deleted}
+	if out.And, err = e.queryElements(collection, modes, query.And); err != nil {
+		return query, err
+	}
+	if out.Or, err = e.queryElements(collection, modes, query.Or); err != nil {
+		return query, err
+	}
+
+	return out, nil
+}
+
+// queryElements rewrites the elements of a query, see Query.
+func (e *Encrypter) queryElements(collection string, modes map[string]Mode, elems []cache.Element) ([]cache.Element, error) {
+	if elems == nil {
+		return nil, nil
+	}
+
+	out := make([]cache.Element, 0, len(elems))
+	for _, elem := range elems {
+		if elem.Query != nil {
+			q, err := e.queryElements(collection, modes, elem.Query.And)
+			if err != nil {
+				return nil, err
+			}
+			or, err := e.queryElements(collection, modes, elem.Query.Or)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, cache.Element{Query: &cache.Query{And: q, Or: or}})
+			continue
+		}
+
+		if elem.Condition == nil {
+			out = append(out, elem)
+			continue
+		}
+
+		cond := *elem.Condition
+		if mode, exact, ok := encryptedPath(modes, cond.Field); ok {
+			if !exact || mode != ModeDeterministic || cond.Operator != cache.Equals || e == nil {
+				return nil, errors.New(errors.ErrFieldNotQueryable)
+			}
+
+			encrypted, err := e.encryptValue(collection, Field{Path: cond.Field, Mode: mode}, cond.Value)
+			if err != nil {
+				return nil, err
+			}
+			cond.Value = encrypted
+		}
+		out = append(out, cache.Element{Condition: &cond})
+	}
+
+	return out, nil
+}
+
+// encryptedPath returns the mode of the encrypted field path is, or is
+// nested in, and whether it is the field itself. Fields nested in an
+// encrypted object are part of its ciphertext.
+func encryptedPath(modes map[string]Mode, path string) (Mode, bool, bool) {
+	for exact := true; ; exact = false {
+		if mode, ok := modes[path]; ok {
+			return mode, exact, true
+		}
+
+		i := strings.LastIndex(path, ".")
+		if i < 0 {
+			return "", false, false
+		}
+		path = path[:i]
+	}
+}
+
+// encryptValue encrypts the JSON encoding of v, the collection and path are
+// authenticated with it so the ciphertext can't be moved to another field.
+func (e *Encrypter) encryptValue(collection string, f Field, v interface{}) (string, error) {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	ad := additionalData(collection, f.Path)
+
+	nonce := make([]byte, e.aead.NonceSize())
+	if f.Mode == ModeDeterministic {
+		// a synthetic nonce derived from the value, equal values share it
+		mac := hmac.New(sha256.New, e.nonceKey)
+		mac.Write(ad)
+		mac.Write(plaintext)
+		copy(nonce, mac.Sum(nil))
+	} else if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := e.aead.Seal(nonce, nonce, plaintext, ad)
+	return prefix + f.Mode.tag() + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// decryptValue decrypts a value written by encryptValue.
+func (e *Encrypter) decryptValue(collection, path, s string) (interface{}, error) {
+	s = strings.TrimPrefix(s, prefix)
+	if len(s) < 2 || (s[:2] != ModeDeterministic.tag() && s[:2] != ModeRandomized.tag()) {
+		return nil, ErrCiphertextInvalid
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(s[2:])
+	if err != nil || len(sealed) < e.aead.NonceSize() {
+		return nil, ErrCiphertextInvalid
+	}
+
+	nonce, ciphertext := sealed[:e.aead.NonceSize()], sealed[e.aead.NonceSize():]
+	plaintext, err := e.aead.Open(nil, nonce, ciphertext, additionalData(collection, path))
+	if err != nil {
+		return nil, ErrCiphertextInvalid
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(plaintext, &v); err != nil {
+		return nil, ErrCiphertextInvalid
+	}
+
+	return v, nil
+}
+
+// additionalData returns the data authenticated with the value of a field.
+func additionalData(collection, path string) []byte {
+	return []byte(collection + "\x00" + path)
+}
+
+// get returns the value of a dot path field.
+func get(data map[string]interface{}, path string) (interface{}, bool) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := data[key].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		data = next
+	}
+
+	v, ok := data[keys[len(keys)-1]]
+	return v, ok
+}
+
+// set returns a copy of data with the dot path field set to v, the objects
+// along the path are copied so data is left untouched.
+func set(data map[string]interface{}, path string, v interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(data))
+	for k, val := range data {
+		out[k] = val
+	}
+
+	key, rest, nested := strings.Cut(path, ".")
+	if !nested {
+		out[key] = v
+		return out
+	}
+
+	next, _ := out[key].(map[string]interface{})
+	out[key] = set(next, rest, v)
+	return out
+}
@@ -0,0 +1,147 @@
+package fieldcrypt_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/errors"
+	"github.com/nexdb/nexdb/pkg/fieldcrypt"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var fields = []fieldcrypt.Field{
+	{Path: "ssn", Mode: fieldcrypt.ModeDeterministic},
+	{Path: "address.street", Mode: fieldcrypt.ModeRandomized},
+}
+
+func newEncrypter(t *testing.T) *fieldcrypt.Encrypter {
+	t.Helper()
+
+	e, err := fieldcrypt.New([]byte("key-that-is-thirty-2-bytes-long!"))
+	require.NoError(t, err)
+
+	return e
+}
+
+func TestEncrypter_RoundTrip(t *testing.T) {
+	e := newEncrypter(t)
+	data := map[string]interface{}{
+		"name": "ada",
+		"ssn":  "123-45-6789",
+		"address": map[string]interface{}{
+			"street": "1 Main St",
+			"city":   "Leeds",
+		},
+	}
+
+	encrypted, err := e.Encrypt("users", fields, data)
+	require.NoError(t, err)
+	assert.Equal(t, "ada", encrypted["name"])
+	assert.True(t, strings.HasPrefix(encrypted["ssn"].(string), "nxf1:d:"))
+	address := encrypted["address"].(map[string]interface{})
+	assert.True(t, strings.HasPrefix(address["street"].(string), "nxf1:r:"))
+	assert.Equal(t, "Leeds", address["city"])
+
+	// the original data is left untouched
+	assert.Equal(t, "123-45-6789", data["ssn"])
+	assert.Equal(t, "1 Main St", data["address"].(map[string]interface{})["street"])
+
+	// encrypting again keeps the ciphertexts
+	again, err := e.Encrypt("users", fields, encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, encrypted, again)
+
+	decrypted, err := e.Decrypt("users", fields, encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, data, decrypted)
+
+	// a ciphertext moved to another collection can't be decrypted
+	_, err = e.Decrypt("admins", fields, encrypted)
+	require.ErrorIs(t, err, fieldcrypt.ErrCiphertextInvalid)
+}
+
+func TestEncrypter_Modes(t *testing.T) {
+	e := newEncrypter(t)
+	data := map[string]interface{}{"ssn": "123-45-6789", "address": map[string]interface{}{"street": "1 Main St"}}
+
+	first, err := e.Encrypt("users", fields, data)
+	require.NoError(t, err)
+	second, err := e.Encrypt("users", fields, data)
+	require.NoError(t, err)
+
+	// deterministic fields encrypt equal values equally, randomized do not
+	assert.Equal(t, first["ssn"], second["ssn"])
+	assert.NotEqual(t, first["address"], second["address"])
+}
+
+func TestEncrypter_Query(t *testing.T) {
+	e := newEncrypter(t)
+
+	stored, err := e.Encrypt("users", fields, map[string]interface{}{"ssn": "123-45-6789"})
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name    string
+		cond    cache.Condition
+		wantErr bool
+	}{
+		{name: "equals deterministic", cond: cache.Condition{Field: "ssn", Operator: cache.Equals, Value: "123-45-6789"}},
+		{name: "plain field", cond: cache.Condition{Field: "name", Operator: cache.Contains, Value: "a"}},
+		{name: "contains deterministic", cond: cache.Condition{Field: "ssn", Operator: cache.Contains, Value: "123"}, wantErr: true},
+		{name: "equals randomized", cond: cache.Condition{Field: "address.street", Operator: cache.Equals, Value: "1 Main St"}, wantErr: true},
+		{name: "nested in encrypted field", cond: cache.Condition{Field: "ssn.part", Operator: cache.Equals, Value: "123"}, wantErr: true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			cond := tc.cond
+			query := cache.Query{Or: []cache.Element{{Query: &cache.Query{And: []cache.Element{{Condition: &cond}}}}}}
+
+			got, err := e.Query("users", fields, query)
+			if tc.wantErr {
+				var internalErr *errors.Error
+				require.ErrorAs(t, err, &internalErr)
+				assert.Equal(t, errors.ErrFieldNotQueryable, internalErr.Code())
+				return
+			}
+			require.NoError(t, err)
+
+			rewritten := got.Or[0].Query.And[0].Condition
+			if cond.Field == "ssn" {
+				assert.Equal(t, stored["ssn"], rewritten.Value)
+			} else {
+				assert.Equal(t, cond.Value, rewritten.Value)
+			}
+
+			// the original query is left untouched
+			assert.Equal(t, tc.cond.Value, query.Or[0].Query.And[0].Condition.Value)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		fields []fieldcrypt.Field
+		valid  bool
+	}{
+		{name: "valid", fields: fields, valid: true},
+		{name: "none", valid: true},
+		{name: "id", fields: []fieldcrypt.Field{{Path: "_id", Mode: fieldcrypt.ModeRandomized}}},
+		{name: "empty path segment", fields: []fieldcrypt.Field{{Path: "address..street", Mode: fieldcrypt.ModeRandomized}}},
+		{name: "unknown mode", fields: []fieldcrypt.Field{{Path: "ssn", Mode: "hashed"}}},
+		{name: "duplicate", fields: []fieldcrypt.Field{{Path: "ssn", Mode: fieldcrypt.ModeRandomized}, {Path: "ssn", Mode: fieldcrypt.ModeDeterministic}}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := fieldcrypt.Validate(tc.fields)
+			if tc.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,363 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/api/rest"
+	"github.com/nexdb/nexdb/pkg/fieldcrypt"
+	"github.com/nexdb/nexdb/pkg/revisions"
+	"github.com/nexdb/nexdb/pkg/services/admin"
+	"github.com/nexdb/nexdb/pkg/services/auth"
+	"github.com/nexdb/nexdb/pkg/trash"
+
+	"github.com/gorilla/mux"
+)
+
+// CreateDatabase is a handler that creates a database.
+func CreateDatabase(a *admin.Admin) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		defer r.Body.Close()
+
+		// get the data
+		var data struct {
+			Name          string `json:"name"`
+			EncryptionKey string `json:"encryption_key"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&data)
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+			)
+		}
+
+		info, err := a.CreateDatabase(r.Context(), data.Name, data.EncryptionKey)
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusCreated),
+			rest.SetBody(info),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// ListDatabases is a handler that lists all databases.
+func ListDatabases(a *admin.Admin) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		defer r.Body.Close()
+
+		list, err := a.ListDatabases(r.Context())
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(list),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// DropDatabase is a handler that deletes a database and all of its documents.
+func DropDatabase(a *admin.Admin) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		vars := mux.Vars(r)
+
+		defer r.Body.Close()
+
+		err := a.DropDatabase(r.Context(), vars["db"])
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(map[string]interface{}{}),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// CreateAPIKey is a handler that adds an api key to a database.
+func CreateAPIKey(a *admin.Admin) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		vars := mux.Vars(r)
+
+		defer r.Body.Close()
+
+		// get the data, an empty body generates a random key
+		var data struct {
+			Key         string            `json:"key"`
+			Subject     string            `json:"subject"`
+			Permissions []auth.Permission `json:"permissions"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&data)
+		if err != nil && err != io.EOF {
+			return rest.JsonResponse(
+				rest.WithError(err),
+			)
+		}
+
+		doc, err := a.CreateAPIKey(r.Context(), vars["db"], data.Key, data.Subject, data.Permissions)
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusCreated),
+			rest.SetBody(doc),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// ListAPIKeys is a handler that lists the ids of the api keys of a database.
+func ListAPIKeys(a *admin.Admin) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		vars := mux.Vars(r)
+
+		defer r.Body.Close()
+
+		ids, err := a.ListAPIKeys(r.Context(), vars["db"])
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(ids),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// DeleteAPIKey is a handler that removes an api key from a database.
+func DeleteAPIKey(a *admin.Admin) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		vars := mux.Vars(r)
+
+		defer r.Body.Close()
+
+		err := a.DeleteAPIKey(r.Context(), vars["db"], vars["id"])
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(map[string]interface{}{}),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// GetEncryptedFields is a handler that returns the encrypted fields of a
+// collection of a database.
+func GetEncryptedFields(a *admin.Admin) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		vars := mux.Vars(r)
+
+		defer r.Body.Close()
+
+		fields, err := a.EncryptedFields(r.Context(), vars["db"], vars["collection"])
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(map[string]interface{}{"fields": fields}),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// SetEncryptedFields is a handler that replaces the encrypted fields of a
+// collection of a database, the documents of the collection are rewritten.
+func SetEncryptedFields(a *admin.Admin) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		vars := mux.Vars(r)
+
+		defer r.Body.Close()
+
+		var data struct {
+			Fields []fieldcrypt.Field `json:"fields"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+			)
+		}
+
+		fields, err := a.SetEncryptedFields(r.Context(), vars["db"], vars["collection"], data.Fields)
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(map[string]interface{}{"fields": fields}),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// GetRevisionSettings is a handler that returns the revision settings of a
+// collection of a database.
+func GetRevisionSettings(a *admin.Admin) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		vars := mux.Vars(r)
+
+		defer r.Body.Close()
+
+		settings, err := a.RevisionSettings(r.Context(), vars["db"], vars["collection"])
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(settings),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// SetRevisionSettings is a handler that replaces the revision settings of a
+// collection of a database.
+func SetRevisionSettings(a *admin.Admin) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		vars := mux.Vars(r)
+
+		defer r.Body.Close()
+
+		var settings revisions.Settings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+			)
+		}
+
+		settings, err := a.SetRevisionSettings(r.Context(), vars["db"], vars["collection"], settings)
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(settings),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// GetSoftDeleteSettings is a handler that returns the soft delete settings
+// of a collection of a database.
+func GetSoftDeleteSettings(a *admin.Admin) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		vars := mux.Vars(r)
+
+		defer r.Body.Close()
+
+		settings, err := a.SoftDeleteSettings(r.Context(), vars["db"], vars["collection"])
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(settings),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// SetSoftDeleteSettings is a handler that replaces the soft delete settings
+// of a collection of a database.
+func SetSoftDeleteSettings(a *admin.Admin) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		vars := mux.Vars(r)
+
+		defer r.Body.Close()
+
+		var settings trash.Settings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+			)
+		}
+
+		settings, err := a.SetSoftDeleteSettings(r.Context(), vars["db"], vars["collection"], settings)
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(settings),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// Backup is a handler that streams a backup archive of every database.
+func Backup(a *admin.Admin) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := "nexdb-" + time.Now().UTC().Format("20060102T150405Z") + ".tar.gz"
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+
+		// the status has been sent once the archive is being written, a
+		// failure can only be logged and the archive is left truncated
+		manifest, err := a.Backup(r.Context(), w)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to write backup", "error", err)
+			return
+		}
+
+		slog.InfoContext(r.Context(), "backup written", "documents", manifest.Documents(), "encrypted", manifest.Encrypted)
+	}
+}
@@ -0,0 +1,192 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/fieldcrypt"
+	"github.com/nexdb/nexdb/pkg/handlers"
+	"github.com/nexdb/nexdb/pkg/services/admin"
+	"github.com/nexdb/nexdb/pkg/services/audit"
+	"github.com/nexdb/nexdb/pkg/services/auth"
+	"github.com/nexdb/nexdb/pkg/services/reader"
+	"github.com/nexdb/nexdb/pkg/services/writer"
+	"github.com/nexdb/nexdb/pkg/storage"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmin_CreateDatabase(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newManager(t, ctx)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/v1/admin/databases", bytes.NewReader([]byte(`{"name": "acme"}`)))
+
+	handlers.CreateDatabase(admin.New(m)).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, `{"data":{"name":"acme","prefix":"_db/acme/","encrypted":false}}`, rr.Body.String())
+
+	// creating it again should conflict
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/v1/admin/databases", bytes.NewReader([]byte(`{"name": "acme"}`)))
+
+	handlers.CreateDatabase(admin.New(m)).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func TestAdmin_CreateAPIKey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newManager(t, ctx)
+	_, err := m.Create("acme", "")
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name    string
+		auditor *audit.Auditor
+	}{
+		{name: "without an auditor"},
+		// the key is stored, so it is returned whether or not it is audited
+		{name: "with a failing auditor", auditor: audit.New(failingSink{})},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/v1/admin/databases/acme/keys", nil)
+			req = mux.SetURLVars(req, map[string]string{
+				"db": "acme",
+			})
+
+			handlers.CreateAPIKey(admin.New(m).WithAuditor(tc.auditor)).ServeHTTP(rr, req)
+			require.Equal(t, http.StatusCreated, rr.Code)
+
+			var body struct {
+				Data struct {
+					Data map[string]interface{} `json:"data"`
+				} `json:"data"`
+			}
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+			assert.NotEmpty(t, body.Data.Data["key"])
+		})
+	}
+}
+
+// failingSink is an audit sink that fails every append.
+type failingSink struct{}
+
+func (failingSink) Append(audit.Entry) error                  { return stderrors.New("sink is down") }
+func (failingSink) Query(audit.Filter) ([]audit.Entry, error) { return nil, nil }
+func (failingSink) Prune(time.Time) (int, error)              { return 0, nil }
+
+func TestAdmin_SetEncryptedFields(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newManager(t, ctx)
+	d, err := m.Get(database.DefaultName)
+	require.NoError(t, err)
+
+	fields, err := fieldcrypt.New([]byte("key-that-is-thirty-2-bytes-long!"))
+	require.NoError(t, err)
+	wr := writer.New(d).WithFieldEncrypter(fields)
+	rd := reader.New(d).WithFieldEncrypter(fields)
+
+	// a document written before the field is encrypted
+	before, err := wr.WriteDocument(ctx, "users", map[string]interface{}{"name": "ada", "ssn": "123-45-6789"})
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("PUT", "/v1/admin/databases/default/collections/users/encrypted-fields",
+		bytes.NewReader([]byte(`{"fields": [{"path": "ssn", "mode": "deterministic"}]}`)))
+	req = mux.SetURLVars(req, map[string]string{"db": database.DefaultName, "collection": "users"})
+
+	handlers.SetEncryptedFields(admin.New(m).WithFieldEncrypter(fields)).ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	// the existing document is encrypted, new documents are encrypted as written
+	assert.NotEqual(t, "123-45-6789", d.GetByID(before.ID.String()).Data["ssn"])
+	_, err = wr.WriteDocument(ctx, "users", map[string]interface{}{"name": "grace", "ssn": "987-65-4321"})
+	require.NoError(t, err)
+
+	query := cache.Query{And: []cache.Element{{Condition: &cache.Condition{Field: "ssn", Operator: cache.Equals, Value: "123-45-6789"}}}}
+	for _, tc := range []struct {
+		name        string
+		permissions []auth.Permission
+		plaintext   bool
+	}{
+		{name: "without permission", plaintext: false},
+		{name: "with permission", permissions: []auth.Permission{auth.PermissionDecryptFields}, plaintext: true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := auth.NewContext(ctx, &auth.Identity{Permissions: tc.permissions})
+
+			docs, err := rd.SearchDocuments(ctx, "users", query)
+			require.NoError(t, err)
+			require.Len(t, docs, 1)
+			assert.Equal(t, "ada", docs[0].Data["name"])
+			assert.Equal(t, tc.plaintext, docs[0].Data["ssn"] == "123-45-6789")
+		})
+	}
+
+	// the cached document is never decrypted in place
+	assert.NotEqual(t, "123-45-6789", d.GetByID(before.ID.String()).Data["ssn"])
+}
+
+func TestDatabaseMiddleware_WithDatabase(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newManager(t, ctx)
+	_, err := m.Create("acme", "")
+	require.NoError(t, err)
+
+	def, err := m.Get(database.DefaultName)
+	require.NoError(t, err)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v1/db/{db}/collections/{collection}", handlers.WriteDocument(writer.New(def)).ServeHTTP).Methods("PUT")
+	r.Use((&handlers.DatabaseMiddleware{Manager: m}).WithDatabase)
+
+	// write to acme, it should not be visible in the default database
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("PUT", "/v1/db/acme/collections/users", bytes.NewReader([]byte(`{"name": "John"}`)))
+	r.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusCreated, rr.Code)
+
+	acme, err := m.Get("acme")
+	require.NoError(t, err)
+	assert.Len(t, acme.Filter("users", cache.Query{}), 1)
+	assert.Empty(t, def.Filter("users", cache.Query{}))
+
+	// unknown databases should not be found
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("PUT", "/v1/db/unknown/collections/users", bytes.NewReader([]byte(`{"name": "John"}`)))
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func newManager(t *testing.T, ctx context.Context) *database.Manager {
+	s, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	d := &database.Database{
+		Cache: cache.NewCache(ctx, cache.NewQueue(s)),
+	}
+
+	return database.NewManager(ctx, storage.MemoryDriver, d)
+}
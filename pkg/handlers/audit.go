@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/api/rest"
+	"github.com/nexdb/nexdb/pkg/services/audit"
+)
+
+// QueryAudit is a handler that queries the audit log, entries are filtered
+// by the key_id, operation, database, collection, document_id, since, until
+// and limit query parameters.
+func QueryAudit(a *audit.Auditor) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		defer r.Body.Close()
+
+		q := r.URL.Query()
+		f := audit.Filter{
+			KeyID:      q.Get("key_id"),
+			Operation:  audit.Operation(q.Get("operation")),
+			Database:   q.Get("database"),
+			Collection: q.Get("collection"),
+			DocumentID: q.Get("document_id"),
+		}
+
+		var err error
+		if v := q.Get("since"); v != "" {
+			if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+				return rest.JsonResponse(
+					rest.WithError(err),
+					rest.SetStatus(http.StatusBadRequest),
+				)
+			}
+		}
+
+		if v := q.Get("until"); v != "" {
+			if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+				return rest.JsonResponse(
+					rest.WithError(err),
+					rest.SetStatus(http.StatusBadRequest),
+				)
+			}
+		}
+
+		if v := q.Get("limit"); v != "" {
+			if f.Limit, err = strconv.Atoi(v); err != nil {
+				return rest.JsonResponse(
+					rest.WithError(err),
+					rest.SetStatus(http.StatusBadRequest),
+				)
+			}
+		}
+
+		entries, err := a.Query(r.Context(), f)
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(entries),
+			rest.SetWrap("data"),
+		)
+	}
+}
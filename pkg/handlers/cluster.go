@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/nexdb/nexdb/pkg/api/rest"
+	"github.com/nexdb/nexdb/pkg/cluster"
+
+	"github.com/gorilla/mux"
+)
+
+// ClusterStatus is a handler that reports the cluster status of the server
+// and the members of its cluster.
+func ClusterStatus(n *cluster.Node) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		defer r.Body.Close()
+
+		s, err := n.Status()
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(s),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// JoinCluster is a handler that adds a member to the cluster, it is served
+// by the leader.
+func JoinCluster(n *cluster.Node) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		defer r.Body.Close()
+
+		var m cluster.Member
+		err := json.NewDecoder(r.Body).Decode(&m)
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+			)
+		}
+
+		members, err := n.Join(r.Context(), m)
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		slog.InfoContext(r.Context(), "added a member to the cluster", "member", m.ID, "address", m.Address)
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(members),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// RemoveMember is a handler that removes a member from the cluster, it is
+// served by the leader.
+func RemoveMember(n *cluster.Node) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		vars := mux.Vars(r)
+
+		defer r.Body.Close()
+
+		err := n.Remove(r.Context(), vars["id"])
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		slog.InfoContext(r.Context(), "removed a member from the cluster", "member", vars["id"])
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(map[string]interface{}{}),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// ApplyWrite is a handler that commits a write forwarded by another member
+// of the cluster, it is served by the leader. It responds with the index of
+// the write in the log.
+func ApplyWrite(n *cluster.Node) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		defer r.Body.Close()
+
+		cmd, err := io.ReadAll(r.Body)
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+			)
+		}
+
+		index, err := n.Apply(cmd)
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(map[string]interface{}{"index": index}),
+			rest.SetWrap("data"),
+		)
+	}
+}
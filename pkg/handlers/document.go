@@ -6,7 +6,7 @@ import (
 
 	"github.com/nexdb/nexdb/pkg/api/rest"
 	"github.com/nexdb/nexdb/pkg/database/cache"
-	"github.com/nexdb/nexdb/pkg/errors"
+	"github.com/nexdb/nexdb/pkg/revisions"
 	"github.com/nexdb/nexdb/pkg/services/reader"
 	"github.com/nexdb/nexdb/pkg/services/writer"
 
@@ -23,9 +23,12 @@ func WriteDocument(w *writer.Writer) rest.JsonHandler {
 
 		defer r.Body.Close()
 
-		// get the data
+		// get the data, numbers are kept as they were sent so integers
+		// aren't rounded through float64
 		var data map[string]interface{}
-		err := json.NewDecoder(r.Body).Decode(&data)
+		dec := json.NewDecoder(r.Body)
+		dec.UseNumber()
+		err := dec.Decode(&data)
 		if err != nil {
 			return rest.JsonResponse(
 				rest.WithError(err),
@@ -34,16 +37,9 @@ func WriteDocument(w *writer.Writer) rest.JsonHandler {
 
 		doc, err := w.WriteDocument(r.Context(), collection, data)
 		if err != nil {
-			code := http.StatusBadRequest
-			if internalErr, ok := err.(*errors.Error); ok {
-				if internalErr.ErrorCode == errors.ErrDocumentNotFound {
-					code = http.StatusNotFound
-				}
-			}
-
 			return rest.JsonResponse(
 				rest.WithError(err),
-				rest.SetStatus(code),
+				rest.SetStatus(statusFromError(err)),
 			)
 		}
 
@@ -60,23 +56,17 @@ func GetDocument(readerSvc *reader.Reader) rest.JsonHandler {
 	return func(r *http.Request) *rest.Response {
 		vars := mux.Vars(r)
 
-		// get the document id
+		// get the collection name and document id
+		collection := vars["collection"]
 		id := vars["id"]
 
 		defer r.Body.Close()
 
-		doc, err := readerSvc.GetDocument(r.Context(), id)
+		doc, err := readerSvc.GetDocument(r.Context(), collection, id)
 		if err != nil {
-			code := http.StatusBadRequest
-			if internalErr, ok := err.(*errors.Error); ok {
-				if internalErr.ErrorCode == errors.ErrDocumentNotFound {
-					code = http.StatusNotFound
-				}
-			}
-
 			return rest.JsonResponse(
 				rest.WithError(err),
-				rest.SetStatus(code),
+				rest.SetStatus(statusFromError(err)),
 			)
 		}
 
@@ -100,16 +90,9 @@ func DeleteDocument(w *writer.Writer) rest.JsonHandler {
 
 		err := w.DeleteDocument(r.Context(), id)
 		if err != nil {
-			code := http.StatusBadRequest
-			if internalErr, ok := err.(*errors.Error); ok {
-				if internalErr.ErrorCode == errors.ErrDocumentNotFound {
-					code = http.StatusNotFound
-				}
-			}
-
 			return rest.JsonResponse(
 				rest.WithError(err),
-				rest.SetStatus(code),
+				rest.SetStatus(statusFromError(err)),
 			)
 		}
 
@@ -155,3 +138,202 @@ func SearchDocuments(readerSvc *reader.Reader) rest.JsonHandler {
 		)
 	}
 }
+
+// ListRevisions is a handler that lists the revisions of a document.
+func ListRevisions(readerSvc *reader.Reader) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		vars := mux.Vars(r)
+
+		defer r.Body.Close()
+
+		list, err := readerSvc.Revisions(r.Context(), vars["collection"], vars["id"])
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(list),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// GetRevision is a handler that gets a revision of a document.
+func GetRevision(readerSvc *reader.Reader) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		vars := mux.Vars(r)
+
+		defer r.Body.Close()
+
+		revision, err := revisions.ParseRevision(vars["revision"])
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		rev, err := readerSvc.Revision(r.Context(), vars["collection"], vars["id"], revision)
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(rev),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// DiffRevision is a handler that returns the changes from a revision of a
+// document to the revision given by the to parameter, or to the document as
+// it is if there is none.
+func DiffRevision(readerSvc *reader.Reader) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		vars := mux.Vars(r)
+
+		defer r.Body.Close()
+
+		from, err := revisions.ParseRevision(vars["revision"])
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		to := 0
+		if s := r.URL.Query().Get("to"); s != "" {
+			if to, err = revisions.ParseRevision(s); err != nil {
+				return rest.JsonResponse(
+					rest.WithError(err),
+					rest.SetStatus(statusFromError(err)),
+				)
+			}
+		}
+
+		changes, err := readerSvc.DiffRevisions(r.Context(), vars["collection"], vars["id"], from, to)
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(changes),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// RestoreRevision is a handler that writes a revision of a document back as
+// its latest version.
+func RestoreRevision(w *writer.Writer) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		vars := mux.Vars(r)
+
+		defer r.Body.Close()
+
+		revision, err := revisions.ParseRevision(vars["revision"])
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		doc, err := w.RestoreRevision(r.Context(), vars["collection"], vars["id"], revision)
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(doc),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// ListTrash is a handler that lists the documents in the trash of a
+// collection.
+func ListTrash(readerSvc *reader.Reader) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		vars := mux.Vars(r)
+
+		defer r.Body.Close()
+
+		docs, err := readerSvc.TrashDocuments(r.Context(), vars["collection"])
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(docs),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// UndeleteDocument is a handler that takes a document out of the trash.
+func UndeleteDocument(w *writer.Writer) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		vars := mux.Vars(r)
+
+		defer r.Body.Close()
+
+		doc, err := w.UndeleteDocument(r.Context(), vars["collection"], vars["id"])
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(doc),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// PurgeDocument is a handler that deletes a document from the trash for
+// good.
+func PurgeDocument(w *writer.Writer) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		vars := mux.Vars(r)
+
+		defer r.Body.Close()
+
+		if err := w.PurgeDocument(r.Context(), vars["collection"], vars["id"]); err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(map[string]interface{}{}),
+			rest.SetWrap("data"),
+		)
+	}
+}
@@ -3,14 +3,17 @@ package handlers_test
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/nexdb/nexdb/pkg/database"
 	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
 	"github.com/nexdb/nexdb/pkg/errors"
 	"github.com/nexdb/nexdb/pkg/handlers"
+	"github.com/nexdb/nexdb/pkg/services/reader"
 	"github.com/nexdb/nexdb/pkg/services/writer"
 	"github.com/nexdb/nexdb/pkg/storage"
 
@@ -36,7 +39,7 @@ func TestDocument_WriteDocument(t *testing.T) {
 	rr := httptest.NewRecorder()
 
 	// set the request body
-	data := []byte(`{"name": "John"}`)
+	data := []byte(`{"name": "John", "visits": 9007199254740993}`)
 
 	req := httptest.NewRequest("POST", "/collection/users", bytes.NewReader(data))
 	req = mux.SetURLVars(req, map[string]string{
@@ -46,6 +49,11 @@ func TestDocument_WriteDocument(t *testing.T) {
 	// call the handler
 	handlers.WriteDocument(wr).ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	// numbers are written exactly rather than rounded through float64
+	docs := d.Documents()
+	require.Len(t, docs, 1)
+	assert.Equal(t, json.Number("9007199254740993"), docs[0].Data["visits"])
 }
 
 func TestDocument_WriteDocumentWithInvalidCollectionName(t *testing.T) {
@@ -80,3 +88,50 @@ func TestDocument_WriteDocumentWithInvalidCollectionName(t *testing.T) {
 	expectedCode := expectedErr.Code().ToString()
 	assert.Equal(t, `{"error":"`+expectedErr.Error()+`","code":`+expectedCode+`}`, rr.Body.String())
 }
+
+func TestDocument_GetDocument(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	d := &database.Database{
+		Cache: cache.NewCache(ctx, cache.NewQueue(s)),
+	}
+	user := document.New().SetCollection("users").SetData(map[string]interface{}{"name": "John"})
+	key := document.New().SetCollection("_api_keys").SetData(map[string]interface{}{"key": "secret"})
+	require.NoError(t, d.Put(user, false))
+	require.NoError(t, d.Put(key, false))
+	rd := reader.New(d)
+
+	for _, tc := range []struct {
+		name       string
+		collection string
+		id         string
+		status     int
+	}{
+		{name: "document of the collection", collection: "users", id: user.ID.String(), status: http.StatusOK},
+		{name: "document of another collection", collection: "orders", id: user.ID.String(), status: http.StatusNotFound},
+		{name: "document of a system collection", collection: "users", id: key.ID.String(), status: http.StatusNotFound},
+		{name: "system collection", collection: "_api_keys", id: key.ID.String(), status: http.StatusBadRequest},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/collections/"+tc.collection+"/"+tc.id, nil)
+			req = mux.SetURLVars(req, map[string]string{"collection": tc.collection, "id": tc.id})
+
+			handlers.GetDocument(rd).ServeHTTP(rr, req)
+			assert.Equal(t, tc.status, rr.Code)
+		})
+	}
+
+	// system collections can't be searched
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/collections/_api_keys", bytes.NewReader([]byte(`{}`)))
+	req = mux.SetURLVars(req, map[string]string{"collection": "_api_keys"})
+	handlers.SearchDocuments(rd).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "secret")
+}
@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/nexdb/nexdb/pkg/errors"
+)
+
+// statusFromError returns the http status code for an error returned
+// by a service.
+func statusFromError(err error) int {
+	internalErr, ok := err.(*errors.Error)
+	if !ok {
+		return http.StatusBadRequest
+	}
+
+	switch internalErr.ErrorCode {
+	case errors.ErrUnauthorized:
+		return http.StatusUnauthorized
+	case errors.ErrDocumentNotFound, errors.ErrDatabaseNotFound, errors.ErrAPIKeyNotFound, errors.ErrRevisionNotFound, errors.ErrMemberNotFound:
+		return http.StatusNotFound
+	case errors.ErrDatabaseAlreadyExists, errors.ErrAlreadyLeader:
+		return http.StatusConflict
+	case errors.ErrNotReady, errors.ErrStorageUnreachable, errors.ErrNotLeader, errors.ErrNoLeader, errors.ErrStaleRead:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadRequest
+	}
+}
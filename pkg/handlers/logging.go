@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/nexdb/nexdb/pkg/api/rest"
+	"github.com/nexdb/nexdb/pkg/errors"
+	"github.com/nexdb/nexdb/pkg/logging"
+)
+
+// logLevel is the body of the log level handlers.
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+// GetLogLevel is a handler that returns the current log level.
+func GetLogLevel() rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		return rest.JsonResponse(
+			rest.SetBody(logLevel{Level: strings.ToLower(logging.Level.Level().String())}),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// SetLogLevel is a handler that changes the log level at runtime.
+func SetLogLevel() rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		defer r.Body.Close()
+
+		var data logLevel
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(http.StatusBadRequest),
+			)
+		}
+
+		level, err := logging.ParseLevel(data.Level)
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(errors.New(errors.ErrLogLevelIsInvalid)),
+				rest.SetStatus(http.StatusBadRequest),
+			)
+		}
+		logging.Level.Set(level)
+
+		return rest.JsonResponse(
+			rest.SetBody(logLevel{Level: strings.ToLower(level.String())}),
+			rest.SetWrap("data"),
+		)
+	}
+}
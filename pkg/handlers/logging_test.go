@@ -0,0 +1,39 @@
+package handlers_test
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nexdb/nexdb/pkg/handlers"
+	"github.com/nexdb/nexdb/pkg/logging"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetLogLevel(t *testing.T) {
+	t.Cleanup(func() {
+		logging.Level.Set(slog.LevelInfo)
+	})
+
+	for _, tc := range []struct {
+		name  string
+		body  string
+		want  int
+		level slog.Level
+	}{
+		{name: "changes the level", body: `{"level":"debug"}`, want: http.StatusOK, level: slog.LevelDebug},
+		{name: "rejects an unknown level", body: `{"level":"loud"}`, want: http.StatusBadRequest, level: slog.LevelDebug},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handlers.SetLogLevel().ServeHTTP(rr, httptest.NewRequest("PUT", "/v1/admin/log-level", strings.NewReader(tc.body)))
+
+			assert.Equal(t, tc.want, rr.Code)
+			assert.Equal(t, tc.level, logging.Level.Level())
+		})
+	}
+}
@@ -1,28 +1,282 @@
 package handlers
 
 import (
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"time"
 
+	"github.com/nexdb/nexdb/pkg/api/rest"
+	"github.com/nexdb/nexdb/pkg/cluster"
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/errors"
+	"github.com/nexdb/nexdb/pkg/logging"
+	"github.com/nexdb/nexdb/pkg/metrics"
+	"github.com/nexdb/nexdb/pkg/replication"
+	"github.com/nexdb/nexdb/pkg/services/audit"
 	"github.com/nexdb/nexdb/pkg/services/auth"
+	"github.com/nexdb/nexdb/pkg/services/status"
+
+	"github.com/gorilla/mux"
+	"github.com/oklog/ulid/v2"
 )
 
 type AuthMiddleware struct {
 	*auth.AuthService
 }
 
+// IsAuthenticated authenticates requests by a verified client certificate
+// when mutual TLS is enabled, falling back to the api key sent as the basic
+// auth username.
 func (a *AuthMiddleware) IsAuthenticated(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			id, err := a.AuthenticateCertificate(r.Context(), r.TLS.VerifiedChains[0][0])
+			if err == nil {
+				next.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), id)))
+				return
+			}
+			metrics.AuthFailuresTotal.WithLabelValues(metrics.AuthInvalidCertificate).Inc()
+		}
+
 		key, _, ok := r.BasicAuth()
 		if !ok {
+			metrics.AuthFailuresTotal.WithLabelValues(metrics.AuthMissingCredentials).Inc()
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		if err := a.Authenticate(key); err != nil {
+		id, err := a.Authenticate(r.Context(), key)
+		if err != nil {
+			metrics.AuthFailuresTotal.WithLabelValues(metrics.AuthInvalidAPIKey).Inc()
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
+		next.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), id)))
+	})
+}
+
+// DatabaseMiddleware resolves the database named by the {db} route variable
+// and passes it to the services through the request context. Routes without
+// the variable are served by the default database.
+type DatabaseMiddleware struct {
+	*database.Manager
+}
+
+func (m *DatabaseMiddleware) WithDatabase(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := mux.Vars(r)["db"]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		d, err := m.Get(name)
+		if err != nil {
+			rest.JsonHandler(func(r *http.Request) *rest.Response {
+				return rest.JsonResponse(
+					rest.WithError(err),
+					rest.SetStatus(statusFromError(err)),
+				)
+			}).ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(database.NewContext(r.Context(), d)))
+	})
+}
+
+// SourceIP passes the ip address of the client to the services through the
+// request context so it can be recorded in the audit log.
+func SourceIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+
+		next.ServeHTTP(w, r.WithContext(audit.WithSourceIP(r.Context(), ip)))
+	})
+}
+
+// ReadyMiddleware rejects requests until the databases have been loaded.
+type ReadyMiddleware struct {
+	*status.Status
+}
+
+func (m *ReadyMiddleware) IsLoaded(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.Loaded() {
+			err := errors.New(errors.ErrNotReady)
+			rest.JsonHandler(func(r *http.Request) *rest.Response {
+				return rest.JsonResponse(
+					rest.WithError(err),
+					rest.SetStatus(statusFromError(err)),
+				)
+			}).ServeHTTP(w, r)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
+
+// ReplicaMiddleware stops followers from taking writes, they are rejected or
+// forwarded to the leader depending on the write policy of the node.
+type ReplicaMiddleware struct {
+	*replication.Node
+}
+
+// IsLeader serves writes on leaders and servers without replication, it
+// wraps the handlers of routes that write rather than a whole router.
+func (m *ReplicaMiddleware) IsLeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.Role() != replication.RoleFollower {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		leader, policy := m.Leader()
+		if target, err := url.Parse(leader); err == nil && policy == replication.WritesForward {
+			httputil.NewSingleHostReverseProxy(target).ServeHTTP(w, r)
+			return
+		}
+
+		writeError(w, r, errors.New(errors.ErrNotLeader))
+	})
+}
+
+// ClusterMiddleware serves requests on the members of a cluster that can
+// serve them, the other members forward them to the leader.
+type ClusterMiddleware struct {
+	*cluster.Node
+}
+
+// IsLeader serves writes on the leader once it is ready to take them and
+// servers that aren't clustered, the other members forward them to the
+// leader. It wraps the handlers of routes that write rather than a whole
+// router.
+func (m *ClusterMiddleware) IsLeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.Node == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		err := m.Write()
+		if err == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if internalErr, ok := err.(*errors.Error); ok && internalErr.Code() == errors.ErrNotLeader {
+			m.forward(w, r)
+			return
+		}
+
+		writeError(w, r, err)
+	})
+}
+
+// IsConsistent serves reads on the members that can serve them with their
+// read consistency and servers that aren't clustered, the other members
+// forward them to the leader or reject them if they are too stale. It wraps
+// the handlers of routes that read rather than a whole router.
+func (m *ClusterMiddleware) IsConsistent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.Node == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		err := m.Read()
+		if err == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if internalErr, ok := err.(*errors.Error); ok && internalErr.Code() == errors.ErrNotLeader {
+			m.forward(w, r)
+			return
+		}
+
+		writeError(w, r, err)
+	})
+}
+
+// forward forwards a request to the leader, unless it was forwarded to
+// this member already.
+func (m *ClusterMiddleware) forward(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(cluster.ForwardedHeader) != "" {
+		writeError(w, r, errors.New(errors.ErrNotLeader))
+		return
+	}
+
+	leader, err := m.LeaderAPIAddress()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	target, err := url.Parse(leader)
+	if err != nil {
+		writeError(w, r, errors.New(errors.ErrNoLeader))
+		return
+	}
+
+	r.Header.Set(cluster.ForwardedHeader, m.ID())
+	httputil.NewSingleHostReverseProxy(target).ServeHTTP(w, r)
+}
+
+// writeError responds to a request with an error returned by a service.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	rest.JsonHandler(func(r *http.Request) *rest.Response {
+		return rest.JsonResponse(
+			rest.WithError(err),
+			rest.SetStatus(statusFromError(err)),
+		)
+	}).ServeHTTP(w, r)
+}
+
+// RequestIDHeader is the header a request ID is propagated in.
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDPattern matches the request IDs accepted from clients, other
+// values are replaced by a generated ID.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestID passes the request ID sent in the X-Request-ID header, or a
+// generated one, to the handlers and loggers through the request context.
+// The ID is echoed in the response header.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = ulid.Make().String()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
+}
+
+// AccessLog logs every request once it has been served.
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := rest.NewStatusRecorder(w)
+		start := time.Now()
+
+		next.ServeHTTP(rec, r)
+
+		slog.InfoContext(r.Context(), "request served",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.Status(),
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+		)
+	})
+}
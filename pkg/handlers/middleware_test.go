@@ -0,0 +1,154 @@
+package handlers_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/handlers"
+	"github.com/nexdb/nexdb/pkg/logging"
+	"github.com/nexdb/nexdb/pkg/services/auth"
+	"github.com/nexdb/nexdb/pkg/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthMiddleware_IsAuthenticated(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		modify func(r *http.Request)
+		want   int
+	}{
+		{
+			name:   "no credentials, expect 401",
+			modify: func(r *http.Request) {},
+			want:   http.StatusUnauthorized,
+		},
+		{
+			name: "valid api key, expect 200",
+			modify: func(r *http.Request) {
+				r.SetBasicAuth("secret", "")
+			},
+			want: http.StatusOK,
+		},
+		{
+			name: "invalid api key, expect 401",
+			modify: func(r *http.Request) {
+				r.SetBasicAuth("wrong", "")
+			},
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "verified client certificate mapped to a key, expect 200",
+			modify: func(r *http.Request) {
+				r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+					{Subject: pkix.Name{CommonName: "reporting"}},
+				}}}
+			},
+			want: http.StatusOK,
+		},
+		{
+			name: "verified client certificate not mapped to a key, expect 401",
+			modify: func(r *http.Request) {
+				r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+					{Subject: pkix.Name{CommonName: "unknown"}},
+				}}}
+			},
+			want: http.StatusUnauthorized,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			s, err := storage.New(storage.MemoryDriver)
+			require.NoError(t, err)
+
+			d := &database.Database{
+				Cache: cache.NewCache(ctx, cache.NewQueue(s)),
+			}
+
+			key := document.New().SetCollection(auth.KeysCollection).SetData(map[string]interface{}{
+				"key":     "secret",
+				"subject": "reporting",
+			})
+			require.NoError(t, d.Put(key, true))
+
+			m := &handlers.AuthMiddleware{AuthService: auth.New(d)}
+
+			var got *auth.Identity
+			h := m.IsAuthenticated(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, _ = auth.FromContext(r.Context())
+			}))
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/", nil)
+			tc.modify(req)
+
+			h.ServeHTTP(rr, req)
+			assert.Equal(t, tc.want, rr.Code)
+
+			if tc.want == http.StatusOK {
+				require.NotNil(t, got)
+				assert.Equal(t, key.ID.String(), got.KeyID)
+			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header string
+		verify func(t *testing.T, id string)
+	}{
+		{
+			name:   "propagates the request id",
+			header: "abc-123",
+			verify: func(t *testing.T, id string) {
+				assert.Equal(t, "abc-123", id)
+			},
+		},
+		{
+			name: "generates a request id",
+			verify: func(t *testing.T, id string) {
+				assert.Len(t, id, 26)
+			},
+		},
+		{
+			name:   "replaces an invalid request id",
+			header: "not valid\"",
+			verify: func(t *testing.T, id string) {
+				assert.Len(t, id, 26)
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var fromContext string
+			h := handlers.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fromContext = logging.RequestID(r.Context())
+			}))
+
+			req := httptest.NewRequest("GET", "/", nil)
+			if tc.header != "" {
+				req.Header.Set(handlers.RequestIDHeader, tc.header)
+			}
+
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			assert.Equal(t, fromContext, rr.Header().Get(handlers.RequestIDHeader))
+			tc.verify(t, fromContext)
+		})
+	}
+}
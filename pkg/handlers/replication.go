@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/nexdb/nexdb/pkg/api/rest"
+	"github.com/nexdb/nexdb/pkg/replication"
+)
+
+// ReplicationStream is a handler that streams the writes of the server to a
+// follower, from the position given by the epoch and seq query parameters.
+func ReplicationStream(n *replication.Node) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// a follower without a position is sent a snapshot
+		seq, _ := strconv.ParseUint(r.URL.Query().Get("seq"), 10, 64)
+		epoch := r.URL.Query().Get("epoch")
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+
+		// the status has been sent once the stream has started, the follower
+		// reconnects when it ends
+		if err := n.Serve(r.Context(), w, epoch, seq); err != nil {
+			slog.WarnContext(r.Context(), "replication stream ended", "error", err)
+		}
+	}
+}
+
+// ReplicationStatus is a handler that reports the replication status of the
+// server.
+func ReplicationStatus(n *replication.Node) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(n.Status()),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// Promote is a handler that promotes a follower to be the leader.
+func Promote(n *replication.Node) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		defer r.Body.Close()
+
+		s, err := n.Promote()
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		slog.InfoContext(r.Context(), "promoted to leader", "epoch", s.Epoch)
+		return rest.JsonResponse(
+			rest.SetStatus(http.StatusOK),
+			rest.SetBody(s),
+			rest.SetWrap("data"),
+		)
+	}
+}
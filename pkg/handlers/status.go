@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/nexdb/nexdb/pkg/api/rest"
+	"github.com/nexdb/nexdb/pkg/services/status"
+)
+
+// Healthz is a handler that reports the server is alive.
+func Healthz() rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		return rest.JsonResponse(
+			rest.SetBody(map[string]string{"status": "ok"}),
+		)
+	}
+}
+
+// Readyz is a handler that reports whether the server is ready to serve
+// requests, the databases must be loaded and storage reachable.
+func Readyz(s *status.Status) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		if err := s.Ready(r.Context()); err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetBody(map[string]string{"status": "ready"}),
+		)
+	}
+}
+
+// Status is a handler that reports the status of the server.
+func Status(s *status.Status) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		return rest.JsonResponse(
+			rest.SetBody(s.Report(r.Context())),
+			rest.SetWrap("data"),
+		)
+	}
+}
@@ -0,0 +1,93 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/handlers"
+	"github.com/nexdb/nexdb/pkg/services/status"
+	"github.com/nexdb/nexdb/pkg/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unreachableStorage is a storage whose backend can't be reached.
+type unreachableStorage struct {
+	storage.Storage
+}
+
+func (unreachableStorage) Ping(context.Context) error {
+	return errors.New("connection refused")
+}
+
+func newStatus(t *testing.T, store storage.Storage) *status.Status {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	system := &database.Database{Cache: cache.NewCache(ctx, cache.NewQueue(store))}
+	require.NoError(t, system.Put(document.New().SetCollection("users"), false))
+
+	m := database.NewManager(ctx, storage.MemoryDriver, system)
+	return status.New(m, store, storage.MemoryDriver, "v1.2.3")
+}
+
+func TestReadyz(t *testing.T) {
+	mem, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name   string
+		store  storage.Storage
+		loaded bool
+		status int
+	}{
+		{name: "not ready while loading", store: mem, status: http.StatusServiceUnavailable},
+		{name: "not ready when storage is unreachable", store: unreachableStorage{Storage: mem}, loaded: true, status: http.StatusServiceUnavailable},
+		{name: "ready once loaded", store: mem, loaded: true, status: http.StatusOK},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			s := newStatus(t, tc.store)
+			if tc.loaded {
+				s.SetLoaded()
+			}
+
+			rr := httptest.NewRecorder()
+			handlers.Readyz(s).ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+			assert.Equal(t, tc.status, rr.Code)
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	mem, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	s := newStatus(t, mem)
+
+	rr := httptest.NewRecorder()
+	handlers.Status(s).ServeHTTP(rr, httptest.NewRequest("GET", "/v1/status", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var body struct {
+		Data status.Report `json:"data"`
+	}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&body))
+
+	assert.Equal(t, "v1.2.3", body.Data.Version)
+	assert.Equal(t, "memory", body.Data.Storage.Driver)
+	assert.True(t, body.Data.Storage.Reachable)
+	require.Len(t, body.Data.Databases, 1)
+	assert.Equal(t, database.DefaultName, body.Data.Databases[0].Name)
+	assert.Equal(t, 1, body.Data.Databases[0].Collections["users"])
+}
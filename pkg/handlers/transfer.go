@@ -0,0 +1,433 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/nexdb/nexdb/pkg/api/rest"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/errors"
+	"github.com/nexdb/nexdb/pkg/services/reader"
+	"github.com/nexdb/nexdb/pkg/services/writer"
+
+	"github.com/gorilla/mux"
+)
+
+// Formats of imports and exports.
+const (
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+)
+
+// flushEvery is the number of exported rows after which the response is
+// flushed to the client.
+const flushEvery = 1000
+
+// maxRowSize is the maximum size of an imported ndjson row.
+const maxRowSize = 16 * 1024 * 1024
+
+// column maps a csv column to a document field, fields of nested objects are
+// given as dot paths.
+type column struct {
+	Header string
+	Field  string
+}
+
+// parseColumns parses a comma separated list of column or column:field.
+func parseColumns(s string) ([]column, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var columns []column
+	for _, part := range strings.Split(s, ",") {
+		header, field, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			field = header
+		}
+
+		if header == "" || field == "" {
+			return nil, errors.New(errors.ErrColumnsAreInvalid)
+		}
+
+		columns = append(columns, column{Header: header, Field: field})
+	}
+
+	return columns, nil
+}
+
+// formatFrom returns the format of a request, given by the format query
+// parameter or, for imports, the content type.
+func formatFrom(r *http.Request) (string, error) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = formatNDJSON
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+			format = formatCSV
+		}
+	}
+
+	if format != formatNDJSON && format != formatCSV {
+		return "", errors.New(errors.ErrFormatIsInvalid)
+	}
+
+	return format, nil
+}
+
+// ExportDocuments is a handler that streams every document of a collection
+// as newline-delimited JSON, or as CSV with the format=csv query parameter.
+// The columns of a CSV export are given by the columns query parameter, they
+// default to _id and every top-level field.
+func ExportDocuments(readerSvc *reader.Reader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fail := func(err error) {
+			rest.JsonHandler(func(r *http.Request) *rest.Response {
+				return rest.JsonResponse(
+					rest.WithError(err),
+					rest.SetStatus(statusFromError(err)),
+				)
+			}).ServeHTTP(w, r)
+		}
+
+		format, err := formatFrom(r)
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		columns, err := parseColumns(r.URL.Query().Get("columns"))
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		collection := mux.Vars(r)["collection"]
+		docs, err := readerSvc.ExportDocuments(r.Context(), collection)
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		if format == formatCSV {
+			if columns == nil {
+				columns = defaultColumns(docs)
+			}
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", `attachment; filename="`+collection+`.csv"`)
+			err = exportCSV(w, docs, columns)
+		} else {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Content-Disposition", `attachment; filename="`+collection+`.ndjson"`)
+			err = exportNDJSON(w, docs)
+		}
+
+		// the status has been sent, a failure leaves the export truncated
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to export documents", "collection", collection, "error", err)
+		}
+	}
+}
+
+// exportNDJSON writes documents as newline-delimited JSON objects of their
+// fields and _id.
+func exportNDJSON(w http.ResponseWriter, docs []*document.Document) error {
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	for i, doc := range docs {
+		row := make(map[string]interface{}, len(doc.Data)+1)
+		for k, v := range doc.Data {
+			row[k] = v
+		}
+		row["_id"] = doc.ID.String()
+
+		if err := enc.Encode(row); err != nil {
+			return err
+		}
+
+		if err := flush(rc, i); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// exportCSV writes documents as CSV rows, nested objects and arrays are
+// written as JSON.
+func exportCSV(w http.ResponseWriter, docs []*document.Document, columns []column) error {
+	rc := http.NewResponseController(w)
+	cw := csv.NewWriter(w)
+
+	header := make([]string, len(columns))
+	for i, c := range columns {
+		header[i] = c.Header
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	record := make([]string, len(columns))
+	for i, doc := range docs {
+		for j, c := range columns {
+			if c.Field == "_id" {
+				record[j] = doc.ID.String()
+				continue
+			}
+
+			record[j] = csvValue(getField(doc.Data, c.Field))
+		}
+
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+
+		if (i+1)%flushEvery == 0 {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+
+			if err := flush(rc, i); err != nil {
+				return err
+			}
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// flush flushes the response every flushEvery rows, responses that can't be
+// flushed are sent once they are written.
+func flush(rc *http.ResponseController, row int) error {
+	if (row+1)%flushEvery != 0 {
+		return nil
+	}
+
+	if err := rc.Flush(); err != nil && !stderrors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+
+	return nil
+}
+
+// defaultColumns returns _id and every top-level field of the documents.
+func defaultColumns(docs []*document.Document) []column {
+	fields := map[string]struct{}{}
+	for _, doc := range docs {
+		for k := range doc.Data {
+			fields[k] = struct{}{}
+		}
+	}
+
+	names := make([]string, 0, len(fields))
+	for k := range fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	columns := []column{{Header: "_id", Field: "_id"}}
+	for _, name := range names {
+		columns = append(columns, column{Header: name, Field: name})
+	}
+
+	return columns
+}
+
+// csvValue returns the CSV cell of a field value.
+func csvValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(v)
+		return string(b)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// getField returns the value of a dot path field.
+func getField(data map[string]interface{}, path string) interface{} {
+	var v interface{} = data
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+
+	return v
+}
+
+// setField sets the value of a dot path field, creating nested objects.
+func setField(data map[string]interface{}, path string, value interface{}) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := data[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			data[key] = next
+		}
+		data = next
+	}
+
+	data[keys[len(keys)-1]] = value
+}
+
+// ImportDocuments is a handler that imports documents into a collection from
+// newline-delimited JSON objects, or from CSV with the format=csv query
+// parameter or a text/csv content type. The first CSV row is the header, the
+// columns query parameter maps columns to fields, otherwise every column is
+// imported as the field of the same name. The id_mode query parameter
+// preserves or regenerates the _id of rows.
+func ImportDocuments(w *writer.Writer) rest.JsonHandler {
+	return func(r *http.Request) *rest.Response {
+		defer r.Body.Close()
+
+		format, err := formatFrom(r)
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		mode := writer.IDMode(r.URL.Query().Get("id_mode"))
+		if mode == "" {
+			mode = writer.IDModeRegenerate
+		}
+
+		var next writer.RowReader
+		if format == formatCSV {
+			columns, err := parseColumns(r.URL.Query().Get("columns"))
+			if err != nil {
+				return rest.JsonResponse(
+					rest.WithError(err),
+					rest.SetStatus(statusFromError(err)),
+				)
+			}
+
+			next, err = csvRows(r.Body, columns)
+			if err != nil {
+				return rest.JsonResponse(
+					rest.WithError(err),
+					rest.SetStatus(http.StatusBadRequest),
+				)
+			}
+		} else {
+			next = ndjsonRows(r.Body)
+		}
+
+		result, err := w.ImportDocuments(r.Context(), mux.Vars(r)["collection"], mode, next)
+		if err != nil {
+			return rest.JsonResponse(
+				rest.WithError(err),
+				rest.SetStatus(statusFromError(err)),
+			)
+		}
+
+		return rest.JsonResponse(
+			rest.SetBody(result),
+			rest.SetWrap("data"),
+		)
+	}
+}
+
+// ndjsonRows returns a row reader of newline-delimited JSON objects, blank
+// lines are skipped. Numbers are kept as json.Number as documents written
+// through the api are.
+func ndjsonRows(r io.Reader) writer.RowReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxRowSize)
+
+	return func() (map[string]interface{}, error) {
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+
+			var row map[string]interface{}
+			dec := json.NewDecoder(bytes.NewReader(line))
+			dec.UseNumber()
+			if err := dec.Decode(&row); err != nil || row == nil || dec.InputOffset() != int64(len(line)) {
+				return nil, fmt.Errorf("%w: must be a json object", writer.ErrInvalidRow)
+			}
+
+			return row, nil
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+
+		return nil, io.EOF
+	}
+}
+
+// csvRows returns a row reader of CSV records, the header is read first.
+// Cells are imported as strings, an empty _id cell is left out.
+func csvRows(r io.Reader, columns []column) (writer.RowReader, error) {
+	cr := csv.NewReader(r)
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read csv header: %w", err)
+	}
+
+	// map the index of each column to its field
+	fields := map[int]string{}
+	for i, h := range header {
+		h = strings.TrimSpace(h)
+		if columns == nil {
+			fields[i] = h
+			continue
+		}
+
+		for _, c := range columns {
+			if c.Header == h {
+				fields[i] = c.Field
+			}
+		}
+	}
+
+	return func() (map[string]interface{}, error) {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+
+		var parseErr *csv.ParseError
+		if stderrors.As(err, &parseErr) {
+			return nil, fmt.Errorf("%w: %s", writer.ErrInvalidRow, parseErr.Err)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		row := map[string]interface{}{}
+		for i, v := range record {
+			field, ok := fields[i]
+			if !ok || (field == "_id" && v == "") {
+				continue
+			}
+
+			setField(row, field, v)
+		}
+
+		return row, nil
+	}, nil
+}
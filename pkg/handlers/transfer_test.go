@@ -0,0 +1,149 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/handlers"
+	"github.com/nexdb/nexdb/pkg/services/reader"
+	"github.com/nexdb/nexdb/pkg/services/writer"
+	"github.com/nexdb/nexdb/pkg/storage"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTransferDatabase(t *testing.T) *database.Database {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	s, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	return &database.Database{
+		Cache: cache.NewCache(ctx, cache.NewQueue(s)),
+	}
+}
+
+func importRows(t *testing.T, d *database.Database, query, contentType, body string) writer.ImportResult {
+	req := httptest.NewRequest("POST", "/collections/users/_import?"+query, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req = mux.SetURLVars(req, map[string]string{"collection": "users"})
+
+	rr := httptest.NewRecorder()
+	handlers.ImportDocuments(writer.New(d)).ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var resp struct {
+		Data writer.ImportResult `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+
+	return resp.Data
+}
+
+func exportRows(t *testing.T, d *database.Database, query string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/collections/users/_export?"+query, nil)
+	req = mux.SetURLVars(req, map[string]string{"collection": "users"})
+
+	rr := httptest.NewRecorder()
+	handlers.ExportDocuments(reader.New(d)).ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestTransfer_NDJSONRoundTrip(t *testing.T) {
+	src := newTransferDatabase(t)
+
+	result := importRows(t, src, "", "application/x-ndjson", `{"name":"John","address":{"city":"Leeds"}}
+
+not json
+{"name":"Jane","visits":9007199254740993}
+`)
+	assert.Equal(t, 2, result.Imported)
+	assert.Equal(t, 1, result.Failed)
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, 2, result.Errors[0].Row)
+
+	// numbers are imported exactly rather than rounded through float64
+	jane := src.Filter("users", cache.Query{And: []cache.Element{{Condition: &cache.Condition{Field: "name", Operator: cache.Equals, Value: "Jane"}}}})
+	require.Len(t, jane, 1)
+	assert.Equal(t, json.Number("9007199254740993"), jane[0].Data["visits"])
+
+	rr := exportRows(t, src, "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/x-ndjson", rr.Header().Get("Content-Type"))
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	require.Len(t, lines, 2)
+
+	// preserving the ids of the export reproduces the documents
+	dst := newTransferDatabase(t)
+	result = importRows(t, dst, "id_mode=preserve", "application/x-ndjson", rr.Body.String())
+	assert.Equal(t, 2, result.Imported)
+
+	for _, doc := range src.Documents() {
+		imported := dst.GetByID(doc.ID.String())
+		require.NotNil(t, imported)
+		assert.Equal(t, doc.Data, imported.Data)
+	}
+
+	// regenerating the ids creates new documents
+	result = importRows(t, dst, "id_mode=regenerate", "application/x-ndjson", rr.Body.String())
+	assert.Equal(t, 2, result.Imported)
+	assert.Len(t, dst.Documents(), 4)
+}
+
+func TestTransfer_CSV(t *testing.T) {
+	d := newTransferDatabase(t)
+
+	result := importRows(t, d, "columns=Name:name,City:address.city", "text/csv", "Name,City,Ignored\nJohn,Leeds,x\nJane,York,y\n")
+	assert.Equal(t, 2, result.Imported)
+
+	docs := d.Documents()
+	require.Len(t, docs, 2)
+	for _, doc := range docs {
+		assert.NotContains(t, doc.Data, "Ignored")
+		assert.Contains(t, doc.Data["address"], "city")
+	}
+
+	rr := exportRows(t, d, "format=csv&columns=name,city:address.city")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/csv", rr.Header().Get("Content-Type"))
+
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, "name,city", lines[0])
+	assert.ElementsMatch(t, []string{"John,Leeds", "Jane,York"}, lines[1:])
+}
+
+func TestTransfer_Invalid(t *testing.T) {
+	d := newTransferDatabase(t)
+
+	for _, tc := range []struct {
+		name  string
+		query string
+	}{
+		{name: "unknown format", query: "format=xml"},
+		{name: "invalid columns", query: "format=csv&columns=name:"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			rr := exportRows(t, d, tc.query)
+			assert.Equal(t, http.StatusBadRequest, rr.Code)
+			assert.Contains(t, rr.Body.String(), `"error"`)
+		})
+	}
+
+	req := httptest.NewRequest("POST", "/collections/users/_import?id_mode=keep", strings.NewReader(`{"name":"John"}`))
+	req = mux.SetURLVars(req, map[string]string{"collection": "users"})
+	rr := httptest.NewRecorder()
+	handlers.ImportDocuments(writer.New(d)).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -0,0 +1,340 @@
+// Package keyring encrypts data with envelope encryption: each payload is
+// sealed with its own data key, which is wrapped by a master key of the
+// keyring. Sealed payloads start with a versioned header naming the master
+// key, so keys can be rotated while payloads sealed with older keys remain
+// readable.
+package keyring
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// KeySize is the size of master and data keys, they are AES-256 keys.
+const KeySize = 32
+
+// version is the version of the header written by Seal.
+const version = 1
+
+// magic starts the header of sealed payloads.
+var magic = []byte("NXE")
+
+var (
+	// ErrKeyInvalid is returned when a key is not 32 bytes long.
+	ErrKeyInvalid = errors.New("key must be 32 bytes")
+	// ErrKeyIDInvalid is returned when a key ID is empty or longer than 255 bytes.
+	ErrKeyIDInvalid = errors.New("key id must be 1 to 255 bytes")
+	// ErrUnknownKey is returned when a payload is sealed with a master key
+	// that is not in the keyring.
+	ErrUnknownKey = errors.New("payload is sealed with a key that is not in the keyring")
+	// ErrNoPrimary is returned when the primary key is not in the keyring.
+	ErrNoPrimary = errors.New("primary key is not in the keyring")
+	// ErrMalformed is returned when a payload can't be opened.
+	ErrMalformed = errors.New("payload is malformed")
+	// ErrUnsupportedVersion is returned when a payload has a header written
+	// by a newer version.
+	ErrUnsupportedVersion = errors.New("payload header version is not supported")
+)
+
+// Keyring holds master keys by ID. Payloads are sealed with the primary
+// key and opened with whichever key they name.
+type Keyring struct {
+	primary string
+	keys    map[string][]byte
+	// plaintext is set while payloads that were never sealed may be read,
+	// see WithPlaintext.
+	plaintext bool
+}
+
+// New returns a keyring of keys whose primary key is primary.
+func New(primary string, keys map[string][]byte) (*Keyring, error) {
+	k := &Keyring{primary: primary, keys: make(map[string][]byte, len(keys))}
+	for id, key := range keys {
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("key %q: %w", id, ErrKeyIDInvalid)
+		}
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("key %q: %w", id, ErrKeyInvalid)
+		}
+		k.keys[id] = key
+	}
+
+	if _, ok := k.keys[primary]; !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNoPrimary, primary)
+	}
+
+	return k, nil
+}
+
+// FromKey returns a keyring of a single key identified by its KeyID, or nil
+// if key is empty.
+func FromKey(key []byte) (*Keyring, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+
+	id := KeyID(key)
+	return New(id, map[string][]byte{id: key})
+}
+
+// KeyID returns the ID of a key that was not given one, derived from its
+// SHA-256.
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// file is the format of a keyring file.
+type file struct {
+	Primary string            `json:"primary"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// Load reads a keyring file, it stands in for a key management service.
+// The file is a JSON object of the primary key ID and the base64 encoded
+// keys by ID:
+//
+//	{"primary": "2024-06", "keys": {"2024-01": "...", "2024-06": "..."}}
+func Load(path string) (*Keyring, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f file
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("keyring file %s: %w", path, err)
+	}
+
+	keys := make(map[string][]byte, len(f.Keys))
+	for id, encoded := range f.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("keyring file %s: key %q: %w", path, id, err)
+		}
+		keys[id] = key
+	}
+
+	k, err := New(f.Primary, keys)
+	if err != nil {
+		return nil, fmt.Errorf("keyring file %s: %w", path, err)
+	}
+
+	return k, nil
+}
+
+// Primary returns the ID of the primary key.
+func (k *Keyring) Primary() string {
+	return k.primary
+}
+
+// IDs returns the sorted IDs of the keys.
+func (k *Keyring) IDs() []string {
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// With returns a keyring of the keys of k and other, the primary key of k
+// is kept.
+func (k *Keyring) With(other *Keyring) *Keyring {
+	merged := &Keyring{primary: k.primary, keys: make(map[string][]byte, len(k.keys)), plaintext: k.plaintext}
+	for id, key := range k.keys {
+		merged.keys[id] = key
+	}
+
+	if other != nil {
+		for id, key := range other.keys {
+			if _, ok := merged.keys[id]; !ok {
+				merged.keys[id] = key
+			}
+		}
+	}
+
+	return merged
+}
+
+// WithPlaintext returns a copy of k that lets payloads that were never
+// sealed be read, for the window while data written before it was encrypted
+// is re-encrypted. Payloads are expected to be sealed otherwise.
+func (k *Keyring) WithPlaintext() *Keyring {
+	c := k.With(nil)
+	c.plaintext = true
+	return c
+}
+
+// AllowsPlaintext reports whether payloads that were never sealed may be
+// read, see WithPlaintext.
+func (k *Keyring) AllowsPlaintext() bool {
+	return k != nil && k.plaintext
+}
+
+// IsSealed reports whether b starts with the header written by Seal.
+func IsSealed(b []byte) bool {
+	return bytes.HasPrefix(b, magic)
+}
+
+// Seal encrypts plaintext with a new data key, which is wrapped by the
+// primary key. The payload is laid out as:
+//
+//	"NXE" | version (1) | key ID length (1) | key ID | wrapped key length (2) | wrapped key | nonce | ciphertext
+//
+// The header is authenticated along with the ciphertext.
+func (k *Keyring) Seal(plaintext []byte) ([]byte, error) {
+	dataKey := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+
+	wrapped, err := seal(k.keys[k.primary], dataKey, []byte(k.primary))
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(magic)+4+len(k.primary)+len(wrapped))
+	header = append(header, magic...)
+	header = append(header, version, byte(len(k.primary)))
+	header = append(header, k.primary...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(wrapped)))
+	header = append(header, wrapped...)
+
+	sealed, err := seal(dataKey, plaintext, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(header, sealed...), nil
+}
+
+// Open decrypts a payload and returns the ID of the master key it was sealed
+// with. Payloads without a header were encrypted directly with a key before
+// envelopes were introduced, every key is tried and the returned ID is
+// empty.
+func (k *Keyring) Open(b []byte) ([]byte, string, error) {
+	if !IsSealed(b) {
+		return k.openLegacy(b)
+	}
+
+	plaintext, id, err := k.openSealed(b)
+	if err != nil {
+		// payloads without a header start with the magic by chance once in
+		// 2^24, their nonce is random
+		if legacy, _, lerr := k.openLegacy(b); lerr == nil {
+			return legacy, "", nil
+		}
+
+		return nil, id, err
+	}
+
+	return plaintext, id, nil
+}
+
+// openLegacy opens a payload without a header with every key.
+func (k *Keyring) openLegacy(b []byte) ([]byte, string, error) {
+	for _, id := range k.IDs() {
+		if plaintext, err := open(k.keys[id], b, nil); err == nil {
+			return plaintext, "", nil
+		}
+	}
+
+	return nil, "", fmt.Errorf("%w: no key in the keyring opens it", ErrMalformed)
+}
+
+// openSealed opens a payload written by Seal.
+func (k *Keyring) openSealed(b []byte) ([]byte, string, error) {
+	r := b[len(magic):]
+	if len(r) < 2 {
+		return nil, "", ErrMalformed
+	}
+	if r[0] != version {
+		return nil, "", fmt.Errorf("%w: %d", ErrUnsupportedVersion, r[0])
+	}
+
+	idLen := int(r[1])
+	r = r[2:]
+	if len(r) < idLen+2 {
+		return nil, "", ErrMalformed
+	}
+	id := string(r[:idLen])
+	r = r[idLen:]
+
+	wrappedLen := int(binary.BigEndian.Uint16(r))
+	r = r[2:]
+	if len(r) < wrappedLen {
+		return nil, "", ErrMalformed
+	}
+	wrapped, sealed := r[:wrappedLen], r[wrappedLen:]
+
+	masterKey, ok := k.keys[id]
+	if !ok {
+		return nil, id, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+
+	dataKey, err := open(masterKey, wrapped, []byte(id))
+	if err != nil {
+		return nil, id, fmt.Errorf("%w: unwrap data key: %v", ErrMalformed, err)
+	}
+
+	plaintext, err := open(dataKey, sealed, b[:len(b)-len(sealed)])
+	if err != nil {
+		return nil, id, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+
+	return plaintext, id, nil
+}
+
+// seal encrypts plaintext with AES-256-GCM, the nonce is prepended.
+func seal(key, plaintext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts a payload written by seal.
+func open(key, b, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < gcm.NonceSize() {
+		return nil, ErrMalformed
+	}
+
+	nonce, ciphertext := b[:gcm.NonceSize()], b[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// newGCM returns an AES-GCM cipher of key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,172 @@
+package keyring_test
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nexdb/nexdb/pkg/keyring"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	oldKey = []byte("key-that-is-thirty-2-bytes-long!")
+	newKey = []byte("another-key-thirty-2-bytes-long!")
+)
+
+func TestKeyring_Rotation(t *testing.T) {
+	before, err := keyring.New("2024-01", map[string][]byte{"2024-01": oldKey})
+	require.NoError(t, err)
+
+	sealed, err := before.Seal([]byte("hello"))
+	require.NoError(t, err)
+	assert.True(t, keyring.IsSealed(sealed))
+
+	// the rotated keyring seals with the new key and still opens the old
+	after, err := keyring.New("2024-06", map[string][]byte{"2024-01": oldKey, "2024-06": newKey})
+	require.NoError(t, err)
+
+	plaintext, keyID, err := after.Open(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(plaintext))
+	assert.Equal(t, "2024-01", keyID)
+
+	resealed, err := after.Seal(plaintext)
+	require.NoError(t, err)
+	_, keyID, err = after.Open(resealed)
+	require.NoError(t, err)
+	assert.Equal(t, "2024-06", keyID)
+
+	// once the old key is retired its payloads name the missing key
+	retired, err := keyring.New("2024-06", map[string][]byte{"2024-06": newKey})
+	require.NoError(t, err)
+	_, keyID, err = retired.Open(sealed)
+	require.ErrorIs(t, err, keyring.ErrUnknownKey)
+	assert.Equal(t, "2024-01", keyID)
+}
+
+func TestKeyring_Open(t *testing.T) {
+	kr, err := keyring.FromKey(oldKey)
+	require.NoError(t, err)
+
+	sealed, err := kr.Seal([]byte("hello"))
+	require.NoError(t, err)
+
+	// payloads encrypted directly with the key, before envelopes
+	gcm := newGCM(t, oldKey)
+	nonce := make([]byte, gcm.NonceSize())
+	legacy := gcm.Seal(nonce, nonce, []byte("hello"), nil)
+
+	// legacy payloads whose random nonce happens to start with the magic
+	magicNonce := append([]byte("NXE"), make([]byte, gcm.NonceSize()-3)...)
+	collision := gcm.Seal(magicNonce, magicNonce, []byte("hello"), nil)
+
+	for _, tc := range []struct {
+		name    string
+		payload func() []byte
+		keyID   string
+		wantErr error
+	}{
+		{
+			name:    "sealed",
+			payload: func() []byte { return sealed },
+			keyID:   keyring.KeyID(oldKey),
+		},
+		{
+			name:    "legacy",
+			payload: func() []byte { return legacy },
+		},
+		{
+			name:    "legacy starting with the magic",
+			payload: func() []byte { return collision },
+		},
+		{
+			name: "tampered key id",
+			payload: func() []byte {
+				b := append([]byte{}, sealed...)
+				b[6] ^= 1
+				return b
+			},
+			wantErr: keyring.ErrUnknownKey,
+		},
+		{
+			name: "tampered ciphertext",
+			payload: func() []byte {
+				b := append([]byte{}, sealed...)
+				b[len(b)-1] ^= 1
+				return b
+			},
+			wantErr: keyring.ErrMalformed,
+		},
+		{
+			name: "newer version",
+			payload: func() []byte {
+				b := append([]byte{}, sealed...)
+				b[3] = 99
+				return b
+			},
+			wantErr: keyring.ErrUnsupportedVersion,
+		},
+		{
+			name:    "truncated",
+			payload: func() []byte { return sealed[:8] },
+			wantErr: keyring.ErrMalformed,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			plaintext, keyID, err := kr.Open(tc.payload())
+			if tc.wantErr != nil {
+				require.ErrorIs(t, err, tc.wantErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, "hello", string(plaintext))
+			assert.Equal(t, tc.keyID, keyID)
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"primary": "2024-06",
+		"keys": {
+			"2024-01": "`+base64.StdEncoding.EncodeToString(oldKey)+`",
+			"2024-06": "`+base64.StdEncoding.EncodeToString(newKey)+`"
+		}
+	}`), 0o600))
+
+	kr, err := keyring.Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, "2024-06", kr.Primary())
+	assert.Equal(t, []string{"2024-01", "2024-06"}, kr.IDs())
+
+	// a key that is not 32 bytes is refused
+	require.NoError(t, os.WriteFile(path, []byte(`{"primary": "a", "keys": {"a": "c2hvcnQ="}}`), 0o600))
+	_, err = keyring.Load(path)
+	require.ErrorIs(t, err, keyring.ErrKeyInvalid)
+
+	// as is a primary key that is not in the keyring
+	require.NoError(t, os.WriteFile(path, []byte(`{"primary": "b", "keys": {"a": "`+base64.StdEncoding.EncodeToString(oldKey)+`"}}`), 0o600))
+	_, err = keyring.Load(path)
+	require.ErrorIs(t, err, keyring.ErrNoPrimary)
+}
+
+func newGCM(t *testing.T, key []byte) cipher.AEAD {
+	t.Helper()
+
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+
+	gcm, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+
+	return gcm
+}
@@ -0,0 +1,47 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/nexdb/nexdb/pkg/logging"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logging.New(&buf)
+
+	t.Cleanup(func() {
+		logging.Level.Set(slog.LevelInfo)
+	})
+
+	ctx := logging.WithRequestID(context.Background(), "req-1")
+
+	logger.DebugContext(ctx, "hidden")
+	assert.Empty(t, buf.String())
+
+	// levels change at runtime
+	logging.Level.Set(slog.LevelDebug)
+	logger.DebugContext(ctx, "shown", "collection", "users")
+
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "shown", record["msg"])
+	assert.Equal(t, "req-1", record["request_id"])
+	assert.Equal(t, "users", record["collection"])
+}
+
+func TestParseLevel(t *testing.T) {
+	l, err := logging.ParseLevel("WARN")
+	require.NoError(t, err)
+	assert.Equal(t, slog.LevelWarn, l)
+
+	_, err = logging.ParseLevel("loud")
+	require.Error(t, err)
+}
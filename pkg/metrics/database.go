@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"github.com/nexdb/nexdb/pkg/database"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	documentsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "cache", "documents"),
+		"Number of documents in the cache by database and collection.",
+		[]string{"database", "collection"}, nil,
+	)
+	queueDepthDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "queue", "depth"),
+		"Number of events waiting to be written to storage by database.",
+		[]string{"database"}, nil,
+	)
+)
+
+// databaseCollector collects the document counts and queue depths of the
+// databases of a manager when scraped.
+type databaseCollector struct {
+	manager *database.Manager
+}
+
+// NewDatabaseCollector returns a collector of the document counts and queue
+// depths of the databases of a manager.
+func NewDatabaseCollector(m *database.Manager) prometheus.Collector {
+	return &databaseCollector{manager: m}
+}
+
+// Describe implements prometheus.Collector.
+func (c *databaseCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- documentsDesc
+	ch <- queueDepthDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *databaseCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, d := range c.manager.Databases() {
+		counts := map[string]int{}
+		for _, doc := range d.Documents() {
+			counts[doc.Collection]++
+		}
+
+		for collection, n := range counts {
+			ch <- prometheus.MustNewConstMetric(documentsDesc, prometheus.GaugeValue, float64(n), d.Name, collection)
+		}
+
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(d.Queue().Len()), d.Name)
+	}
+}
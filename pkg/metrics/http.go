@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/api/rest"
+
+	"github.com/gorilla/mux"
+)
+
+// Middleware records the count and latency of requests. Requests are labelled
+// by their route template rather than path so ids don't blow up the number of
+// series, it must be used by a mux router so the matched route is known.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+
+		rec := rest.NewStatusRecorder(w)
+		start := time.Now()
+
+		next.ServeHTTP(rec, r)
+
+		RequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		RequestsTotal.WithLabelValues(route, r.Method, strconv.Itoa(rec.Status())).Inc()
+	})
+}
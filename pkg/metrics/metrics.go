@@ -0,0 +1,96 @@
+// Package metrics exposes the Prometheus metrics of a server. The collectors
+// are fed by wrappers around the http handlers, the cache queues and the
+// storage implementations.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "nexdb"
+
+// Registry is the registry every metric of the server is registered with.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// RequestsTotal counts the http requests served by route, method and status.
+	RequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of http requests served by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	// RequestDuration observes how long http requests take by route and method.
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to serve http requests by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	// QueueProcessingDuration observes how long queue events take to be
+	// written to storage by operation and result.
+	QueueProcessingDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "queue",
+		Name:      "processing_duration_seconds",
+		Help:      "Time taken to write queued events to storage by operation and result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "result"})
+
+	// StorageDuration observes how long storage calls take by driver and operation.
+	StorageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "storage",
+		Name:      "operation_duration_seconds",
+		Help:      "Time taken by storage operations by driver and operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"driver", "operation"})
+
+	// StorageErrorsTotal counts failed storage calls by driver and operation.
+	StorageErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "storage",
+		Name:      "errors_total",
+		Help:      "Number of failed storage operations by driver and operation.",
+	}, []string{"driver", "operation"})
+
+	// AuthFailuresTotal counts rejected authentication attempts by reason.
+	AuthFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "auth",
+		Name:      "failures_total",
+		Help:      "Number of rejected authentication attempts by reason.",
+	}, []string{"reason"})
+)
+
+// Reasons an authentication attempt is rejected.
+const (
+	AuthMissingCredentials = "missing_credentials"
+	AuthInvalidAPIKey      = "invalid_api_key"
+	AuthInvalidCertificate = "invalid_certificate"
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		RequestsTotal,
+		RequestDuration,
+		QueueProcessingDuration,
+		StorageDuration,
+		StorageErrorsTotal,
+		AuthFailuresTotal,
+	)
+}
+
+// Handler returns the handler serving the metrics of the registry.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
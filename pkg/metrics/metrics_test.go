@@ -0,0 +1,110 @@
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/metrics"
+	"github.com/nexdb/nexdb/pkg/storage"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingStorage is a storage whose writes fail.
+type failingStorage struct {
+	storage.Storage
+}
+
+func (failingStorage) Write(*document.Document) error {
+	return errors.New("write failed")
+}
+
+func TestMiddleware(t *testing.T) {
+	r := mux.NewRouter()
+	r.Use(metrics.Middleware)
+	r.HandleFunc("/v1/collections/{collection}/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}).Methods("GET")
+
+	before := testutil.ToFloat64(metrics.RequestsTotal.WithLabelValues("/v1/collections/{collection}/{id}", "GET", "404"))
+
+	for _, id := range []string{"a", "b"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/collections/users/"+id, nil))
+	}
+
+	// requests are labelled by route template, not by path
+	after := testutil.ToFloat64(metrics.RequestsTotal.WithLabelValues("/v1/collections/{collection}/{id}", "GET", "404"))
+	assert.Equal(t, float64(2), after-before)
+}
+
+func TestStorage(t *testing.T) {
+	mem, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	s := metrics.Storage("test", failingStorage{Storage: mem})
+
+	before := testutil.ToFloat64(metrics.StorageErrorsTotal.WithLabelValues("test", "write"))
+
+	require.Error(t, s.Write(document.New().SetCollection("users")))
+	require.NoError(t, s.Delete(document.New().SetCollection("users")))
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.StorageErrorsTotal.WithLabelValues("test", "write"))-before)
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.StorageErrorsTotal.WithLabelValues("test", "delete")))
+}
+
+func TestQueue(t *testing.T) {
+	mem, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	q := cache.NewQueue(failingStorage{Storage: mem})
+	q.Use(metrics.Queue)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go q.Start(ctx)
+
+	q.Push(cache.Event{Operation: cache.OperationCreate, Document: document.New().SetCollection("users")})
+	q.Push(cache.Event{Operation: cache.OperationDelete, Document: document.New().SetCollection("users")})
+	cancel()
+
+	stats := q.WaitForShutdown()
+	assert.Equal(t, cache.Stats{Flushed: 1, Failed: 1}, stats)
+
+	assert.Equal(t, 2, testutil.CollectAndCount(metrics.QueueProcessingDuration))
+}
+
+func TestDatabaseCollector(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mem, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	system := &database.Database{Cache: cache.NewCache(ctx, cache.NewQueue(mem))}
+	m := database.NewManager(ctx, storage.MemoryDriver, system)
+
+	tenant, err := m.Create("tenant", "")
+	require.NoError(t, err)
+	d, err := m.Get(tenant.Name)
+	require.NoError(t, err)
+
+	require.NoError(t, d.Put(document.New().SetCollection("users"), false))
+	require.NoError(t, d.Put(document.New().SetCollection("users"), false))
+
+	expected := `
+# HELP nexdb_cache_documents Number of documents in the cache by database and collection.
+# TYPE nexdb_cache_documents gauge
+nexdb_cache_documents{collection="_databases",database="default"} 1
+nexdb_cache_documents{collection="users",database="tenant"} 2
+`
+	require.NoError(t, testutil.CollectAndCompare(metrics.NewDatabaseCollector(m), strings.NewReader(expected), "nexdb_cache_documents"))
+}
@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/database/cache"
+)
+
+// Queue is a cache.Middleware that records how long events take to be
+// written to storage.
+func Queue(next cache.Processor) cache.Processor {
+	return func(event cache.Event) error {
+		start := time.Now()
+		err := next(event)
+
+		QueueProcessingDuration.
+			WithLabelValues(event.Operation.String(), result(err)).
+			Observe(time.Since(start).Seconds())
+
+		return err
+	}
+}
+
+// result returns the result label of an error.
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+
+	return "success"
+}
@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/storage"
+)
+
+// instrumentedStorage records the duration and errors of storage calls.
+type instrumentedStorage struct {
+	next   storage.Storage
+	driver string
+}
+
+// Storage is a storage.Middleware that records the duration and errors of
+// the calls to a storage implementation.
+func Storage(d storage.Driver, next storage.Storage) storage.Storage {
+	return &instrumentedStorage{next: next, driver: string(d)}
+}
+
+// Write writes a document to the storage.
+func (s *instrumentedStorage) Write(doc *document.Document) error {
+	return s.observe("write", func() error {
+		return s.next.Write(doc)
+	})
+}
+
+// Delete deletes a document from the storage.
+func (s *instrumentedStorage) Delete(doc *document.Document) error {
+	return s.observe("delete", func() error {
+		return s.next.Delete(doc)
+	})
+}
+
+// Stream streams documents from the storage, only the time taken to start
+// the stream is recorded.
+func (s *instrumentedStorage) Stream() (<-chan *document.Document, error) {
+	var ch <-chan *document.Document
+	err := s.observe("stream", func() error {
+		var err error
+		ch, err = s.next.Stream()
+		return err
+	})
+
+	return ch, err
+}
+
+// StreamErrors forwards to the wrapped storage, see storage.StreamErrors,
+// only the time taken to start the stream is recorded.
+func (s *instrumentedStorage) StreamErrors(ctx context.Context) (<-chan *document.Document, <-chan error, error) {
+	var (
+		docs <-chan *document.Document
+		errs <-chan error
+	)
+	err := s.observe("stream", func() error {
+		var err error
+		docs, errs, err = storage.StreamErrors(ctx, s.next)
+		return err
+	})
+
+	return docs, errs, err
+}
+
+// Ping forwards to the wrapped storage if it implements storage.Pinger.
+func (s *instrumentedStorage) Ping(ctx context.Context) error {
+	return s.observe("ping", func() error {
+		return storage.Ping(ctx, s.next)
+	})
+}
+
+// Describe forwards to the wrapped storage if it implements storage.Describer.
+func (s *instrumentedStorage) Describe() map[string]string {
+	return storage.Describe(s.next)
+}
+
+// Close forwards to the wrapped storage if it implements io.Closer.
+func (s *instrumentedStorage) Close() error {
+	return storage.Close(s.next)
+}
+
+// observe records the duration of fn and counts its error, if any.
+func (s *instrumentedStorage) observe(operation string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+
+	StorageDuration.WithLabelValues(s.driver, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		StorageErrorsTotal.WithLabelValues(s.driver, operation).Inc()
+	}
+
+	return err
+}
@@ -0,0 +1,504 @@
+// Package migrate copies every database from one storage driver to another.
+//
+// A migration reads the source while it copies it, so the servers writing to
+// the source must be stopped first. Documents written during a migration may
+// be missed and those deleted may be copied anyway, which fails the
+// verification at the end. Documents that can't be read fail the migration
+// rather than being left behind.
+package migrate
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/keyring"
+	"github.com/nexdb/nexdb/pkg/storage"
+)
+
+// checkpointEvery is the number of copied documents after which the
+// checkpoint is flushed to disk.
+const checkpointEvery = 100
+
+var (
+	// ErrVerificationFailed is returned when the target doesn't hold the
+	// same documents as the source.
+	ErrVerificationFailed = errors.New("verification failed")
+)
+
+// Opener returns the storage of a database, encryptionKey is the key of the
+// database and is empty for the default database and databases without
+// their own key.
+type Opener func(name, encryptionKey string) (storage.Storage, error)
+
+// Options are the settings of a migration.
+type Options struct {
+	// Source opens the storage documents are read from.
+	Source Opener
+	// Target opens the storage documents are written to, it re-encrypts
+	// documents if its key differs from the source.
+	Target Opener
+	// Checkpoint is the path of the file copied documents are recorded in,
+	// an interrupted migration given the same checkpoint resumes where it
+	// stopped. Resuming is disabled if it is empty.
+	Checkpoint string
+	// SourceKeyring and TargetKeyring are the keyrings the keys of
+	// databases are sealed with in the source and target, see
+	// database.SealKey. Sealed keys are resealed for the target.
+	SourceKeyring *keyring.Keyring
+	TargetKeyring *keyring.Keyring
+}
+
+// reseal returns the key of a database as it is recorded in the target,
+// sealed keys are opened with the source keyring and sealed with the
+// target keyring.
+func (o Options) reseal(encryptionKey string) (string, error) {
+	if !database.IsSealedKey(encryptionKey) {
+		return encryptionKey, nil
+	}
+
+	key, err := database.OpenKey(o.SourceKeyring, encryptionKey)
+	if err != nil {
+		return "", err
+	}
+
+	return database.SealKey(o.TargetKeyring, key)
+}
+
+// isDatabaseRecord reports whether doc records a database, see
+// database.Metadata.
+func isDatabaseRecord(name string, doc *document.Document) bool {
+	return name == database.DefaultName && doc.Collection == database.DatabasesCollection
+}
+
+// withKey returns a copy of the record of a database with its key set to
+// encryptionKey.
+func withKey(doc *document.Document, encryptionKey string) *document.Document {
+	data := make(map[string]interface{}, len(doc.Data))
+	for k, v := range doc.Data {
+		data[k] = v
+	}
+	data["encryption_key"] = encryptionKey
+
+	return document.New().SetID(doc.ID.String()).SetCollection(doc.Collection).SetData(data)
+}
+
+// Database is the result of migrating or verifying a database.
+type Database struct {
+	Name string `json:"name"`
+	// Documents is the number of documents in the source.
+	Documents int `json:"documents"`
+	// Copied is the number of documents written to the target.
+	Copied int `json:"copied"`
+	// Skipped is the number of documents copied by an earlier run.
+	Skipped int `json:"skipped"`
+	// Checksum is the SHA-256 of the sorted checksums of the documents.
+	Checksum string `json:"checksum"`
+}
+
+// Report is the result of a migration.
+type Report struct {
+	Databases []Database `json:"databases"`
+}
+
+// Documents returns the number of documents of every database.
+func (r *Report) Documents() int {
+	n := 0
+	for _, db := range r.Databases {
+		n += db.Documents
+	}
+
+	return n
+}
+
+// Run copies every database from the source to the target and verifies the
+// target holds the same documents. The default database is copied first,
+// the other databases are found in its database collection. Writes to the
+// source must be stopped for the duration of the run, there is no catch-up
+// pass for documents written or deleted while it is copied. The run fails
+// at the first document that can't be read, with a *storage.ObjectError.
+func Run(ctx context.Context, opts Options) (*Report, error) {
+	cp, err := openCheckpoint(opts.Checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer cp.Close()
+
+	report := &Report{}
+	err = walk(opts.Source, func(name, encryptionKey string, src storage.Storage) error {
+		key, err := opts.reseal(encryptionKey)
+		if err != nil {
+			return fmt.Errorf("database %s: %w", name, err)
+		}
+
+		dst, err := opts.Target(name, key)
+		if err != nil {
+			return fmt.Errorf("database %s: %w", name, err)
+		}
+		defer storage.Close(dst)
+
+		db, err := copyDatabase(ctx, name, src, dst, cp, opts)
+		if err != nil {
+			return fmt.Errorf("database %s: %w", name, err)
+		}
+
+		slog.Info("database copied", "database", name, "documents", db.Documents, "copied", db.Copied, "skipped", db.Skipped)
+		report.Databases = append(report.Databases, db)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	if err := cp.Flush(); err != nil {
+		return report, err
+	}
+
+	if _, err := Verify(ctx, opts); err != nil {
+		return report, err
+	}
+
+	// the migration is complete, a later one must start from scratch
+	return report, cp.Remove()
+}
+
+// Verify checks the target holds the same documents as the source, by the
+// number of documents and the checksum of every database.
+func Verify(ctx context.Context, opts Options) (*Report, error) {
+	report := &Report{}
+	err := walk(opts.Source, func(name, encryptionKey string, src storage.Storage) error {
+		key, err := opts.reseal(encryptionKey)
+		if err != nil {
+			return fmt.Errorf("database %s: %w", name, err)
+		}
+
+		dst, err := opts.Target(name, key)
+		if err != nil {
+			return fmt.Errorf("database %s: %w", name, err)
+		}
+		defer storage.Close(dst)
+
+		want, err := checksum(ctx, name, src, opts.SourceKeyring)
+		if err != nil {
+			return fmt.Errorf("database %s: %w", name, err)
+		}
+
+		got, err := checksum(ctx, name, dst, opts.TargetKeyring)
+		if err != nil {
+			return fmt.Errorf("database %s: %w", name, err)
+		}
+
+		if want.Documents != got.Documents || want.Checksum != got.Checksum {
+			return fmt.Errorf("%w: database %s has %d documents with checksum %s in the source and %d with checksum %s in the target",
+				ErrVerificationFailed, name, want.Documents, want.Checksum, got.Documents, got.Checksum)
+		}
+
+		want.Name = name
+		report.Databases = append(report.Databases, want)
+		return nil
+	})
+
+	return report, err
+}
+
+// walk opens the storage of every database of the source, the default
+// database first, and passes it to fn. Each storage is closed once fn is
+// done with it.
+func walk(source Opener, fn func(name, encryptionKey string, s storage.Storage) error) error {
+	system, err := source(database.DefaultName, "")
+	if err != nil {
+		return fmt.Errorf("database %s: %w", database.DefaultName, err)
+	}
+	defer storage.Close(system)
+
+	if err := fn(database.DefaultName, "", system); err != nil {
+		return err
+	}
+
+	// the other databases and their keys are found in the database
+	// collection of the default database
+	keys := map[string]string{}
+	if err := each(context.Background(), system, func(doc *document.Document) error {
+		if doc.Collection == database.DatabasesCollection {
+			name, encryptionKey := database.Metadata(doc)
+			keys[name] = encryptionKey
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		s, err := source(name, keys[name])
+		if err != nil {
+			return fmt.Errorf("database %s: %w", name, err)
+		}
+
+		err = fn(name, keys[name], s)
+		storage.Close(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyDatabase writes every document of src to dst, documents recorded in
+// the checkpoint with the same checksum are skipped. The keys of the
+// databases recorded by the default database are resealed for the target.
+func copyDatabase(ctx context.Context, name string, src, dst storage.Storage, cp *checkpoint, opts Options) (Database, error) {
+	db := Database{Name: name}
+
+	sums := []string{}
+	err := each(ctx, src, func(doc *document.Document) error {
+		sum, err := sumOf(name, doc, opts.SourceKeyring)
+		if err != nil {
+			return err
+		}
+		db.Documents++
+		sums = append(sums, sum)
+
+		key := name + "/" + doc.Collection + "/" + doc.ID.String()
+		if cp.Done(key, sum) {
+			db.Skipped++
+			return nil
+		}
+
+		if isDatabaseRecord(name, doc) {
+			_, encryptionKey := database.Metadata(doc)
+			key, err := opts.reseal(encryptionKey)
+			if err != nil {
+				return fmt.Errorf("database %s: %w", doc.ID, err)
+			}
+			doc = withKey(doc, key)
+		}
+
+		if err := storage.WriteContext(ctx, dst, doc); err != nil {
+			return fmt.Errorf("write %s/%s: %w", doc.Collection, doc.ID, err)
+		}
+		db.Copied++
+
+		return cp.Record(key, sum, db.Copied%checkpointEvery == 0)
+	})
+
+	db.Checksum = combine(sums)
+	return db, err
+}
+
+// checksum returns the number of documents and the checksum of the storage
+// of the named database, kr opens the keys of the databases it records.
+func checksum(ctx context.Context, name string, s storage.Storage, kr *keyring.Keyring) (Database, error) {
+	db := Database{}
+
+	sums := []string{}
+	err := each(ctx, s, func(doc *document.Document) error {
+		sum, err := sumOf(name, doc, kr)
+		if err != nil {
+			return err
+		}
+		db.Documents++
+		sums = append(sums, sum)
+		return nil
+	})
+
+	db.Checksum = combine(sums)
+	return db, err
+}
+
+// each passes every document of a storage to fn, it stops at the first
+// error, including documents that can't be read.
+func each(ctx context.Context, s storage.Storage, fn func(doc *document.Document) error) error {
+	// stop the stream on return so the storage isn't left blocked
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	docs, errs, err := storage.StreamErrors(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	for docs != nil || errs != nil {
+		select {
+		case doc, ok := <-docs:
+			if !ok {
+				docs = nil
+				continue
+			}
+
+			if err := fn(doc); err != nil {
+				return err
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// sumOf returns the SHA-256 of the unencrypted encoding of a document of the
+// named database, which is the same whichever key and driver it is stored
+// with. Sealed keys of databases are summed opened with kr, as they are
+// sealed afresh for the target.
+func sumOf(name string, doc *document.Document, kr *keyring.Keyring) (string, error) {
+	if isDatabaseRecord(name, doc) {
+		if _, encryptionKey := database.Metadata(doc); database.IsSealedKey(encryptionKey) {
+			key, err := database.OpenKey(kr, encryptionKey)
+			if err != nil {
+				return "", fmt.Errorf("database %s: %w", doc.ID, err)
+			}
+			doc = withKey(doc, key)
+		}
+	}
+
+	b, err := doc.ToStorage(nil)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// combine returns the SHA-256 of checksums regardless of their order.
+func combine(sums []string) string {
+	sort.Strings(sums)
+
+	h := sha256.New()
+	for _, sum := range sums {
+		h.Write([]byte(sum))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// checkpoint records the documents copied by a migration, one line of key
+// and checksum per document.
+type checkpoint struct {
+	path string
+	done map[string]string
+	file *os.File
+	w    *bufio.Writer
+}
+
+// openCheckpoint reads the documents recorded at path and opens it for
+// appending, a checkpoint without a path records nothing.
+func openCheckpoint(path string) (*checkpoint, error) {
+	cp := &checkpoint{path: path, done: map[string]string{}}
+	if path == "" {
+		return cp, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// a line cut short by a crash is ignored, its document is copied again
+		key, sum, ok := strings.Cut(scanner.Text(), " ")
+		if ok && len(sum) == sha256.Size*2 {
+			cp.done[key] = sum
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if len(cp.done) > 0 {
+		slog.Info("resuming migration", "checkpoint", path, "documents", len(cp.done))
+	}
+
+	cp.file = f
+	cp.w = bufio.NewWriter(f)
+	return cp, nil
+}
+
+// Done reports whether the document was copied with the same checksum.
+func (c *checkpoint) Done(key, sum string) bool {
+	return c.done[key] == sum
+}
+
+// Record records a copied document, the checkpoint is written to disk if
+// flush is set.
+func (c *checkpoint) Record(key, sum string, flush bool) error {
+	if c.w == nil {
+		return nil
+	}
+
+	if _, err := c.w.WriteString(key + " " + sum + "\n"); err != nil {
+		return err
+	}
+
+	if flush {
+		return c.Flush()
+	}
+
+	return nil
+}
+
+// Flush writes the recorded documents to disk.
+func (c *checkpoint) Flush() error {
+	if c.w == nil {
+		return nil
+	}
+
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	return c.file.Sync()
+}
+
+// Close flushes and closes the checkpoint.
+func (c *checkpoint) Close() error {
+	if c.file == nil {
+		return nil
+	}
+
+	err := c.Flush()
+	if cerr := c.file.Close(); err == nil {
+		err = cerr
+	}
+	c.file, c.w = nil, nil
+
+	return err
+}
+
+// Remove closes and deletes the checkpoint.
+func (c *checkpoint) Remove() error {
+	if err := c.Close(); err != nil {
+		return err
+	}
+
+	if c.path == "" {
+		return nil
+	}
+
+	return os.Remove(c.path)
+}
@@ -0,0 +1,212 @@
+package migrate_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/keyring"
+	"github.com/nexdb/nexdb/pkg/migrate"
+	"github.com/nexdb/nexdb/pkg/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	sourceKey = "key-that-is-thirty-2-bytes-long!"
+	targetKey = "another-key-thirty-2-bytes-long!"
+	tenantKey = "tenant-key-is-thirty-2-bytes-ok!"
+)
+
+// opener returns an opener of filesystem storage in dir, key is the key of
+// the default database.
+func opener(dir, key string) migrate.Opener {
+	return func(name, encryptionKey string) (storage.Storage, error) {
+		return database.OpenStorage(storage.FilesystemDriver, name, encryptionKey,
+			storage.WithPath(dir), storage.WithEncryptionKey([]byte(key)))
+	}
+}
+
+// seed writes a default database holding an api key and a tenant database
+// with its own key holding two users, the key is recorded in plaintext.
+func seed(t *testing.T, open migrate.Opener) {
+	t.Helper()
+	seedKey(t, open, tenantKey)
+}
+
+// seedKey is seed with the key of the tenant recorded as recordedKey.
+func seedKey(t *testing.T, open migrate.Opener, recordedKey string) {
+	t.Helper()
+
+	system, err := open(database.DefaultName, "")
+	require.NoError(t, err)
+	require.NoError(t, system.Write(document.New().SetCollection("_api_keys").SetData(map[string]interface{}{"key": "secret"})))
+	require.NoError(t, system.Write(document.New().SetCollection(database.DatabasesCollection).SetData(map[string]interface{}{
+		"name":           "tenant",
+		"encryption_key": recordedKey,
+	})))
+
+	tenant, err := open("tenant", tenantKey)
+	require.NoError(t, err)
+	for _, name := range []string{"ada", "grace"} {
+		require.NoError(t, tenant.Write(document.New().SetCollection("users").SetData(map[string]interface{}{"name": name})))
+	}
+}
+
+func TestRun(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	seed(t, opener(src, sourceKey))
+
+	report, err := migrate.Run(context.Background(), migrate.Options{
+		Source:     opener(src, sourceKey),
+		Target:     opener(dst, targetKey),
+		Checkpoint: checkpoint,
+	})
+	require.NoError(t, err)
+	require.Len(t, report.Databases, 2)
+	assert.Equal(t, database.DefaultName, report.Databases[0].Name)
+	assert.Equal(t, "tenant", report.Databases[1].Name)
+	assert.Equal(t, 4, report.Documents())
+
+	// the checkpoint of a completed migration is removed
+	assert.NoFileExists(t, checkpoint)
+
+	// the default database is re-encrypted, the tenant keeps its own key
+	_, err = migrate.Verify(context.Background(), migrate.Options{Source: opener(src, sourceKey), Target: opener(dst, targetKey)})
+	require.NoError(t, err)
+
+	tenant, err := opener(dst, "")("tenant", tenantKey)
+	require.NoError(t, err)
+	users, err := tenant.Stream()
+	require.NoError(t, err)
+	n := 0
+	for range users {
+		n++
+	}
+	assert.Equal(t, 2, n)
+}
+
+func TestRun_SealedKey(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	sourceKeyring, err := keyring.FromKey([]byte(sourceKey))
+	require.NoError(t, err)
+	targetKeyring, err := keyring.FromKey([]byte(targetKey))
+	require.NoError(t, err)
+
+	sealed, err := database.SealKey(sourceKeyring, tenantKey)
+	require.NoError(t, err)
+	seedKey(t, opener(src, sourceKey), sealed)
+
+	opts := migrate.Options{
+		Source:        opener(src, sourceKey),
+		Target:        opener(dst, targetKey),
+		SourceKeyring: sourceKeyring,
+		TargetKeyring: targetKeyring,
+	}
+	report, err := migrate.Run(context.Background(), opts)
+	require.NoError(t, err)
+	assert.Equal(t, 4, report.Documents())
+
+	// the key of the tenant is resealed with the key of the target
+	system, err := opener(dst, targetKey)(database.DefaultName, "")
+	require.NoError(t, err)
+	docs, err := system.Stream()
+	require.NoError(t, err)
+	var recorded string
+	for doc := range docs {
+		if doc.Collection == database.DatabasesCollection {
+			_, recorded = database.Metadata(doc)
+		}
+	}
+	require.True(t, database.IsSealedKey(recorded))
+	_, err = database.OpenKey(sourceKeyring, recorded)
+	require.Error(t, err)
+	key, err := database.OpenKey(targetKeyring, recorded)
+	require.NoError(t, err)
+	assert.Equal(t, tenantKey, key)
+
+	_, err = migrate.Verify(context.Background(), opts)
+	require.NoError(t, err)
+}
+
+func TestRun_Resume(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	seed(t, opener(src, sourceKey))
+
+	// a first run that fails once the default database is copied
+	_, err := migrate.Run(context.Background(), migrate.Options{
+		Source: opener(src, sourceKey),
+		Target: func(name, encryptionKey string) (storage.Storage, error) {
+			if name != database.DefaultName {
+				return nil, os.ErrPermission
+			}
+			return opener(dst, targetKey)(name, encryptionKey)
+		},
+		Checkpoint: checkpoint,
+	})
+	require.ErrorIs(t, err, os.ErrPermission)
+	assert.FileExists(t, checkpoint)
+
+	report, err := migrate.Run(context.Background(), migrate.Options{
+		Source:     opener(src, sourceKey),
+		Target:     opener(dst, targetKey),
+		Checkpoint: checkpoint,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Databases[0].Skipped)
+	assert.Equal(t, 0, report.Databases[0].Copied)
+	assert.Equal(t, 2, report.Databases[1].Copied)
+}
+
+func TestVerify(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	seed(t, opener(src, sourceKey))
+
+	_, err := migrate.Run(context.Background(), migrate.Options{
+		Source: opener(src, sourceKey),
+		Target: opener(dst, targetKey),
+	})
+	require.NoError(t, err)
+
+	// a document changed in the target is caught by its checksum
+	target, err := opener(dst, targetKey)(database.DefaultName, "")
+	require.NoError(t, err)
+	docs, err := target.Stream()
+	require.NoError(t, err)
+	var doc *document.Document
+	for d := range docs {
+		if d.Collection == "_api_keys" {
+			doc = d
+		}
+	}
+	require.NotNil(t, doc)
+	doc.Data["key"] = "changed"
+	require.NoError(t, target.Write(doc))
+
+	_, err = migrate.Verify(context.Background(), migrate.Options{Source: opener(src, sourceKey), Target: opener(dst, targetKey)})
+	require.ErrorIs(t, err, migrate.ErrVerificationFailed)
+}
+
+func TestRun_UnreadableDocument(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	seed(t, opener(src, sourceKey))
+
+	// a document of the tenant that can't be decrypted
+	files, err := filepath.Glob(filepath.Join(src, "_db", "tenant", "users", "*"))
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	require.NoError(t, os.WriteFile(files[0], []byte("NXEcorrupt"), 0o600))
+
+	_, err = migrate.Run(context.Background(), migrate.Options{
+		Source: opener(src, sourceKey),
+		Target: opener(dst, targetKey),
+	})
+	var objErr *storage.ObjectError
+	require.ErrorAs(t, err, &objErr)
+}
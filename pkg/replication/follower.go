@@ -0,0 +1,289 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
+)
+
+// maxBackoff is the longest a follower waits before reconnecting.
+const maxBackoff = 30 * time.Second
+
+// Start follows the leader of a follower until the context is cancelled or
+// it is promoted, reconnecting whenever the stream ends. It returns straight
+// away for leaders.
+func (n *Node) Start(ctx context.Context) {
+	n.mx.Lock()
+	if n.role != RoleFollower {
+		n.mx.Unlock()
+		return
+	}
+
+	ctx, n.stop = context.WithCancel(ctx)
+	n.done = make(chan struct{})
+	defer close(n.done)
+	n.following.Leader = n.leader
+	n.mx.Unlock()
+
+	backoff := time.Second
+	for {
+		connected, err := n.follow(ctx)
+		n.setConnected(false)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if connected {
+			backoff = time.Second
+		}
+		slog.Warn("lost the replication stream of the leader, reconnecting", "leader", n.leader, "error", err, "in", backoff.String())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// follow applies the writes streamed by the leader until the stream ends,
+// it reports whether the stream was opened.
+func (n *Node) follow(ctx context.Context) (bool, error) {
+	// a leader that stops streaming without closing the stream is given up
+	// on once it misses three heartbeats
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	silence := time.AfterFunc(3*n.heartbeat, cancel)
+	defer silence.Stop()
+
+	n.mx.RLock()
+	epoch, seq := n.following.Epoch, n.following.Seq
+	n.mx.RUnlock()
+
+	resp, err := n.open(ctx, epoch, seq)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	n.setConnected(true)
+	slog.Info("following the leader", "leader", n.leader, "epoch", epoch, "seq", seq)
+
+	var pending *snapshot
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg Message
+		if err := dec.Decode(&msg); err != nil {
+			return true, err
+		}
+		silence.Reset(3 * n.heartbeat)
+
+		switch msg.Type {
+		case MessageSnapshot:
+			pending = &snapshot{documents: map[string][]*document.Document{}}
+		case MessageDocument:
+			if pending == nil {
+				return true, fmt.Errorf("document streamed outside of a snapshot")
+			}
+			pending.documents[msg.Database] = append(pending.documents[msg.Database], msg.Document)
+		case MessageSynced:
+			if pending == nil {
+				return true, fmt.Errorf("snapshot ended before it started")
+			}
+			if err := n.restore(ctx, pending); err != nil {
+				return true, err
+			}
+			pending = nil
+			n.applied(msg.Epoch, msg.Seq)
+			slog.Info("restored a snapshot of the leader", "leader", n.leader, "epoch", msg.Epoch, "seq", msg.Seq)
+		case MessageWrite:
+			if err := n.apply(ctx, msg); err != nil {
+				return true, err
+			}
+			n.applied("", msg.Seq)
+		case MessageHeartbeat:
+			n.heard(msg.Seq)
+		}
+	}
+}
+
+// open opens the stream of the leader from the given position.
+func (n *Node) open(ctx context.Context, epoch string, seq uint64) (*http.Response, error) {
+	query := url.Values{}
+	query.Set("epoch", epoch)
+	query.Set("seq", strconv.FormatUint(seq, 10))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(n.leader, "/")+StreamPath+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(n.apiKey, "")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("leader responded with %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return resp, nil
+}
+
+// snapshot is a snapshot of the leader being streamed.
+type snapshot struct {
+	// documents are the documents of each database by name.
+	documents map[string][]*document.Document
+}
+
+// restore replaces the documents of every database with those of a
+// snapshot, opening and dropping databases to match it.
+func (n *Node) restore(ctx context.Context, s *snapshot) error {
+	// the default database first, it records the other databases
+	system, err := n.manager.Get(database.DefaultName)
+	if err != nil {
+		return err
+	}
+
+	if err := n.replace(ctx, system, s.documents[database.DefaultName]); err != nil {
+		return err
+	}
+
+	if err := n.manager.Sync(); err != nil {
+		return err
+	}
+
+	for _, d := range n.manager.Databases() {
+		if d.Name == database.DefaultName {
+			continue
+		}
+
+		if err := n.replace(ctx, d, s.documents[d.Name]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replace replaces the documents of d with docs, documents that are
+// unchanged are left alone.
+func (n *Node) replace(ctx context.Context, d *database.Database, docs []*document.Document) error {
+	keep := make(map[string]bool, len(docs))
+	for _, doc := range docs {
+		id := doc.ID.String()
+		keep[id] = true
+
+		current := d.GetAnyByID(id)
+		if current != nil && current.Collection == doc.Collection && reflect.DeepEqual(current.Data, doc.Data) {
+			continue
+		}
+
+		if err := d.PutContext(ctx, doc, n.shared); err != nil {
+			return err
+		}
+	}
+
+	for _, doc := range d.Documents() {
+		if !keep[doc.ID.String()] {
+			if err := n.delete(ctx, d, doc.ID.String()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// apply applies a write streamed by the leader, writes of databases that
+// aren't open are skipped.
+func (n *Node) apply(ctx context.Context, msg Message) error {
+	if msg.Document == nil {
+		return fmt.Errorf("write %d has no document", msg.Seq)
+	}
+
+	d, err := n.manager.Get(msg.Database)
+	if err != nil {
+		slog.Debug("skipped a write of a database that isn't open", "database", msg.Database, "seq", msg.Seq)
+		return nil
+	}
+
+	if msg.Operation == cache.OperationDelete.String() {
+		err = n.delete(ctx, d, msg.Document.ID.String())
+	} else {
+		err = d.PutContext(ctx, msg.Document, n.shared)
+	}
+	if err != nil {
+		return err
+	}
+
+	// databases are created and dropped by writing their metadata
+	if d.Name == database.DefaultName && msg.Document.Collection == database.DatabasesCollection {
+		return n.manager.Sync()
+	}
+
+	return nil
+}
+
+// delete deletes a document of d, from its cache alone if the storage is
+// shared with the leader.
+func (n *Node) delete(ctx context.Context, d *database.Database, id string) error {
+	if n.shared {
+		d.Evict(id)
+		return nil
+	}
+
+	return d.DeleteContext(ctx, id)
+}
+
+// setConnected records whether the follower is connected to its leader.
+func (n *Node) setConnected(connected bool) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	n.following.Connected = connected
+	if connected {
+		n.following.LastContact = time.Now()
+	}
+}
+
+// applied records the position the follower has applied the writes of the
+// leader up to, the epoch is only given by snapshots and kept otherwise.
+func (n *Node) applied(epoch string, seq uint64) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	if epoch != "" {
+		// a snapshot, possibly of a leader that has restarted since
+		n.following.Epoch = epoch
+		n.following.LeaderSeq = seq
+	}
+	n.following.Seq = seq
+	n.following.LeaderSeq = max(n.following.LeaderSeq, seq)
+	n.following.LastContact = time.Now()
+}
+
+// heard records a heartbeat of the leader.
+func (n *Node) heard(seq uint64) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	n.following.LeaderSeq = seq
+	n.following.LastContact = time.Now()
+}
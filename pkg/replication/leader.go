@@ -0,0 +1,112 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/database/cache"
+)
+
+// Serve streams the writes of the node to a follower until ctx is done. The
+// follower has applied the writes of the log with the given epoch up to seq,
+// it is sent a snapshot first if the log can't catch it up from there.
+//
+// An error is returned if the stream can't be written to, or the follower
+// falls too far behind for the log to keep up with it.
+func (n *Node) Serve(ctx context.Context, w http.ResponseWriter, epoch string, seq uint64) error {
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+
+	logEpoch, _ := n.log.Position()
+	if _, _, ok := n.log.Since(seq); epoch != logEpoch || !ok {
+		var err error
+		if seq, err = n.snapshot(enc); err != nil {
+			return err
+		}
+	}
+
+	// the follower is waiting for the stream to start
+	if err := rc.Flush(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(n.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		entries, appended, ok := n.log.Since(seq)
+		if !ok {
+			return fmt.Errorf("follower fell behind the log at write %d", seq)
+		}
+
+		for _, e := range entries {
+			if err := enc.Encode(Message{
+				Type:      MessageWrite,
+				Seq:       e.Seq,
+				Database:  e.Database,
+				Operation: e.Operation.String(),
+				Document:  e.Document,
+			}); err != nil {
+				return err
+			}
+			seq = e.Seq
+		}
+
+		if len(entries) > 0 {
+			if err := rc.Flush(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-appended:
+		case <-ticker.C:
+			epoch, latest := n.log.Position()
+			if err := enc.Encode(Message{Type: MessageHeartbeat, Epoch: epoch, Seq: latest}); err != nil {
+				return err
+			}
+			if err := rc.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// snapshot streams every document of every database, it returns the number
+// of the write of the log the snapshot was taken at.
+func (n *Node) snapshot(enc *json.Encoder) (uint64, error) {
+	// writes are recorded while their cache is locked, so every write up to
+	// seq is in the copy of the caches taken after it
+	epoch, seq := n.log.Position()
+
+	databases := n.manager.Databases()
+	caches := make([]*cache.Cache, len(databases))
+	for i, d := range databases {
+		caches[i] = d.Cache
+	}
+	snapshot := cache.Snapshot(caches...)
+
+	if err := enc.Encode(Message{Type: MessageSnapshot, Epoch: epoch, Seq: seq}); err != nil {
+		return 0, err
+	}
+
+	for i, d := range databases {
+		for j := range snapshot[i] {
+			if err := enc.Encode(Message{
+				Type:     MessageDocument,
+				Database: d.Name,
+				Document: &snapshot[i][j],
+			}); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return seq, enc.Encode(Message{Type: MessageSynced, Epoch: epoch, Seq: seq})
+}
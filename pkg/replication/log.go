@@ -0,0 +1,109 @@
+package replication
+
+import (
+	"sync"
+
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// DefaultLogSize is the number of writes a log keeps if its size isn't set.
+const DefaultLogSize = 10000
+
+// Entry is a write to a database recorded in a log.
+type Entry struct {
+	// Seq numbers the writes of a log from 1 in the order they were made.
+	Seq       uint64
+	Database  string
+	Operation cache.Operation
+	Document  *document.Document
+}
+
+// Log keeps the latest writes made to the databases of a server, numbered in
+// the order they were made, for followers to catch up from. Writes are
+// recorded by observing the queue of every database, see Observer.
+//
+// Each log has an epoch of its own, the numbers of its writes only mean
+// something within it.
+//
+// To initialise a new Log use the NewLog function.
+type Log struct {
+	epoch string
+	size  int
+
+	mx sync.Mutex
+	// entries are the writes kept, oldest first.
+	entries []Entry
+	// seq is the number of the latest write.
+	seq uint64
+	// appended is closed and replaced when a write is recorded.
+	appended chan struct{}
+}
+
+// Observer returns the observer of the queue of the named database, it
+// records every event pushed to the queue.
+func (l *Log) Observer(name string) cache.Observer {
+	return func(event cache.Event) {
+		l.append(name, event)
+	}
+}
+
+// append records an event of the named database.
+func (l *Log) append(name string, event cache.Event) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	l.seq++
+	l.entries = append(l.entries, Entry{
+		Seq:       l.seq,
+		Database:  name,
+		Operation: event.Operation,
+		Document:  event.Document,
+	})
+	if len(l.entries) > l.size {
+		l.entries = l.entries[len(l.entries)-l.size:]
+	}
+
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
+
+// Position returns the epoch of the log and the number of its latest write.
+func (l *Log) Position() (epoch string, seq uint64) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	return l.epoch, l.seq
+}
+
+// Since returns the writes recorded after write seq and a channel that is
+// closed when the next write is recorded. ok is false if the writes after
+// seq are no longer kept, or seq is ahead of the log.
+func (l *Log) Since(seq uint64) (entries []Entry, appended <-chan struct{}, ok bool) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	first := l.seq - uint64(len(l.entries)) + 1
+	if seq > l.seq || seq+1 < first {
+		return nil, l.appended, false
+	}
+
+	kept := l.entries[seq+1-first:]
+	return append([]Entry(nil), kept...), l.appended, true
+}
+
+// NewLog returns a new log with an epoch of its own that keeps the latest
+// size writes, DefaultLogSize if size isn't positive.
+func NewLog(size int) *Log {
+	if size <= 0 {
+		size = DefaultLogSize
+	}
+
+	return &Log{
+		epoch:    ulid.Make().String(),
+		size:     size,
+		appended: make(chan struct{}),
+	}
+}
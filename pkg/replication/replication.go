@@ -0,0 +1,235 @@
+// Package replication replicates the databases of a leader to followers
+// over HTTP, so a follower can serve reads and take over from its leader.
+//
+// Replication is asynchronous. The leader records the events pushed to the
+// queue of every database in a Log and streams them to followers, which
+// apply them to their own caches. A follower that is new, or too far behind
+// for the log to catch it up, is first sent a snapshot of every database.
+//
+// Followers don't take writes, they reject them or forward them to their
+// leader. A follower becomes a leader when it is promoted, which is manual.
+package replication
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/errors"
+)
+
+// Role is the part a server plays in replication.
+type Role string
+
+const (
+	// RoleLeader takes writes and streams them to its followers.
+	RoleLeader Role = "leader"
+	// RoleFollower applies the writes streamed by its leader.
+	RoleFollower Role = "follower"
+)
+
+// WritePolicy is what a follower does with the writes it is sent.
+type WritePolicy string
+
+const (
+	// WritesReject rejects writes with ErrNotLeader.
+	WritesReject WritePolicy = "reject"
+	// WritesForward forwards writes to the leader.
+	WritesForward WritePolicy = "forward"
+)
+
+// DefaultHeartbeat is how often a leader tells its followers it is still
+// there when there are no writes to stream.
+const DefaultHeartbeat = 5 * time.Second
+
+// StreamPath is the path of the leader's stream, relative to its address.
+const StreamPath = "/v1/admin/replication/stream"
+
+// MessageType is the type of a message streamed to followers.
+type MessageType string
+
+const (
+	// MessageSnapshot starts a snapshot, the state of the leader at Seq of
+	// the log with the given Epoch.
+	MessageSnapshot MessageType = "snapshot"
+	// MessageDocument is a document of a database in a snapshot.
+	MessageDocument MessageType = "document"
+	// MessageSynced ends a snapshot, the databases of the follower are
+	// replaced by the documents it was sent.
+	MessageSynced MessageType = "synced"
+	// MessageWrite is a write made after the snapshot or position the
+	// follower asked for.
+	MessageWrite MessageType = "write"
+	// MessageHeartbeat tells a follower the leader is still there and the
+	// number of its latest write.
+	MessageHeartbeat MessageType = "heartbeat"
+)
+
+// Message is a message streamed to followers, one JSON object per line.
+type Message struct {
+	Type      MessageType        `json:"type"`
+	Epoch     string             `json:"epoch,omitempty"`
+	Seq       uint64             `json:"seq,omitempty"`
+	Database  string             `json:"database,omitempty"`
+	Operation string             `json:"operation,omitempty"`
+	Document  *document.Document `json:"document,omitempty"`
+}
+
+// Status is the replication status of a server.
+type Status struct {
+	Role Role `json:"role"`
+	// Epoch and Seq are the position of the server's own log.
+	Epoch string `json:"epoch"`
+	Seq   uint64 `json:"seq"`
+	// Following is set on followers.
+	Following *FollowerStatus `json:"following,omitempty"`
+}
+
+// FollowerStatus is how far a follower has caught up with its leader.
+type FollowerStatus struct {
+	Leader    string `json:"leader"`
+	Connected bool   `json:"connected"`
+	// Epoch and Seq are the position in the leader's log the follower has
+	// applied the writes up to.
+	Epoch string `json:"epoch,omitempty"`
+	Seq   uint64 `json:"seq"`
+	// LeaderSeq is the number of the leader's latest write it was told of.
+	LeaderSeq uint64 `json:"leader_seq"`
+	// Lag is the number of writes the follower is behind the leader by.
+	Lag         uint64    `json:"lag"`
+	LastContact time.Time `json:"last_contact,omitempty"`
+}
+
+// Node is the replication of a server, it records the writes of a leader
+// and applies the writes of the leader of a follower.
+//
+// To initialise a new Node use the New function.
+type Node struct {
+	manager   *database.Manager
+	log       *Log
+	heartbeat time.Duration
+	client    *http.Client
+	writes    WritePolicy
+	// shared is set if the follower shares the storage of its leader, the
+	// writes it applies are not written to storage.
+	shared bool
+
+	mx     sync.RWMutex
+	role   Role
+	leader string
+	apiKey string
+	// following is how far the follower has caught up.
+	following FollowerStatus
+	// stop stops following the leader, done is closed once it has.
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+// Role returns the role of the node, a server without replication takes
+// writes like a leader.
+func (n *Node) Role() Role {
+	if n == nil {
+		return RoleLeader
+	}
+
+	n.mx.RLock()
+	defer n.mx.RUnlock()
+
+	return n.role
+}
+
+// Leader returns the address of the leader of a follower and the write
+// policy it was configured with.
+func (n *Node) Leader() (string, WritePolicy) {
+	n.mx.RLock()
+	defer n.mx.RUnlock()
+
+	return n.leader, n.writes
+}
+
+// Status returns the replication status of the node.
+func (n *Node) Status() Status {
+	epoch, seq := n.log.Position()
+
+	n.mx.RLock()
+	defer n.mx.RUnlock()
+
+	s := Status{Role: n.role, Epoch: epoch, Seq: seq}
+	if n.role == RoleFollower {
+		following := n.following
+		if following.LeaderSeq > following.Seq {
+			following.Lag = following.LeaderSeq - following.Seq
+		}
+		s.Following = &following
+	}
+
+	return s
+}
+
+// Promote makes a follower the leader, it stops following its leader and
+// takes writes from then on. Other followers must be pointed at it.
+func (n *Node) Promote() (Status, error) {
+	n.mx.Lock()
+	if n.role != RoleFollower {
+		n.mx.Unlock()
+		return Status{}, errors.New(errors.ErrAlreadyLeader)
+	}
+
+	n.role = RoleLeader
+	stop, done := n.stop, n.done
+	n.mx.Unlock()
+
+	// wait for the write being applied, if any
+	if stop != nil {
+		stop()
+		<-done
+	}
+
+	return n.Status(), nil
+}
+
+// WithLeader sets the address of the leader a follower follows, such as
+// http://leader:9000, and the api key of its default database it
+// authenticates with.
+func (n *Node) WithLeader(address, apiKey string) *Node {
+	n.leader = address
+	n.apiKey = apiKey
+	return n
+}
+
+// WithWritePolicy sets what a follower does with the writes it is sent,
+// WritesReject if it isn't set.
+func (n *Node) WithWritePolicy(p WritePolicy) *Node {
+	n.writes = p
+	return n
+}
+
+// WithSharedStorage sets whether a follower shares the storage of its
+// leader, in which case the writes it applies are only made to its cache.
+func (n *Node) WithSharedStorage(shared bool) *Node {
+	n.shared = shared
+	return n
+}
+
+// WithHeartbeat sets how often a leader streams a heartbeat when there are
+// no writes, followers reconnect if they miss three in a row.
+func (n *Node) WithHeartbeat(d time.Duration) *Node {
+	n.heartbeat = d
+	return n
+}
+
+// New returns the replication of the databases of manager, whose writes are
+// recorded by log, for a server with the given role.
+func New(manager *database.Manager, log *Log, role Role) *Node {
+	return &Node{
+		manager:   manager,
+		log:       log,
+		role:      role,
+		heartbeat: DefaultHeartbeat,
+		client:    &http.Client{},
+		writes:    WritesReject,
+	}
+}
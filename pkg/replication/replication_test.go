@@ -0,0 +1,215 @@
+package replication_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/errors"
+	"github.com/nexdb/nexdb/pkg/replication"
+	"github.com/nexdb/nexdb/pkg/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newNode returns the replication of a new server with the given role, its
+// log keeps size writes.
+func newNode(t *testing.T, role replication.Role, size int) (*replication.Node, *database.Manager) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	s, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	log := replication.NewLog(size)
+	q := cache.NewQueue(s)
+	q.Observe(log.Observer(database.DefaultName))
+
+	m := database.NewManager(ctx, storage.MemoryDriver, &database.Database{Cache: cache.NewCache(ctx, q)}).
+		WithQueueObserver(log.Observer)
+
+	return replication.New(m, log, role).WithHeartbeat(50 * time.Millisecond), m
+}
+
+// serve serves the stream of a leader, it returns its address.
+func serve(t *testing.T, leader *replication.Node) string {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seq, _ := strconv.ParseUint(r.URL.Query().Get("seq"), 10, 64)
+		_ = leader.Serve(r.Context(), w, r.URL.Query().Get("epoch"), seq)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv.URL
+}
+
+// follow starts following the leader at address.
+func follow(t *testing.T, follower *replication.Node, address string) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	follower.WithLeader(address, "key")
+	go follower.Start(ctx)
+}
+
+// caughtUp waits for the follower to apply the writes of its leader.
+func caughtUp(t *testing.T, follower *replication.Node, leader *replication.Node) {
+	t.Helper()
+
+	epoch, seq := leader.Status().Epoch, leader.Status().Seq
+	require.Eventually(t, func() bool {
+		s := follower.Status().Following
+		return s.Connected && s.Epoch == epoch && s.Seq == seq
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestNode(t *testing.T) {
+	leader, lm := newNode(t, replication.RoleLeader, 0)
+	follower, fm := newNode(t, replication.RoleFollower, 0)
+
+	ldb, err := lm.Get(database.DefaultName)
+	require.NoError(t, err)
+	fdb, err := fm.Get(database.DefaultName)
+	require.NoError(t, err)
+
+	// written before the follower starts, it is sent a snapshot
+	ada := document.New().SetCollection("users").SetData(map[string]interface{}{"name": "ada"})
+	require.NoError(t, ldb.Put(ada, false))
+
+	// documents the leader doesn't have are removed by the snapshot
+	stale := document.New().SetCollection("users").SetData(map[string]interface{}{"name": "stale"})
+	require.NoError(t, fdb.Put(stale, false))
+
+	follow(t, follower, serve(t, leader))
+	caughtUp(t, follower, leader)
+	assert.Equal(t, "ada", fdb.GetByID(ada.ID.String()).Data["name"])
+	assert.Nil(t, fdb.GetAnyByID(stale.ID.String()))
+
+	// writes made since are streamed
+	grace := document.New().SetCollection("users").SetData(map[string]interface{}{"name": "grace"})
+	require.NoError(t, ldb.Put(grace, false))
+	require.NoError(t, ldb.Delete(ada.ID.String()))
+	caughtUp(t, follower, leader)
+	assert.Nil(t, fdb.GetAnyByID(ada.ID.String()))
+	assert.Equal(t, "grace", fdb.GetByID(grace.ID.String()).Data["name"])
+
+	// databases are created and dropped with their metadata
+	_, err = lm.Create("acme", "")
+	require.NoError(t, err)
+	acme, err := lm.Get("acme")
+	require.NoError(t, err)
+	order := document.New().SetCollection("orders").SetData(map[string]interface{}{"total": 42.0})
+	require.NoError(t, acme.Put(order, false))
+	caughtUp(t, follower, leader)
+
+	replica, err := fm.Get("acme")
+	require.NoError(t, err)
+	assert.Equal(t, 42.0, replica.GetByID(order.ID.String()).Data["total"])
+
+	require.NoError(t, lm.Drop("acme"))
+	caughtUp(t, follower, leader)
+	_, err = fm.Get("acme")
+	assert.Equal(t, errors.New(errors.ErrDatabaseNotFound).Error(), err.Error())
+
+	// a promoted follower stops following and takes writes
+	s, err := follower.Promote()
+	require.NoError(t, err)
+	assert.Equal(t, replication.RoleLeader, s.Role)
+	assert.Nil(t, s.Following)
+	assert.Equal(t, replication.RoleLeader, follower.Role())
+
+	require.NoError(t, ldb.Put(document.New().SetCollection("users"), false))
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, fdb.Filter("users", cache.Query{}), 1)
+
+	_, err = follower.Promote()
+	assert.Equal(t, errors.New(errors.ErrAlreadyLeader).Error(), err.Error())
+}
+
+func TestNode_Serve(t *testing.T) {
+	// the log only keeps two writes
+	leader, lm := newNode(t, replication.RoleLeader, 2)
+	address := serve(t, leader)
+
+	ldb, err := lm.Get(database.DefaultName)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, ldb.Put(document.New().SetCollection("users"), false))
+	}
+	epoch := leader.Status().Epoch
+
+	for _, tc := range []struct {
+		name  string
+		epoch string
+		seq   uint64
+		first replication.MessageType
+	}{
+		{name: "new follower", first: replication.MessageSnapshot},
+		{name: "follower of another leader", epoch: "other", seq: 4, first: replication.MessageSnapshot},
+		{name: "follower behind the log", epoch: epoch, seq: 2, first: replication.MessageSnapshot},
+		{name: "follower within the log", epoch: epoch, seq: 3, first: replication.MessageWrite},
+		{name: "follower caught up", epoch: epoch, seq: 5, first: replication.MessageHeartbeat},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := http.Get(address + "?epoch=" + tc.epoch + "&seq=" + strconv.FormatUint(tc.seq, 10))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			var msg replication.Message
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&msg))
+			assert.Equal(t, tc.first, msg.Type)
+			if msg.Type == replication.MessageWrite {
+				assert.Equal(t, tc.seq+1, msg.Seq)
+			}
+		})
+	}
+}
+
+func TestLog_Since(t *testing.T) {
+	log := replication.NewLog(3)
+	observe := log.Observer(database.DefaultName)
+
+	entries, _, ok := log.Since(0)
+	assert.True(t, ok)
+	assert.Empty(t, entries)
+
+	for i := 0; i < 5; i++ {
+		observe(cache.Event{Operation: cache.OperationCreate, Document: document.New()})
+	}
+
+	_, seq := log.Position()
+	assert.Equal(t, uint64(5), seq)
+
+	entries, appended, ok := log.Since(2)
+	require.True(t, ok)
+	require.Len(t, entries, 3)
+	assert.Equal(t, uint64(3), entries[0].Seq)
+	assert.Equal(t, database.DefaultName, entries[0].Database)
+
+	// writes before those kept, or after the latest, can't be caught up from
+	_, _, ok = log.Since(1)
+	assert.False(t, ok)
+	_, _, ok = log.Since(6)
+	assert.False(t, ok)
+
+	observe(cache.Event{Operation: cache.OperationDelete, Document: document.New()})
+	select {
+	case <-appended:
+	default:
+		t.Fatal("appending a write didn't notify the log's readers")
+	}
+}
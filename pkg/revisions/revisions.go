@@ -0,0 +1,307 @@
+// Package revisions keeps previous versions of the documents of collections
+// that track them, so they can be listed, compared and restored.
+//
+// Every write of a document of a tracked collection records its data as a
+// new revision, numbered from 1. Revisions are stored as documents of their
+// own, so they are persisted, encrypted and backed up with the database.
+package revisions
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/errors"
+)
+
+const (
+	// SettingsCollection is the collection of each database that holds the
+	// revision settings of its collections, one document per collection.
+	SettingsCollection = "_revision_settings"
+	// Collection is the collection of each database that holds the
+	// revisions of its documents, one document per revision.
+	Collection = "_revisions"
+)
+
+// Settings is how the revisions of the documents of a collection are kept.
+// A collection is tracked if either is set, revisions are kept until both
+// limits are passed.
+type Settings struct {
+	// Keep is how many revisions of each document are kept, 0 is no limit.
+	Keep int `json:"keep"`
+	// MaxAge is how long revisions are kept for, such as 720h, empty is no
+	// limit. The latest revision of a document is always kept.
+	MaxAge string `json:"max_age,omitempty"`
+}
+
+// Enabled returns whether the settings track revisions.
+func (s Settings) Enabled() bool {
+	return s.Keep > 0 || s.MaxAge != ""
+}
+
+// Validate checks the settings are a valid configuration of a collection.
+func (s Settings) Validate() error {
+	if s.Keep < 0 {
+		return errors.New(errors.ErrRevisionSettingsAreInvalid)
+	}
+
+	if s.MaxAge != "" {
+		if d, err := time.ParseDuration(s.MaxAge); err != nil || d <= 0 {
+			return errors.New(errors.ErrRevisionSettingsAreInvalid)
+		}
+	}
+
+	return nil
+}
+
+// Revision is a previous version of a document.
+type Revision struct {
+	Revision  int                    `json:"revision"`
+	CreatedAt time.Time              `json:"created_at"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+// Change is a difference between the data of two revisions, fields of
+// nested objects are given as dot paths.
+type Change struct {
+	Path string `json:"path"`
+	// Op is added, removed or changed.
+	Op   string      `json:"op"`
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
+}
+
+// Get returns the revision settings of a collection of d.
+func Get(ctx context.Context, d *database.Database, collection string) Settings {
+	doc := Config(ctx, d, collection)
+	if doc == nil {
+		return Settings{}
+	}
+
+	maxAge, _ := doc.Data["max_age"].(string)
+	return Settings{Keep: number(doc.Data["keep"]), MaxAge: maxAge}
+}
+
+// Config returns the document of d that holds the revision settings of a
+// collection, if any.
+func Config(ctx context.Context, d *database.Database, collection string) *document.Document {
+	results := d.FilterContext(ctx, SettingsCollection, equals("collection", collection))
+	if len(results) == 0 {
+		return nil
+	}
+
+	return results[0]
+}
+
+// Record records the data of doc as its latest revision, created at the
+// given time, if its collection tracks revisions. The revisions no longer
+// kept by the settings of the collection are deleted. Records of the same
+// document must not run concurrently.
+func Record(ctx context.Context, d *database.Database, doc *document.Document, at time.Time) error {
+	settings := Get(ctx, d, doc.Collection)
+	if !settings.Enabled() {
+		return nil
+	}
+
+	docs := revisionsOf(ctx, d, doc.ID.String())
+	next := 1
+	if len(docs) > 0 {
+		next = number(docs[len(docs)-1].Data["revision"]) + 1
+	}
+
+	revision := document.New().SetCollection(Collection).SetData(map[string]interface{}{
+		"document_id": doc.ID.String(),
+		"collection":  doc.Collection,
+		"revision":    next,
+		"created_at":  at.UTC().Format(time.RFC3339Nano),
+		"data":        doc.Data,
+	})
+	if err := d.PutContext(ctx, revision, false); err != nil {
+		return err
+	}
+
+	return prune(ctx, d, settings, docs, at)
+}
+
+// prune deletes the revisions of docs, which are sorted oldest first and
+// followed by a newer revision, that settings no longer keeps at the given
+// time.
+func prune(ctx context.Context, d *database.Database, settings Settings, docs []*document.Document, at time.Time) error {
+	maxAge, _ := time.ParseDuration(settings.MaxAge)
+
+	for i, doc := range docs {
+		// the newer revisions, including the one just recorded
+		newer := len(docs) - i
+		byCount := settings.Keep > 0 && newer >= settings.Keep
+		byAge := maxAge > 0 && at.Sub(createdAt(doc)) > maxAge
+
+		// a revision is kept while either limit that is set keeps it
+		expired := (settings.Keep == 0 || byCount) && (maxAge == 0 || byAge)
+		if !expired {
+			continue
+		}
+
+		if err := d.DeleteContext(ctx, doc.ID.String()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List returns the revisions of the document with the given id without
+// their data, newest first.
+func List(ctx context.Context, d *database.Database, id string) []Revision {
+	docs := revisionsOf(ctx, d, id)
+
+	revisions := make([]Revision, 0, len(docs))
+	for i := len(docs) - 1; i >= 0; i-- {
+		r := revisionFrom(docs[i])
+		r.Data = nil
+		revisions = append(revisions, r)
+	}
+
+	return revisions
+}
+
+// Find returns the revision n of the document with the given id.
+func Find(ctx context.Context, d *database.Database, id string, n int) (Revision, error) {
+	for _, doc := range revisionsOf(ctx, d, id) {
+		if number(doc.Data["revision"]) == n {
+			return revisionFrom(doc), nil
+		}
+	}
+
+	return Revision{}, errors.New(errors.ErrRevisionNotFound)
+}
+
+// Forget deletes every revision of the document with the given id.
+func Forget(ctx context.Context, d *database.Database, id string) error {
+	for _, doc := range revisionsOf(ctx, d, id) {
+		if err := d.DeleteContext(ctx, doc.ID.String()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Diff returns the changes from the data from to the data to, sorted by
+// path. Nested objects are compared field by field, any other values
+// including arrays are compared as a whole.
+func Diff(from, to map[string]interface{}) []Change {
+	changes := []Change{}
+	diff("", from, to, &changes)
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+
+	return changes
+}
+
+// diff appends the changes from the object from to the object to, whose
+// fields are under path, to changes.
+func diff(path string, from, to map[string]interface{}, changes *[]Change) {
+	for k, a := range from {
+		p := strings.TrimPrefix(path+"."+k, ".")
+
+		b, ok := to[k]
+		if !ok {
+			*changes = append(*changes, Change{Path: p, Op: "removed", From: a})
+			continue
+		}
+
+		am, aIsMap := a.(map[string]interface{})
+		bm, bIsMap := b.(map[string]interface{})
+		switch {
+		case aIsMap && bIsMap:
+			diff(p, am, bm, changes)
+		case !reflect.DeepEqual(a, b):
+			*changes = append(*changes, Change{Path: p, Op: "changed", From: a, To: b})
+		}
+	}
+
+	for k, b := range to {
+		if _, ok := from[k]; !ok {
+			*changes = append(*changes, Change{Path: strings.TrimPrefix(path+"."+k, "."), Op: "added", To: b})
+		}
+	}
+}
+
+// ParseRevision parses the number of a revision, ErrRevisionNotFound is
+// returned if it isn't a positive integer.
+func ParseRevision(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, errors.New(errors.ErrRevisionNotFound)
+	}
+
+	return n, nil
+}
+
+// revisionsOf returns the revision documents of the document with the given
+// id, oldest first.
+func revisionsOf(ctx context.Context, d *database.Database, id string) []*document.Document {
+	docs := d.FilterContext(ctx, Collection, equals("document_id", id))
+	sort.Slice(docs, func(i, j int) bool {
+		return number(docs[i].Data["revision"]) < number(docs[j].Data["revision"])
+	})
+
+	return docs
+}
+
+// revisionFrom returns the revision held by a revision document.
+func revisionFrom(doc *document.Document) Revision {
+	data, _ := doc.Data["data"].(map[string]interface{})
+
+	return Revision{
+		Revision:  number(doc.Data["revision"]),
+		CreatedAt: createdAt(doc),
+		Data:      data,
+	}
+}
+
+// createdAt returns when a revision document was recorded.
+func createdAt(doc *document.Document) time.Time {
+	s, _ := doc.Data["created_at"].(string)
+	t, _ := time.Parse(time.RFC3339Nano, s)
+
+	return t
+}
+
+// number returns v as an int, numbers are read back from storage as
+// float64 or int64 depending on its format.
+func number(v interface{}) int {
+	switch n := v.(type) {
+	case int:
+		return n
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	default:
+		return 0
+	}
+}
+
+// equals returns a query matching the documents whose field equals value.
+func equals(field, value string) cache.Query {
+	return cache.Query{
+		And: []cache.Element{
+			{
+				Condition: &cache.Condition{
+					Field:    field,
+					Operator: cache.Equals,
+					Value:    value,
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,165 @@
+package revisions_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/errors"
+	"github.com/nexdb/nexdb/pkg/revisions"
+	"github.com/nexdb/nexdb/pkg/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newDatabase returns a database whose users collection keeps revisions with
+// the given settings.
+func newDatabase(t *testing.T, settings revisions.Settings) *database.Database {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	s, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	d := &database.Database{Cache: cache.NewCache(ctx, cache.NewQueue(s))}
+	require.NoError(t, d.Put(document.New().SetCollection(revisions.SettingsCollection).SetData(map[string]interface{}{
+		"collection": "users",
+		"keep":       settings.Keep,
+		"max_age":    settings.MaxAge,
+	}), false))
+
+	return d
+}
+
+func TestRecord(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		settings revisions.Settings
+		// every write is an hour after the one before
+		writes int
+		kept   []int
+	}{
+		{
+			name:     "keep the last revisions",
+			settings: revisions.Settings{Keep: 3},
+			writes:   5,
+			kept:     []int{5, 4, 3},
+		},
+		{
+			name:     "keep the revisions within a window",
+			settings: revisions.Settings{MaxAge: "90m"},
+			writes:   5,
+			kept:     []int{5, 4},
+		},
+		{
+			name:     "keep the last revisions or those within a window",
+			settings: revisions.Settings{Keep: 1, MaxAge: "150m"},
+			writes:   5,
+			kept:     []int{5, 4, 3},
+		},
+		{
+			name:     "the latest revision outlives the window",
+			settings: revisions.Settings{MaxAge: "1m"},
+			writes:   3,
+			kept:     []int{3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			d := newDatabase(t, tt.settings)
+
+			doc := document.New().SetCollection("users")
+			for i := 1; i <= tt.writes; i++ {
+				doc.SetData(map[string]interface{}{"version": i})
+				require.NoError(t, revisions.Record(ctx, d, doc, start.Add(time.Duration(i)*time.Hour)))
+			}
+
+			var kept []int
+			for _, r := range revisions.List(ctx, d, doc.ID.String()) {
+				assert.Nil(t, r.Data)
+				kept = append(kept, r.Revision)
+			}
+			assert.Equal(t, tt.kept, kept)
+
+			latest, err := revisions.Find(ctx, d, doc.ID.String(), tt.writes)
+			require.NoError(t, err)
+			assert.Equal(t, map[string]interface{}{"version": tt.writes}, latest.Data)
+			assert.Equal(t, start.Add(time.Duration(tt.writes)*time.Hour), latest.CreatedAt)
+		})
+	}
+}
+
+func TestRecord_Untracked(t *testing.T) {
+	ctx := context.Background()
+	d := newDatabase(t, revisions.Settings{Keep: 1})
+
+	doc := document.New().SetCollection("orders")
+	require.NoError(t, revisions.Record(ctx, d, doc, time.Now()))
+	assert.Empty(t, revisions.List(ctx, d, doc.ID.String()))
+
+	_, err := revisions.Find(ctx, d, doc.ID.String(), 1)
+	assert.Equal(t, errors.New(errors.ErrRevisionNotFound).Error(), err.Error())
+}
+
+func TestForget(t *testing.T) {
+	ctx := context.Background()
+	d := newDatabase(t, revisions.Settings{Keep: 10})
+
+	doc := document.New().SetCollection("users")
+	other := document.New().SetCollection("users")
+	for _, doc := range []*document.Document{doc, doc, other} {
+		require.NoError(t, revisions.Record(ctx, d, doc, time.Now()))
+	}
+
+	require.NoError(t, revisions.Forget(ctx, d, doc.ID.String()))
+	assert.Empty(t, revisions.List(ctx, d, doc.ID.String()))
+	assert.Len(t, revisions.List(ctx, d, other.ID.String()), 1)
+}
+
+func TestDiff(t *testing.T) {
+	from := map[string]interface{}{
+		"name": "ada",
+		"age":  36.0,
+		"tags": []interface{}{"a"},
+		"address": map[string]interface{}{
+			"city":   "London",
+			"street": "1 Main St",
+		},
+	}
+	to := map[string]interface{}{
+		"name": "ada",
+		"age":  37.0,
+		"tags": []interface{}{"a", "b"},
+		"address": map[string]interface{}{
+			"city": "Leeds",
+		},
+		"email": "ada@example.com",
+	}
+
+	assert.Equal(t, []revisions.Change{
+		{Path: "address.city", Op: "changed", From: "London", To: "Leeds"},
+		{Path: "address.street", Op: "removed", From: "1 Main St"},
+		{Path: "age", Op: "changed", From: 36.0, To: 37.0},
+		{Path: "email", Op: "added", To: "ada@example.com"},
+		{Path: "tags", Op: "changed", From: []interface{}{"a"}, To: []interface{}{"a", "b"}},
+	}, revisions.Diff(from, to))
+	assert.Empty(t, revisions.Diff(from, from))
+}
+
+func TestSettings_Validate(t *testing.T) {
+	for _, s := range []revisions.Settings{{Keep: -1}, {MaxAge: "a week"}, {MaxAge: "-1h"}} {
+		assert.Error(t, s.Validate(), s)
+	}
+
+	assert.NoError(t, revisions.Settings{Keep: 10, MaxAge: "720h"}.Validate())
+}
@@ -0,0 +1,434 @@
+package admin
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"reflect"
+	"sort"
+
+	"github.com/nexdb/nexdb/pkg/backup"
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/database/validation"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/errors"
+	"github.com/nexdb/nexdb/pkg/fieldcrypt"
+	"github.com/nexdb/nexdb/pkg/revisions"
+	"github.com/nexdb/nexdb/pkg/services/audit"
+	"github.com/nexdb/nexdb/pkg/services/auth"
+	"github.com/nexdb/nexdb/pkg/trash"
+)
+
+// Admin is a service that handles requests from handlers to manage databases
+// and their api keys.
+type Admin struct {
+	manager   *database.Manager
+	auditor   *audit.Auditor
+	backupKey []byte
+	fields    *fieldcrypt.Encrypter
+}
+
+// CreateDatabase creates a new database.
+func (a *Admin) CreateDatabase(ctx context.Context, name, encryptionKey string) (database.Info, error) {
+	info, err := a.manager.Create(name, encryptionKey)
+	if err != nil {
+		return info, err
+	}
+
+	a.recordAudit(ctx, audit.Entry{
+		Operation: audit.OperationCreateDatabase,
+		Database:  name,
+	})
+
+	return info, nil
+}
+
+// ListDatabases lists all databases.
+func (a *Admin) ListDatabases(ctx context.Context) ([]database.Info, error) {
+	return a.manager.List(), nil
+}
+
+// DropDatabase deletes a database and all of its documents.
+func (a *Admin) DropDatabase(ctx context.Context, name string) error {
+	if err := a.manager.Drop(name); err != nil {
+		return err
+	}
+
+	a.recordAudit(ctx, audit.Entry{
+		Operation: audit.OperationDropDatabase,
+		Database:  name,
+	})
+
+	return nil
+}
+
+// CreateAPIKey adds an api key to a database, if key is empty a random key
+// is generated. The returned document holds the key and is the only time it
+// is returned. If subject is set, clients presenting a verified certificate
+// with that common name are authenticated as this key.
+func (a *Admin) CreateAPIKey(ctx context.Context, name, key, subject string, permissions []auth.Permission) (*document.Document, error) {
+	d, err := a.manager.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := auth.ValidatePermissions(permissions); err != nil {
+		return nil, err
+	}
+
+	if key == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		key = hex.EncodeToString(b)
+	}
+
+	data := map[string]interface{}{
+		"key": key,
+	}
+	if subject != "" {
+		data["subject"] = subject
+	}
+	if len(permissions) > 0 {
+		// stored as they are decoded from storage
+		granted := make([]interface{}, len(permissions))
+		for i, p := range permissions {
+			granted[i] = string(p)
+		}
+		data["permissions"] = granted
+	}
+
+	doc := document.New().SetCollection(auth.KeysCollection).SetData(data)
+
+	if err := d.PutContext(ctx, doc, false); err != nil {
+		return nil, err
+	}
+
+	a.recordAudit(ctx, audit.Entry{
+		Operation:  audit.OperationCreateAPIKey,
+		Database:   name,
+		Collection: auth.KeysCollection,
+		DocumentID: doc.ID.String(),
+	})
+
+	return doc, nil
+}
+
+// ListAPIKeys returns the ids of the api keys of a database.
+func (a *Admin) ListAPIKeys(ctx context.Context, name string) ([]string, error) {
+	d, err := a.manager.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, doc := range d.FilterContext(ctx, auth.KeysCollection, cache.Query{}) {
+		ids = append(ids, doc.ID.String())
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// DeleteAPIKey removes an api key from a database.
+func (a *Admin) DeleteAPIKey(ctx context.Context, name, id string) error {
+	d, err := a.manager.Get(name)
+	if err != nil {
+		return err
+	}
+
+	if doc := d.GetByID(id); doc == nil || doc.Collection != auth.KeysCollection {
+		return errors.New(errors.ErrAPIKeyNotFound)
+	}
+
+	if err := d.DeleteContext(ctx, id); err != nil {
+		return err
+	}
+
+	a.recordAudit(ctx, audit.Entry{
+		Operation:  audit.OperationDeleteAPIKey,
+		Database:   name,
+		Collection: auth.KeysCollection,
+		DocumentID: id,
+	})
+
+	return nil
+}
+
+// EncryptedFields returns the encrypted fields of a collection of a database.
+func (a *Admin) EncryptedFields(ctx context.Context, name, collection string) ([]fieldcrypt.Field, error) {
+	d, err := a.manager.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validation.ValidateCollectionName(collection); err != nil {
+		return nil, err
+	}
+
+	return fieldcrypt.Fields(ctx, d, collection), nil
+}
+
+// SetEncryptedFields replaces the encrypted fields of a collection of a
+// database. The documents already in the collection are rewritten so fields
+// no longer listed are decrypted and newly listed fields are encrypted.
+func (a *Admin) SetEncryptedFields(ctx context.Context, name, collection string, fields []fieldcrypt.Field) ([]fieldcrypt.Field, error) {
+	d, err := a.manager.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validation.ValidateCollectionName(collection); err != nil {
+		return nil, err
+	}
+
+	if err := fieldcrypt.Validate(fields); err != nil {
+		return nil, err
+	}
+
+	if len(fields) > 0 && a.fields == nil {
+		return nil, errors.New(errors.ErrFieldEncryptionDisabled)
+	}
+
+	// writes to the collection wait until its documents are rewritten, so
+	// none are encrypted with the fields being replaced
+	unlock := d.LockCollection(collection)
+	defer unlock()
+
+	before := fieldcrypt.Fields(ctx, d, collection)
+
+	// record the fields first so documents written from now on are
+	// encrypted with them
+	config := fieldcrypt.Config(ctx, d, collection)
+	switch {
+	case config != nil && len(fields) == 0:
+		err = d.DeleteContext(ctx, config.ID.String())
+	case config == nil && len(fields) == 0:
+	default:
+		if config == nil {
+			config = document.New().SetCollection(fieldcrypt.Collection)
+		}
+
+		// stored as they are decoded from storage
+		list := make([]interface{}, len(fields))
+		for i, f := range fields {
+			list[i] = map[string]interface{}{"path": f.Path, "mode": string(f.Mode)}
+		}
+
+		updated := document.New().SetCollection(fieldcrypt.Collection).SetID(config.ID.String()).SetData(map[string]interface{}{
+			"collection": collection,
+			"fields":     list,
+		})
+		err = d.PutContext(ctx, updated, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, doc := range d.FilterContext(ctx, collection, cache.Query{Deleted: cache.DeletedInclude}) {
+		plain, err := a.fields.Decrypt(collection, before, doc.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := a.fields.Encrypt(collection, fields, plain)
+		if err != nil {
+			return nil, err
+		}
+
+		if reflect.DeepEqual(data, doc.Data) {
+			continue
+		}
+
+		rewritten := document.New().SetCollection(collection).SetID(doc.ID.String()).SetData(data)
+		if err := d.PutContext(ctx, rewritten, false); err != nil {
+			return nil, err
+		}
+	}
+
+	a.recordAudit(ctx, audit.Entry{
+		Operation:  audit.OperationSetEncryptedFields,
+		Database:   name,
+		Collection: collection,
+	})
+
+	return fields, nil
+}
+
+// RevisionSettings returns the revision settings of a collection of a
+// database.
+func (a *Admin) RevisionSettings(ctx context.Context, name, collection string) (revisions.Settings, error) {
+	d, err := a.manager.Get(name)
+	if err != nil {
+		return revisions.Settings{}, err
+	}
+
+	if err := validation.ValidateCollectionName(collection); err != nil {
+		return revisions.Settings{}, err
+	}
+
+	return revisions.Get(ctx, d, collection), nil
+}
+
+// SetRevisionSettings replaces the revision settings of a collection of a
+// database, settings that keep nothing stop revisions being recorded. The
+// revisions already recorded are pruned as the documents are next written.
+func (a *Admin) SetRevisionSettings(ctx context.Context, name, collection string, settings revisions.Settings) (revisions.Settings, error) {
+	d, err := a.manager.Get(name)
+	if err != nil {
+		return revisions.Settings{}, err
+	}
+
+	if err := validation.ValidateCollectionName(collection); err != nil {
+		return revisions.Settings{}, err
+	}
+
+	if err := settings.Validate(); err != nil {
+		return revisions.Settings{}, err
+	}
+
+	config := revisions.Config(ctx, d, collection)
+	switch {
+	case config != nil && !settings.Enabled():
+		err = d.DeleteContext(ctx, config.ID.String())
+	case config == nil && !settings.Enabled():
+	default:
+		if config == nil {
+			config = document.New().SetCollection(revisions.SettingsCollection)
+		}
+
+		updated := document.New().SetCollection(revisions.SettingsCollection).SetID(config.ID.String()).SetData(map[string]interface{}{
+			"collection": collection,
+			"keep":       settings.Keep,
+			"max_age":    settings.MaxAge,
+		})
+		err = d.PutContext(ctx, updated, false)
+	}
+	if err != nil {
+		return revisions.Settings{}, err
+	}
+
+	a.recordAudit(ctx, audit.Entry{
+		Operation:  audit.OperationSetRevisionSettings,
+		Database:   name,
+		Collection: collection,
+	})
+
+	return settings, nil
+}
+
+// SoftDeleteSettings returns the soft delete settings of a collection of a
+// database.
+func (a *Admin) SoftDeleteSettings(ctx context.Context, name, collection string) (trash.Settings, error) {
+	d, err := a.manager.Get(name)
+	if err != nil {
+		return trash.Settings{}, err
+	}
+
+	if err := validation.ValidateCollectionName(collection); err != nil {
+		return trash.Settings{}, err
+	}
+
+	return trash.Get(ctx, d, collection), nil
+}
+
+// SetSoftDeleteSettings replaces the soft delete settings of a collection of
+// a database. Documents already in the trash stay there when soft delete is
+// disabled, until they are undeleted or purged.
+func (a *Admin) SetSoftDeleteSettings(ctx context.Context, name, collection string, settings trash.Settings) (trash.Settings, error) {
+	d, err := a.manager.Get(name)
+	if err != nil {
+		return trash.Settings{}, err
+	}
+
+	if err := validation.ValidateCollectionName(collection); err != nil {
+		return trash.Settings{}, err
+	}
+
+	if err := settings.Validate(); err != nil {
+		return trash.Settings{}, err
+	}
+
+	config := trash.Config(ctx, d, collection)
+	switch {
+	case config != nil && !settings.Enabled:
+		err = d.DeleteContext(ctx, config.ID.String())
+	case config == nil && !settings.Enabled:
+	default:
+		if config == nil {
+			config = document.New().SetCollection(trash.SettingsCollection)
+		}
+
+		updated := document.New().SetCollection(trash.SettingsCollection).SetID(config.ID.String()).SetData(map[string]interface{}{
+			"collection": collection,
+			"retention":  settings.Retention,
+		})
+		err = d.PutContext(ctx, updated, false)
+	}
+	if err != nil {
+		return trash.Settings{}, err
+	}
+
+	a.recordAudit(ctx, audit.Entry{
+		Operation:  audit.OperationSetSoftDeleteSettings,
+		Database:   name,
+		Collection: collection,
+	})
+
+	return settings, nil
+}
+
+// Backup writes a backup archive of every database to w.
+func (a *Admin) Backup(ctx context.Context, w io.Writer) (*backup.Manifest, error) {
+	manifest, err := backup.Write(w, a.manager, a.backupKey)
+	if err != nil {
+		return nil, err
+	}
+
+	a.recordAudit(ctx, audit.Entry{
+		Operation: audit.OperationBackup,
+	})
+
+	return manifest, nil
+}
+
+// recordAudit records the audit entry of a change that has been made. The
+// change can't be taken back, so an entry that can't be recorded is logged
+// rather than failing the request.
+func (a *Admin) recordAudit(ctx context.Context, e audit.Entry) {
+	if err := a.auditor.Record(ctx, e); err != nil {
+		slog.Error("failed to record audit entry", "operation", e.Operation, "database", e.Database,
+			"collection", e.Collection, "document", e.DocumentID, "error", err)
+	}
+}
+
+// WithBackupKey sets the key backups are encrypted with, backups are not
+// encrypted if it is empty.
+func (a *Admin) WithBackupKey(key []byte) *Admin {
+	a.backupKey = key
+	return a
+}
+
+// WithFieldEncrypter sets the encrypter of the encrypted fields of
+// collections.
+func (a *Admin) WithFieldEncrypter(e *fieldcrypt.Encrypter) *Admin {
+	a.fields = e
+	return a
+}
+
+// WithAuditor sets the auditor that records every change.
+func (a *Admin) WithAuditor(auditor *audit.Auditor) *Admin {
+	a.auditor = auditor
+	return a
+}
+
+// New returns a new instance of Admin.
+func New(m *database.Manager) *Admin {
+	return &Admin{
+		manager: m,
+	}
+}
@@ -0,0 +1,204 @@
+package audit
+
+import (
+	"context"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/services/auth"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Operation is the type of operation recorded by an entry.
+type Operation string
+
+const (
+	// OperationCreate records a document being created.
+	OperationCreate Operation = "create"
+	// OperationUpdate records a document being updated.
+	OperationUpdate Operation = "update"
+	// OperationDelete records a document being deleted.
+	OperationDelete Operation = "delete"
+	// OperationUndelete records a document being taken out of the trash.
+	OperationUndelete Operation = "undelete"
+	// OperationPurge records a document being deleted from the trash for good.
+	OperationPurge Operation = "purge"
+	// OperationCreateDatabase records a database being created.
+	OperationCreateDatabase Operation = "create_database"
+	// OperationDropDatabase records a database being dropped.
+	OperationDropDatabase Operation = "drop_database"
+	// OperationCreateAPIKey records an api key being added to a database.
+	OperationCreateAPIKey Operation = "create_api_key"
+	// OperationDeleteAPIKey records an api key being removed from a database.
+	OperationDeleteAPIKey Operation = "delete_api_key"
+	// OperationBackup records a backup being taken.
+	OperationBackup Operation = "backup"
+	// OperationSetEncryptedFields records the encrypted fields of a
+	// collection being changed.
+	OperationSetEncryptedFields Operation = "set_encrypted_fields"
+	// OperationSetRevisionSettings records the revision settings of a
+	// collection being changed.
+	OperationSetRevisionSettings Operation = "set_revision_settings"
+	// OperationSetSoftDeleteSettings records the soft delete settings of a
+	// collection being changed.
+	OperationSetSoftDeleteSettings Operation = "set_soft_delete_settings"
+)
+
+// Entry is a record of an authenticated operation.
+type Entry struct {
+	ID         string                 `json:"id"`
+	Timestamp  time.Time              `json:"timestamp"`
+	KeyID      string                 `json:"key_id"`
+	SourceIP   string                 `json:"source_ip"`
+	Operation  Operation              `json:"operation"`
+	Database   string                 `json:"database"`
+	Collection string                 `json:"collection,omitempty"`
+	DocumentID string                 `json:"document_id,omitempty"`
+	Before     map[string]interface{} `json:"before,omitempty"`
+	After      map[string]interface{} `json:"after,omitempty"`
+}
+
+// Filter selects entries when querying a sink, empty fields match everything.
+type Filter struct {
+	KeyID      string
+	Operation  Operation
+	Database   string
+	Collection string
+	DocumentID string
+	Since      time.Time
+	Until      time.Time
+	// Limit is the maximum number of entries returned, newest first.
+	Limit int
+}
+
+// matches reports whether the entry is selected by the filter.
+func (f Filter) matches(e Entry) bool {
+	switch {
+	case f.KeyID != "" && f.KeyID != e.KeyID,
+		f.Operation != "" && f.Operation != e.Operation,
+		f.Database != "" && f.Database != e.Database,
+		f.Collection != "" && f.Collection != e.Collection,
+		f.DocumentID != "" && f.DocumentID != e.DocumentID,
+		!f.Since.IsZero() && e.Timestamp.Before(f.Since),
+		!f.Until.IsZero() && e.Timestamp.After(f.Until):
+		return false
+	}
+
+	return true
+}
+
+// Sink is an append-only store of audit entries.
+type Sink interface {
+	// Append appends an entry to the sink.
+	Append(e Entry) error
+	// Query returns the entries selected by the filter, newest first.
+	Query(f Filter) ([]Entry, error)
+	// Prune removes entries recorded before the given time and returns
+	// how many were removed.
+	Prune(before time.Time) (int, error)
+}
+
+// Auditor records authenticated operations to a sink.
+//
+// A nil *Auditor is valid and records nothing, so services can hold one
+// without checking whether auditing is enabled.
+type Auditor struct {
+	sink      Sink
+	diffs     bool
+	retention time.Duration
+}
+
+// Record records an entry, the id, timestamp, key id and source ip are
+// taken from the context.
+func (a *Auditor) Record(ctx context.Context, e Entry) error {
+	if a == nil {
+		return nil
+	}
+
+	e.ID = ulid.Make().String()
+	e.Timestamp = time.Now().UTC()
+
+	if id, ok := auth.FromContext(ctx); ok {
+		e.KeyID = id.KeyID
+	}
+
+	if ip, ok := sourceIPFromContext(ctx); ok {
+		e.SourceIP = ip
+	}
+
+	if !a.diffs {
+		e.Before = nil
+		e.After = nil
+	}
+
+	return a.sink.Append(e)
+}
+
+// Query returns the entries selected by the filter, newest first.
+func (a *Auditor) Query(ctx context.Context, f Filter) ([]Entry, error) {
+	if a == nil {
+		return []Entry{}, nil
+	}
+
+	return a.sink.Query(f)
+}
+
+// Start prunes entries older than the retention period until the context
+// is cancelled, it returns straight away when entries are kept forever.
+func (a *Auditor) Start(ctx context.Context) {
+	if a == nil || a.retention <= 0 {
+		return
+	}
+
+	interval := time.Hour
+	if a.retention < interval {
+		interval = a.retention
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		_, _ = a.sink.Prune(time.Now().Add(-a.retention))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// WithDiffs sets whether the before and after data of documents is recorded.
+func (a *Auditor) WithDiffs(diffs bool) *Auditor {
+	a.diffs = diffs
+	return a
+}
+
+// WithRetention sets how long entries are kept for, zero keeps them forever.
+func (a *Auditor) WithRetention(retention time.Duration) *Auditor {
+	a.retention = retention
+	return a
+}
+
+// contextKey is the key used to store the source ip in a context.
+type contextKey struct{}
+
+// WithSourceIP returns a copy of ctx that carries the ip address the
+// request came from.
+func WithSourceIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, contextKey{}, ip)
+}
+
+// sourceIPFromContext returns the source ip carried by ctx, if any.
+func sourceIPFromContext(ctx context.Context) (string, bool) {
+	ip, ok := ctx.Value(contextKey{}).(string)
+	return ip, ok
+}
+
+// New returns a new Auditor recording to the sink.
+func New(sink Sink) *Auditor {
+	return &Auditor{
+		sink: sink,
+	}
+}
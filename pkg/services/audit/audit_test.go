@@ -0,0 +1,133 @@
+package audit_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/services/audit"
+	"github.com/nexdb/nexdb/pkg/services/auth"
+	"github.com/nexdb/nexdb/pkg/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditor(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		sink func(t *testing.T, ctx context.Context) audit.Sink
+	}{
+		{
+			name: "collection sink",
+			sink: func(t *testing.T, ctx context.Context) audit.Sink {
+				s, err := storage.New(storage.MemoryDriver)
+				require.NoError(t, err)
+
+				return audit.NewCollectionSink(&database.Database{
+					Cache: cache.NewCache(ctx, cache.NewQueue(s)),
+				})
+			},
+		},
+		{
+			name: "file sink",
+			sink: func(t *testing.T, ctx context.Context) audit.Sink {
+				return audit.NewFileSink(filepath.Join(t.TempDir(), "audit.log"))
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			a := audit.New(tc.sink(t, ctx)).WithDiffs(true)
+
+			reqCtx := auth.NewContext(ctx, &auth.Identity{KeyID: "key-1"})
+			reqCtx = audit.WithSourceIP(reqCtx, "10.0.0.1")
+
+			require.NoError(t, a.Record(reqCtx, audit.Entry{
+				Operation:  audit.OperationCreate,
+				Database:   "default",
+				Collection: "users",
+				DocumentID: "1",
+				After:      map[string]interface{}{"name": "John"},
+			}))
+			require.NoError(t, a.Record(reqCtx, audit.Entry{
+				Operation:  audit.OperationDelete,
+				Database:   "default",
+				Collection: "users",
+				DocumentID: "1",
+				Before:     map[string]interface{}{"name": "John"},
+			}))
+
+			// newest entries are returned first
+			entries, err := a.Query(ctx, audit.Filter{Collection: "users"})
+			require.NoError(t, err)
+			require.Len(t, entries, 2)
+			assert.Equal(t, audit.OperationDelete, entries[0].Operation)
+			assert.Equal(t, "key-1", entries[0].KeyID)
+			assert.Equal(t, "10.0.0.1", entries[0].SourceIP)
+			assert.Equal(t, map[string]interface{}{"name": "John"}, entries[0].Before)
+
+			entries, err = a.Query(ctx, audit.Filter{Operation: audit.OperationCreate})
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+			assert.Equal(t, map[string]interface{}{"name": "John"}, entries[0].After)
+
+			entries, err = a.Query(ctx, audit.Filter{Limit: 1})
+			require.NoError(t, err)
+			assert.Len(t, entries, 1)
+
+			entries, err = a.Query(ctx, audit.Filter{KeyID: "key-2"})
+			require.NoError(t, err)
+			assert.Empty(t, entries)
+		})
+	}
+}
+
+func TestAuditor_WithoutDiffs(t *testing.T) {
+	a := audit.New(audit.NewFileSink(filepath.Join(t.TempDir(), "audit.log")))
+
+	require.NoError(t, a.Record(context.Background(), audit.Entry{
+		Operation: audit.OperationCreate,
+		After:     map[string]interface{}{"name": "John"},
+	}))
+
+	entries, err := a.Query(context.Background(), audit.Filter{})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Nil(t, entries[0].After)
+}
+
+func TestAuditor_Nil(t *testing.T) {
+	var a *audit.Auditor
+
+	require.NoError(t, a.Record(context.Background(), audit.Entry{}))
+
+	entries, err := a.Query(context.Background(), audit.Filter{})
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestFileSink_Prune(t *testing.T) {
+	s := audit.NewFileSink(filepath.Join(t.TempDir(), "audit.log"))
+	a := audit.New(s)
+
+	require.NoError(t, a.Record(context.Background(), audit.Entry{Operation: audit.OperationCreate}))
+
+	pruned, err := s.Prune(time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 0, pruned)
+
+	pruned, err = s.Prune(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, pruned)
+
+	entries, err := s.Query(audit.Filter{})
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,250 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
+)
+
+// Collection is the collection the CollectionSink records entries in.
+const Collection = "_audit"
+
+var _ Sink = (*CollectionSink)(nil)
+
+// CollectionSink is a sink that records entries as documents of the _audit
+// collection, they are persisted with the rest of the database.
+type CollectionSink struct {
+	database *database.Database
+}
+
+// Append implements Sink.
+func (s *CollectionSink) Append(e Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	// the document id doubles as the entry id
+	delete(data, "id")
+
+	doc := document.New().SetID(e.ID).SetCollection(Collection).SetData(data)
+
+	return s.database.Put(doc, false)
+}
+
+// Query implements Sink.
+func (s *CollectionSink) Query(f Filter) ([]Entry, error) {
+	entries := []Entry{}
+	for _, doc := range s.database.Filter(Collection, cache.Query{}) {
+		e, err := entryFromDocument(doc)
+		if err != nil {
+			return nil, err
+		}
+
+		if f.matches(e) {
+			entries = append(entries, e)
+		}
+	}
+
+	return limit(entries, f.Limit), nil
+}
+
+// Prune implements Sink.
+func (s *CollectionSink) Prune(before time.Time) (int, error) {
+	pruned := 0
+	for _, doc := range s.database.Filter(Collection, cache.Query{}) {
+		e, err := entryFromDocument(doc)
+		if err != nil {
+			return pruned, err
+		}
+
+		if !e.Timestamp.Before(before) {
+			continue
+		}
+
+		if err := s.database.Delete(doc.ID.String()); err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+
+	return pruned, nil
+}
+
+// entryFromDocument returns the entry stored in a document.
+func entryFromDocument(doc *document.Document) (Entry, error) {
+	var e Entry
+
+	b, err := json.Marshal(doc.Data)
+	if err != nil {
+		return e, err
+	}
+
+	if err := json.Unmarshal(b, &e); err != nil {
+		return e, err
+	}
+	e.ID = doc.ID.String()
+
+	return e, nil
+}
+
+// NewCollectionSink returns a new sink recording entries in the database.
+func NewCollectionSink(d *database.Database) *CollectionSink {
+	return &CollectionSink{
+		database: d,
+	}
+}
+
+var _ Sink = (*FileSink)(nil)
+
+// FileSink is a sink that appends entries to a file, one JSON object per line.
+type FileSink struct {
+	mx   sync.Mutex
+	path string
+}
+
+// Append implements Sink.
+func (s *FileSink) Append(e Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// Query implements Sink.
+func (s *FileSink) Query(f Filter) ([]Entry, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	all, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []Entry{}
+	for _, e := range all {
+		if f.matches(e) {
+			entries = append(entries, e)
+		}
+	}
+
+	return limit(entries, f.Limit), nil
+}
+
+// Prune implements Sink, the file is rewritten without the pruned entries.
+func (s *FileSink) Prune(before time.Time) (int, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	all, err := s.read()
+	if err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".audit-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	pruned := 0
+	w := bufio.NewWriter(tmp)
+	for _, e := range all {
+		if e.Timestamp.Before(before) {
+			pruned++
+			continue
+		}
+
+		b, err := json.Marshal(e)
+		if err != nil {
+			tmp.Close()
+			return 0, err
+		}
+		w.Write(append(b, '\n'))
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+
+	if pruned == 0 {
+		return 0, nil
+	}
+
+	return pruned, os.Rename(tmp.Name(), s.path)
+}
+
+// read reads every entry from the file, the lock must be held.
+func (s *FileSink) read() ([]Entry, error) {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []Entry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, scanner.Err()
+}
+
+// NewFileSink returns a new sink appending entries to the file at path.
+func NewFileSink(path string) *FileSink {
+	return &FileSink{
+		path: path,
+	}
+}
+
+// limit sorts the entries newest first and truncates them to n, if n is positive.
+func limit(entries []Entry, n int) []Entry {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID > entries[j].ID
+	})
+
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+
+	return entries
+}
@@ -1,35 +1,181 @@
 package auth
 
 import (
+	"context"
+	"crypto/x509"
+
 	"github.com/nexdb/nexdb/pkg/database"
 	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
 	"github.com/nexdb/nexdb/pkg/errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// tracer traces authentication.
+var tracer = otel.Tracer("github.com/nexdb/nexdb/pkg/services/auth")
+
+// KeysCollection is the collection api keys are stored in, each database
+// has its own.
+const KeysCollection = "_api_keys"
+
+// Permission allows an api key to do more than read and write documents.
+type Permission string
+
+const (
+	// PermissionDecryptFields allows reading the encrypted fields of
+	// documents in plaintext.
+	PermissionDecryptFields Permission = "decrypt_fields"
 )
 
+// ValidatePermissions checks every permission is recognised.
+func ValidatePermissions(permissions []Permission) error {
+	for _, p := range permissions {
+		if p != PermissionDecryptFields {
+			return errors.New(errors.ErrPermissionIsInvalid)
+		}
+	}
+
+	return nil
+}
+
+// Identity identifies the api key a request was authenticated with.
+type Identity struct {
+	// KeyID is the id of the api key document, never the key itself.
+	KeyID string
+	// Database is the name of the database the key belongs to.
+	Database string
+	// Permissions are the permissions of the api key.
+	Permissions []Permission
+}
+
+// Can reports whether the identity has a permission.
+func (i *Identity) Can(p Permission) bool {
+	for _, granted := range i.Permissions {
+		if granted == p {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Can reports whether the identity carried by ctx has a permission.
+func Can(ctx context.Context, p Permission) bool {
+	id, ok := FromContext(ctx)
+	return ok && id.Can(p)
+}
+
 // AuthService is a service that handles requests from middleware
 // to authenticate users.
 type AuthService struct {
 	database *database.Database
 }
 
-// Authenticate authenticates a user.
-func (a *AuthService) Authenticate(key string) error {
-	results := a.database.Filter("_api_keys", cache.Query{
+// Authenticate authenticates a user. Keys of the default database are valid
+// for every database, keys of any other database are only valid when that
+// database is carried by the context.
+func (a *AuthService) Authenticate(ctx context.Context, key string) (*Identity, error) {
+	ctx, span := tracer.Start(ctx, "AuthService.Authenticate")
+	defer span.End()
+
+	id, err := a.authenticateBy(ctx, "key", key)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.String("nexdb.key_id", id.KeyID), attribute.String("nexdb.database", id.Database))
+	return id, nil
+}
+
+// AuthenticateCertificate authenticates a user by a verified client
+// certificate, the certificate's common name must match the subject of an
+// api key.
+func (a *AuthService) AuthenticateCertificate(ctx context.Context, cert *x509.Certificate) (*Identity, error) {
+	ctx, span := tracer.Start(ctx, "AuthService.AuthenticateCertificate")
+	defer span.End()
+
+	if cert.Subject.CommonName == "" {
+		span.SetStatus(codes.Error, "certificate has no common name")
+		return nil, errors.New(errors.ErrUnauthorized)
+	}
+
+	id, err := a.authenticateBy(ctx, "subject", cert.Subject.CommonName)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.String("nexdb.key_id", id.KeyID), attribute.String("nexdb.database", id.Database))
+	return id, nil
+}
+
+// authenticateBy looks for an api key whose field equals value, first in the
+// default database and then in the database carried by the context.
+func (a *AuthService) authenticateBy(ctx context.Context, field, value string) (*Identity, error) {
+	if doc := findKey(ctx, a.database, field, value); doc != nil {
+		return identityOf(a.database, doc), nil
+	}
+
+	if d, ok := database.FromContext(ctx); ok && d != a.database {
+		if doc := findKey(ctx, d, field, value); doc != nil {
+			return identityOf(d, doc), nil
+		}
+	}
+
+	return nil, errors.New(errors.ErrUnauthorized)
+}
+
+// identityOf returns the identity of an api key document of d.
+func identityOf(d *database.Database, doc *document.Document) *Identity {
+	id := &Identity{KeyID: doc.ID.String(), Database: d.Name}
+
+	raw, _ := doc.Data["permissions"].([]interface{})
+	for _, p := range raw {
+		if p, ok := p.(string); ok {
+			id.Permissions = append(id.Permissions, Permission(p))
+		}
+	}
+
+	return id
+}
+
+// findKey returns the api key document whose field equals value, if it
+// exists in the database.
+func findKey(ctx context.Context, d *database.Database, field, value string) *document.Document {
+	results := d.FilterContext(ctx, KeysCollection, cache.Query{
 		And: []cache.Element{
 			{
 				Condition: &cache.Condition{
-					Field:    "key",
+					Field:    field,
 					Operator: cache.Equals,
-					Value:    key,
+					Value:    value,
 				},
 			},
 		},
 	})
 	if len(results) == 0 {
-		return errors.New(errors.ErrUnauthorized)
+		return nil
 	}
 
-	return nil
+	return results[0]
+}
+
+// contextKey is the key used to store an identity in a context.
+type contextKey struct{}
+
+// NewContext returns a copy of ctx that carries the identity id.
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the identity carried by ctx, if any.
+func FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(contextKey{}).(*Identity)
+	return id, ok
 }
 
 func New(d *database.Database) *AuthService {
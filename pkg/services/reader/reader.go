@@ -2,32 +2,207 @@ package reader
 
 import (
 	"context"
+	"sort"
 
 	"github.com/nexdb/nexdb/pkg/database"
 	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/database/validation"
 	"github.com/nexdb/nexdb/pkg/document"
 	"github.com/nexdb/nexdb/pkg/errors"
+	"github.com/nexdb/nexdb/pkg/fieldcrypt"
+	"github.com/nexdb/nexdb/pkg/revisions"
+	"github.com/nexdb/nexdb/pkg/services/auth"
+	"github.com/nexdb/nexdb/pkg/trash"
 )
 
 // Reader is a service that handles requests from handlers to read from the database.
 type Reader struct {
 	database *database.Database
+	fields   *fieldcrypt.Encrypter
 }
 
-// WriteDocument writes a document to the database.
-func (r *Reader) GetDocument(ctx context.Context, id string) (*document.Document, error) {
-	doc := r.database.GetByID(id)
-	if doc == nil {
+// GetDocument gets a document of a collection from the database, documents
+// of system collections can't be read.
+func (r *Reader) GetDocument(ctx context.Context, collection, id string) (*document.Document, error) {
+	if err := validation.ValidateCollectionName(collection); err != nil {
+		return nil, err
+	}
+
+	d := r.databaseFor(ctx)
+	doc := d.GetByID(id)
+	if doc == nil || doc.Collection != collection {
 		return nil, errors.New(errors.ErrDocumentNotFound)
 	}
 
-	return doc, nil
+	docs, err := r.reveal(ctx, d, collection, []*document.Document{doc})
+	if err != nil {
+		return nil, err
+	}
+
+	return docs[0], nil
 }
 
-// SearchDocuments searches the database for documents that match the query.
+// SearchDocuments searches the database for documents that match the query,
+// documents of system collections can't be searched.
 func (r *Reader) SearchDocuments(ctx context.Context, collection string, query cache.Query) ([]*document.Document, error) {
-	docs := r.database.Filter(collection, query)
-	return docs, nil
+	if err := validation.ValidateCollectionName(collection); err != nil {
+		return nil, err
+	}
+
+	d := r.databaseFor(ctx)
+
+	// equals conditions on encrypted fields compare ciphertexts
+	query, err := r.fields.Query(collection, fieldcrypt.Fields(ctx, d, collection), query)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.reveal(ctx, d, collection, d.FilterContext(ctx, collection, query))
+}
+
+// ExportDocuments returns every document of a collection sorted by id,
+// which sorts them by creation time.
+func (r *Reader) ExportDocuments(ctx context.Context, collection string) ([]*document.Document, error) {
+	if err := validation.ValidateCollectionName(collection); err != nil {
+		return nil, err
+	}
+
+	d := r.databaseFor(ctx)
+	docs := d.FilterContext(ctx, collection, cache.Query{})
+	sort.Slice(docs, func(i, j int) bool {
+		return docs[i].ID.Compare(docs[j].ID) < 0
+	})
+
+	return r.reveal(ctx, d, collection, docs)
+}
+
+// TrashDocuments returns the documents in the trash of a collection sorted
+// by id.
+func (r *Reader) TrashDocuments(ctx context.Context, collection string) ([]*document.Document, error) {
+	if err := validation.ValidateCollectionName(collection); err != nil {
+		return nil, err
+	}
+
+	d := r.databaseFor(ctx)
+	docs := trash.List(ctx, d, collection)
+	sort.Slice(docs, func(i, j int) bool {
+		return docs[i].ID.Compare(docs[j].ID) < 0
+	})
+
+	return r.reveal(ctx, d, collection, docs)
+}
+
+// Revisions returns the revisions of a document of a collection without
+// their data, newest first.
+func (r *Reader) Revisions(ctx context.Context, collection, id string) ([]revisions.Revision, error) {
+	d := r.databaseFor(ctx)
+	if doc := d.GetByID(id); doc == nil || doc.Collection != collection {
+		return nil, errors.New(errors.ErrDocumentNotFound)
+	}
+
+	return revisions.List(ctx, d, id), nil
+}
+
+// Revision returns revision n of a document of a collection.
+func (r *Reader) Revision(ctx context.Context, collection, id string, n int) (revisions.Revision, error) {
+	d := r.databaseFor(ctx)
+	if doc := d.GetByID(id); doc == nil || doc.Collection != collection {
+		return revisions.Revision{}, errors.New(errors.ErrDocumentNotFound)
+	}
+
+	revision, err := revisions.Find(ctx, d, id, n)
+	if err != nil {
+		return revisions.Revision{}, err
+	}
+
+	revision.Data, err = r.revealData(ctx, d, collection, revision.Data)
+	return revision, err
+}
+
+// DiffRevisions returns the changes from revision from of a document of a
+// collection to revision to, or to the document as it is if to is 0.
+func (r *Reader) DiffRevisions(ctx context.Context, collection, id string, from, to int) ([]revisions.Change, error) {
+	d := r.databaseFor(ctx)
+	doc := d.GetByID(id)
+	if doc == nil || doc.Collection != collection {
+		return nil, errors.New(errors.ErrDocumentNotFound)
+	}
+
+	a, err := revisions.Find(ctx, d, id, from)
+	if err != nil {
+		return nil, err
+	}
+
+	b := revisions.Revision{Data: doc.Data}
+	if to != 0 {
+		if b, err = revisions.Find(ctx, d, id, to); err != nil {
+			return nil, err
+		}
+	}
+
+	// compare the values, not the ciphertexts of encrypted fields
+	if a.Data, err = r.revealData(ctx, d, collection, a.Data); err != nil {
+		return nil, err
+	}
+	if b.Data, err = r.revealData(ctx, d, collection, b.Data); err != nil {
+		return nil, err
+	}
+
+	return revisions.Diff(a.Data, b.Data), nil
+}
+
+// revealData returns the data of a document of a collection of d, see
+// reveal.
+func (r *Reader) revealData(ctx context.Context, d *database.Database, collection string, data map[string]interface{}) (map[string]interface{}, error) {
+	docs, err := r.reveal(ctx, d, collection, []*document.Document{document.New().SetCollection(collection).SetData(data)})
+	if err != nil {
+		return nil, err
+	}
+
+	return docs[0].Data, nil
+}
+
+// reveal returns copies of the documents of a collection of d with their
+// encrypted fields decrypted, if the identity carried by ctx is allowed to
+// decrypt them. Otherwise the documents are returned as they are stored.
+func (r *Reader) reveal(ctx context.Context, d *database.Database, collection string, docs []*document.Document) ([]*document.Document, error) {
+	if !auth.Can(ctx, auth.PermissionDecryptFields) {
+		return docs, nil
+	}
+
+	fields := fieldcrypt.Fields(ctx, d, collection)
+	if len(fields) == 0 {
+		return docs, nil
+	}
+
+	revealed := make([]*document.Document, len(docs))
+	for i, doc := range docs {
+		data, err := r.fields.Decrypt(collection, fields, doc.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		revealed[i] = document.New().SetCollection(doc.Collection).SetID(doc.ID.String()).SetData(data)
+	}
+
+	return revealed, nil
+}
+
+// WithFieldEncrypter sets the encrypter of the encrypted fields of
+// collections.
+func (r *Reader) WithFieldEncrypter(e *fieldcrypt.Encrypter) *Reader {
+	r.fields = e
+	return r
+}
+
+// databaseFor returns the database carried by the context, falling back
+// to the database the reader was created with.
+func (r *Reader) databaseFor(ctx context.Context) *database.Database {
+	if d, ok := database.FromContext(ctx); ok {
+		return d
+	}
+
+	return r.database
 }
 
 // New returns a new instance of Reader
@@ -0,0 +1,124 @@
+package status
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/errors"
+	"github.com/nexdb/nexdb/pkg/storage"
+)
+
+// Status is a service that reports the health of the server.
+type Status struct {
+	manager *database.Manager
+	store   storage.Storage
+	driver  storage.Driver
+	version string
+	started time.Time
+	loaded  atomic.Bool
+}
+
+// Report is the status of the server.
+type Report struct {
+	Version   string     `json:"version"`
+	StartedAt time.Time  `json:"started_at"`
+	Uptime    string     `json:"uptime"`
+	Databases []Database `json:"databases"`
+	Storage   Storage    `json:"storage"`
+}
+
+// Database is the status of a database.
+type Database struct {
+	Name         string         `json:"name"`
+	Documents    int            `json:"documents"`
+	Collections  map[string]int `json:"collections"`
+	QueueBacklog int            `json:"queue_backlog"`
+}
+
+// Storage is the status of the storage backend.
+type Storage struct {
+	Driver    string            `json:"driver"`
+	Reachable bool              `json:"reachable"`
+	Error     string            `json:"error,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+// SetLoaded marks the databases as loaded, the server isn't ready before.
+func (s *Status) SetLoaded() {
+	s.loaded.Store(true)
+}
+
+// Loaded returns whether the databases have been loaded.
+func (s *Status) Loaded() bool {
+	return s.loaded.Load()
+}
+
+// Ready returns an error unless the databases are loaded and the storage
+// backend is reachable.
+func (s *Status) Ready(ctx context.Context) error {
+	if !s.Loaded() {
+		return errors.New(errors.ErrNotReady)
+	}
+
+	if err := storage.Ping(ctx, s.store); err != nil {
+		return errors.New(errors.ErrStorageUnreachable)
+	}
+
+	return nil
+}
+
+// Report returns the status of the server.
+func (s *Status) Report(ctx context.Context) Report {
+	report := Report{
+		Version:   s.version,
+		StartedAt: s.started,
+		Uptime:    time.Since(s.started).Round(time.Second).String(),
+		Databases: []Database{},
+		Storage: Storage{
+			Driver:    string(s.driver),
+			Reachable: true,
+			Details:   storage.Describe(s.store),
+		},
+	}
+
+	if err := storage.Ping(ctx, s.store); err != nil {
+		report.Storage.Reachable = false
+		report.Storage.Error = err.Error()
+	}
+
+	for _, d := range s.manager.Databases() {
+		status := Database{
+			Name:         d.Name,
+			Collections:  map[string]int{},
+			QueueBacklog: d.Queue().Len(),
+		}
+
+		for _, doc := range d.Documents() {
+			status.Documents++
+			status.Collections[doc.Collection]++
+		}
+
+		report.Databases = append(report.Databases, status)
+	}
+
+	sort.Slice(report.Databases, func(i, j int) bool {
+		return report.Databases[i].Name < report.Databases[j].Name
+	})
+
+	return report
+}
+
+// New returns a new status service, store is the storage of the default
+// database and is checked for reachability.
+func New(manager *database.Manager, store storage.Storage, driver storage.Driver, version string) *Status {
+	return &Status{
+		manager: manager,
+		store:   store,
+		driver:  driver,
+		version: version,
+		started: time.Now(),
+	}
+}
@@ -0,0 +1,161 @@
+package writer
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"io"
+
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/database/validation"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/errors"
+	"github.com/nexdb/nexdb/pkg/fieldcrypt"
+	"github.com/nexdb/nexdb/pkg/services/audit"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// IDMode is how the _id of imported rows is handled.
+type IDMode string
+
+const (
+	// IDModeRegenerate ignores the _id of rows, every row is created as a
+	// new document.
+	IDModeRegenerate IDMode = "regenerate"
+	// IDModePreserve keeps the _id of rows, rows whose document already
+	// exists in the collection overwrite it. Rows without an _id are created
+	// as new documents.
+	IDModePreserve IDMode = "preserve"
+)
+
+// maxImportErrors is the number of row errors reported by an import, rows
+// failing afterwards are only counted.
+const maxImportErrors = 100
+
+// ImportError is the error of a row that could not be imported.
+type ImportError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// ImportResult is the result of an import.
+type ImportResult struct {
+	Imported int           `json:"imported"`
+	Failed   int           `json:"failed"`
+	Errors   []ImportError `json:"errors,omitempty"`
+}
+
+// ErrInvalidRow is wrapped by the errors of a RowReader for rows that can't
+// be read, the row is skipped and the import carries on.
+var ErrInvalidRow = stderrors.New("invalid row")
+
+// RowReader returns the next row of an import, io.EOF ends the import.
+type RowReader func() (map[string]interface{}, error)
+
+// ImportDocuments imports the rows returned by next into a collection, one
+// document per row. Rows are written as they are read so imports of any size
+// are never held in memory. Rows that can't be imported are skipped and
+// reported in the result, an error reading the rows ends the import.
+func (w *Writer) ImportDocuments(ctx context.Context, collection string, mode IDMode, next RowReader) (ImportResult, error) {
+	result := ImportResult{}
+
+	if err := validation.ValidateCollectionName(collection); err != nil {
+		return result, err
+	}
+
+	if mode != IDModeRegenerate && mode != IDModePreserve {
+		return result, errors.New(errors.ErrIDModeIsInvalid)
+	}
+
+	for row := 1; ; row++ {
+		data, err := next()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil && !stderrors.Is(err, ErrInvalidRow) {
+			return result, fmt.Errorf("row %d: %w", row, err)
+		}
+
+		var entry audit.Entry
+		if err == nil {
+			entry, err = w.importRow(ctx, collection, mode, data)
+		}
+		if err != nil {
+			result.Failed++
+			if len(result.Errors) < maxImportErrors {
+				result.Errors = append(result.Errors, ImportError{Row: row, Error: err.Error()})
+			}
+			continue
+		}
+		result.Imported++
+
+		w.recordAudit(ctx, entry)
+	}
+}
+
+// importRow writes a single imported row, encrypting the encrypted fields
+// of the collection. It returns the audit entry of the write.
+func (w *Writer) importRow(ctx context.Context, collection string, mode IDMode, data map[string]interface{}) (audit.Entry, error) {
+	d := w.databaseFor(ctx)
+
+	if _, ok := data[cache.DeletedAt]; ok {
+		return audit.Entry{}, errors.New(errors.ErrFieldIsReserved)
+	}
+
+	rawID, hasID := data["_id"]
+	delete(data, "_id")
+
+	doc := document.New().SetCollection(collection)
+	preserve := mode == IDModePreserve && hasID && rawID != ""
+	if preserve {
+		id, ok := rawID.(string)
+		if !ok {
+			return audit.Entry{}, fmt.Errorf("_id must be a string")
+		}
+
+		parsed, err := ulid.ParseStrict(id)
+		if err != nil {
+			return audit.Entry{}, fmt.Errorf("_id %q is invalid: %w", id, err)
+		}
+		doc.ID = parsed
+	}
+	id := doc.ID.String()
+
+	// the encrypted fields of the collection and the document can't change
+	// until the row is written
+	unlock := d.LockDocument(collection, id)
+	defer unlock()
+
+	data, err := w.fields.Encrypt(collection, fieldcrypt.Fields(ctx, d, collection), data)
+	if err != nil {
+		return audit.Entry{}, err
+	}
+	doc.SetData(data)
+
+	op := audit.OperationCreate
+	var before map[string]interface{}
+	if existing := d.GetByID(id); preserve && existing != nil {
+		if existing.Collection != collection {
+			return audit.Entry{}, fmt.Errorf("_id %q belongs to a document of another collection", id)
+		}
+
+		op = audit.OperationUpdate
+		before = existing.Data
+	}
+
+	if err := d.PutContext(ctx, doc, false); err != nil {
+		return audit.Entry{}, err
+	}
+
+	w.recordRevision(ctx, d, doc)
+
+	return audit.Entry{
+		Operation:  op,
+		Database:   d.Name,
+		Collection: collection,
+		DocumentID: id,
+		Before:     before,
+		After:      doc.Data,
+	}, nil
+}
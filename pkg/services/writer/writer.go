@@ -2,16 +2,26 @@ package writer
 
 import (
 	"context"
+	"log/slog"
+	"strings"
+	"time"
 
 	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
 	"github.com/nexdb/nexdb/pkg/database/validation"
 	"github.com/nexdb/nexdb/pkg/document"
 	"github.com/nexdb/nexdb/pkg/errors"
+	"github.com/nexdb/nexdb/pkg/fieldcrypt"
+	"github.com/nexdb/nexdb/pkg/revisions"
+	"github.com/nexdb/nexdb/pkg/services/audit"
+	"github.com/nexdb/nexdb/pkg/trash"
 )
 
 // Writer is a service that handles requests from handlers to write to the database.
 type Writer struct {
 	database *database.Database
+	auditor  *audit.Auditor
+	fields   *fieldcrypt.Encrypter
 }
 
 // WriteDocument writes a document to the database.
@@ -20,37 +30,313 @@ func (w *Writer) WriteDocument(ctx context.Context, collection string, data map[
 		return nil, err
 	}
 
+	if _, ok := data[cache.DeletedAt]; ok {
+		return nil, errors.New(errors.ErrFieldIsReserved)
+	}
+
+	d := w.databaseFor(ctx)
+
+	// new documents are given their id up front, so they are locked the
+	// same as updates
+	doc := document.New().SetCollection(collection)
+	id := doc.ID.String()
+	if data["_id"] != nil {
+		id = data["_id"].(string)
+	}
+
+	// the encrypted fields of the collection and the document can't change
+	// until it is written
+	unlock := d.LockDocument(collection, id)
+	defer unlock()
+
+	// encrypt the encrypted fields of the collection, _id is never one
+	data, err := w.fields.Encrypt(collection, fieldcrypt.Fields(ctx, d, collection), data)
+	if err != nil {
+		return nil, err
+	}
+
 	// if the document has an id, then it already exists in the database
 	// and we need to update it.
 	if data["_id"] != nil {
-		existing := w.database.GetByID(data["_id"].(string))
-		if existing == nil {
+		existing := d.GetByID(id)
+		if existing == nil || existing.Collection != collection {
 			return nil, errors.New(errors.ErrDocumentNotFound)
 		}
 
 		// remove _id from the data
 		delete(data, "_id")
 
-		existing.SetData(data)
+		// the cached document may be being read, it is replaced rather
+		// than changed
+		updated := (&document.Document{ID: existing.ID, Collection: collection}).SetData(data)
+		if err := d.PutContext(ctx, updated, false); err != nil {
+			return nil, err
+		}
+
+		w.recordRevision(ctx, d, updated)
 
-		err := w.database.Put(existing, false)
-		return existing, err
+		w.recordAudit(ctx, audit.Entry{
+			Operation:  audit.OperationUpdate,
+			Database:   d.Name,
+			Collection: collection,
+			DocumentID: updated.ID.String(),
+			Before:     existing.Data,
+			After:      updated.Data,
+		})
+
+		return updated, nil
 	}
 
 	// if the document does not have an id, then we need to create a new one.
-	doc := document.New().SetCollection(collection).SetData(data)
-	err := w.database.Put(doc, false)
+	doc.SetData(data)
+	if err := d.PutContext(ctx, doc, false); err != nil {
+		return nil, err
+	}
 
-	return doc, err
+	w.recordRevision(ctx, d, doc)
+
+	w.recordAudit(ctx, audit.Entry{
+		Operation:  audit.OperationCreate,
+		Database:   d.Name,
+		Collection: collection,
+		DocumentID: doc.ID.String(),
+		After:      doc.Data,
+	})
+
+	return doc, nil
 }
 
-// DeleteDocument deletes a document from the database.
+// DeleteDocument deletes a document from the database, documents of system
+// collections such as api keys and the audit log can not be deleted.
+// Documents of collections that soft delete are moved to the trash instead.
 func (w *Writer) DeleteDocument(ctx context.Context, id string) error {
-	if doc := w.database.GetByID(id); doc == nil {
+	d := w.databaseFor(ctx)
+	doc := d.GetByID(id)
+	if doc == nil || strings.HasPrefix(doc.Collection, "_") {
+		return errors.New(errors.ErrDocumentNotFound)
+	}
+	collection := doc.Collection
+
+	unlock := d.LockDocument(collection, id)
+	defer unlock()
+
+	// the document may have been written or deleted before it was locked
+	doc = d.GetByID(id)
+	if doc == nil || doc.Collection != collection {
 		return errors.New(errors.ErrDocumentNotFound)
 	}
 
-	return w.database.Delete(id)
+	if trash.Get(ctx, d, collection).Enabled {
+		deleted, err := trash.Delete(ctx, d, doc, time.Now())
+		if err != nil {
+			return err
+		}
+
+		w.recordAudit(ctx, audit.Entry{
+			Operation:  audit.OperationDelete,
+			Database:   d.Name,
+			Collection: collection,
+			DocumentID: id,
+			Before:     doc.Data,
+			After:      deleted.Data,
+		})
+
+		return nil
+	}
+
+	if err := d.DeleteContext(ctx, id); err != nil {
+		return err
+	}
+
+	w.forgetRevisions(ctx, d, collection, id)
+
+	w.recordAudit(ctx, audit.Entry{
+		Operation:  audit.OperationDelete,
+		Database:   d.Name,
+		Collection: collection,
+		DocumentID: id,
+		Before:     doc.Data,
+	})
+
+	return nil
+}
+
+// UndeleteDocument takes a document of a collection out of the trash.
+func (w *Writer) UndeleteDocument(ctx context.Context, collection, id string) (*document.Document, error) {
+	if err := validation.ValidateCollectionName(collection); err != nil {
+		return nil, err
+	}
+
+	d := w.databaseFor(ctx)
+	unlock := d.LockDocument(collection, id)
+	defer unlock()
+
+	doc, err := trash.Undelete(ctx, d, collection, id)
+	if err != nil {
+		return nil, err
+	}
+
+	w.recordAudit(ctx, audit.Entry{
+		Operation:  audit.OperationUndelete,
+		Database:   d.Name,
+		Collection: collection,
+		DocumentID: id,
+		After:      doc.Data,
+	})
+
+	return doc, nil
+}
+
+// PurgeDocument deletes a document of a collection from the trash for good.
+func (w *Writer) PurgeDocument(ctx context.Context, collection, id string) error {
+	if err := validation.ValidateCollectionName(collection); err != nil {
+		return err
+	}
+
+	d := w.databaseFor(ctx)
+	unlock := d.LockDocument(collection, id)
+	defer unlock()
+
+	doc, err := trash.Purge(ctx, d, collection, id)
+	if err != nil {
+		return err
+	}
+
+	w.recordPurge(ctx, d, doc)
+
+	return nil
+}
+
+// PurgeExpired deletes the documents of d that have been in the trash for
+// longer than the retention of their collection for good, it returns how
+// many were purged.
+func (w *Writer) PurgeExpired(ctx context.Context, d *database.Database) (int, error) {
+	now := time.Now()
+
+	purged := 0
+	for _, doc := range trash.Expired(ctx, d, now) {
+		ok, err := w.purgeExpired(ctx, d, doc, now)
+		if err != nil {
+			return purged, err
+		}
+		if ok {
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+// purgeExpired purges doc, an expired document of the trash, unless it has
+// been undeleted or deleted again since. It returns whether it was purged.
+func (w *Writer) purgeExpired(ctx context.Context, d *database.Database, doc *document.Document, now time.Time) (bool, error) {
+	id := doc.ID.String()
+
+	unlock := d.LockDocument(doc.Collection, id)
+	defer unlock()
+
+	current := d.GetAnyByID(id)
+	if current == nil || current.Collection != doc.Collection || !trash.IsExpired(ctx, d, current, now) {
+		return false, nil
+	}
+
+	purged, err := trash.Purge(ctx, d, doc.Collection, id)
+	if err != nil {
+		return false, err
+	}
+
+	w.recordPurge(ctx, d, purged)
+
+	return true, nil
+}
+
+// recordPurge records the audit entry of a document purged from the trash.
+func (w *Writer) recordPurge(ctx context.Context, d *database.Database, doc *document.Document) {
+	w.recordAudit(ctx, audit.Entry{
+		Operation:  audit.OperationPurge,
+		Database:   d.Name,
+		Collection: doc.Collection,
+		DocumentID: doc.ID.String(),
+		Before:     doc.Data,
+	})
+}
+
+// RestoreRevision writes the data of revision n of a document back as its
+// latest version, which is recorded as a new revision.
+func (w *Writer) RestoreRevision(ctx context.Context, collection, id string, n int) (*document.Document, error) {
+	d := w.databaseFor(ctx)
+	doc := d.GetByID(id)
+	if doc == nil || doc.Collection != collection {
+		return nil, errors.New(errors.ErrDocumentNotFound)
+	}
+
+	revision, err := revisions.Find(ctx, d, id, n)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[string]interface{}, len(revision.Data)+1)
+	for k, v := range revision.Data {
+		data[k] = v
+	}
+	data["_id"] = id
+
+	return w.WriteDocument(ctx, collection, data)
+}
+
+// recordRevision records the data of doc as its latest revision, if its
+// collection tracks revisions. The lock of the document must be held so no
+// two writes of it are given the same revision. The write has been committed
+// by then, so a revision that can't be recorded is logged rather than
+// failing the request.
+func (w *Writer) recordRevision(ctx context.Context, d *database.Database, doc *document.Document) {
+	if err := revisions.Record(ctx, d, doc, time.Now()); err != nil {
+		slog.Error("failed to record revision", "database", d.Name, "collection", doc.Collection,
+			"document", doc.ID.String(), "error", err)
+	}
+}
+
+// forgetRevisions deletes the revisions of a document that has been
+// deleted for good. The delete has been committed by then, so revisions that
+// can't be deleted are logged rather than failing the request.
+func (w *Writer) forgetRevisions(ctx context.Context, d *database.Database, collection, id string) {
+	if err := revisions.Forget(ctx, d, id); err != nil {
+		slog.Error("failed to delete revisions", "database", d.Name, "collection", collection,
+			"document", id, "error", err)
+	}
+}
+
+// recordAudit records the audit entry of a write that has been committed.
+// The write can't be taken back, so an entry that can't be recorded is
+// logged rather than failing the request.
+func (w *Writer) recordAudit(ctx context.Context, e audit.Entry) {
+	if err := w.auditor.Record(ctx, e); err != nil {
+		slog.Error("failed to record audit entry", "operation", e.Operation, "database", e.Database,
+			"collection", e.Collection, "document", e.DocumentID, "error", err)
+	}
+}
+
+// WithAuditor sets the auditor that records every write.
+func (w *Writer) WithAuditor(a *audit.Auditor) *Writer {
+	w.auditor = a
+	return w
+}
+
+// WithFieldEncrypter sets the encrypter of the encrypted fields of
+// collections.
+func (w *Writer) WithFieldEncrypter(e *fieldcrypt.Encrypter) *Writer {
+	w.fields = e
+	return w
+}
+
+// databaseFor returns the database carried by the context, falling back
+// to the database the writer was created with.
+func (w *Writer) databaseFor(ctx context.Context) *database.Database {
+	if d, ok := database.FromContext(ctx); ok {
+		return d
+	}
+
+	return w.database
 }
 
 // New returns a new instance of Writer.
@@ -2,15 +2,22 @@ package writer_test
 
 import (
 	"context"
+	stderrors "errors"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/nexdb/nexdb/pkg/database"
 	"github.com/nexdb/nexdb/pkg/database/cache"
 	"github.com/nexdb/nexdb/pkg/document"
 	"github.com/nexdb/nexdb/pkg/errors"
+	"github.com/nexdb/nexdb/pkg/revisions"
+	"github.com/nexdb/nexdb/pkg/services/audit"
 	"github.com/nexdb/nexdb/pkg/services/writer"
 	"github.com/nexdb/nexdb/pkg/storage"
+	"github.com/nexdb/nexdb/pkg/trash"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -39,6 +46,15 @@ func TestWriter_WriteDocument(t *testing.T) {
 				require.Nil(t, doc)
 			},
 		},
+		{
+			name:       "reserved field, expect ErrFieldIsReserved to be returned",
+			collection: "users",
+			data:       map[string]interface{}{"name": "John", cache.DeletedAt: "2024-01-01T00:00:00Z"},
+			verify: func(t *testing.T, doc *document.Document, err error) {
+				require.Equal(t, errors.New(errors.ErrFieldIsReserved).Error(), err.Error())
+				require.Nil(t, doc)
+			},
+		},
 	} {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
@@ -60,3 +76,316 @@ func TestWriter_WriteDocument(t *testing.T) {
 		})
 	}
 }
+
+func TestWriter_Audit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	d := &database.Database{
+		Cache: cache.NewCache(ctx, cache.NewQueue(s)),
+		Name:  "default",
+	}
+	a := audit.New(audit.NewCollectionSink(d))
+	wr := writer.New(d).WithAuditor(a)
+
+	doc, err := wr.WriteDocument(ctx, "users", map[string]interface{}{"name": "John"})
+	require.NoError(t, err)
+
+	_, err = wr.WriteDocument(ctx, "users", map[string]interface{}{"_id": doc.ID.String(), "name": "Jane"})
+	require.NoError(t, err)
+
+	require.NoError(t, wr.DeleteDocument(ctx, doc.ID.String()))
+
+	entries, err := a.Query(ctx, audit.Filter{DocumentID: doc.ID.String()})
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, audit.OperationDelete, entries[0].Operation)
+	assert.Equal(t, audit.OperationUpdate, entries[1].Operation)
+	assert.Equal(t, audit.OperationCreate, entries[2].Operation)
+	assert.Equal(t, "users", entries[0].Collection)
+	assert.Equal(t, "default", entries[0].Database)
+
+	// the audit log itself can not be deleted through the writer
+	err = wr.DeleteDocument(ctx, entries[0].ID)
+	require.Equal(t, errors.New(errors.ErrDocumentNotFound).Error(), err.Error())
+}
+
+// failingSink is an audit sink that fails every append.
+type failingSink struct{}
+
+func (failingSink) Append(audit.Entry) error                  { return stderrors.New("sink is down") }
+func (failingSink) Query(audit.Filter) ([]audit.Entry, error) { return nil, nil }
+func (failingSink) Prune(time.Time) (int, error)              { return 0, nil }
+
+func TestWriter_AuditFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	d := &database.Database{Cache: cache.NewCache(ctx, cache.NewQueue(s))}
+	wr := writer.New(d).WithAuditor(audit.New(failingSink{}))
+
+	// committed writes are not failed by the audit log
+	doc, err := wr.WriteDocument(ctx, "users", map[string]interface{}{"name": "John"})
+	require.NoError(t, err)
+	require.NotNil(t, d.GetByID(doc.ID.String()))
+
+	require.NoError(t, wr.DeleteDocument(ctx, doc.ID.String()))
+	assert.Nil(t, d.GetByID(doc.ID.String()))
+}
+
+// revisionsCommitter applies writes straight to the cache of d, except the
+// deletes of revisions which it fails.
+type revisionsCommitter struct {
+	d *database.Database
+}
+
+func (c revisionsCommitter) Commit(ctx context.Context, _ string, op cache.Operation, doc *document.Document) error {
+	if op == cache.OperationDelete {
+		if current := c.d.GetAnyByID(doc.ID.String()); current != nil && current.Collection == revisions.Collection {
+			return stderrors.New("log is down")
+		}
+		return c.d.Cache.DeleteContext(ctx, doc.ID.String())
+	}
+
+	return c.d.Cache.PutContext(ctx, doc, false)
+}
+
+func TestWriter_ForgetRevisionsFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	d := &database.Database{Cache: cache.NewCache(ctx, cache.NewQueue(s))}
+	database.NewManager(ctx, storage.MemoryDriver, d).WithCommitter(revisionsCommitter{d: d})
+	require.NoError(t, d.Put(document.New().SetCollection(revisions.SettingsCollection).SetData(map[string]interface{}{
+		"collection": "users",
+		"keep":       10,
+	}), false))
+	a := audit.New(audit.NewCollectionSink(d))
+	wr := writer.New(d).WithAuditor(a)
+
+	doc, err := wr.WriteDocument(ctx, "users", map[string]interface{}{"name": "John"})
+	require.NoError(t, err)
+	id := doc.ID.String()
+
+	// the document is deleted and audited even though its revisions aren't
+	require.NoError(t, wr.DeleteDocument(ctx, id))
+	assert.Nil(t, d.GetAnyByID(id))
+
+	entries, err := a.Query(ctx, audit.Filter{DocumentID: id})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, audit.OperationDelete, entries[0].Operation)
+}
+
+func TestWriter_RestoreRevision(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	d := &database.Database{Cache: cache.NewCache(ctx, cache.NewQueue(s))}
+	require.NoError(t, d.Put(document.New().SetCollection(revisions.SettingsCollection).SetData(map[string]interface{}{
+		"collection": "users",
+		"keep":       10,
+	}), false))
+	wr := writer.New(d)
+
+	doc, err := wr.WriteDocument(ctx, "users", map[string]interface{}{"name": "John"})
+	require.NoError(t, err)
+	id := doc.ID.String()
+
+	_, err = wr.WriteDocument(ctx, "users", map[string]interface{}{"_id": id, "name": "Jane"})
+	require.NoError(t, err)
+
+	restored, err := wr.RestoreRevision(ctx, "users", id, 1)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "John"}, restored.Data)
+	assert.Equal(t, "John", d.GetByID(id).Data["name"])
+
+	// restoring is recorded as a revision of its own
+	require.Len(t, revisions.List(ctx, d, id), 3)
+
+	_, err = wr.RestoreRevision(ctx, "users", id, 4)
+	require.Equal(t, errors.New(errors.ErrRevisionNotFound).Error(), err.Error())
+	_, err = wr.RestoreRevision(ctx, "orders", id, 1)
+	require.Equal(t, errors.New(errors.ErrDocumentNotFound).Error(), err.Error())
+
+	// the revisions of a deleted document are deleted with it
+	require.NoError(t, wr.DeleteDocument(ctx, id))
+	assert.Empty(t, revisions.List(ctx, d, id))
+}
+
+func TestWriter_ConcurrentRevisions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	d := &database.Database{Cache: cache.NewCache(ctx, cache.NewQueue(s))}
+	require.NoError(t, d.Put(document.New().SetCollection(revisions.SettingsCollection).SetData(map[string]interface{}{
+		"collection": "users",
+		"keep":       100,
+	}), false))
+	wr := writer.New(d)
+
+	doc, err := wr.WriteDocument(ctx, "users", map[string]interface{}{"name": "John"})
+	require.NoError(t, err)
+	id := doc.ID.String()
+
+	// concurrent writes of a document are each given a revision of their own
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := wr.WriteDocument(ctx, "users", map[string]interface{}{"_id": id, "name": i})
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	list := revisions.List(ctx, d, id)
+	require.Len(t, list, 21)
+	for i, r := range list {
+		assert.Equal(t, 21-i, r.Revision)
+	}
+}
+
+func TestWriter_SoftDelete(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	d := &database.Database{Cache: cache.NewCache(ctx, cache.NewQueue(s))}
+	require.NoError(t, d.Put(document.New().SetCollection(trash.SettingsCollection).SetData(map[string]interface{}{
+		"collection": "users",
+	}), false))
+	a := audit.New(audit.NewCollectionSink(d))
+	wr := writer.New(d).WithAuditor(a)
+
+	doc, err := wr.WriteDocument(ctx, "users", map[string]interface{}{"name": "John"})
+	require.NoError(t, err)
+	id := doc.ID.String()
+
+	require.NoError(t, wr.DeleteDocument(ctx, id))
+	assert.Nil(t, d.GetByID(id))
+	require.Len(t, trash.List(ctx, d, "users"), 1)
+
+	// documents in the trash can't be updated or deleted again
+	_, err = wr.WriteDocument(ctx, "users", map[string]interface{}{"_id": id, "name": "Jane"})
+	require.Equal(t, errors.New(errors.ErrDocumentNotFound).Error(), err.Error())
+	err = wr.DeleteDocument(ctx, id)
+	require.Equal(t, errors.New(errors.ErrDocumentNotFound).Error(), err.Error())
+
+	restored, err := wr.UndeleteDocument(ctx, "users", id)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "John"}, restored.Data)
+	assert.NotNil(t, d.GetByID(id))
+
+	require.NoError(t, wr.DeleteDocument(ctx, id))
+	require.NoError(t, wr.PurgeDocument(ctx, "users", id))
+	assert.Nil(t, d.GetAnyByID(id))
+	assert.Empty(t, trash.List(ctx, d, "users"))
+
+	entries, err := a.Query(ctx, audit.Filter{DocumentID: id})
+	require.NoError(t, err)
+	require.Len(t, entries, 5)
+	assert.Equal(t, audit.OperationPurge, entries[0].Operation)
+	assert.Equal(t, audit.OperationUndelete, entries[2].Operation)
+}
+
+func TestWriter_SoftDelete_Concurrent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	d := &database.Database{Cache: cache.NewCache(ctx, cache.NewQueue(s))}
+	require.NoError(t, d.Put(document.New().SetCollection(trash.SettingsCollection).SetData(map[string]interface{}{
+		"collection": "users",
+	}), false))
+	wr := writer.New(d).WithAuditor(audit.New(failingSink{}))
+
+	for i := 0; i < 20; i++ {
+		doc, err := wr.WriteDocument(ctx, "users", map[string]interface{}{"name": "John"})
+		require.NoError(t, err)
+		id := doc.ID.String()
+
+		// audit failures don't fail writes that were moved to the trash
+		require.NoError(t, wr.DeleteDocument(ctx, id))
+
+		// a document is either undeleted or purged, never both
+		var (
+			wg                    sync.WaitGroup
+			undeleteErr, purgeErr error
+		)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, undeleteErr = wr.UndeleteDocument(ctx, "users", id)
+		}()
+		go func() {
+			defer wg.Done()
+			purgeErr = wr.PurgeDocument(ctx, "users", id)
+		}()
+		wg.Wait()
+
+		if undeleteErr == nil {
+			require.Error(t, purgeErr)
+			assert.NotNil(t, d.GetByID(id))
+		} else {
+			require.NoError(t, purgeErr)
+			assert.Nil(t, d.GetAnyByID(id))
+		}
+	}
+}
+
+func TestWriter_PurgeExpired(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	d := &database.Database{Cache: cache.NewCache(ctx, cache.NewQueue(s))}
+	require.NoError(t, d.Put(document.New().SetCollection(trash.SettingsCollection).SetData(map[string]interface{}{
+		"collection": "users",
+		"retention":  "1h",
+	}), false))
+	a := audit.New(audit.NewCollectionSink(d))
+	wr := writer.New(d).WithAuditor(a)
+
+	expired := document.New().SetCollection("users").SetData(map[string]interface{}{"name": "ada"})
+	require.NoError(t, d.Put(expired, false))
+	_, err = trash.Delete(ctx, d, expired, time.Now().Add(-2*time.Hour))
+	require.NoError(t, err)
+
+	doc, err := wr.WriteDocument(ctx, "users", map[string]interface{}{"name": "grace"})
+	require.NoError(t, err)
+	require.NoError(t, wr.DeleteDocument(ctx, doc.ID.String()))
+
+	n, err := wr.PurgeExpired(ctx, d)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Nil(t, d.GetAnyByID(expired.ID.String()))
+	assert.Len(t, trash.List(ctx, d, "users"), 1)
+
+	entries, err := a.Query(ctx, audit.Filter{DocumentID: expired.ID.String()})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, audit.OperationPurge, entries[0].Operation)
+}
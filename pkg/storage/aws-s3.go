@@ -2,12 +2,19 @@ package storage
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/keyring"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -17,80 +24,188 @@ var _ Storage = (*AWSS3)(nil)
 
 // AWS S3 is a storage implementation that stores all data in AWS S3.
 type AWSS3 struct {
-	encryptionKey []byte
-	bucket        string
-	client        *s3.S3
-	uploader      *s3manager.Uploader
+	keyring  *keyring.Keyring
+	encoding []document.Option
+	// concurrency is how many objects are fetched at once while streaming.
+	concurrency int
+	bucket      string
+	config      S3Config
+	prefix      string
+	client      *s3.S3
+	uploader    *s3manager.Uploader
 }
 
 // Delete implements Storage.
 func (a *AWSS3) Delete(doc *document.Document) error {
 	_, err := a.client.DeleteObject(&s3.DeleteObjectInput{
 		Bucket: aws.String(a.bucket),
-		Key:    aws.String(makeKey(doc.Collection, doc.ID.String())),
+		Key:    aws.String(a.prefix + makeKey(doc.Collection, doc.ID.String())),
 	})
 	return err
 }
 
-// Stream implements Storage.
+// Stream implements Storage, the stream ends at the first document that
+// can't be read. Use StreamErrors to carry on past them.
 func (a *AWSS3) Stream() (<-chan *document.Document, error) {
-	c := make(chan *document.Document)
-
-	go func() {
-		defer close(c)
-		_ = a.client.ListObjectsV2Pages(
-			&s3.ListObjectsV2Input{
-				Bucket: aws.String(a.bucket),
-			},
-			func(page *s3.ListObjectsV2Output, lastPage bool) bool {
-				for _, obj := range page.Contents {
-					o, err := a.client.GetObject(&s3.GetObjectInput{
-						Bucket: aws.String(a.bucket),
-						Key:    obj.Key,
-					})
-					if err != nil {
-						return false
-					}
-
-					// get bytes
-					b, err := io.ReadAll(o.Body)
-					if err != nil {
-						return false
-					}
-
-					// decode the document
-					doc, err := document.FromStorage(b, a.encryptionKey)
-					if err != nil {
-						return false
-					}
-					c <- doc
+	return streamUntilError(a)
+}
+
+// StreamErrors implements ErrorStreamer, objects are fetched by a pool of
+// workers so documents are streamed in no particular order.
+func (a *AWSS3) StreamErrors(ctx context.Context) (<-chan *document.Document, <-chan error, error) {
+	docs, errs := fetchAll(ctx, a.concurrency, a.list, a.fetch)
+	return docs, errs, nil
+}
+
+// list sends the key of every document under the prefix to keys.
+func (a *AWSS3) list(ctx context.Context, keys chan<- string) error {
+	return a.client.ListObjectsV2PagesWithContext(ctx,
+		&s3.ListObjectsV2Input{
+			Bucket: aws.String(a.bucket),
+			Prefix: aws.String(a.prefix),
+		},
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				// skip objects that belong to a database nested under
+				// this prefix, documents are stored as collection/id.
+				if strings.Count(strings.TrimPrefix(*obj.Key, a.prefix), "/") != 1 {
+					continue
 				}
-				return true
-			})
-	}()
 
-	return c, nil
+				select {
+				case keys <- *obj.Key:
+				case <-ctx.Done():
+					return false
+				}
+			}
+			return true
+		})
+}
+
+// fetch gets and decodes the document stored under key.
+func (a *AWSS3) fetch(ctx context.Context, key string) (*document.Document, error) {
+	o, err := a.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(a.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer o.Body.Close()
+
+	b, err := io.ReadAll(o.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return document.FromStorage(b, a.keyring)
 }
 
 // Write implements Storage.
 func (a *AWSS3) Write(doc *document.Document) error {
-	b, err := doc.ToStorage(a.encryptionKey)
+	b, err := doc.ToStorage(a.keyring, a.encoding...)
 	if err != nil {
 		return err
 	}
-	r := bytes.NewReader(b)
 
-	_, err = a.uploader.Upload(&s3manager.UploadInput{
+	return a.put(context.Background(), a.prefix+makeKey(doc.Collection, doc.ID.String()), b)
+}
+
+// put uploads b to the object key, with the server-side encryption and
+// storage class of the configuration.
+func (a *AWSS3) put(ctx context.Context, key string, b []byte) error {
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(a.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(b),
+	}
+	if a.config.ServerSideEncryption != "" {
+		input.ServerSideEncryption = aws.String(a.config.ServerSideEncryption)
+	}
+	if a.config.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(a.config.KMSKeyID)
+	}
+	if a.config.StorageClass != "" {
+		input.StorageClass = aws.String(a.config.StorageClass)
+	}
+
+	_, err := a.uploader.UploadWithContext(ctx, input)
+	return err
+}
+
+// PutBlob implements BlobStore.
+func (a *AWSS3) PutBlob(ctx context.Context, name string, b []byte) error {
+	return a.put(ctx, a.prefix+name, b)
+}
+
+// GetBlob implements BlobStore.
+func (a *AWSS3) GetBlob(ctx context.Context, name string) ([]byte, error) {
+	o, err := a.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(a.bucket),
+		Key:    aws.String(a.prefix + name),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer o.Body.Close()
+
+	return io.ReadAll(o.Body)
+}
+
+// ListBlobs implements BlobStore.
+func (a *AWSS3) ListBlobs(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	err := a.client.ListObjectsV2PagesWithContext(ctx,
+		&s3.ListObjectsV2Input{
+			Bucket: aws.String(a.bucket),
+			Prefix: aws.String(a.prefix + prefix),
+		},
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				names = append(names, strings.TrimPrefix(*obj.Key, a.prefix))
+			}
+			return true
+		})
+
+	return names, err
+}
+
+// DeleteBlob implements BlobStore.
+func (a *AWSS3) DeleteBlob(ctx context.Context, name string) error {
+	_, err := a.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(a.bucket),
+		Key:    aws.String(a.prefix + name),
+	})
+	return err
+}
+
+// Ping implements Pinger, it checks the bucket exists and can be accessed.
+func (a *AWSS3) Ping(ctx context.Context) error {
+	_, err := a.client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
 		Bucket: aws.String(a.bucket),
-		Key:    aws.String(makeKey(doc.Collection, doc.ID.String())),
-		Body:   r,
 	})
 	return err
 }
 
-// WithEncryptionKey sets the encryption key.
-func (a *AWSS3) WithEncryptionKey(key []byte) (Storage, error) {
-	a.encryptionKey = key
+// Describe implements Describer.
+func (a *AWSS3) Describe() map[string]string {
+	return describeKeyring(map[string]string{
+		"region":                 aws.StringValue(a.client.Config.Region),
+		"bucket":                 a.bucket,
+		"prefix":                 a.prefix,
+		"endpoint":               a.client.Endpoint,
+		"path_style":             strconv.FormatBool(a.config.PathStyle),
+		"server_side_encryption": a.config.ServerSideEncryption,
+		"storage_class":          a.config.StorageClass,
+	}, a.keyring)
+}
+
+// WithKeyring sets the keyring documents are encrypted with.
+func (a *AWSS3) WithKeyring(kr *keyring.Keyring) (Storage, error) {
+	a.keyring = kr
 	return a, nil
 }
 
@@ -99,12 +214,78 @@ func makeKey(collection, id string) string {
 	return collection + "/" + id
 }
 
-// NewAWSS3 returns a new AWS S3 storage implementation.
-func NewAWSS3(region, bucket string) (*AWSS3, error) {
+// S3Config is the configuration of the aws-s3 driver beyond its region and
+// bucket, it also points the driver at S3 compatible services such as MinIO
+// and LocalStack.
+type S3Config struct {
+	// Endpoint is the URL of an S3 compatible service, AWS when empty.
+	Endpoint string
+	// PathStyle addresses buckets as endpoint/bucket rather than as
+	// bucket.endpoint, which most S3 compatible services need.
+	PathStyle bool
+	// Prefix is prepended to the key of every object, ahead of the prefix
+	// of each database.
+	Prefix string
+	// Profile is the shared config profile credentials are read from when
+	// they are not set by the environment, the default profile when empty.
+	Profile string
+	// ServerSideEncryption is how objects are encrypted by S3: AES256 or
+	// aws:kms, the bucket's default when empty.
+	ServerSideEncryption string
+	// KMSKeyID is the KMS key objects are encrypted with by aws:kms.
+	KMSKeyID string
+	// StorageClass is the storage class of objects, STANDARD when empty.
+	StorageClass string
+}
+
+// Validate checks the server-side encryption and storage class are known
+// to S3.
+func (c S3Config) Validate() error {
+	switch c.ServerSideEncryption {
+	case "", s3.ServerSideEncryptionAes256:
+		if c.KMSKeyID != "" {
+			return fmt.Errorf("%w: a kms key requires aws:kms server-side encryption", ErrS3ConfigInvalid)
+		}
+	case s3.ServerSideEncryptionAwsKms:
+	default:
+		return fmt.Errorf("%w: unknown server-side encryption %q, must be AES256 or aws:kms", ErrS3ConfigInvalid, c.ServerSideEncryption)
+	}
+
+	if c.StorageClass != "" && !slices.Contains(s3.StorageClass_Values(), c.StorageClass) {
+		return fmt.Errorf("%w: unknown storage class %q", ErrS3ConfigInvalid, c.StorageClass)
+	}
+
+	if c.Endpoint != "" {
+		if u, err := url.Parse(c.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("%w: endpoint %q must be a URL", ErrS3ConfigInvalid, c.Endpoint)
+		}
+	}
+
+	return nil
+}
+
+// NewAWSS3 returns a new AWS S3 storage implementation. Credentials are read
+// from the environment, then the shared config and credentials files, then
+// the IAM role of the instance or task.
+func NewAWSS3(region, bucket string, cfg S3Config) (*AWSS3, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	awsCfg := aws.NewConfig().WithRegion(region).WithS3ForcePathStyle(cfg.PathStyle)
+	if cfg.Endpoint != "" {
+		awsCfg = awsCfg.WithEndpoint(cfg.Endpoint)
+	}
+
 	// The session the S3 Uploader will use
-	sess := session.Must(session.NewSession(
-		aws.NewConfig().WithCredentials(credentials.NewEnvCredentials()).WithRegion(region),
-	))
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsCfg,
+		Profile:           cfg.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	// Create an uploader with the session and default options
 	uploader := s3manager.NewUploader(sess)
@@ -112,8 +293,15 @@ func NewAWSS3(region, bucket string) (*AWSS3, error) {
 	// create a client with the session
 	client := s3.New(sess)
 
+	prefix := cfg.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
 	return &AWSS3{
 		bucket:   bucket,
+		prefix:   prefix,
+		config:   cfg,
 		client:   client,
 		uploader: uploader,
 	}, nil
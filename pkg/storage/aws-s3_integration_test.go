@@ -0,0 +1,148 @@
+//go:build integration
+
+package storage_test
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/storage"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The tests in this file run against an S3 compatible service, such as
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//	NEXDB_TEST_S3_ENDPOINT=http://localhost:9000 AWS_ACCESS_KEY_ID=minioadmin \
+//	AWS_SECRET_ACCESS_KEY=minioadmin go test -tags integration ./pkg/storage/...
+
+// newBucket creates a bucket on the service at NEXDB_TEST_S3_ENDPOINT and
+// returns its name, the test is skipped if it isn't set.
+func newBucket(t *testing.T) (endpoint, bucket string) {
+	t.Helper()
+
+	endpoint = os.Getenv("NEXDB_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("NEXDB_TEST_S3_ENDPOINT is not set")
+	}
+
+	client := s3.New(session.Must(session.NewSession(aws.NewConfig().
+		WithRegion("us-east-1").
+		WithEndpoint(endpoint).
+		WithS3ForcePathStyle(true))))
+
+	bucket = "nexdb-" + strings.ToLower(ulid.Make().String())
+	_, err := client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(bucket)})
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		_ = client.ListObjectsV2Pages(&s3.ListObjectsV2Input{Bucket: aws.String(bucket)}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+			for _, obj := range page.Contents {
+				_, _ = client.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: obj.Key})
+			}
+			return true
+		})
+		_, _ = client.DeleteBucket(&s3.DeleteBucketInput{Bucket: aws.String(bucket)})
+	})
+
+	return endpoint, bucket
+}
+
+func TestStorage_AWSS3_Integration(t *testing.T) {
+	endpoint, bucket := newBucket(t)
+	key := []byte("key-that-is-thirty-2-bytes-long!")
+
+	open := func(prefix string, opts ...storage.Option) storage.Storage {
+		s, err := storage.New(storage.AWS3Driver, append([]storage.Option{
+			storage.WithAWS("us-east-1", bucket),
+			storage.WithS3(storage.S3Config{
+				Endpoint:     endpoint,
+				PathStyle:    true,
+				Prefix:       "nexdb",
+				StorageClass: s3.StorageClassStandard,
+			}),
+			storage.WithPrefix(prefix),
+		}, opts...)...)
+		require.NoError(t, err)
+		return s
+	}
+
+	s := open("", storage.WithEncryptionKey(key), storage.WithFormat(document.FormatCBOR))
+	tenant := open("_db/tenant/")
+
+	require.NoError(t, storage.Ping(context.Background(), s))
+	assert.Equal(t, "nexdb/", storage.Describe(s)["prefix"])
+	assert.Equal(t, "nexdb/_db/tenant/", storage.Describe(tenant)["prefix"])
+
+	doc := document.New().SetCollection("users").SetData(map[string]interface{}{"name": "ada", "age": int64(36)})
+	require.NoError(t, s.Write(doc))
+	require.NoError(t, tenant.Write(document.New().SetCollection("users")))
+
+	// documents of the nested database are not streamed
+	docs := stream(t, s)
+	require.Len(t, docs, 1)
+	assert.Equal(t, doc, docs[0])
+	assert.Len(t, stream(t, tenant), 1)
+
+	require.NoError(t, s.Delete(doc))
+	assert.Empty(t, stream(t, s))
+}
+
+func TestStorage_AWSS3_Integration_StreamErrors(t *testing.T) {
+	endpoint, bucket := newBucket(t)
+
+	s, err := storage.New(storage.AWS3Driver,
+		storage.WithAWS("us-east-1", bucket),
+		storage.WithS3(storage.S3Config{Endpoint: endpoint, PathStyle: true}),
+		storage.WithConcurrency(4),
+	)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, s.Write(document.New().SetCollection("users")))
+	}
+
+	// a document another key was used for can't be read
+	sealed, err := storage.New(storage.AWS3Driver,
+		storage.WithAWS("us-east-1", bucket),
+		storage.WithS3(storage.S3Config{Endpoint: endpoint, PathStyle: true}),
+		storage.WithEncryptionKey([]byte("key-that-is-thirty-2-bytes-long!")),
+	)
+	require.NoError(t, err)
+	require.NoError(t, sealed.Write(document.New().SetCollection("users")))
+
+	docs, errs, err := storage.StreamErrors(context.Background(), s)
+	require.NoError(t, err)
+
+	n, failed := 0, 0
+	for docs != nil || errs != nil {
+		select {
+		case _, ok := <-docs:
+			if !ok {
+				docs = nil
+				continue
+			}
+			n++
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			var objErr *storage.ObjectError
+			require.ErrorAs(t, err, &objErr)
+			failed++
+		}
+	}
+
+	assert.Equal(t, 10, n)
+	assert.Equal(t, 1, failed)
+}
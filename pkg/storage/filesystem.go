@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/keyring"
+)
+
+var _ Storage = (*Filesystem)(nil)
+
+// Filesystem is a storage implementation that stores each document as a file
+// named by its ID in a directory named by its collection.
+type Filesystem struct {
+	keyring  *keyring.Keyring
+	encoding []document.Option
+	// concurrency is how many files are read at once while streaming.
+	concurrency int
+	dir         string
+	prefix      string
+}
+
+// Write implements Storage, the document is written to a temporary file
+// and renamed so a document is never left half written.
+func (f *Filesystem) Write(doc *document.Document) error {
+	if doc == nil {
+		return ErrDocumentInvalid
+	}
+
+	b, err := doc.ToStorage(f.keyring, f.encoding...)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(f.path(doc), b)
+}
+
+// writeFile writes b to a temporary file renamed to path, so the file is
+// never left half written.
+func writeFile(path string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Delete implements Storage.
+func (f *Filesystem) Delete(doc *document.Document) error {
+	err := os.Remove(f.path(doc))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Stream implements Storage, the stream ends at the first document that
+// can't be read. Use StreamErrors to carry on past them.
+func (f *Filesystem) Stream() (<-chan *document.Document, error) {
+	return streamUntilError(f)
+}
+
+// StreamErrors implements ErrorStreamer, files are read by a pool of workers
+// so documents are streamed in no particular order.
+func (f *Filesystem) StreamErrors(ctx context.Context) (<-chan *document.Document, <-chan error, error) {
+	root := filepath.Join(f.dir, filepath.FromSlash(f.prefix))
+
+	collections, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		collections, err = nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	list := func(ctx context.Context, keys chan<- string) error {
+		for _, collection := range collections {
+			// skip the directories of databases nested under this prefix,
+			// documents are stored as collection/id.
+			if !collection.IsDir() || strings.HasPrefix(collection.Name(), ".") {
+				continue
+			}
+
+			dir := filepath.Join(root, collection.Name())
+			files, err := os.ReadDir(dir)
+			if err != nil {
+				return err
+			}
+
+			for _, file := range files {
+				if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+					continue
+				}
+
+				select {
+				case keys <- filepath.Join(dir, file.Name()):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+
+		return nil
+	}
+
+	docs, errs := fetchAll(ctx, f.concurrency, list, f.fetch)
+	return docs, errs, nil
+}
+
+// fetch reads and decodes the document stored in the file at path.
+func (f *Filesystem) fetch(_ context.Context, path string) (*document.Document, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return document.FromStorage(b, f.keyring)
+}
+
+// PutBlob implements BlobStore.
+func (f *Filesystem) PutBlob(_ context.Context, name string, b []byte) error {
+	return writeFile(f.blobPath(name), b)
+}
+
+// GetBlob implements BlobStore.
+func (f *Filesystem) GetBlob(_ context.Context, name string) ([]byte, error) {
+	b, err := os.ReadFile(f.blobPath(name))
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+
+	return b, err
+}
+
+// ListBlobs implements BlobStore.
+func (f *Filesystem) ListBlobs(_ context.Context, prefix string) ([]string, error) {
+	root := filepath.Join(f.dir, filepath.FromSlash(f.prefix))
+
+	var names []string
+	err := filepath.WalkDir(f.blobPath(prefix), func(path string, entry os.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+
+		return nil
+	})
+
+	return names, err
+}
+
+// DeleteBlob implements BlobStore.
+func (f *Filesystem) DeleteBlob(_ context.Context, name string) error {
+	err := os.Remove(f.blobPath(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Ping implements Pinger, it checks the directory exists.
+func (f *Filesystem) Ping(ctx context.Context) error {
+	_, err := os.Stat(f.dir)
+	return err
+}
+
+// Describe implements Describer.
+func (f *Filesystem) Describe() map[string]string {
+	return describeKeyring(map[string]string{
+		"path":   f.dir,
+		"prefix": f.prefix,
+	}, f.keyring)
+}
+
+// WithKeyring sets the keyring documents are encrypted with.
+func (f *Filesystem) WithKeyring(kr *keyring.Keyring) (Storage, error) {
+	f.keyring = kr
+	return f, nil
+}
+
+// path returns the path of the file of a document.
+func (f *Filesystem) path(doc *document.Document) string {
+	return filepath.Join(f.dir, filepath.FromSlash(f.prefix+makeKey(doc.Collection, doc.ID.String())))
+}
+
+// blobPath returns the path of the blob named name.
+func (f *Filesystem) blobPath(name string) string {
+	return filepath.Join(f.dir, filepath.FromSlash(f.prefix+name))
+}
+
+// NewFilesystem returns a new filesystem storage implementation that stores
+// documents under dir, the directory is created if it doesn't exist.
+func NewFilesystem(dir string) (*Filesystem, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	return &Filesystem{
+		dir: dir,
+	}, nil
+}
@@ -0,0 +1,102 @@
+package storage_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorage_Filesystem(t *testing.T) {
+	dir := t.TempDir()
+	key := []byte("key-that-is-thirty-2-bytes-long!")
+
+	s, err := storage.New(storage.FilesystemDriver, storage.WithPath(dir), storage.WithEncryptionKey(key))
+	require.NoError(t, err)
+
+	nested, err := storage.New(storage.FilesystemDriver, storage.WithPath(dir), storage.WithPrefix("_db/tenant/"))
+	require.NoError(t, err)
+
+	doc := document.New().SetCollection("users").SetData(map[string]interface{}{"name": "ada"})
+	require.NoError(t, s.Write(doc))
+	require.NoError(t, s.Write(doc.SetData(map[string]interface{}{"name": "grace"})))
+	require.NoError(t, nested.Write(document.New().SetCollection("users")))
+	require.ErrorIs(t, s.Write(nil), storage.ErrDocumentInvalid)
+
+	// documents of nested prefixes are not streamed
+	streamed := stream(t, s)
+	require.Len(t, streamed, 1)
+	assert.Equal(t, doc.ID, streamed[0].ID)
+	assert.Equal(t, "grace", streamed[0].Data["name"])
+	assert.Len(t, stream(t, nested), 1)
+
+	// documents can't be read without the key
+	wrongKey, err := storage.New(storage.FilesystemDriver, storage.WithPath(dir))
+	require.NoError(t, err)
+	_, err = wrongKey.Stream()
+	assert.ErrorIs(t, err, document.ErrKeyringRequired)
+
+	require.NoError(t, s.Delete(doc))
+	require.NoError(t, s.Delete(doc))
+	assert.Empty(t, stream(t, s))
+}
+
+func stream(t *testing.T, s storage.Storage) []*document.Document {
+	t.Helper()
+
+	c, err := s.Stream()
+	require.NoError(t, err)
+
+	var docs []*document.Document
+	for d := range c {
+		docs = append(docs, d)
+	}
+
+	return docs
+}
+
+func TestStorage_Filesystem_StreamErrors(t *testing.T) {
+	dir := t.TempDir()
+	s, err := storage.New(storage.FilesystemDriver, storage.WithPath(dir), storage.WithConcurrency(4))
+	require.NoError(t, err)
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, s.Write(document.New().SetCollection("users")))
+	}
+	corrupt := filepath.Join(dir, "users", document.New().ID.String())
+	require.NoError(t, os.WriteFile(corrupt, []byte("{corrupt"), 0o600))
+
+	// the stream carries on past the corrupt document
+	docs, errs, err := storage.StreamErrors(context.Background(), s)
+	require.NoError(t, err)
+
+	n, failed := 0, []error{}
+	for docs != nil || errs != nil {
+		select {
+		case _, ok := <-docs:
+			if !ok {
+				docs = nil
+				continue
+			}
+			n++
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			failed = append(failed, err)
+		}
+	}
+
+	assert.Equal(t, 20, n)
+	require.Len(t, failed, 1)
+	var objErr *storage.ObjectError
+	require.ErrorAs(t, failed[0], &objErr)
+	assert.Equal(t, corrupt, objErr.Key)
+}
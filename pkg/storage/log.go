@@ -0,0 +1,834 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/keyring"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Layout is how documents are laid out by a storage driver.
+type Layout string
+
+const (
+	// LayoutDocuments stores every document as its own object.
+	LayoutDocuments Layout = "documents"
+	// LayoutLog stores changes as change-log segments, compacted into a
+	// snapshot of each collection every so many segments, see Log.
+	LayoutLog Layout = "log"
+)
+
+// DefaultSnapshotEvery is how many segments the log layout writes before
+// compacting them into a snapshot, unless set by WithSnapshotEvery.
+const DefaultSnapshotEvery = 1000
+
+var (
+	// ErrUnknownLayout is returned when a layout is not recognised.
+	ErrUnknownLayout = errors.New("unknown layout")
+	// ErrLayoutUnsupported is returned when a driver can't store a layout.
+	ErrLayoutUnsupported = errors.New("driver does not support the layout")
+	// ErrBlobNotFound is returned when a blob doesn't exist.
+	ErrBlobNotFound = errors.New("blob not found")
+	// ErrLogCorrupt is returned when a segment or snapshot can't be read.
+	ErrLogCorrupt = errors.New("log is corrupt")
+	// ErrRestoreUnsupported is returned when storage keeps no history of
+	// changes to restore from.
+	ErrRestoreUnsupported = errors.New("storage does not keep a history of changes, it must use the log layout")
+	// ErrOutsideRetention is returned when restoring to a point in time the
+	// history of changes no longer goes back to.
+	ErrOutsideRetention = errors.New("point in time is outside the retention window")
+)
+
+// BlobStore is implemented by storage drivers that can store named blobs,
+// which layouts other than LayoutDocuments are stored as. Names are relative
+// to the prefix of the storage.
+type BlobStore interface {
+	PutBlob(ctx context.Context, name string, b []byte) error
+	// GetBlob returns ErrBlobNotFound if there is no blob named name.
+	GetBlob(ctx context.Context, name string) ([]byte, error)
+	// ListBlobs returns the names of the blobs starting with prefix, which
+	// names a directory such as "a/b/".
+	ListBlobs(ctx context.Context, prefix string) ([]string, error)
+	DeleteBlob(ctx context.Context, name string) error
+}
+
+// The blobs of the log layout, segments and snapshots are named by ULIDs so
+// they sort in the order they were written.
+const (
+	segmentsPrefix  = "_log/segments/"
+	snapshotsPrefix = "_log/snapshots/"
+)
+
+// Log is a storage implementation that stores each write and delete as a
+// change-log segment. Every so many segments they are compacted into a
+// snapshot of each collection, so loading reads the latest snapshot and
+// replays the segments written since rather than listing every document.
+//
+// Segments and snapshots are kept for the retention of the log, so the
+// documents can be restored as they were at any point in time since, see
+// Restore.
+//
+// A log must have a single writer.
+type Log struct {
+	next      Storage
+	blobs     BlobStore
+	keyring   *keyring.Keyring
+	encoding  []document.Option
+	every     int
+	retention time.Duration
+
+	// mx is held for reading while segments are written or read, and for
+	// writing while a snapshot picks the segments it compacts and deletes
+	// the blobs it replaces.
+	mx sync.RWMutex
+	// pending is how many segments have been written since the latest
+	// snapshot.
+	pending    atomic.Int64
+	compacting atomic.Bool
+
+	// compactions is the compaction running in the background, if any.
+	// closeMx guards adding to it once the log is closed.
+	compactions sync.WaitGroup
+	closeMx     sync.Mutex
+	closed      bool
+}
+
+// manifest describes a snapshot, it is written once every collection of
+// the snapshot is so snapshots are never read half written.
+type manifest struct {
+	// LastSegment is the last segment included in the snapshot.
+	LastSegment string    `json:"last_segment"`
+	Collections []string  `json:"collections"`
+	Documents   int       `json:"documents"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Write implements Storage.
+func (l *Log) Write(doc *document.Document) error {
+	if doc == nil {
+		return ErrDocumentInvalid
+	}
+
+	b, err := doc.ToStorage(l.keyring, l.encoding...)
+	if err != nil {
+		return err
+	}
+
+	return l.append(context.Background(), entry{op: opPut, collection: doc.Collection, id: doc.ID, payload: b})
+}
+
+// Delete implements Storage.
+func (l *Log) Delete(doc *document.Document) error {
+	return l.append(context.Background(), entry{op: opDelete, collection: doc.Collection, id: doc.ID})
+}
+
+// append writes a segment holding e, then starts compacting the segments
+// in the background if enough have been written.
+func (l *Log) append(ctx context.Context, e entry) error {
+	l.mx.RLock()
+	err := l.blobs.PutBlob(ctx, segmentsPrefix+ulid.Make().String(), encodeEntries([]entry{e}))
+	l.mx.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	l.pending.Add(1)
+	l.compactIfDue()
+
+	return nil
+}
+
+// compactIfDue compacts the segments in the background once enough have
+// been written since the latest snapshot.
+func (l *Log) compactIfDue() {
+	if l.pending.Load() < int64(l.every) || !l.compacting.CompareAndSwap(false, true) {
+		return
+	}
+
+	l.closeMx.Lock()
+	defer l.closeMx.Unlock()
+	if l.closed {
+		l.compacting.Store(false)
+		return
+	}
+
+	l.compactions.Add(1)
+	go func() {
+		defer l.compactions.Done()
+		defer l.compacting.Store(false)
+
+		if err := l.Compact(context.Background()); err != nil {
+			slog.Error("failed to compact the change log", "error", err)
+		}
+	}()
+}
+
+// Close implements io.Closer, it waits for the compaction running in the
+// background, if any, and starts no more. Segments written afterwards are
+// compacted the next time the log is opened.
+func (l *Log) Close() error {
+	l.closeMx.Lock()
+	l.closed = true
+	l.closeMx.Unlock()
+
+	l.compactions.Wait()
+
+	return nil
+}
+
+// Stream implements Storage, the stream ends at the first document that
+// can't be decoded. Use StreamErrors to carry on past them.
+func (l *Log) Stream() (<-chan *document.Document, error) {
+	return streamUntilError(l)
+}
+
+// StreamErrors implements ErrorStreamer. The latest snapshot and the
+// segments written since are read before streaming starts, an error
+// reading them is returned as it is.
+func (l *Log) StreamErrors(ctx context.Context) (<-chan *document.Document, <-chan error, error) {
+	s, err := l.state(ctx, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	l.pending.Store(int64(s.segments))
+	l.compactIfDue()
+
+	docs, errs := l.stream(ctx, s)
+	return docs, errs, nil
+}
+
+// stream streams the documents of s, the errors decoding them are sent to
+// the error channel.
+func (l *Log) stream(ctx context.Context, s state) (<-chan *document.Document, <-chan error) {
+	docs := make(chan *document.Document)
+	errs := make(chan error)
+	go func() {
+		defer close(docs)
+		defer close(errs)
+
+		for _, e := range s.sorted() {
+			doc, err := document.FromStorage(e.payload, l.keyring)
+			if err != nil {
+				select {
+				case errs <- &ObjectError{Key: makeKey(e.collection, e.id.String()), Err: err}:
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case docs <- doc:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return docs, errs
+}
+
+// Compact writes a snapshot of every collection holding the changes of the
+// latest snapshot and every segment written since, then deletes the
+// segments and snapshots it replaces.
+func (l *Log) Compact(ctx context.Context) error {
+	// wait for the segments being written so none is left out
+	l.mx.Lock()
+	segments, err := l.blobs.ListBlobs(ctx, segmentsPrefix)
+	l.mx.Unlock()
+	if err != nil || len(segments) == 0 {
+		return err
+	}
+	sort.Strings(segments)
+	last := strings.TrimPrefix(segments[len(segments)-1], segmentsPrefix)
+
+	s, err := l.state(ctx, last)
+	if err != nil {
+		return err
+	}
+
+	byCollection := map[string][]entry{}
+	for _, e := range s.sorted() {
+		byCollection[e.collection] = append(byCollection[e.collection], e)
+	}
+
+	m := manifest{LastSegment: last, Documents: len(s.docs), CreatedAt: time.Now().UTC()}
+	dir := snapshotsPrefix + ulid.Make().String() + "/"
+	for collection, entries := range byCollection {
+		if err := l.blobs.PutBlob(ctx, dir+"collections/"+collection, encodeEntries(entries)); err != nil {
+			return err
+		}
+		m.Collections = append(m.Collections, collection)
+	}
+	sort.Strings(m.Collections)
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := l.blobs.PutBlob(ctx, dir+"manifest", b); err != nil {
+		return err
+	}
+
+	// the segments of earlier snapshots kept for the retention were
+	// subtracted when they were compacted
+	l.pending.Add(-int64(s.segments))
+
+	return l.prune(ctx)
+}
+
+// prune deletes the segments and snapshots that are no longer needed to
+// restore any point in time within the retention. The latest snapshot that
+// is older than the retention is kept, along with every segment after it.
+func (l *Log) prune(ctx context.Context) error {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	dir, m, err := l.latestSnapshot(ctx, untilID(time.Now().Add(-l.retention)))
+	if err != nil || dir == "" {
+		return err
+	}
+
+	segments, err := l.blobs.ListBlobs(ctx, segmentsPrefix)
+	if err != nil {
+		return err
+	}
+
+	snapshots, err := l.blobs.ListBlobs(ctx, snapshotsPrefix)
+	if err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		if strings.TrimPrefix(segment, segmentsPrefix) <= m.LastSegment {
+			if err := l.blobs.DeleteBlob(ctx, segment); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, name := range snapshots {
+		if name < dir {
+			if err := l.blobs.DeleteBlob(ctx, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// RestoreReport is what restoring storage to a point in time changed.
+type RestoreReport struct {
+	// Written is how many documents were written back as they were.
+	Written int
+	// Deleted is how many documents written since were deleted.
+	Deleted int
+}
+
+// Restorer is implemented by storage that keeps a history of changes it can
+// be restored from.
+type Restorer interface {
+	// Restore restores the documents as they were at the point in time.
+	Restore(ctx context.Context, at time.Time) (RestoreReport, error)
+	// CanRestore returns ErrOutsideRetention if the documents can't be
+	// restored as they were at the point in time.
+	CanRestore(ctx context.Context, at time.Time) error
+	// StreamAt streams the documents as they were at the point in time
+	// without restoring them, as StreamErrors does.
+	StreamAt(ctx context.Context, at time.Time) (<-chan *document.Document, <-chan error, error)
+}
+
+// Restore restores the documents of the storage as they were at the given
+// point in time, see Restorer. ErrRestoreUnsupported is returned if the
+// storage doesn't implement Restorer.
+func Restore(ctx context.Context, s Storage, at time.Time) (RestoreReport, error) {
+	r, ok := s.(Restorer)
+	if !ok {
+		return RestoreReport{}, ErrRestoreUnsupported
+	}
+
+	return r.Restore(ctx, at)
+}
+
+// CanRestore checks whether the storage can be restored to the given point
+// in time, see Restorer. ErrRestoreUnsupported is returned if the storage
+// doesn't implement Restorer.
+func CanRestore(ctx context.Context, s Storage, at time.Time) error {
+	r, ok := s.(Restorer)
+	if !ok {
+		return ErrRestoreUnsupported
+	}
+
+	return r.CanRestore(ctx, at)
+}
+
+// StreamAt streams the documents of the storage as they were at the given
+// point in time, see Restorer. ErrRestoreUnsupported is returned if the
+// storage doesn't implement Restorer.
+func StreamAt(ctx context.Context, s Storage, at time.Time) (<-chan *document.Document, <-chan error, error) {
+	r, ok := s.(Restorer)
+	if !ok {
+		return nil, nil, ErrRestoreUnsupported
+	}
+
+	return r.StreamAt(ctx, at)
+}
+
+// Restore implements Restorer. The documents that changed since are written
+// back, or deleted if they didn't exist, as a single segment so restoring is
+// itself part of the history and can be undone. ErrOutsideRetention is
+// returned if the log can't be restored to at, see CanRestore.
+func (l *Log) Restore(ctx context.Context, at time.Time) (RestoreReport, error) {
+	if err := l.CanRestore(ctx, at); err != nil {
+		return RestoreReport{}, err
+	}
+
+	past, err := l.state(ctx, untilID(at))
+	if err != nil {
+		return RestoreReport{}, err
+	}
+
+	current, err := l.state(ctx, "")
+	if err != nil {
+		return RestoreReport{}, err
+	}
+
+	var report RestoreReport
+	var changes []entry
+	for _, e := range past.sorted() {
+		if c, ok := current.docs[e.id]; !ok || !bytes.Equal(c.payload, e.payload) {
+			changes = append(changes, e)
+			report.Written++
+		}
+	}
+	for _, e := range current.sorted() {
+		if _, ok := past.docs[e.id]; !ok {
+			changes = append(changes, entry{op: opDelete, collection: e.collection, id: e.id})
+			report.Deleted++
+		}
+	}
+
+	if len(changes) == 0 {
+		return report, nil
+	}
+
+	l.mx.RLock()
+	err = l.blobs.PutBlob(ctx, segmentsPrefix+ulid.Make().String(), encodeEntries(changes))
+	l.mx.RUnlock()
+	if err != nil {
+		return RestoreReport{}, err
+	}
+
+	l.pending.Add(1)
+	l.compactIfDue()
+
+	return report, nil
+}
+
+// CanRestore implements Restorer. A log that still holds its whole history
+// was empty before its first change, so it can be restored to any point in
+// time. Once its history is pruned it can't be restored to a point before
+// Earliest.
+func (l *Log) CanRestore(ctx context.Context, at time.Time) error {
+	earliest, whole, err := l.history(ctx)
+	if err != nil {
+		return err
+	}
+	if !whole && at.Before(earliest) {
+		return fmt.Errorf("%w: the earliest point is %s", ErrOutsideRetention, earliest.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// StreamAt implements Restorer, ErrOutsideRetention is returned if the log
+// can't be restored to at, see CanRestore.
+func (l *Log) StreamAt(ctx context.Context, at time.Time) (<-chan *document.Document, <-chan error, error) {
+	if err := l.CanRestore(ctx, at); err != nil {
+		return nil, nil, err
+	}
+
+	s, err := l.state(ctx, untilID(at))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	docs, errs := l.stream(ctx, s)
+	return docs, errs, nil
+}
+
+// Earliest returns the earliest point in time the log can be restored to,
+// the first change it recorded unless its history has been pruned since. It
+// is zero if nothing has been recorded.
+func (l *Log) Earliest(ctx context.Context) (time.Time, error) {
+	earliest, _, err := l.history(ctx)
+	return earliest, err
+}
+
+// history returns the earliest change the log holds, and whether it holds
+// every change since its first, none of its segments having been pruned.
+func (l *Log) history(ctx context.Context) (time.Time, bool, error) {
+	l.mx.RLock()
+	defer l.mx.RUnlock()
+
+	snapshots, err := l.blobs.ListBlobs(ctx, snapshotsPrefix)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	segments, err := l.blobs.ListBlobs(ctx, segmentsPrefix)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	first := ""
+	if len(segments) > 0 {
+		sort.Strings(segments)
+		first = strings.TrimPrefix(segments[0], segmentsPrefix)
+	}
+
+	// the segments the oldest snapshot includes are deleted once it is
+	// pruned down to, it can't be restored to a point before it
+	whole := true
+	sort.Strings(snapshots)
+	for _, name := range snapshots {
+		if !strings.HasSuffix(name, "/manifest") {
+			continue
+		}
+
+		m, err := l.manifest(ctx, name)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+
+		if first == "" || first > m.LastSegment {
+			first = m.LastSegment
+			whole = false
+		}
+		break
+	}
+
+	if first == "" {
+		return time.Time{}, true, nil
+	}
+
+	id, err := ulid.ParseStrict(first)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%s: %w: %v", first, ErrLogCorrupt, err)
+	}
+
+	return ulid.Time(id.Time()), whole, nil
+}
+
+// untilID returns the greatest segment ID that could have been written at t,
+// so the segments up to and including t sort before or equal to it.
+func untilID(t time.Time) string {
+	var id ulid.ULID
+	for i := range id {
+		id[i] = 0xff
+	}
+	_ = id.SetTime(ulid.Timestamp(t))
+
+	return id.String()
+}
+
+// state is the state of the documents of a log.
+type state struct {
+	docs map[ulid.ULID]entry
+	// segments is how many segments were replayed over the snapshot.
+	segments int
+}
+
+// sorted returns the entries of the documents sorted by ID.
+func (s state) sorted() []entry {
+	entries := make([]entry, 0, len(s.docs))
+	for _, e := range s.docs {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].id.Compare(entries[j].id) < 0
+	})
+
+	return entries
+}
+
+// state reads the latest snapshot and replays the segments written since,
+// up to and including the segment until if it isn't empty.
+func (l *Log) state(ctx context.Context, until string) (state, error) {
+	l.mx.RLock()
+	defer l.mx.RUnlock()
+
+	s := state{docs: map[ulid.ULID]entry{}}
+
+	dir, m, err := l.latestSnapshot(ctx, until)
+	if err != nil {
+		return s, err
+	}
+
+	for _, collection := range m.Collections {
+		name := dir + "collections/" + collection
+		if err := l.replay(ctx, s, name); err != nil {
+			return s, err
+		}
+	}
+
+	segments, err := l.blobs.ListBlobs(ctx, segmentsPrefix)
+	if err != nil {
+		return s, err
+	}
+	sort.Strings(segments)
+
+	for _, segment := range segments {
+		id := strings.TrimPrefix(segment, segmentsPrefix)
+		if id <= m.LastSegment || (until != "" && id > until) {
+			continue
+		}
+
+		if err := l.replay(ctx, s, segment); err != nil {
+			return s, err
+		}
+		s.segments++
+	}
+
+	return s, nil
+}
+
+// replay applies the entries of the blob named name to s.
+func (l *Log) replay(ctx context.Context, s state, name string) error {
+	b, err := l.blobs.GetBlob(ctx, name)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	entries, err := decodeEntries(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	for _, e := range entries {
+		switch e.op {
+		case opPut:
+			s.docs[e.id] = e
+		case opDelete:
+			delete(s.docs, e.id)
+		}
+	}
+
+	return nil
+}
+
+// latestSnapshot returns the directory and manifest of the latest snapshot
+// that includes no segment after until, if until isn't empty. Snapshots
+// without a manifest are skipped, the manifest is zero if there are none.
+func (l *Log) latestSnapshot(ctx context.Context, until string) (string, manifest, error) {
+	names, err := l.blobs.ListBlobs(ctx, snapshotsPrefix)
+	if err != nil {
+		return "", manifest{}, err
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for _, name := range names {
+		if !strings.HasSuffix(name, "/manifest") {
+			continue
+		}
+
+		m, err := l.manifest(ctx, name)
+		if err != nil {
+			return "", manifest{}, err
+		}
+
+		if until == "" || m.LastSegment <= until {
+			return strings.TrimSuffix(name, "manifest"), m, nil
+		}
+	}
+
+	return "", manifest{}, nil
+}
+
+// manifest reads the manifest named name.
+func (l *Log) manifest(ctx context.Context, name string) (manifest, error) {
+	b, err := l.blobs.GetBlob(ctx, name)
+	if err != nil {
+		return manifest{}, err
+	}
+
+	var m manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return manifest{}, fmt.Errorf("%s: %w: %v", name, ErrLogCorrupt, err)
+	}
+
+	return m, nil
+}
+
+// Ping forwards to the driver if it implements Pinger.
+func (l *Log) Ping(ctx context.Context) error {
+	return Ping(ctx, l.next)
+}
+
+// Describe forwards to the driver if it implements Describer, adding the
+// layout.
+func (l *Log) Describe() map[string]string {
+	details := Describe(l.next)
+	if details == nil {
+		details = map[string]string{}
+	}
+	details["layout"] = string(LayoutLog)
+	if l.retention > 0 {
+		details["retention"] = l.retention.String()
+	}
+
+	return details
+}
+
+// WithRetention keeps the history of changes for d, so the log can be
+// restored to any point in time since. Only what loading needs is kept if d
+// is not positive.
+func (l *Log) WithRetention(d time.Duration) *Log {
+	l.retention = d
+	return l
+}
+
+// NewLog returns a log layout stored as the blobs of next, which must
+// implement BlobStore. It is compacted every so many segments, or
+// DefaultSnapshotEvery if every is not positive.
+func NewLog(next Storage, kr *keyring.Keyring, every int, opts ...document.Option) (*Log, error) {
+	blobs, ok := next.(BlobStore)
+	if !ok {
+		return nil, ErrLayoutUnsupported
+	}
+
+	if every <= 0 {
+		every = DefaultSnapshotEvery
+	}
+
+	return &Log{
+		next:     next,
+		blobs:    blobs,
+		keyring:  kr,
+		encoding: opts,
+		every:    every,
+	}, nil
+}
+
+// op is the operation of an entry of the log.
+type op byte
+
+const (
+	opPut    op = 1
+	opDelete op = 2
+)
+
+// entry is a write or delete of a document, the payload of a write is the
+// document as it is stored by ToStorage.
+type entry struct {
+	op         op
+	collection string
+	id         ulid.ULID
+	payload    []byte
+}
+
+// Segments and snapshots start with logMagic and the version of their
+// layout, and end with the CRC-32 of everything before it.
+const (
+	logMagic   = "NXL"
+	logVersion = 1
+)
+
+// encodeEntries returns entries encoded as a segment or snapshot.
+func encodeEntries(entries []entry) []byte {
+	b := append([]byte(logMagic), logVersion)
+	for _, e := range entries {
+		b = append(b, byte(e.op))
+		b = binary.AppendUvarint(b, uint64(len(e.collection)))
+		b = append(b, e.collection...)
+		b = append(b, e.id[:]...)
+		b = binary.AppendUvarint(b, uint64(len(e.payload)))
+		b = append(b, e.payload...)
+	}
+
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+}
+
+// decodeEntries returns the entries of a segment or snapshot.
+func decodeEntries(b []byte) ([]entry, error) {
+	header := len(logMagic) + 1
+	if len(b) < header+4 || string(b[:len(logMagic)]) != logMagic {
+		return nil, ErrLogCorrupt
+	}
+
+	if b[len(logMagic)] != logVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrLogCorrupt, b[len(logMagic)])
+	}
+
+	body, sum := b[:len(b)-4], binary.BigEndian.Uint32(b[len(b)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrLogCorrupt)
+	}
+
+	body = body[header:]
+
+	// next returns the next n bytes of body, uvarint the next uvarint
+	next := func(n uint64) ([]byte, bool) {
+		if uint64(len(body)) < n {
+			return nil, false
+		}
+		v := body[:n]
+		body = body[n:]
+		return v, true
+	}
+	uvarint := func() (uint64, bool) {
+		v, n := binary.Uvarint(body)
+		if n <= 0 {
+			return 0, false
+		}
+		body = body[n:]
+		return v, true
+	}
+
+	var entries []entry
+	for len(body) > 0 {
+		var e entry
+		e.op = op(body[0])
+		body = body[1:]
+
+		n, ok := uvarint()
+		collection, ok2 := next(n)
+		if !ok || !ok2 {
+			return nil, ErrLogCorrupt
+		}
+		e.collection = string(collection)
+
+		id, ok := next(uint64(len(e.id)))
+		if !ok {
+			return nil, ErrLogCorrupt
+		}
+		copy(e.id[:], id)
+
+		n, ok = uvarint()
+		payload, ok2 := next(n)
+		if !ok || !ok2 {
+			return nil, ErrLogCorrupt
+		}
+		e.payload = payload
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
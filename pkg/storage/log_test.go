@@ -0,0 +1,284 @@
+package storage_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorage_Log(t *testing.T) {
+	dir := t.TempDir()
+	key := []byte("key-that-is-thirty-2-bytes-long!")
+	open := func() storage.Storage {
+		s, err := storage.New(storage.FilesystemDriver,
+			storage.WithPath(dir),
+			storage.WithEncryptionKey(key),
+			storage.WithLayout(storage.LayoutLog),
+			storage.WithSnapshotEvery(1000),
+		)
+		require.NoError(t, err)
+		return s
+	}
+	s := open()
+	assert.Equal(t, "log", storage.Describe(s)["layout"])
+
+	docs := map[string]*document.Document{}
+	for _, name := range []string{"ada", "grace", "linus", "ken"} {
+		doc := document.New().SetCollection("users").SetData(map[string]interface{}{"name": name})
+		require.NoError(t, s.Write(doc))
+		docs[doc.ID.String()] = doc
+	}
+	order := document.New().SetCollection("orders").SetData(map[string]interface{}{"total": 10.0})
+	require.NoError(t, s.Write(order))
+	docs[order.ID.String()] = order
+
+	// updates and deletes are replayed in order
+	var ada *document.Document
+	for _, doc := range docs {
+		if doc.Data["name"] == "ada" {
+			ada = doc
+		}
+	}
+	require.NoError(t, s.Write(ada.SetData(map[string]interface{}{"name": "ada lovelace"})))
+	for _, doc := range docs {
+		if doc.Data["name"] == "ken" {
+			require.NoError(t, s.Delete(doc))
+			delete(docs, doc.ID.String())
+		}
+	}
+
+	assertDocs := func(t *testing.T, s storage.Storage) {
+		t.Helper()
+
+		got := stream(t, s)
+		require.Len(t, got, len(docs))
+		for _, doc := range got {
+			assert.Equal(t, docs[doc.ID.String()].Data, doc.Data)
+		}
+	}
+
+	assertDocs(t, open())
+	assert.Len(t, files(t, dir), 7)
+
+	// compacting leaves a manifest and a snapshot of each collection
+	require.NoError(t, s.(*storage.Log).Compact(context.Background()))
+	assert.Len(t, files(t, dir), 3)
+	assertDocs(t, open())
+
+	// segments written after the snapshot are replayed over it
+	doc := document.New().SetCollection("users").SetData(map[string]interface{}{"name": "barbara"})
+	require.NoError(t, s.Write(doc))
+	docs[doc.ID.String()] = doc
+	assertDocs(t, open())
+
+	require.NoError(t, s.(*storage.Log).Compact(context.Background()))
+	assert.Len(t, files(t, dir), 3)
+	assertDocs(t, open())
+}
+
+func TestStorage_Log_Close(t *testing.T) {
+	dir := t.TempDir()
+	s, err := storage.New(storage.FilesystemDriver,
+		storage.WithPath(dir),
+		storage.WithLayout(storage.LayoutLog),
+		storage.WithSnapshotEvery(2),
+	)
+	require.NoError(t, err)
+
+	// the second write starts compacting in the background
+	for _, name := range []string{"ada", "grace"} {
+		require.NoError(t, s.Write(document.New().SetCollection("users").SetData(map[string]interface{}{"name": name})))
+	}
+
+	// closing waits for it to leave a manifest and a snapshot
+	require.NoError(t, storage.Close(s))
+	assert.Len(t, files(t, dir), 2)
+}
+
+func TestStorage_Log_CompactWithRetention(t *testing.T) {
+	dir := t.TempDir()
+	s, err := storage.New(storage.FilesystemDriver,
+		storage.WithPath(dir),
+		storage.WithLayout(storage.LayoutLog),
+		storage.WithSnapshotEvery(2),
+		storage.WithRetention(time.Hour),
+	)
+	require.NoError(t, err)
+	defer storage.Close(s)
+
+	manifests := func() int {
+		n := 0
+		for _, path := range files(t, dir) {
+			if filepath.Base(path) == "manifest" {
+				n++
+			}
+		}
+		return n
+	}
+
+	// the segments kept for the retention don't hold up later compactions
+	for i := 1; i <= 3; i++ {
+		for _, name := range []string{"ada", "grace"} {
+			require.NoError(t, s.Write(document.New().SetCollection("users").SetData(map[string]interface{}{"name": name})))
+		}
+		require.Eventually(t, func() bool { return manifests() == i }, 5*time.Second, 10*time.Millisecond, "compaction %d", i)
+	}
+}
+
+func TestStorage_Log_Corrupt(t *testing.T) {
+	dir := t.TempDir()
+	s, err := storage.New(storage.FilesystemDriver, storage.WithPath(dir), storage.WithLayout(storage.LayoutLog))
+	require.NoError(t, err)
+	require.NoError(t, s.Write(document.New().SetCollection("users")))
+
+	segment := files(t, dir)[0]
+	b, err := os.ReadFile(segment)
+	require.NoError(t, err)
+	b[len(b)/2] ^= 0xff
+	require.NoError(t, os.WriteFile(segment, b, 0o600))
+
+	_, _, err = storage.StreamErrors(context.Background(), s)
+	require.ErrorIs(t, err, storage.ErrLogCorrupt)
+}
+
+func TestStorage_Log_Unsupported(t *testing.T) {
+	_, err := storage.New(storage.MemoryDriver, storage.WithLayout("tree"))
+	require.ErrorIs(t, err, storage.ErrUnknownLayout)
+}
+
+// files returns the paths of the files under dir.
+func files(t *testing.T, dir string) []string {
+	t.Helper()
+
+	var paths []string
+	require.NoError(t, filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			paths = append(paths, path)
+		}
+		return err
+	}))
+
+	return paths
+}
+
+func TestStorage_Log_Restore(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention time.Duration
+		compact   bool
+		err       error
+	}{
+		{
+			name: "from segments",
+		},
+		{
+			name:      "from a snapshot within the retention",
+			retention: time.Hour,
+			compact:   true,
+		},
+		{
+			name:    "pruned history",
+			compact: true,
+			err:     storage.ErrOutsideRetention,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := storage.New(storage.MemoryDriver,
+				storage.WithSerialisation(true),
+				storage.WithLayout(storage.LayoutLog),
+				storage.WithRetention(tt.retention),
+			)
+			require.NoError(t, err)
+			log := s.(*storage.Log)
+
+			ada := document.New().SetCollection("users").SetData(map[string]interface{}{"name": "ada"})
+			grace := document.New().SetCollection("users").SetData(map[string]interface{}{"name": "grace"})
+			require.NoError(t, s.Write(ada))
+			require.NoError(t, s.Write(grace))
+			if tt.compact {
+				require.NoError(t, log.Compact(context.Background()))
+			}
+
+			time.Sleep(2 * time.Millisecond)
+			at := time.Now()
+			time.Sleep(2 * time.Millisecond)
+
+			// a bad bulk update
+			require.NoError(t, s.Write(document.New().SetCollection("users").SetID(ada.ID.String()).SetData(map[string]interface{}{"name": "oops"})))
+			require.NoError(t, s.Delete(grace))
+			require.NoError(t, s.Write(document.New().SetCollection("users")))
+			if tt.compact {
+				time.Sleep(2 * time.Millisecond)
+				require.NoError(t, log.Compact(context.Background()))
+			}
+
+			report, err := storage.Restore(context.Background(), s, at)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, storage.RestoreReport{Written: 2, Deleted: 1}, report)
+
+			docs := stream(t, s)
+			require.Len(t, docs, 2)
+			assert.Equal(t, ada.Data, docs[0].Data)
+			assert.Equal(t, grace.Data, docs[1].Data)
+
+			// restoring again changes nothing
+			report, err = storage.Restore(context.Background(), s, time.Now())
+			require.NoError(t, err)
+			assert.Zero(t, report)
+		})
+	}
+}
+
+func TestStorage_Log_Restore_BeforeHistory(t *testing.T) {
+	s, err := storage.New(storage.MemoryDriver, storage.WithLayout(storage.LayoutLog), storage.WithRetention(time.Hour))
+	require.NoError(t, err)
+
+	before := time.Now().Add(-time.Second)
+	require.NoError(t, s.Write(document.New().SetCollection("users")))
+
+	// the whole history is kept, the log was empty before its first change
+	require.NoError(t, storage.CanRestore(context.Background(), s, before))
+	docs, _, err := storage.StreamAt(context.Background(), s, before)
+	require.NoError(t, err)
+	for range docs {
+		t.Fatal("the log was empty before its first change")
+	}
+
+	report, err := storage.Restore(context.Background(), s, before)
+	require.NoError(t, err)
+	assert.Equal(t, storage.RestoreReport{Deleted: 1}, report)
+	assert.Empty(t, stream(t, s))
+
+	// once pruned, the state before the history left isn't known
+	pruned, err := storage.New(storage.MemoryDriver, storage.WithLayout(storage.LayoutLog))
+	require.NoError(t, err)
+	require.NoError(t, pruned.Write(document.New().SetCollection("users")))
+	require.NoError(t, pruned.(*storage.Log).Compact(context.Background()))
+
+	require.ErrorIs(t, storage.CanRestore(context.Background(), pruned, before), storage.ErrOutsideRetention)
+	_, _, err = storage.StreamAt(context.Background(), pruned, before)
+	require.ErrorIs(t, err, storage.ErrOutsideRetention)
+}
+
+func TestStorage_Log_Restore_Unsupported(t *testing.T) {
+	s, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	_, err = storage.Restore(context.Background(), s, time.Now())
+	require.ErrorIs(t, err, storage.ErrRestoreUnsupported)
+}
@@ -1,16 +1,38 @@
 package storage
 
 import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/keyring"
+
+	"github.com/oklog/ulid/v2"
 )
 
 // Memory is a storage implementation that stores all data in memory.
+//
+// By default documents are stored as they are written, sharing them with
+// the writer. Serialised, documents are stored encoded and encrypted as
+// other drivers store them, so they are decoded afresh on every stream.
 type Memory struct {
-	encryptionKey []byte
-	mx            sync.RWMutex
-	data          []*document.Document
+	keyring   *keyring.Keyring
+	encoding  []document.Option
+	serialise bool
+	mx        sync.RWMutex
+	data      []record
+	blobs     map[string][]byte
+}
+
+// record is a document held by Memory, it holds the encoding of the
+// document instead if Memory is serialised.
+type record struct {
+	id   ulid.ULID
+	doc  *document.Document
+	blob []byte
 }
 
 // Write writes a document to the storage, if the document already exists
@@ -20,37 +42,77 @@ func (m *Memory) Write(doc *document.Document) error {
 		return ErrDocumentInvalid
 	}
 
+	r := record{id: doc.ID, doc: doc}
+	if m.serialise {
+		b, err := doc.ToStorage(m.keyring, m.encoding...)
+		if err != nil {
+			return err
+		}
+		r = record{id: doc.ID, blob: b}
+	}
+
 	m.mx.Lock()
 	defer m.mx.Unlock()
 
 	// check if document already exists
 	// and overwrite if it does.
 	for i, d := range m.data {
-		if d.ID.String() == doc.ID.String() {
-			m.data[i] = doc
+		if d.id == doc.ID {
+			m.data[i] = r
 			return nil
 		}
 	}
 
-	m.data = append(m.data, doc)
+	m.data = append(m.data, r)
 
 	return nil
 }
 
-// Stream streams documents from the storage.
+// Stream streams documents from the storage, the stream ends at the first
+// document that can't be decoded. Use StreamErrors to carry on past them.
 func (m *Memory) Stream() (<-chan *document.Document, error) {
+	return streamUntilError(m)
+}
+
+// StreamErrors implements ErrorStreamer, documents are streamed in the order
+// they were first written.
+func (m *Memory) StreamErrors(ctx context.Context) (<-chan *document.Document, <-chan error, error) {
 	m.mx.RLock()
 	defer m.mx.RUnlock()
 
+	// stream the records held when called
+	data := make([]record, len(m.data))
+	copy(data, m.data)
+
 	c := make(chan *document.Document)
+	errs := make(chan error)
 	go func() {
 		defer close(c)
-		for _, d := range m.data {
-			c <- d
+		defer close(errs)
+
+		for _, r := range data {
+			doc := r.doc
+			if r.blob != nil {
+				var err error
+				if doc, err = document.FromStorage(r.blob, m.keyring); err != nil {
+					select {
+					case errs <- &ObjectError{Key: r.id.String(), Err: err}:
+					case <-ctx.Done():
+						return
+					}
+					continue
+				}
+			}
+
+			select {
+			case c <- doc:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
-	return c, nil
+	return c, errs, nil
 }
 
 // Delete deletes a document from the storage.
@@ -59,7 +121,7 @@ func (m *Memory) Delete(doc *document.Document) error {
 	defer m.mx.Unlock()
 
 	for i, d := range m.data {
-		if d.ID.Compare(doc.ID) == 0 {
+		if d.id == doc.ID {
 			m.data = append(m.data[:i], m.data[i+1:]...)
 			return nil
 		}
@@ -68,12 +130,77 @@ func (m *Memory) Delete(doc *document.Document) error {
 	return nil
 }
 
-// WithEncryptionKey sets the encryption key.
-func (m *Memory) WithEncryptionKey(key []byte) (Storage, error) {
-	m.encryptionKey = key
+// PutBlob implements BlobStore.
+func (m *Memory) PutBlob(_ context.Context, name string, b []byte) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if m.blobs == nil {
+		m.blobs = make(map[string][]byte)
+	}
+	m.blobs[name] = append([]byte(nil), b...)
+
+	return nil
+}
+
+// GetBlob implements BlobStore.
+func (m *Memory) GetBlob(_ context.Context, name string) ([]byte, error) {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+
+	b, ok := m.blobs[name]
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+
+	return append([]byte(nil), b...), nil
+}
+
+// ListBlobs implements BlobStore.
+func (m *Memory) ListBlobs(_ context.Context, prefix string) ([]string, error) {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+
+	var names []string
+	for name := range m.blobs {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// DeleteBlob implements BlobStore.
+func (m *Memory) DeleteBlob(_ context.Context, name string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	delete(m.blobs, name)
+
+	return nil
+}
+
+// Describe implements Describer.
+func (m *Memory) Describe() map[string]string {
+	return describeKeyring(map[string]string{
+		"serialised": strconv.FormatBool(m.serialise),
+	}, m.keyring)
+}
+
+// WithKeyring sets the keyring documents are encrypted with.
+func (m *Memory) WithKeyring(kr *keyring.Keyring) (Storage, error) {
+	m.keyring = kr
 	return m, nil
 }
 
+// WithSerialisation sets whether documents are stored serialised.
+func (m *Memory) WithSerialisation(serialise bool) *Memory {
+	m.serialise = serialise
+	return m
+}
+
 // NewMemory returns a new Memory storage implementation.
 func NewMemory() (*Memory, error) {
 	return &Memory{}, nil
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/keyring"
 	"github.com/nexdb/nexdb/pkg/storage"
 
 	"github.com/stretchr/testify/assert"
@@ -125,6 +126,111 @@ func TestStorage_Memory_Delete(t *testing.T) {
 	require.Nil(t, found)
 }
 
+func TestStorage_Memory_Serialised(t *testing.T) {
+	key := []byte("key-that-is-thirty-2-bytes-long!")
+	other, err := keyring.FromKey([]byte("a-different-key-of-thirty-2-byte"))
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name   string
+		opts   []storage.Option
+		verify func(t *testing.T, m *storage.Memory, doc *document.Document)
+	}{
+		{
+			name: "write document, expect a copy to be streamed",
+			opts: []storage.Option{storage.WithEncryptionKey(key)},
+			verify: func(t *testing.T, m *storage.Memory, doc *document.Document) {
+				// changes made after the write must not reach storage
+				doc.Data["foo"] = "changed"
+
+				c, err := m.Stream()
+				require.NoError(t, err)
+
+				got := getDocumentFromStream(c, doc.ID.String())
+				require.NotNil(t, got)
+				assert.NotSame(t, doc, got)
+				assert.Equal(t, "bar", got.Data["foo"])
+				assert.Equal(t, doc.Collection, got.Collection)
+				assert.False(t, got.Stale)
+			},
+		},
+		{
+			name: "stream with a different key, expect an error",
+			opts: []storage.Option{storage.WithEncryptionKey(key)},
+			verify: func(t *testing.T, m *storage.Memory, doc *document.Document) {
+				_, err := m.WithKeyring(other)
+				require.NoError(t, err)
+
+				_, err = m.Stream()
+				var objErr *storage.ObjectError
+				require.ErrorAs(t, err, &objErr)
+				assert.Equal(t, doc.ID.String(), objErr.Key)
+				assert.ErrorIs(t, err, keyring.ErrUnknownKey)
+			},
+		},
+		{
+			name: "stream plaintext with a key, expect an error",
+			verify: func(t *testing.T, m *storage.Memory, doc *document.Document) {
+				_, err := m.WithKeyring(other)
+				require.NoError(t, err)
+
+				_, err = m.Stream()
+				assert.ErrorIs(t, err, document.ErrPlaintextNotAllowed)
+			},
+		},
+		{
+			name: "database key, expect documents sealed with the storage key to be stale",
+			opts: []storage.Option{storage.WithEncryptionKey(key)},
+			verify: func(t *testing.T, m *storage.Memory, doc *document.Document) {
+				kr, err := storage.Keyring(storage.WithEncryptionKey(key), storage.WithDatabaseKey([]byte("database-key-is-thirty-2-bytes!!")))
+				require.NoError(t, err)
+				_, err = m.WithKeyring(kr)
+				require.NoError(t, err)
+
+				c, err := m.Stream()
+				require.NoError(t, err)
+				got := getDocumentFromStream(c, doc.ID.String())
+				require.NotNil(t, got)
+				assert.True(t, got.Stale)
+
+				// rewritten, it is sealed with the database key
+				require.NoError(t, m.Write(got))
+				c, err = m.Stream()
+				require.NoError(t, err)
+				got = getDocumentFromStream(c, doc.ID.String())
+				require.NotNil(t, got)
+				assert.False(t, got.Stale)
+			},
+		},
+		{
+			name: "stream plaintext with a key allowing plaintext, expect a stale document",
+			verify: func(t *testing.T, m *storage.Memory, doc *document.Document) {
+				_, err := m.WithKeyring(other.WithPlaintext())
+				require.NoError(t, err)
+
+				c, err := m.Stream()
+				require.NoError(t, err)
+
+				got := getDocumentFromStream(c, doc.ID.String())
+				require.NotNil(t, got)
+				assert.True(t, got.Stale)
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := storage.New(storage.MemoryDriver, append(tc.opts, storage.WithSerialisation(true))...)
+			require.NoError(t, err)
+			assert.Equal(t, "true", storage.Describe(s)["serialised"])
+
+			doc := document.New().SetCollection("test").SetData(map[string]interface{}{"foo": "bar"})
+			require.NoError(t, s.Write(doc))
+
+			tc.verify(t, s.(*storage.Memory), doc)
+		})
+	}
+}
+
 func getDocumentFromStream(c <-chan *document.Document, id string) *document.Document {
 	for d := range c {
 		if d.ID.String() == id {
@@ -1,11 +1,15 @@
 package storage
 
 import (
+	"context"
 	"errors"
-	"log"
-	"os"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
 
 	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/keyring"
 )
 
 // Driver is a storage driver.
@@ -14,6 +18,8 @@ type Driver string
 const (
 	MemoryDriver Driver = "memory"
 	AWS3Driver   Driver = "aws-s3"
+	// FilesystemDriver stores documents as files in a local directory.
+	FilesystemDriver Driver = "filesystem"
 )
 
 var (
@@ -21,6 +27,11 @@ var (
 	ErrUnknownDriver = errors.New("unknown driver")
 	// ErrDocumentInvalid is returned when a document is invalid.
 	ErrDocumentInvalid = errors.New("document is invalid")
+	// ErrEncryptionKeyInvalid is returned when the encryption key is not 32 bytes long.
+	ErrEncryptionKeyInvalid = errors.New("encryption key must be 32 bytes")
+	// ErrS3ConfigInvalid is returned when the configuration of the aws-s3
+	// driver is invalid.
+	ErrS3ConfigInvalid = errors.New("aws-s3 configuration is invalid")
 )
 
 // Storage is an interface for storage implementations.
@@ -34,15 +45,353 @@ type Storage interface {
 	Stream() (<-chan *document.Document, error)
 }
 
+// ContextStorage is implemented by storage implementations that accept the
+// context of a write or delete, such as to trace it.
+type ContextStorage interface {
+	WriteContext(ctx context.Context, doc *document.Document) error
+	DeleteContext(ctx context.Context, doc *document.Document) error
+}
+
+// WriteContext writes a document to the storage, passing ctx along if the
+// storage implements ContextStorage.
+func WriteContext(ctx context.Context, s Storage, doc *document.Document) error {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.WriteContext(ctx, doc)
+	}
+
+	return s.Write(doc)
+}
+
+// DeleteContext deletes a document from the storage, passing ctx along if
+// the storage implements ContextStorage.
+func DeleteContext(ctx context.Context, s Storage, doc *document.Document) error {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.DeleteContext(ctx, doc)
+	}
+
+	return s.Delete(doc)
+}
+
+// Pinger is implemented by storage implementations that can check whether
+// their backend is reachable.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Describer is implemented by storage implementations that can describe how
+// they are configured, secrets are never included.
+type Describer interface {
+	Describe() map[string]string
+}
+
+// Ping checks whether the backend of the storage is reachable, storage that
+// doesn't implement Pinger is always reachable.
+func Ping(ctx context.Context, s Storage) error {
+	if p, ok := s.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+
+	return nil
+}
+
+// Describe returns the details of the storage, or nil if it doesn't
+// implement Describer.
+func Describe(s Storage) map[string]string {
+	if d, ok := s.(Describer); ok {
+		return d.Describe()
+	}
+
+	return nil
+}
+
+// Close closes the storage if it implements io.Closer, such as to wait for
+// the work it does in the background. Storage must not be used once closed.
+func Close(s Storage) error {
+	if c, ok := s.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+// describeKeyring adds whether documents are encrypted, and the ID of the
+// key they are sealed with, to the details of a storage.
+func describeKeyring(details map[string]string, kr *keyring.Keyring) map[string]string {
+	details["encrypted"] = strconv.FormatBool(kr != nil)
+	if kr != nil {
+		details["key_id"] = kr.Primary()
+	}
+
+	return details
+}
+
+// Middleware wraps a storage implementation created by New, such as to
+// instrument it.
+type Middleware func(d Driver, next Storage) Storage
+
+// Option is a function that modifies how a storage implementation is created.
+type Option func(*options)
+
+// options are the settings applied to a storage implementation by New.
+type options struct {
+	encryptionKey []byte
+	keyringFile   string
+	databaseKey   []byte
+	plaintext     bool
+	prefix        string
+	awsRegion     string
+	awsBucket     string
+	s3            S3Config
+	path          string
+	serialise     bool
+	format        document.Format
+	compression   document.Compression
+	concurrency   int
+	layout        Layout
+	snapshotEvery int
+	retention     time.Duration
+	middleware    []Middleware
+}
+
+// WithEncryptionKey sets the key documents are encrypted with at rest,
+// documents are not encrypted if the key is empty.
+func WithEncryptionKey(key []byte) Option {
+	return func(o *options) {
+		o.encryptionKey = key
+	}
+}
+
+// WithKeyringFile sets the keyring file documents are encrypted with at rest,
+// see keyring.Load. Documents are sealed with its primary key, the key set by
+// WithEncryptionKey is kept to read documents sealed before the keyring was
+// introduced.
+func WithKeyringFile(path string) Option {
+	return func(o *options) {
+		o.keyringFile = path
+	}
+}
+
+// WithDatabaseKey sets the own key of a database, documents are sealed with
+// it rather than the primary key of the keyring. The keys set by
+// WithEncryptionKey and WithKeyringFile are kept to read documents sealed
+// with them, which are re-encrypted with the database key.
+func WithDatabaseKey(key []byte) Option {
+	return func(o *options) {
+		o.databaseKey = key
+	}
+}
+
+// WithPlaintextReads sets whether documents written before the storage was
+// encrypted are read, for the window while they are re-encrypted. Documents
+// that are not encrypted fail to be read otherwise.
+func WithPlaintextReads(allow bool) Option {
+	return func(o *options) {
+		o.plaintext = allow
+	}
+}
+
+// WithPrefix scopes the storage to a key prefix, so several databases can
+// share a single bucket.
+func WithPrefix(prefix string) Option {
+	return func(o *options) {
+		o.prefix = prefix
+	}
+}
+
+// WithAWS sets the region and bucket used by the aws-s3 driver.
+func WithAWS(region, bucket string) Option {
+	return func(o *options) {
+		o.awsRegion = region
+		o.awsBucket = bucket
+	}
+}
+
+// WithS3 sets the configuration of the aws-s3 driver beyond its region and
+// bucket, such as the endpoint of an S3 compatible service.
+func WithS3(c S3Config) Option {
+	return func(o *options) {
+		o.s3 = c
+	}
+}
+
+// WithPath sets the directory documents are stored in by the filesystem driver.
+func WithPath(path string) Option {
+	return func(o *options) {
+		o.path = path
+	}
+}
+
+// WithFormat sets the format documents are serialised with, documents
+// stored in any format can be read.
+func WithFormat(f document.Format) Option {
+	return func(o *options) {
+		o.format = f
+	}
+}
+
+// WithCompression sets the compression documents are compressed with before
+// they are encrypted, documents stored with any compression can be read.
+func WithCompression(c document.Compression) Option {
+	return func(o *options) {
+		o.compression = c
+	}
+}
+
+// WithConcurrency sets how many documents the aws-s3 and filesystem drivers
+// read at once while streaming, DefaultConcurrency if n is not positive.
+func WithConcurrency(n int) Option {
+	return func(o *options) {
+		o.concurrency = n
+	}
+}
+
+// WithLayout sets how documents are laid out in storage, LayoutDocuments
+// if it isn't set.
+func WithLayout(l Layout) Option {
+	return func(o *options) {
+		o.layout = l
+	}
+}
+
+// WithSnapshotEvery sets how many segments the log layout writes before
+// compacting them into a snapshot, DefaultSnapshotEvery if n is not positive.
+func WithSnapshotEvery(n int) Option {
+	return func(o *options) {
+		o.snapshotEvery = n
+	}
+}
+
+// WithRetention sets how long the log layout keeps the history of changes
+// for, so storage can be restored to any point in time since.
+func WithRetention(d time.Duration) Option {
+	return func(o *options) {
+		o.retention = d
+	}
+}
+
+// WithSerialisation makes the memory driver store documents serialised and
+// encrypted as the other drivers do, rather than sharing them with the writer.
+func WithSerialisation(serialise bool) Option {
+	return func(o *options) {
+		o.serialise = serialise
+	}
+}
+
+// WithMiddleware wraps the storage implementation in the given middleware,
+// the first middleware is the outermost.
+func WithMiddleware(mw ...Middleware) Option {
+	return func(o *options) {
+		o.middleware = append(o.middleware, mw...)
+	}
+}
+
 // New returns a new storage implementation.
-func New(d Driver) (Storage, error) {
-	encryptionKey := []byte(os.Getenv("NEXDB_ENCRYPTION_KEY"))
-	if len(encryptionKey) > 0 {
-		if len(encryptionKey) != 32 {
-			log.Fatal("encryption key must be 32 bytes")
+func New(d Driver, opts ...Option) (Storage, error) {
+	o := &options{}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if len(o.encryptionKey) > 0 && len(o.encryptionKey) != 32 {
+		return nil, ErrEncryptionKeyInvalid
+	}
+
+	if _, err := document.ParseFormat(string(o.format)); err != nil {
+		return nil, err
+	}
+
+	if _, err := document.ParseCompression(string(o.compression)); err != nil {
+		return nil, err
+	}
+
+	kr, err := o.keyring()
+	if err != nil {
+		return nil, err
+	}
+
+	switch o.layout {
+	case "", LayoutDocuments, LayoutLog:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownLayout, o.layout)
+	}
+
+	s, err := newDriver(d, o, kr)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.layout == LayoutLog {
+		log, err := NewLog(s, kr, o.snapshotEvery, o.encoding()...)
+		if err != nil {
+			return nil, err
 		}
+		s = log.WithRetention(o.retention)
 	}
 
+	for i := len(o.middleware) - 1; i >= 0; i-- {
+		s = o.middleware[i](d, s)
+	}
+
+	return s, nil
+}
+
+// Keyring returns the keyring documents are encrypted with by storage
+// created with opts, or nil if they are not encrypted.
+func Keyring(opts ...Option) (*keyring.Keyring, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if len(o.encryptionKey) > 0 && len(o.encryptionKey) != 32 {
+		return nil, ErrEncryptionKeyInvalid
+	}
+
+	return o.keyring()
+}
+
+// keyring returns the keyring documents are encrypted with, or nil if
+// they are not encrypted.
+func (o *options) keyring() (*keyring.Keyring, error) {
+	kr, err := keyring.FromKey(o.encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.keyringFile != "" {
+		file, err := keyring.Load(o.keyringFile)
+		if err != nil {
+			return nil, err
+		}
+		kr = file.With(kr)
+	}
+
+	if len(o.databaseKey) > 0 {
+		db, err := keyring.FromKey(o.databaseKey)
+		if err != nil {
+			return nil, err
+		}
+		kr = db.With(kr)
+	}
+
+	if kr != nil && o.plaintext {
+		kr = kr.WithPlaintext()
+	}
+
+	return kr, nil
+}
+
+// encoding returns the options documents are encoded with by ToStorage.
+func (o *options) encoding() []document.Option {
+	return []document.Option{
+		document.WithFormat(o.format),
+		document.WithCompression(o.compression),
+	}
+}
+
+// newDriver returns the storage implementation of the driver.
+func newDriver(d Driver, o *options, kr *keyring.Keyring) (Storage, error) {
 	switch d {
 	case MemoryDriver:
 		m, err := NewMemory()
@@ -50,14 +399,29 @@ func New(d Driver) (Storage, error) {
 			return nil, err
 		}
 
-		return m.WithEncryptionKey(encryptionKey)
+		m.encoding = o.encoding()
+
+		return m.WithSerialisation(o.serialise).WithKeyring(kr)
 	case AWS3Driver:
-		a, err := NewAWSS3(os.Getenv("AWS_REGION"), os.Getenv("AWS_BUCKET"))
+		a, err := NewAWSS3(o.awsRegion, o.awsBucket, o.s3)
+		if err != nil {
+			return nil, err
+		}
+		a.prefix += o.prefix
+		a.encoding = o.encoding()
+		a.concurrency = o.concurrency
+
+		return a.WithKeyring(kr)
+	case FilesystemDriver:
+		f, err := NewFilesystem(o.path)
 		if err != nil {
 			return nil, err
 		}
+		f.prefix = o.prefix
+		f.encoding = o.encoding()
+		f.concurrency = o.concurrency
 
-		return a.WithEncryptionKey(encryptionKey)
+		return f.WithKeyring(kr)
 	default:
 		return nil, ErrUnknownDriver
 	}
@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/nexdb/nexdb/pkg/document"
+)
+
+// DefaultConcurrency is how many documents are read at once while
+// streaming, unless set by WithConcurrency.
+const DefaultConcurrency = 16
+
+// ObjectError is an error reading a single document from storage, the other
+// documents can still be read.
+type ObjectError struct {
+	// Key is the key the document is stored under.
+	Key string
+	Err error
+}
+
+// Error implements error.
+func (e *ObjectError) Error() string {
+	return e.Key + ": " + e.Err.Error()
+}
+
+// Unwrap returns the error reading the document.
+func (e *ObjectError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorStreamer is implemented by storage implementations that report the
+// errors of a stream rather than ending it early. Documents that can't be
+// read are reported as an *ObjectError and the stream carries on, any other
+// error ends the stream. Both channels are closed once the stream ends or
+// ctx is done.
+type ErrorStreamer interface {
+	StreamErrors(ctx context.Context) (<-chan *document.Document, <-chan error, error)
+}
+
+// StreamErrors streams the documents of the storage and the errors reading
+// them, see ErrorStreamer. Storage that doesn't implement ErrorStreamer never
+// reports an error once the stream has started.
+func StreamErrors(ctx context.Context, s Storage) (<-chan *document.Document, <-chan error, error) {
+	if es, ok := s.(ErrorStreamer); ok {
+		return es.StreamErrors(ctx)
+	}
+
+	docs, err := s.Stream()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// once ctx is done the rest of the stream is drained, so the storage
+	// isn't left blocked
+	c := make(chan *document.Document)
+	go func() {
+		defer close(c)
+		for doc := range docs {
+			select {
+			case c <- doc:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	errs := make(chan error)
+	close(errs)
+
+	return c, errs, nil
+}
+
+// streamUntilError adapts an ErrorStreamer to Stream. The stream is read
+// until its first document before Stream returns, so storage whose
+// documents can't be read, such as with the wrong key, returns the error
+// rather than an empty stream. An error after the first document ends the
+// stream and is logged, use StreamErrors to be sent every error.
+func streamUntilError(es ErrorStreamer) (<-chan *document.Document, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	docs, errs, err := es.StreamErrors(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// next returns the next document, nil once the stream has ended
+	next := func() (*document.Document, error) {
+		for docs != nil || errs != nil {
+			select {
+			case doc, ok := <-docs:
+				if !ok {
+					docs = nil
+					continue
+				}
+				return doc, nil
+			case err, ok := <-errs:
+				if !ok {
+					errs = nil
+					continue
+				}
+				return nil, err
+			}
+		}
+
+		return nil, nil
+	}
+
+	first, err := next()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	c := make(chan *document.Document)
+	go func() {
+		defer close(c)
+		defer cancel()
+
+		for doc := first; doc != nil; {
+			c <- doc
+
+			var err error
+			if doc, err = next(); err != nil {
+				slog.Error("failed to stream documents", "error", err)
+				return
+			}
+		}
+	}()
+
+	return c, nil
+}
+
+// fetchAll reads the documents stored under the keys sent by list with
+// workers goroutines, errors reading a document are sent as an
+// *ObjectError and an error returned by list is sent as it is.
+func fetchAll(
+	ctx context.Context,
+	workers int,
+	list func(ctx context.Context, keys chan<- string) error,
+	fetch func(ctx context.Context, key string) (*document.Document, error),
+) (<-chan *document.Document, <-chan error) {
+	if workers <= 0 {
+		workers = DefaultConcurrency
+	}
+
+	docs := make(chan *document.Document)
+	errs := make(chan error)
+	keys := make(chan string)
+
+	// send reports an error, unless the stream has been abandoned
+	send := func(err error) {
+		select {
+		case errs <- err:
+		case <-ctx.Done():
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers + 1)
+	go func() {
+		defer wg.Done()
+		defer close(keys)
+
+		if err := list(ctx, keys); err != nil && ctx.Err() == nil {
+			send(err)
+		}
+	}()
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+
+			for key := range keys {
+				doc, err := fetch(ctx, key)
+				if err != nil {
+					send(&ObjectError{Key: key, Err: err})
+					continue
+				}
+
+				select {
+				case docs <- doc:
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(docs)
+		close(errs)
+	}()
+
+	return docs, errs
+}
@@ -0,0 +1,44 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/nexdb/nexdb/pkg/database/cache"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Queue is a cache.Middleware that traces the processing of events. Events
+// are processed after the request that emitted them has finished, so each
+// is traced as a new trace linked to the span of the originating write.
+func Queue(next cache.Processor) cache.Processor {
+	return func(event cache.Event) error {
+		opts := []trace.SpanStartOption{
+			trace.WithNewRoot(),
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(
+				attribute.String("nexdb.operation", event.Operation.String()),
+				attribute.String("nexdb.collection", event.Document.Collection),
+				attribute.String("nexdb.document_id", event.Document.ID.String()),
+			),
+		}
+		if event.Context != nil {
+			opts = append(opts, trace.WithLinks(trace.LinkFromContext(event.Context)))
+		}
+
+		ctx, span := otel.Tracer(tracerName).Start(context.Background(), "Queue.process", opts...)
+		defer span.End()
+
+		event.Context = ctx
+		err := next(event)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+
+		return err
+	}
+}
@@ -0,0 +1,121 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/storage"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracedStorage traces the calls to a storage implementation.
+type tracedStorage struct {
+	next   storage.Storage
+	driver string
+}
+
+// Storage is a storage.Middleware that traces every call to a storage
+// implementation. Writes and deletes made through storage.WriteContext and
+// storage.DeleteContext are traced as children of the context's span.
+func Storage(d storage.Driver, next storage.Storage) storage.Storage {
+	return &tracedStorage{next: next, driver: string(d)}
+}
+
+// Write implements storage.Storage.
+func (s *tracedStorage) Write(doc *document.Document) error {
+	return s.WriteContext(context.Background(), doc)
+}
+
+// Delete implements storage.Storage.
+func (s *tracedStorage) Delete(doc *document.Document) error {
+	return s.DeleteContext(context.Background(), doc)
+}
+
+// WriteContext implements storage.ContextStorage.
+func (s *tracedStorage) WriteContext(ctx context.Context, doc *document.Document) error {
+	return s.trace(ctx, "Storage.Write", doc, func(ctx context.Context) error {
+		return storage.WriteContext(ctx, s.next, doc)
+	})
+}
+
+// DeleteContext implements storage.ContextStorage.
+func (s *tracedStorage) DeleteContext(ctx context.Context, doc *document.Document) error {
+	return s.trace(ctx, "Storage.Delete", doc, func(ctx context.Context) error {
+		return storage.DeleteContext(ctx, s.next, doc)
+	})
+}
+
+// Stream implements storage.Storage, only the time taken to start the stream
+// is traced.
+func (s *tracedStorage) Stream() (<-chan *document.Document, error) {
+	var ch <-chan *document.Document
+	err := s.trace(context.Background(), "Storage.Stream", nil, func(context.Context) error {
+		var err error
+		ch, err = s.next.Stream()
+		return err
+	})
+
+	return ch, err
+}
+
+// StreamErrors forwards to the wrapped storage, see storage.StreamErrors,
+// only the time taken to start the stream is traced.
+func (s *tracedStorage) StreamErrors(ctx context.Context) (<-chan *document.Document, <-chan error, error) {
+	var (
+		docs <-chan *document.Document
+		errs <-chan error
+	)
+	err := s.trace(ctx, "Storage.Stream", nil, func(ctx context.Context) error {
+		var err error
+		docs, errs, err = storage.StreamErrors(ctx, s.next)
+		return err
+	})
+
+	return docs, errs, err
+}
+
+// Ping forwards to the wrapped storage if it implements storage.Pinger.
+func (s *tracedStorage) Ping(ctx context.Context) error {
+	return s.trace(ctx, "Storage.Ping", nil, func(ctx context.Context) error {
+		return storage.Ping(ctx, s.next)
+	})
+}
+
+// Describe forwards to the wrapped storage if it implements storage.Describer.
+func (s *tracedStorage) Describe() map[string]string {
+	return storage.Describe(s.next)
+}
+
+// Close forwards to the wrapped storage if it implements io.Closer.
+func (s *tracedStorage) Close() error {
+	return storage.Close(s.next)
+}
+
+// trace runs fn in a client span named name.
+func (s *tracedStorage) trace(ctx context.Context, name string, doc *document.Document, fn func(ctx context.Context) error) error {
+	attrs := []attribute.KeyValue{attribute.String("nexdb.storage.driver", s.driver)}
+	if doc != nil {
+		attrs = append(attrs,
+			attribute.String("nexdb.collection", doc.Collection),
+			attribute.String("nexdb.document_id", doc.ID.String()),
+		)
+	}
+
+	ctx, span := otel.Tracer(tracerName).Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+	defer span.End()
+
+	err := fn(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return err
+}
@@ -0,0 +1,150 @@
+// Package tracing sets up OpenTelemetry tracing for the server. Spans are
+// started by wrappers around the http handlers, the cache queues and the
+// storage implementations, and by the services themselves.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Exporter is where spans are exported to.
+type Exporter string
+
+const (
+	// NoExporter disables tracing.
+	NoExporter Exporter = ""
+	// OTLPExporter exports spans to an OTLP collector over http.
+	OTLPExporter Exporter = "otlp"
+	// StdoutExporter writes spans to stdout as JSON.
+	StdoutExporter Exporter = "stdout"
+	// FileExporter writes spans to a file as JSON.
+	FileExporter Exporter = "file"
+)
+
+// ErrUnknownExporter is returned when an exporter is not recognised.
+var ErrUnknownExporter = errors.New("unknown exporter")
+
+// tracerName is the name of the tracer of the wrappers in this package.
+const tracerName = "github.com/nexdb/nexdb/pkg/tracing"
+
+// Options are the settings of tracing.
+type Options struct {
+	Exporter Exporter
+	// Endpoint is the host and port of the OTLP collector, the
+	// OTEL_EXPORTER_OTLP_ENDPOINT environment variable is used if empty.
+	Endpoint string
+	// Insecure sends spans to the OTLP collector without TLS.
+	Insecure bool
+	// File is the path spans are written to by the file exporter.
+	File string
+	// Version is the version of the server recorded on every span.
+	Version string
+}
+
+// Validate validates the options.
+func (o Options) Validate() error {
+	switch o.Exporter {
+	case NoExporter, OTLPExporter, StdoutExporter:
+	case FileExporter:
+		if o.File == "" {
+			return errors.New("a file is required by the file exporter")
+		}
+	default:
+		return fmt.Errorf("%w %q, must be otlp, stdout or file", ErrUnknownExporter, o.Exporter)
+	}
+
+	return nil
+}
+
+// Setup installs the global tracer provider and propagator, it returns a
+// function that flushes the spans and stops the exporter. Tracing is left
+// disabled when no exporter is set.
+func Setup(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	if opts.Exporter == NoExporter {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, closer, err := newExporter(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName("nexdb"),
+		semconv.ServiceVersion(opts.Version),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			err = errors.Join(err, closer.Close())
+		}
+		return err
+	}, nil
+}
+
+// newExporter returns the exporter of the options and, for the file
+// exporter, the file to close once it is shut down.
+func newExporter(ctx context.Context, opts Options) (sdktrace.SpanExporter, io.Closer, error) {
+	switch opts.Exporter {
+	case OTLPExporter:
+		var o []otlptracehttp.Option
+		if opts.Endpoint != "" {
+			o = append(o, otlptracehttp.WithEndpoint(opts.Endpoint))
+		}
+		if opts.Insecure {
+			o = append(o, otlptracehttp.WithInsecure())
+		}
+
+		exporter, err := otlptracehttp.New(ctx, o...)
+		return exporter, nil, err
+	case StdoutExporter:
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		return exporter, nil, err
+	case FileExporter:
+		f, err := os.OpenFile(opts.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return exporter, f, nil
+	default:
+		return nil, nil, ErrUnknownExporter
+	}
+}
@@ -0,0 +1,75 @@
+package tracing_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/storage"
+	"github.com/nexdb/nexdb/pkg/tracing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	store, err := storage.New(storage.MemoryDriver, storage.WithMiddleware(tracing.Storage))
+	require.NoError(t, err)
+
+	q := cache.NewQueue(store)
+	q.Use(tracing.Queue)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := cache.NewCache(ctx, q)
+
+	r := mux.NewRouter()
+	r.Use(tracing.Middleware)
+	r.HandleFunc("/v1/collections/{collection}", func(w http.ResponseWriter, r *http.Request) {
+		doc := document.New().SetCollection(mux.Vars(r)["collection"])
+		require.NoError(t, c.PutContext(r.Context(), doc, false))
+		w.WriteHeader(http.StatusCreated)
+	}).Methods("PUT")
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/v1/collections/users", nil))
+
+	cancel()
+	q.WaitForShutdown()
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	require.Contains(t, spans, "PUT /v1/collections/{collection}")
+	require.Contains(t, spans, "Cache.Put")
+	require.Contains(t, spans, "Queue.process")
+	require.Contains(t, spans, "Storage.Write")
+
+	server, put, process, write := spans["PUT /v1/collections/{collection}"], spans["Cache.Put"], spans["Queue.process"], spans["Storage.Write"]
+
+	// the cache write is part of the request's trace
+	assert.Equal(t, server.SpanContext().SpanID(), put.Parent().SpanID())
+
+	// processing starts a new trace linked to the write that emitted the event
+	assert.NotEqual(t, server.SpanContext().TraceID(), process.SpanContext().TraceID())
+	require.Len(t, process.Links(), 1)
+	assert.Equal(t, put.SpanContext().SpanID(), process.Links()[0].SpanContext.SpanID())
+
+	// the storage call is a child of the processing
+	assert.Equal(t, process.SpanContext().SpanID(), write.Parent().SpanID())
+}
+
+func TestOptions_Validate(t *testing.T) {
+	require.NoError(t, tracing.Options{}.Validate())
+	require.NoError(t, tracing.Options{Exporter: tracing.FileExporter, File: "spans.json"}.Validate())
+	require.ErrorIs(t, tracing.Options{Exporter: "jaeger"}.Validate(), tracing.ErrUnknownExporter)
+}
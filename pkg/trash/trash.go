@@ -0,0 +1,175 @@
+// Package trash soft deletes the documents of collections that keep deleted
+// documents, so they can be listed and undeleted until they are purged.
+//
+// Soft deleted documents are marked with cache.DeletedAt rather than removed,
+// which hides them from reads. They are purged for good once they have been
+// in the trash for the retention of their collection.
+package trash
+
+import (
+	"context"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/errors"
+	"github.com/nexdb/nexdb/pkg/revisions"
+)
+
+// SettingsCollection is the collection of each database that holds the soft
+// delete settings of its collections, one document per collection.
+const SettingsCollection = "_soft_delete_settings"
+
+// Settings is how the documents of a collection are deleted.
+type Settings struct {
+	// Enabled soft deletes the documents of the collection.
+	Enabled bool `json:"enabled"`
+	// Retention is how long deleted documents are kept in the trash for,
+	// such as 720h, empty keeps them until they are purged.
+	Retention string `json:"retention,omitempty"`
+}
+
+// Validate checks the settings are a valid configuration of a collection.
+func (s Settings) Validate() error {
+	if s.Retention == "" {
+		return nil
+	}
+
+	if d, err := time.ParseDuration(s.Retention); err != nil || d <= 0 || !s.Enabled {
+		return errors.New(errors.ErrSoftDeleteSettingsAreInvalid)
+	}
+
+	return nil
+}
+
+// Get returns the soft delete settings of a collection of d.
+func Get(ctx context.Context, d *database.Database, collection string) Settings {
+	doc := Config(ctx, d, collection)
+	if doc == nil {
+		return Settings{}
+	}
+
+	retention, _ := doc.Data["retention"].(string)
+	return Settings{Enabled: true, Retention: retention}
+}
+
+// Config returns the document of d that holds the soft delete settings of a
+// collection, if any.
+func Config(ctx context.Context, d *database.Database, collection string) *document.Document {
+	results := d.FilterContext(ctx, SettingsCollection, cache.Query{
+		And: []cache.Element{
+			{
+				Condition: &cache.Condition{
+					Field:    "collection",
+					Operator: cache.Equals,
+					Value:    collection,
+				},
+			},
+		},
+	})
+	if len(results) == 0 {
+		return nil
+	}
+
+	return results[0]
+}
+
+// Delete moves doc to the trash, marking it as deleted at the given time.
+// The document written is returned.
+//
+// Delete, Undelete and Purge read the document before writing it, the lock of
+// the document must be held, see database.LockDocument, and doc read while it
+// is.
+func Delete(ctx context.Context, d *database.Database, doc *document.Document, at time.Time) (*document.Document, error) {
+	data := make(map[string]interface{}, len(doc.Data)+1)
+	for k, v := range doc.Data {
+		data[k] = v
+	}
+	data[cache.DeletedAt] = at.UTC().Format(time.RFC3339Nano)
+
+	deleted := document.New().SetCollection(doc.Collection).SetID(doc.ID.String()).SetData(data)
+	return deleted, d.PutContext(ctx, deleted, false)
+}
+
+// Undelete takes the document of a collection with the given id out of the
+// trash, the document written is returned.
+func Undelete(ctx context.Context, d *database.Database, collection, id string) (*document.Document, error) {
+	doc := d.GetAnyByID(id)
+	if doc == nil || doc.Collection != collection || !cache.IsDeleted(doc) {
+		return nil, errors.New(errors.ErrDocumentNotFound)
+	}
+
+	data := make(map[string]interface{}, len(doc.Data))
+	for k, v := range doc.Data {
+		if k != cache.DeletedAt {
+			data[k] = v
+		}
+	}
+
+	restored := document.New().SetCollection(collection).SetID(id).SetData(data)
+	return restored, d.PutContext(ctx, restored, false)
+}
+
+// List returns the documents in the trash of a collection of d.
+func List(ctx context.Context, d *database.Database, collection string) []*document.Document {
+	return d.FilterContext(ctx, collection, cache.Query{Deleted: cache.DeletedOnly})
+}
+
+// Purge deletes the document of a collection with the given id from the
+// trash for good, along with its revisions. The document purged is
+// returned.
+func Purge(ctx context.Context, d *database.Database, collection, id string) (*document.Document, error) {
+	doc := d.GetAnyByID(id)
+	if doc == nil || doc.Collection != collection || !cache.IsDeleted(doc) {
+		return nil, errors.New(errors.ErrDocumentNotFound)
+	}
+
+	if err := d.DeleteContext(ctx, id); err != nil {
+		return nil, err
+	}
+
+	return doc, revisions.Forget(ctx, d, id)
+}
+
+// Expired returns the documents of d that have been in the trash for longer
+// than the retention of their collection at the given time.
+func Expired(ctx context.Context, d *database.Database, now time.Time) []*document.Document {
+	var expired []*document.Document
+	for _, config := range d.FilterContext(ctx, SettingsCollection, cache.Query{}) {
+		collection, _ := config.Data["collection"].(string)
+		s, _ := config.Data["retention"].(string)
+		retention, err := time.ParseDuration(s)
+		if err != nil {
+			// kept until purged
+			continue
+		}
+
+		for _, doc := range List(ctx, d, collection) {
+			if now.Sub(deletedAt(doc)) > retention {
+				expired = append(expired, doc)
+			}
+		}
+	}
+
+	return expired
+}
+
+// IsExpired returns whether doc has been in the trash for longer than the
+// retention of its collection at the given time.
+func IsExpired(ctx context.Context, d *database.Database, doc *document.Document, now time.Time) bool {
+	if !cache.IsDeleted(doc) {
+		return false
+	}
+
+	retention, err := time.ParseDuration(Get(ctx, d, doc.Collection).Retention)
+	return err == nil && now.Sub(deletedAt(doc)) > retention
+}
+
+// deletedAt returns when a document was deleted.
+func deletedAt(doc *document.Document) time.Time {
+	s, _ := doc.Data[cache.DeletedAt].(string)
+	t, _ := time.Parse(time.RFC3339Nano, s)
+
+	return t
+}
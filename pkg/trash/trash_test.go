@@ -0,0 +1,157 @@
+package trash_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nexdb/nexdb/pkg/database"
+	"github.com/nexdb/nexdb/pkg/database/cache"
+	"github.com/nexdb/nexdb/pkg/document"
+	"github.com/nexdb/nexdb/pkg/errors"
+	"github.com/nexdb/nexdb/pkg/storage"
+	"github.com/nexdb/nexdb/pkg/trash"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newDatabase returns a database whose users collection soft deletes its
+// documents, keeping them in the trash for retention.
+func newDatabase(t *testing.T, retention string) *database.Database {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	s, err := storage.New(storage.MemoryDriver)
+	require.NoError(t, err)
+
+	d := &database.Database{Cache: cache.NewCache(ctx, cache.NewQueue(s))}
+	require.NoError(t, d.Put(document.New().SetCollection(trash.SettingsCollection).SetData(map[string]interface{}{
+		"collection": "users",
+		"retention":  retention,
+	}), false))
+
+	return d
+}
+
+func TestDelete(t *testing.T) {
+	ctx := context.Background()
+	d := newDatabase(t, "")
+
+	ada := document.New().SetCollection("users").SetData(map[string]interface{}{"name": "ada"})
+	require.NoError(t, d.Put(ada, false))
+
+	_, err := trash.Delete(ctx, d, ada, time.Now())
+	require.NoError(t, err)
+
+	// hidden from reads unless asked for
+	assert.Nil(t, d.GetByID(ada.ID.String()))
+	assert.Empty(t, d.Filter("users", cache.Query{}))
+	assert.Len(t, d.Filter("users", cache.Query{Deleted: cache.DeletedInclude}), 1)
+
+	deleted := trash.List(ctx, d, "users")
+	require.Len(t, deleted, 1)
+	assert.Equal(t, "ada", deleted[0].Data["name"])
+	assert.Contains(t, deleted[0].Data, cache.DeletedAt)
+
+	// only documents in the trash of the collection can be undeleted
+	_, err = trash.Undelete(ctx, d, "accounts", ada.ID.String())
+	assert.Equal(t, errors.New(errors.ErrDocumentNotFound).Error(), err.Error())
+
+	restored, err := trash.Undelete(ctx, d, "users", ada.ID.String())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "ada"}, restored.Data)
+	assert.Equal(t, restored, d.GetByID(ada.ID.String()))
+	assert.Empty(t, trash.List(ctx, d, "users"))
+
+	_, err = trash.Undelete(ctx, d, "users", ada.ID.String())
+	assert.Equal(t, errors.New(errors.ErrDocumentNotFound).Error(), err.Error())
+}
+
+func TestPurge(t *testing.T) {
+	ctx := context.Background()
+	d := newDatabase(t, "")
+
+	ada := document.New().SetCollection("users").SetData(map[string]interface{}{"name": "ada"})
+	require.NoError(t, d.Put(ada, false))
+
+	// documents not in the trash are left alone
+	_, err := trash.Purge(ctx, d, "users", ada.ID.String())
+	assert.Equal(t, errors.New(errors.ErrDocumentNotFound).Error(), err.Error())
+
+	_, err = trash.Delete(ctx, d, ada, time.Now())
+	require.NoError(t, err)
+
+	purged, err := trash.Purge(ctx, d, "users", ada.ID.String())
+	require.NoError(t, err)
+	assert.Equal(t, ada.ID, purged.ID)
+	assert.Nil(t, d.GetAnyByID(ada.ID.String()))
+	assert.Empty(t, trash.List(ctx, d, "users"))
+}
+
+func TestExpired(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		retention string
+		expired   []string
+	}{
+		{
+			name:      "documents past the retention",
+			retention: "90m",
+			expired:   []string{"ada"},
+		},
+		{
+			name:      "no retention",
+			retention: "",
+			expired:   nil,
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			d := newDatabase(t, tc.retention)
+
+			for name, at := range map[string]time.Time{
+				"ada":   now.Add(-2 * time.Hour),
+				"grace": now.Add(-time.Hour),
+			} {
+				doc := document.New().SetCollection("users").SetData(map[string]interface{}{"name": name})
+				require.NoError(t, d.Put(doc, false))
+				_, err := trash.Delete(ctx, d, doc, at)
+				require.NoError(t, err)
+			}
+
+			var names []string
+			for _, doc := range trash.Expired(ctx, d, now) {
+				names = append(names, doc.Data["name"].(string))
+				assert.True(t, trash.IsExpired(ctx, d, doc, now))
+			}
+			assert.Equal(t, tc.expired, names)
+
+			for _, doc := range trash.List(ctx, d, "users") {
+				assert.Equal(t, slices.Contains(tc.expired, doc.Data["name"].(string)), trash.IsExpired(ctx, d, doc, now))
+			}
+		})
+	}
+}
+
+func TestSettings_Validate(t *testing.T) {
+	assert.NoError(t, trash.Settings{}.Validate())
+	assert.NoError(t, trash.Settings{Enabled: true}.Validate())
+	assert.NoError(t, trash.Settings{Enabled: true, Retention: "720h"}.Validate())
+
+	for _, s := range []trash.Settings{
+		{Enabled: true, Retention: "-1h"},
+		{Enabled: true, Retention: "a month"},
+		{Retention: "720h"},
+	} {
+		assert.Equal(t, errors.New(errors.ErrSoftDeleteSettingsAreInvalid).Error(), s.Validate().Error(), s)
+	}
+}